@@ -12,7 +12,7 @@ package auth
 import (
 	"encoding/json"
 	"fmt"
-	"golang.org/x/crypto/bcrypt"
+	"net/http"
 
 	"github.com/coreos/go-oidc/jose"
 	"github.com/coreos/go-oidc/oidc"
@@ -25,13 +25,16 @@ import (
 type Authenticator struct {
 	bucket            base.Bucket
 	channelComputer   ChannelComputer
-	sessionCookieName string // Custom per-database session cookie name
+	sessionCookieName string          // Custom per-database session cookie name
+	passwordPolicy    *PasswordPolicy // Rules that new passwords must satisfy; nil means no policy
+	sessionOptions    SessionOptions  // Login session limits and cookie attributes
 }
 
 // Interface for deriving the set of channels and roles a User/Role has access to.
 // The instantiator of an Authenticator must provide an implementation.
 type ChannelComputer interface {
 	ComputeChannelsForPrincipal(Principal) (ch.TimedSet, error)
+	ComputeWriteChannelsForPrincipal(Principal) (ch.TimedSet, error)
 	ComputeRolesForUser(User) (ch.TimedSet, error)
 	UseGlobalSequence() bool
 }
@@ -59,6 +62,21 @@ func (auth *Authenticator) SetSessionCookieName(cookieName string) {
 	auth.sessionCookieName = cookieName
 }
 
+func (auth *Authenticator) SetSessionOptions(options *SessionOptions) {
+	if options != nil {
+		auth.sessionOptions = *options
+	}
+}
+
+func (auth *Authenticator) SetPasswordPolicy(policy *PasswordPolicy) {
+	auth.passwordPolicy = policy
+}
+
+// Returns an HTTP 400 error if the password doesn't satisfy the password policy.
+func (auth *Authenticator) ValidatePassword(password string) error {
+	return auth.passwordPolicy.Validate(password)
+}
+
 func docIDForUserEmail(email string) string {
 	return "_sync:useremail:" + email
 }
@@ -194,8 +212,26 @@ func (auth *Authenticator) rebuildChannels(princ Principal) error {
 	princ.SetPreviousChannels(nil)
 	princ.setChannels(channels)
 
-	return nil
+	return auth.rebuildWriteChannels(princ)
+}
+
+// Recomputes the set of channels the principal is allowed to write to, from the explicit (admin) write
+// grants and the grants made by the sync function's writeAccess() callback.
+func (auth *Authenticator) rebuildWriteChannels(princ Principal) error {
+	writeChannels := princ.ExplicitWriteChannels().Copy()
+
+	if auth.channelComputer != nil {
+		viewWriteChannels, err := auth.channelComputer.ComputeWriteChannelsForPrincipal(princ)
+		if err != nil {
+			base.Warnf(base.KeyAll, "channelComputer.ComputeWriteChannelsForPrincipal returned error for %v: %v", base.UD(princ), err)
+			return err
+		}
+		writeChannels.Add(viewWriteChannels)
+	}
 
+	base.Infof(base.KeyAccess, "Computed write channels for %q: %s", base.UD(princ.Name()), base.UD(writeChannels))
+	princ.setWriteChannels(writeChannels)
+	return nil
 }
 
 func (auth *Authenticator) rebuildRoles(user User) error {
@@ -221,16 +257,86 @@ func (auth *Authenticator) rebuildRoles(user User) error {
 	return nil
 }
 
+// Expands a set of role grants to include every ancestor role reachable through ParentRoles.  An inherited
+// role is granted at the later of the sequence its child role was granted at and the sequence the parent
+// link was added at; when a role is reachable along several paths, the earliest of those grants wins.
+// A role is only revisited when a path yields an earlier grant, so cycles in the hierarchy terminate.
+func (auth *Authenticator) expandRoles(granted ch.TimedSet) ([]Role, ch.TimedSet) {
+	grants := granted.Copy()
+	loaded := make(map[string]Role, len(grants))
+	pending := make([]string, 0, len(grants))
+	for name := range grants {
+		pending = append(pending, name)
+	}
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		role, found := loaded[name]
+		if !found {
+			var err error
+			role, err = auth.GetRole(name)
+			if err != nil {
+				panic(fmt.Sprintf("Error getting user role %q: %v", name, err))
+			}
+			loaded[name] = role
+		}
+		if role == nil {
+			continue
+		}
+		grant := grants[name]
+		for parent, link := range role.ParentRoles() {
+			parentGrant := grant
+			if link.Sequence > parentGrant.Sequence {
+				parentGrant = link
+			}
+			if existing, ok := grants[parent]; ok && existing.Sequence <= parentGrant.Sequence {
+				continue
+			}
+			grants[parent] = parentGrant
+			pending = append(pending, parent)
+		}
+	}
+
+	roles := make([]Role, 0, len(loaded))
+	for _, role := range loaded {
+		if role != nil {
+			roles = append(roles, role)
+		}
+	}
+	return roles, grants
+}
+
+// Returns an HTTP 400 error if the role's parent roles would make it an ancestor of itself.
+func (auth *Authenticator) validateRoleHierarchy(role Role) error {
+	visited := base.Set{}
+	pending := role.ParentRoles().AllChannels()
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		if name == role.Name() {
+			return base.HTTPErrorf(http.StatusBadRequest, "Parent roles of %q would create a cycle", role.Name())
+		}
+		if visited.Contains(name) {
+			continue
+		}
+		visited[name] = struct{}{}
+		ancestor, err := auth.GetRole(name)
+		if err != nil {
+			return err
+		} else if ancestor != nil {
+			pending = append(pending, ancestor.ParentRoles().AllChannels()...)
+		}
+	}
+	return nil
+}
+
 // Looks up a User by email address.
 func (auth *Authenticator) GetUserByEmail(email string) (User, error) {
-	var info userByEmailInfo
-	_, err := auth.bucket.Get(docIDForUserEmail(email), &info)
-	if base.IsDocNotFoundError(err) {
-		return nil, nil
-	} else if err != nil {
+	username, err := auth.userNameForEmail(email)
+	if err != nil || username == "" {
 		return nil, err
 	}
-	return auth.GetUser(info.Username)
+	return auth.GetUser(username)
 }
 
 // CAS-safe save of the information for a user/role.  For updates, expects the incoming principal to have
@@ -239,6 +345,11 @@ func (auth *Authenticator) Save(p Principal) error {
 	if err := p.validate(); err != nil {
 		return err
 	}
+	if role, ok := p.(*roleImpl); ok && len(role.ParentRoles_) > 0 {
+		if err := auth.validateRoleHierarchy(role); err != nil {
+			return err
+		}
+	}
 
 	casOut, writeErr := auth.bucket.WriteCas(p.DocID(), 0, 0, p.Cas(), p, 0)
 	if writeErr != nil {
@@ -297,16 +408,36 @@ func (auth *Authenticator) InvalidateRoles(user User) error {
 	return auth.casUpdatePrincipal(user, invalidateRolesCallback)
 }
 
-// Updates user email and writes user doc
+// Updates user email and writes user doc.  Fails with a 409 if the email is registered to another
+// user, and unregisters the user's previous email.
 func (auth *Authenticator) UpdateUserEmail(u User, email string) error {
 
+	// Register the email to the user first, so that it can't be taken from another user
+	claimed := false
+	if email != "" {
+		added, err := auth.bucket.Add(docIDForUserEmail(email), 0, userByEmailInfo{u.Name()})
+		if err != nil {
+			return err
+		}
+		if !added {
+			if registeredTo, err := auth.userNameForEmail(email); err != nil {
+				return err
+			} else if registeredTo != u.Name() {
+				return base.HTTPErrorf(http.StatusConflict, "Email address is already registered to another user")
+			}
+		}
+		claimed = added
+	}
+
+	var oldEmail string
 	updateUserEmailCallback := func(currentPrincipal Principal) (updatedPrincipal Principal, err error) {
 		currentUser, ok := currentPrincipal.(User)
 		if !ok {
 			return nil, base.ErrUpdateCancel
 		}
 
-		if currentUser.Email() == email {
+		oldEmail = currentUser.Email()
+		if oldEmail == email {
 			return currentUser, base.ErrUpdateCancel
 		}
 
@@ -318,19 +449,62 @@ func (auth *Authenticator) UpdateUserEmail(u User, email string) error {
 		return currentUser, nil
 	}
 
-	return auth.casUpdatePrincipal(u, updateUserEmailCallback)
+	if err := auth.casUpdatePrincipal(u, updateUserEmailCallback); err != nil {
+		if claimed {
+			auth.unregisterEmail(email, u.Name())
+		}
+		return err
+	}
+	if oldEmail != "" && oldEmail != email {
+		auth.unregisterEmail(oldEmail, u.Name())
+	}
+	return nil
+}
+
+// Returns the name of the user an email is registered to, or "" if none.
+func (auth *Authenticator) userNameForEmail(email string) (string, error) {
+	var info userByEmailInfo
+	_, err := auth.bucket.Get(docIDForUserEmail(email), &info)
+	if base.IsDocNotFoundError(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return info.Username, nil
+}
+
+// Removes an email's registration, if it's registered to the given user.
+func (auth *Authenticator) unregisterEmail(email string, username string) {
+	if registeredTo, err := auth.userNameForEmail(email); err != nil || registeredTo != username {
+		return
+	}
+	if err := auth.bucket.Delete(docIDForUserEmail(email)); err != nil && !base.IsDocNotFoundError(err) {
+		base.Warnf(base.KeyAll, "Unable to unregister email %s of user %s: %v", base.UD(email), base.UD(username), err)
+	}
+}
+
+// Updates user password and writes user doc.  Callers are responsible for validating the new password.
+func (auth *Authenticator) UpdateUserPassword(u User, password string) error {
+
+	updateUserPasswordCallback := func(currentPrincipal Principal) (updatedPrincipal Principal, err error) {
+		currentUser, ok := currentPrincipal.(User)
+		if !ok {
+			return nil, base.ErrUpdateCancel
+		}
+
+		base.Debugf(base.KeyAuth, "Updating password for user %s", base.UD(u.Name()))
+		currentUser.SetPassword(password)
+		return currentUser, nil
+	}
+
+	return auth.casUpdatePrincipal(u, updateUserPasswordCallback)
 }
 
-// rehashPassword will check the bcrypt cost of the given hash
-// and will reset the user's password if the configured cost has since changed
+// rehashPassword will check the algorithm and cost of the user's password hash
+// and will reset the user's password if the configured algorithm or cost has since changed
 // Callers must verify password is correct before calling this
 func (auth *Authenticator) rehashPassword(user User, password string) error {
 
-	// Exit early if bcryptCost has not been set
-	if !bcryptCostChanged {
-		return nil
-	}
-	var hashCost int
 	rehashPasswordCallback := func(currentPrincipal Principal) (updatedPrincipal Principal, err error) {
 
 		currentUserImpl, ok := currentPrincipal.(*userImpl)
@@ -338,23 +512,26 @@ func (auth *Authenticator) rehashPassword(user User, password string) error {
 			return nil, base.ErrUpdateCancel
 		}
 
-		hashCost, costErr := bcrypt.Cost(currentUserImpl.PasswordHash_)
-		if costErr == nil && hashCost != bcryptCost {
-			// the cost of the existing hash is different than the configured bcrypt cost.
-			// We'll re-hash the password to adopt the new cost:
-			currentUserImpl.SetPassword(password)
+		if passwordHashNeedsUpgrade(currentUserImpl.PasswordHash_) {
+			// the existing hash doesn't match the configured algorithm or cost.
+			// We'll re-hash the password to adopt them, without restarting the password's expiry:
+			currentUserImpl.setPasswordHash(password)
 			return currentUserImpl, nil
 		} else {
 			return nil, base.ErrUpdateCancel
 		}
 	}
 
+	// Exit early if the hash is already up to date
+	if userImpl, ok := user.(*userImpl); !ok || !passwordHashNeedsUpgrade(userImpl.PasswordHash_) {
+		return nil
+	}
+
 	if err := auth.casUpdatePrincipal(user, rehashPasswordCallback); err != nil {
 		return err
 	}
 
-	base.Debugf(base.KeyAuth, "User account %q changed password hash cost from %d to %d",
-		base.UD(user.Name()), hashCost, bcryptCost)
+	base.Debugf(base.KeyAuth, "User account %q password hash upgraded to %s", base.UD(user.Name()), passwordHashAlgorithm)
 	return nil
 }
 
@@ -380,7 +557,7 @@ func (auth *Authenticator) casUpdatePrincipal(p Principal, callback casUpdatePri
 		}
 
 		if !base.IsCasMismatch(saveErr) {
-			return err
+			return saveErr
 		}
 
 		base.Infof(base.KeyAuth, "CAS mismatch in casUpdatePrincipal, retrying.  Principal:%s", base.UD(p.Name()))
@@ -546,6 +723,9 @@ func (auth *Authenticator) RegisterNewUser(username, email string) (User, error)
 		user.SetEmail(email)
 	}
 
+	// The random password is never used to log in, so it mustn't be subject to password expiry
+	user.(*userImpl).PasswordChangedAt_ = 0
+
 	err = auth.Save(user)
 	if base.IsCasMismatch(err) {
 		return auth.GetUser(username)
@@ -287,10 +287,11 @@ func TestSaveRoles(t *testing.T) {
 }
 
 type mockComputer struct {
-	channels     ch.TimedSet
-	roles        ch.TimedSet
-	roleChannels ch.TimedSet
-	err          error
+	channels      ch.TimedSet
+	roles         ch.TimedSet
+	roleChannels  ch.TimedSet
+	writeChannels ch.TimedSet
+	err           error
 }
 
 func (self *mockComputer) ComputeChannelsForPrincipal(p Principal) (ch.TimedSet, error) {
@@ -304,6 +305,10 @@ func (self *mockComputer) ComputeChannelsForPrincipal(p Principal) (ch.TimedSet,
 	}
 }
 
+func (self *mockComputer) ComputeWriteChannelsForPrincipal(p Principal) (ch.TimedSet, error) {
+	return self.writeChannels, self.err
+}
+
 func (self *mockComputer) ComputeRolesForUser(User) (ch.TimedSet, error) {
 	return self.roles, self.err
 }
@@ -343,6 +348,27 @@ func TestRebuildRoleChannels(t *testing.T) {
 	goassert.DeepEquals(t, role2.Channels(), ch.AtSequence(ch.SetOf("explicit1", "derived1", "derived2", "!"), 1))
 }
 
+func TestRebuildUserWriteChannels(t *testing.T) {
+
+	gTestBucket := base.GetTestBucketOrPanic()
+	defer gTestBucket.Close()
+	computer := mockComputer{writeChannels: ch.AtSequence(ch.SetOf("derived1"), 1)}
+	auth := NewAuthenticator(gTestBucket.Bucket, &computer)
+	user, _ := auth.NewUser("testUser", "password", ch.SetOf("explicit1", "explicit2"))
+	user.SetExplicitWriteChannels(ch.AtSequence(ch.SetOf("explicit1"), 1))
+	err := auth.Save(user)
+	assert.Equal(t, nil, err)
+
+	user2, err := auth.GetUser("testUser")
+	assert.Equal(t, nil, err)
+	goassert.DeepEquals(t, user2.WriteChannels(), ch.AtSequence(ch.SetOf("explicit1", "derived1"), 1))
+	assert.True(t, user2.CanSeeChannel("explicit2"))
+	assert.False(t, user2.CanWriteChannel("explicit2"))
+	assert.True(t, user2.CanWriteChannel("explicit1"))
+	assert.Equal(t, nil, user2.AuthorizeWriteChannels(ch.SetOf("explicit1", "derived1")))
+	assert.Error(t, user2.AuthorizeWriteChannels(ch.SetOf("explicit1", "explicit2")))
+}
+
 func TestRebuildChannelsError(t *testing.T) {
 
 	gTestBucket := base.GetTestBucketOrPanic()
@@ -416,6 +442,93 @@ func TestRoleInheritance(t *testing.T) {
 	assert.Equal(t, nil, user2.AuthorizeAllChannels(ch.SetOf("britain", "dull", "hoopiest")))
 }
 
+func TestWriteChannelInheritance(t *testing.T) {
+	gTestBucket := base.GetTestBucketOrPanic()
+	defer gTestBucket.Close()
+	auth := NewAuthenticator(gTestBucket.Bucket, nil)
+	role, _ := auth.NewRole("editor", ch.SetOf("drafts", "published"))
+	role.SetExplicitWriteChannels(ch.AtSequence(ch.SetOf("drafts"), 1))
+	assert.Equal(t, nil, auth.Save(role))
+
+	user, _ := auth.NewUser("ford", "password", ch.SetOf("notes"))
+	user.SetExplicitWriteChannels(ch.AtSequence(ch.SetOf("notes"), 1))
+	user.(*userImpl).setRolesSince(ch.TimedSet{"editor": ch.NewVbSimpleSequence(0x3)})
+	assert.Equal(t, nil, auth.Save(user))
+
+	user2, err := auth.GetUser("ford")
+	assert.Equal(t, nil, err)
+	goassert.DeepEquals(t, user2.InheritedWriteChannels(),
+		ch.TimedSet{"notes": ch.NewVbSimpleSequence(0x1), "drafts": ch.NewVbSimpleSequence(0x3)})
+	assert.True(t, user2.CanSeeChannel("published"))
+	assert.False(t, user2.CanWriteChannel("published"))
+	assert.True(t, user2.CanWriteChannel("drafts"))
+	assert.Equal(t, nil, user2.AuthorizeWriteChannels(ch.SetOf("notes", "drafts")))
+}
+
+func TestNestedRoleInheritance(t *testing.T) {
+	gTestBucket := base.GetTestBucketOrPanic()
+	defer gTestBucket.Close()
+	auth := NewAuthenticator(gTestBucket.Bucket, nil)
+	staff, _ := auth.NewRole("staff", ch.SetOf("memos"))
+	assert.Equal(t, nil, auth.Save(staff))
+	team, _ := auth.NewRole("team", ch.SetOf("plans"))
+	team.SetParentRoles(ch.TimedSet{"staff": ch.NewVbSimpleSequence(0x5)})
+	assert.Equal(t, nil, auth.Save(team))
+
+	user, _ := auth.NewUser("zaphod", "password", ch.SetOf("heart"))
+	user.(*userImpl).setRolesSince(ch.TimedSet{"team": ch.NewVbSimpleSequence(0x3)})
+	assert.Equal(t, nil, auth.Save(user))
+
+	// staff is inherited through team, and only becomes visible once the parent link was added
+	user2, err := auth.GetUser("zaphod")
+	assert.Equal(t, nil, err)
+	goassert.DeepEquals(t, user2.InheritedRoleNames(), ch.TimedSet{"team": ch.NewVbSimpleSequence(0x3), "staff": ch.NewVbSimpleSequence(0x5)})
+	goassert.DeepEquals(t, user2.InheritedChannels(),
+		ch.TimedSet{"!": ch.NewVbSimpleSequence(0x1), "heart": ch.NewVbSimpleSequence(0x1), "plans": ch.NewVbSimpleSequence(0x3), "memos": ch.NewVbSimpleSequence(0x5)})
+	assert.True(t, user2.CanSeeChannel("memos"))
+	goassert.Equals(t, user2.CanSeeChannelSince("plans"), uint64(3))
+	goassert.Equals(t, user2.CanSeeChannelSince("memos"), uint64(5))
+
+	// A second path to staff with an earlier effective grant takes precedence
+	lead, _ := auth.NewRole("lead", nil)
+	lead.SetParentRoles(ch.TimedSet{"staff": ch.NewVbSimpleSequence(0x2)})
+	assert.Equal(t, nil, auth.Save(lead))
+	user2.(*userImpl).setRolesSince(ch.TimedSet{"team": ch.NewVbSimpleSequence(0x3), "lead": ch.NewVbSimpleSequence(0x4)})
+	goassert.Equals(t, user2.InheritedRoleNames()["staff"].Sequence, uint64(4))
+	goassert.Equals(t, user2.CanSeeChannelSince("memos"), uint64(4))
+}
+
+func TestRoleHierarchyCycles(t *testing.T) {
+	gTestBucket := base.GetTestBucketOrPanic()
+	defer gTestBucket.Close()
+	auth := NewAuthenticator(gTestBucket.Bucket, nil)
+
+	role, _ := auth.NewRole("narcissus", nil)
+	role.SetParentRoles(ch.TimedSet{"narcissus": ch.NewVbSimpleSequence(0x1)})
+	assert.Error(t, auth.Save(role))
+
+	alpha, _ := auth.NewRole("alpha", ch.SetOf("a"))
+	alpha.SetParentRoles(ch.TimedSet{"beta": ch.NewVbSimpleSequence(0x1)})
+	assert.Equal(t, nil, auth.Save(alpha))
+	beta, _ := auth.NewRole("beta", ch.SetOf("b"))
+	beta.SetParentRoles(ch.TimedSet{"gamma": ch.NewVbSimpleSequence(0x1)})
+	assert.Equal(t, nil, auth.Save(beta))
+	gamma, _ := auth.NewRole("gamma", ch.SetOf("c"))
+	gamma.SetParentRoles(ch.TimedSet{"alpha": ch.NewVbSimpleSequence(0x1)})
+	err := auth.Save(gamma)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cycle")
+
+	// A cycle written without validation must not stop role expansion from terminating
+	gamma.(*roleImpl).SetCas(0)
+	_, err = gTestBucket.Bucket.Add(gamma.DocID(), 0, gamma)
+	assert.NoError(t, err)
+	user, _ := auth.NewUser("sisyphus", "password", nil)
+	user.(*userImpl).setRolesSince(ch.TimedSet{"alpha": ch.NewVbSimpleSequence(0x2)})
+	goassert.DeepEquals(t, user.InheritedRoleNames(), ch.TimedSet{"alpha": ch.NewVbSimpleSequence(0x2), "beta": ch.NewVbSimpleSequence(0x2), "gamma": ch.NewVbSimpleSequence(0x2)})
+	assert.True(t, user.CanSeeChannel("c"))
+}
+
 func TestRegisterUser(t *testing.T) {
 	gTestBucket := base.GetTestBucketOrPanic()
 	defer gTestBucket.Close()
@@ -10,15 +10,53 @@
 package auth
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
 	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Supported password hash algorithms
+const (
+	PasswordHashBcrypt   = "bcrypt"
+	PasswordHashScrypt   = "scrypt"
+	PasswordHashArgon2id = "argon2id"
+)
+
+// Parameters used when hashing new passwords with scrypt and argon2id.  Hashes created with
+// different parameters are still verified, and are upgraded to these on the next login.
+const (
+	scryptLogN       = 15
+	scryptR          = 8
+	scryptP          = 1
+	argon2idTime     = 1
+	argon2idMemoryKB = 64 * 1024
+	argon2idThreads  = 4
+	passwordSaltLen  = 16
+	passwordKeyLen   = 32
 )
 
+var (
+	scryptParams   = fmt.Sprintf("ln=%d,r=%d,p=%d", scryptLogN, scryptR, scryptP)
+	argon2idParams = fmt.Sprintf("v=%d$m=%d,t=%d,p=%d", argon2.Version, argon2idMemoryKB, argon2idTime, argon2idThreads)
+)
+
+var ErrInvalidPasswordHashAlgorithm = fmt.Errorf("invalid password hash algorithm")
+
+// passwordHashAlgorithm is used when hashing new passwords.  Existing hashes using a different
+// algorithm are upgraded by rehashPassword on the next successful login.
+var passwordHashAlgorithm = PasswordHashBcrypt
+
 var (
 	// bcryptDefaultCost is the default bcrypt cost to use
 	bcryptDefaultCost = bcrypt.DefaultCost
@@ -39,7 +77,7 @@ var cacheLock sync.Mutex
 // The maximum number of pairs to keep in the above cache
 const kMaxCacheSize = 25000
 
-// Optimized wrapper around bcrypt.CompareHashAndPassword that caches successful results in
+// Optimized wrapper around verifyPasswordHash that caches successful results in
 // memory to avoid the _very_ high overhead of calling bcrypt.
 func compareHashAndPassword(hash []byte, password []byte) bool {
 	// Actually we cache the SHA1 digest of the password to avoid keeping passwords in RAM.
@@ -55,8 +93,8 @@ func compareHashAndPassword(hash []byte, password []byte) bool {
 		return true
 	}
 
-	// Cache missed; now we make the very slow (~100ms) bcrypt call:
-	if err := bcrypt.CompareHashAndPassword(hash, password); err != nil {
+	// Cache missed; now we make the very slow (~100ms) hash comparison:
+	if !verifyPasswordHash(hash, password) {
 		// Note: It's important to only cache successful matches, not failures.
 		// Failure is supposed to be slow, to make online attacks impractical.
 		return false
@@ -95,3 +133,153 @@ func SetBcryptCost(cost int) error {
 
 	return nil
 }
+
+// SetPasswordHashAlgorithm will set the algorithm Sync Gateway uses to hash new passwords
+// An empty value will use bcrypt
+func SetPasswordHashAlgorithm(algorithm string) error {
+	switch algorithm {
+	case "":
+		algorithm = PasswordHashBcrypt
+	case PasswordHashBcrypt, PasswordHashScrypt, PasswordHashArgon2id:
+	default:
+		return errors.Wrapf(ErrInvalidPasswordHashAlgorithm, "%q is not one of %s, %s, %s",
+			algorithm, PasswordHashBcrypt, PasswordHashScrypt, PasswordHashArgon2id)
+	}
+
+	base.Infof(base.KeyAuth, "Password hash algorithm set to: %s", algorithm)
+	passwordHashAlgorithm = algorithm
+	return nil
+}
+
+// Hashes a password using the configured algorithm.  scrypt and argon2id hashes are encoded in
+// the PHC string format, e.g. $scrypt$ln=15,r=8,p=1$<salt>$<key>, while bcrypt uses its own
+// modular crypt format, so the algorithm can always be identified from the hash itself.
+func hashPassword(password []byte) ([]byte, error) {
+	switch passwordHashAlgorithm {
+	case PasswordHashScrypt:
+		salt, err := newPasswordSalt()
+		if err != nil {
+			return nil, err
+		}
+		key, err := scrypt.Key(password, salt, 1<<scryptLogN, scryptR, scryptP, passwordKeyLen)
+		if err != nil {
+			return nil, err
+		}
+		return encodePasswordHash(PasswordHashScrypt, scryptParams, salt, key), nil
+	case PasswordHashArgon2id:
+		salt, err := newPasswordSalt()
+		if err != nil {
+			return nil, err
+		}
+		key := argon2.IDKey(password, salt, argon2idTime, argon2idMemoryKB, argon2idThreads, passwordKeyLen)
+		return encodePasswordHash(PasswordHashArgon2id, argon2idParams, salt, key), nil
+	default:
+		return bcrypt.GenerateFromPassword(password, bcryptCost)
+	}
+}
+
+func newPasswordSalt() ([]byte, error) {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+func encodePasswordHash(algorithm, params string, salt, key []byte) []byte {
+	return []byte(fmt.Sprintf("$%s$%s$%s$%s", algorithm, params,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)))
+}
+
+// Splits a PHC-formatted hash into its parameters, salt and key.
+func decodePasswordHash(algorithm string, hash []byte) (params string, salt, key []byte, err error) {
+	encoded := strings.TrimPrefix(string(hash), "$"+algorithm+"$")
+	sep := strings.LastIndex(encoded, "$")
+	if sep < 0 {
+		return "", nil, nil, fmt.Errorf("malformed %s password hash", algorithm)
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(encoded[sep+1:]); err != nil {
+		return "", nil, nil, err
+	}
+	encoded = encoded[:sep]
+	sep = strings.LastIndex(encoded, "$")
+	if sep < 0 {
+		return "", nil, nil, fmt.Errorf("malformed %s password hash", algorithm)
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(encoded[sep+1:]); err != nil {
+		return "", nil, nil, err
+	}
+	return encoded[:sep], salt, key, nil
+}
+
+// Returns the algorithm a password hash was created with.
+func passwordHashAlgorithmOf(hash []byte) string {
+	switch {
+	case bytes.HasPrefix(hash, []byte("$"+PasswordHashScrypt+"$")):
+		return PasswordHashScrypt
+	case bytes.HasPrefix(hash, []byte("$"+PasswordHashArgon2id+"$")):
+		return PasswordHashArgon2id
+	default:
+		return PasswordHashBcrypt
+	}
+}
+
+// Returns true if the password matches the hash, whichever algorithm created it.
+func verifyPasswordHash(hash []byte, password []byte) bool {
+	algorithm := passwordHashAlgorithmOf(hash)
+	if algorithm == PasswordHashBcrypt {
+		return bcrypt.CompareHashAndPassword(hash, password) == nil
+	}
+
+	params, salt, key, err := decodePasswordHash(algorithm, hash)
+	if err != nil {
+		base.Warnf(base.KeyAuth, "Unable to decode password hash: %v", err)
+		return false
+	}
+
+	var computed []byte
+	if algorithm == PasswordHashScrypt {
+		var logN, r, p int
+		if _, err := fmt.Sscanf(params, "ln=%d,r=%d,p=%d", &logN, &r, &p); err != nil {
+			base.Warnf(base.KeyAuth, "Invalid scrypt password hash parameters %q: %v", params, err)
+			return false
+		}
+		if computed, err = scrypt.Key(password, salt, 1<<uint(logN), r, p, len(key)); err != nil {
+			return false
+		}
+	} else {
+		var version int
+		var memory, iterations uint32
+		var threads uint8
+		if _, err := fmt.Sscanf(params, "v=%d$m=%d,t=%d,p=%d", &version, &memory, &iterations, &threads); err != nil || version != argon2.Version {
+			base.Warnf(base.KeyAuth, "Invalid argon2id password hash parameters %q", params)
+			return false
+		}
+		computed = argon2.IDKey(password, salt, iterations, memory, threads, uint32(len(key)))
+	}
+	return subtle.ConstantTimeCompare(computed, key) == 1
+}
+
+// Returns true if a password hash was created with a different algorithm or different parameters
+// than would be used to hash the password now.
+func passwordHashNeedsUpgrade(hash []byte) bool {
+	algorithm := passwordHashAlgorithmOf(hash)
+	if algorithm != passwordHashAlgorithm {
+		return true
+	}
+	switch algorithm {
+	case PasswordHashScrypt:
+		params, _, _, err := decodePasswordHash(algorithm, hash)
+		return err == nil && params != scryptParams
+	case PasswordHashArgon2id:
+		params, _, _, err := decodePasswordHash(algorithm, hash)
+		return err == nil && params != argon2idParams
+	default:
+		// Exit early if bcryptCost has not been set
+		if !bcryptCostChanged {
+			return false
+		}
+		hashCost, err := bcrypt.Cost(hash)
+		return err == nil && hashCost != bcryptCost
+	}
+}
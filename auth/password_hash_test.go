@@ -2,9 +2,11 @@ package auth
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/couchbase/sync_gateway/base"
 	goassert "github.com/couchbaselabs/go.assert"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/bcrypt"
@@ -64,3 +66,66 @@ func TestSetBcryptCost(t *testing.T) {
 	goassert.Equals(t, bcryptCost, bcryptDefaultCost)
 	goassert.True(t, bcryptCostChanged)
 }
+
+func TestSetPasswordHashAlgorithm(t *testing.T) {
+	defer func() { passwordHashAlgorithm = PasswordHashBcrypt }()
+
+	err := SetPasswordHashAlgorithm("md5")
+	goassert.Equals(t, errors.Cause(err), ErrInvalidPasswordHashAlgorithm)
+	goassert.Equals(t, passwordHashAlgorithm, PasswordHashBcrypt)
+
+	err = SetPasswordHashAlgorithm(PasswordHashArgon2id)
+	goassert.Equals(t, err, nil)
+	goassert.Equals(t, passwordHashAlgorithm, PasswordHashArgon2id)
+
+	err = SetPasswordHashAlgorithm("") // use default value
+	goassert.Equals(t, err, nil)
+	goassert.Equals(t, passwordHashAlgorithm, PasswordHashBcrypt)
+}
+
+func TestPasswordHashAlgorithms(t *testing.T) {
+	defer func() { passwordHashAlgorithm = PasswordHashBcrypt }()
+
+	hashes := make(map[string][]byte)
+	for _, algorithm := range []string{PasswordHashBcrypt, PasswordHashScrypt, PasswordHashArgon2id} {
+		goassert.Equals(t, SetPasswordHashAlgorithm(algorithm), nil)
+		hash, err := hashPassword([]byte("hunter2"))
+		goassert.Equals(t, err, nil)
+		goassert.Equals(t, passwordHashAlgorithmOf(hash), algorithm)
+		goassert.True(t, verifyPasswordHash(hash, []byte("hunter2")))
+		goassert.False(t, verifyPasswordHash(hash, []byte("hunter3")))
+		goassert.False(t, passwordHashNeedsUpgrade(hash))
+		hashes[algorithm] = hash
+	}
+
+	// Hashes made with another algorithm, or other parameters, still verify but need upgrading
+	goassert.True(t, passwordHashNeedsUpgrade(hashes[PasswordHashBcrypt]))
+	goassert.True(t, passwordHashNeedsUpgrade(hashes[PasswordHashScrypt]))
+	goassert.True(t, verifyPasswordHash(hashes[PasswordHashScrypt], []byte("hunter2")))
+	weakHash := []byte(strings.Replace(string(hashes[PasswordHashArgon2id]), ",t=1,", ",t=2,", 1))
+	goassert.True(t, passwordHashNeedsUpgrade(weakHash))
+
+	goassert.False(t, verifyPasswordHash([]byte("$scrypt$garbage"), []byte("hunter2")))
+}
+
+func TestRehashPasswordAlgorithm(t *testing.T) {
+	gTestBucket := base.GetTestBucketOrPanic()
+	defer gTestBucket.Close()
+	defer func() { passwordHashAlgorithm = PasswordHashBcrypt }()
+
+	auth := NewAuthenticator(gTestBucket.Bucket, nil)
+	user, _ := auth.NewUser("arthur", "hunter2", nil)
+	goassert.Equals(t, auth.Save(user), nil)
+	changedAt := user.(*userImpl).PasswordChangedAt_
+
+	// Logging in after the algorithm changes upgrades the stored hash, without restarting expiry
+	goassert.Equals(t, SetPasswordHashAlgorithm(PasswordHashScrypt), nil)
+	goassert.True(t, auth.AuthenticateUser("arthur", "hunter2") != nil)
+
+	user, err := auth.GetUser("arthur")
+	goassert.Equals(t, err, nil)
+	goassert.Equals(t, passwordHashAlgorithmOf(user.(*userImpl).PasswordHash_), PasswordHashScrypt)
+	goassert.Equals(t, user.(*userImpl).PasswordChangedAt_, changedAt)
+	goassert.True(t, auth.AuthenticateUser("arthur", "hunter2") != nil)
+	goassert.True(t, auth.AuthenticateUser("arthur", "hunter3") == nil)
+}
@@ -0,0 +1,92 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Rules that user passwords must satisfy, and how long they remain valid.
+type PasswordPolicy struct {
+	MinLength        int      `json:"min_length,omitempty"`        // Minimum number of characters
+	RequireUppercase bool     `json:"require_uppercase,omitempty"` // Must contain an uppercase letter
+	RequireLowercase bool     `json:"require_lowercase,omitempty"` // Must contain a lowercase letter
+	RequireDigit     bool     `json:"require_digit,omitempty"`     // Must contain a digit
+	RequireSymbol    bool     `json:"require_symbol,omitempty"`    // Must contain a character that isn't a letter or digit
+	DenyList         []string `json:"deny_list,omitempty"`         // Passwords that may not be used, compared case-insensitively
+	MaxAgeDays       int      `json:"max_age_days,omitempty"`      // Days after which a password expires and must be changed
+}
+
+// Returns an HTTP 400 error describing every rule the password breaks.  A nil policy, or an empty
+// password (only accepted when the database allows empty passwords), always passes.
+func (policy *PasswordPolicy) Validate(password string) error {
+	if policy == nil || password == "" {
+		return nil
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case !unicode.IsLetter(r):
+			hasSymbol = true
+		}
+	}
+
+	var reasons []string
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		reasons = append(reasons, fmt.Sprintf("be at least %d characters", policy.MinLength))
+	}
+	if policy.RequireUppercase && !hasUpper {
+		reasons = append(reasons, "contain an uppercase letter")
+	}
+	if policy.RequireLowercase && !hasLower {
+		reasons = append(reasons, "contain a lowercase letter")
+	}
+	if policy.RequireDigit && !hasDigit {
+		reasons = append(reasons, "contain a digit")
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		reasons = append(reasons, "contain a symbol")
+	}
+	for _, denied := range policy.DenyList {
+		if strings.EqualFold(password, denied) {
+			reasons = append(reasons, "not be a commonly used password")
+			break
+		}
+	}
+
+	if len(reasons) > 0 {
+		return base.HTTPErrorf(http.StatusBadRequest, "Password must %s", strings.Join(reasons, ", "))
+	}
+	return nil
+}
+
+// Returns true if a password set at the given Unix time has expired.  Passwords set before
+// their change time was recorded never expire.
+func (policy *PasswordPolicy) isExpired(changedAt int64) bool {
+	if policy == nil || policy.MaxAgeDays <= 0 || changedAt == 0 {
+		return false
+	}
+	maxAge := time.Duration(policy.MaxAgeDays) * 24 * time.Hour
+	return time.Since(time.Unix(changedAt, 0)) > maxAge
+}
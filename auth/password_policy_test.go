@@ -0,0 +1,73 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	var nilPolicy *PasswordPolicy
+	assert.NoError(t, nilPolicy.Validate("a"))
+
+	policy := &PasswordPolicy{
+		MinLength:        8,
+		RequireUppercase: true,
+		RequireLowercase: true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+		DenyList:         []string{"Passw0rd!"},
+	}
+	assert.NoError(t, policy.Validate("Tr0ub4dor&3"))
+	assert.NoError(t, policy.Validate(""), "Empty passwords are governed by allow_empty_password")
+
+	err := policy.Validate("abc")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "be at least 8 characters")
+	assert.Contains(t, err.Error(), "contain an uppercase letter")
+	assert.Contains(t, err.Error(), "contain a digit")
+	assert.Contains(t, err.Error(), "contain a symbol")
+	assert.NotContains(t, err.Error(), "lowercase")
+
+	err = policy.Validate("PASSW0RD!")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "commonly used")
+}
+
+func TestPasswordExpiry(t *testing.T) {
+	gTestBucket := base.GetTestBucketOrPanic()
+	defer gTestBucket.Close()
+	auth := NewAuthenticator(gTestBucket.Bucket, nil)
+
+	user, _ := auth.NewUser("arthur", "hunter2", nil)
+	assert.False(t, user.PasswordChangeRequired())
+
+	// Explicit flag, cleared by changing the password
+	user.SetPasswordChangeRequired(true)
+	assert.True(t, user.PasswordChangeRequired())
+	user.SetPassword("hunter3")
+	assert.False(t, user.PasswordChangeRequired())
+
+	// Expiry under the policy
+	auth.SetPasswordPolicy(&PasswordPolicy{MaxAgeDays: 30})
+	assert.False(t, user.PasswordChangeRequired())
+	user.(*userImpl).PasswordChangedAt_ = time.Now().Add(-31 * 24 * time.Hour).Unix()
+	assert.True(t, user.PasswordChangeRequired())
+	assert.True(t, user.PasswordExpired())
+	assert.False(t, user.PasswordChangeFlagged())
+
+	// Passwords set before change times were recorded don't expire
+	user.(*userImpl).PasswordChangedAt_ = 0
+	assert.False(t, user.PasswordChangeRequired())
+}
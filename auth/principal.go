@@ -38,6 +38,15 @@ type Principal interface {
 	// Sets the previous set of channels the Principal has access to.
 	SetPreviousChannels(ch.TimedSet)
 
+	// The set of channels the Principal is allowed to write documents to.
+	WriteChannels() ch.TimedSet
+
+	// The channels the Principal was explicitly granted write access to thru the admin API.
+	ExplicitWriteChannels() ch.TimedSet
+
+	// Sets the explicit channels the Principal has write access to.
+	SetExplicitWriteChannels(ch.TimedSet)
+
 	// Returns true if the Principal has access to the given channel.
 	CanSeeChannel(channel string) bool
 
@@ -59,6 +68,12 @@ type Principal interface {
 	// Returns an error if the Principal does not have access to any of the channels in the set.
 	AuthorizeAnyChannel(channels base.Set) error
 
+	// Returns true if the Principal is allowed to write documents to the given channel.
+	CanWriteChannel(channel string) bool
+
+	// Returns an error if the Principal does not have write access to all the channels in the set.
+	AuthorizeWriteChannels(channels base.Set) error
+
 	// Returns an appropriate HTTPError for unauthorized access -- a 401 if the receiver is
 	// the guest user, else 403.
 	UnauthError(message string) error
@@ -67,6 +82,7 @@ type Principal interface {
 	accessViewKey() string
 	validate() error
 	setChannels(ch.TimedSet)
+	setWriteChannels(ch.TimedSet)
 	getVbNo(hashFunction VBHashFunction) uint16
 
 	// Cas value for the associated principal document in the bucket
@@ -74,9 +90,16 @@ type Principal interface {
 	SetCas(cas uint64)
 }
 
-// Role is basically the same as Principal, just concrete. Users can inherit channels from Roles.
+// Role is basically the same as Principal, just concrete. Users can inherit channels from Roles,
+// and Roles can in turn inherit channels from parent Roles.
 type Role interface {
 	Principal
+
+	// The roles this Role inherits from, and the sequence at which each was added.
+	ParentRoles() ch.TimedSet
+
+	// Sets the roles this Role inherits from.
+	SetParentRoles(ch.TimedSet)
 }
 
 // A User is a Principal that can log in and have multiple Roles.
@@ -98,12 +121,32 @@ type User interface {
 	// Authenticates the user's password.
 	Authenticate(password string) bool
 
+	// Whether the user has a password, as opposed to only authenticating through a provider.
+	HasPassword() bool
+
 	// Changes the user's password.
 	SetPassword(password string)
 
+	// If true, the user must change their password before doing anything else, either because
+	// an admin required it or because the password has expired.
+	PasswordChangeRequired() bool
+
+	// Whether an admin required the user to change their password, regardless of its expiry.
+	PasswordChangeFlagged() bool
+
+	// Whether the user's password has expired under the password policy.
+	PasswordExpired() bool
+
+	// Sets whether the user must change their password.
+	SetPasswordChangeRequired(bool)
+
 	// The set of Roles the user belongs to (including ones given to it by the sync function)
 	RoleNames() ch.TimedSet
 
+	// Every role the user belongs to, including the ancestors of its roles, and the sequence at
+	// which the user effectively gained each one.
+	InheritedRoleNames() ch.TimedSet
+
 	// The roles the user was explicitly granted access to thru the admin API.
 	ExplicitRoles() ch.TimedSet
 
@@ -113,6 +156,9 @@ type User interface {
 	// Every channel the user has access to, including those inherited from Roles.
 	InheritedChannels() ch.TimedSet
 
+	// Every channel the user has write access to, including those inherited from Roles.
+	InheritedWriteChannels() ch.TimedSet
+
 	// If the input set contains the wildcard "*" channel, returns the user's InheritedChannels;
 	// else returns the input channel list unaltered.
 	ExpandWildCardChannel(channels base.Set) base.Set
@@ -21,13 +21,16 @@ import (
 
 /** A group that users can belong to, with associated channel permisisons. */
 type roleImpl struct {
-	Name_             string      `json:"name,omitempty"`
-	ExplicitChannels_ ch.TimedSet `json:"admin_channels,omitempty"`
-	Channels_         ch.TimedSet `json:"all_channels"`
-	Sequence_         uint64      `json:"sequence"`
-	PreviousChannels_ ch.TimedSet `json:"previous_channels,omitempty"`
-	vbNo              *uint16
-	cas               uint64
+	Name_                  string      `json:"name,omitempty"`
+	ExplicitChannels_      ch.TimedSet `json:"admin_channels,omitempty"`
+	Channels_              ch.TimedSet `json:"all_channels"`
+	Sequence_              uint64      `json:"sequence"`
+	PreviousChannels_      ch.TimedSet `json:"previous_channels,omitempty"`
+	ExplicitWriteChannels_ ch.TimedSet `json:"admin_write_channels,omitempty"`
+	WriteChannels_         ch.TimedSet `json:"all_write_channels,omitempty"`
+	ParentRoles_           ch.TimedSet `json:"parent_roles,omitempty"`
+	vbNo                   *uint16
+	cas                    uint64
 }
 
 var kValidNameRegexp = regexp.MustCompile(`^[-+.@%\w]*$`)
@@ -131,6 +134,33 @@ func (role *roleImpl) SetExplicitChannels(channels ch.TimedSet) {
 	role.setChannels(nil)
 }
 
+func (role *roleImpl) WriteChannels() ch.TimedSet {
+	return role.WriteChannels_
+}
+
+func (role *roleImpl) setWriteChannels(channels ch.TimedSet) {
+	role.WriteChannels_ = channels
+}
+
+func (role *roleImpl) ExplicitWriteChannels() ch.TimedSet {
+	return role.ExplicitWriteChannels_
+}
+
+// Sets the explicit write channels, and invalidates the computed channels so that both the read
+// and write sets are rebuilt on next load.
+func (role *roleImpl) SetExplicitWriteChannels(channels ch.TimedSet) {
+	role.ExplicitWriteChannels_ = channels
+	role.setChannels(nil)
+}
+
+func (role *roleImpl) ParentRoles() ch.TimedSet {
+	return role.ParentRoles_
+}
+
+func (role *roleImpl) SetParentRoles(parents ch.TimedSet) {
+	role.ParentRoles_ = parents
+}
+
 func (role *roleImpl) PreviousChannels() ch.TimedSet {
 	return role.PreviousChannels_
 }
@@ -144,6 +174,17 @@ func (role *roleImpl) validate() error {
 	if !IsValidPrincipalName(role.Name_) {
 		return base.HTTPErrorf(http.StatusBadRequest, "Invalid name %q", role.Name_)
 	}
+	if err := role.ExplicitWriteChannels_.Validate(); err != nil {
+		return err
+	}
+	for parent := range role.ParentRoles_ {
+		if !IsValidPrincipalName(parent) {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid parent role name %q", parent)
+		}
+		if parent == role.Name_ {
+			return base.HTTPErrorf(http.StatusBadRequest, "Role %q cannot be its own parent", role.Name_)
+		}
+	}
 	return role.ExplicitChannels_.Validate()
 }
 
@@ -196,6 +237,16 @@ func (role *roleImpl) AuthorizeAnyChannel(channels base.Set) error {
 	return authorizeAnyChannel(role, channels)
 }
 
+// Returns true if the Role is allowed to write documents to the channel.
+// A nil Role means access control is disabled, so the function will return true.
+func (role *roleImpl) CanWriteChannel(channel string) bool {
+	return role == nil || role.WriteChannels_.Contains(channel) || role.WriteChannels_.Contains(ch.UserStarChannel)
+}
+
+func (role *roleImpl) AuthorizeWriteChannels(channels base.Set) error {
+	return authorizeWriteChannels(role, channels)
+}
+
 func (role *roleImpl) ValidateGrant(vbSeq *ch.VbSequence, hashFunction VBHashFunction) bool {
 
 	// If the sequence is zero, this is an admin grant that hasn't been updated by accel - ignore
@@ -237,6 +288,21 @@ func authorizeAllChannels(princ Principal, channels base.Set) error {
 	return nil
 }
 
+// Returns an HTTP 403 error if the Principal is not allowed to write to all the given channels.
+// A nil Principal means access control is disabled, so the function will return nil.
+func authorizeWriteChannels(princ Principal, channels base.Set) error {
+	var forbidden []string
+	for channel := range channels {
+		if !princ.CanWriteChannel(channel) {
+			forbidden = append(forbidden, channel)
+		}
+	}
+	if forbidden != nil {
+		return princ.UnauthError(fmt.Sprintf("You are not allowed to write to channels %v", forbidden))
+	}
+	return nil
+}
+
 // Returns an HTTP 403 error if the Principal is not allowed to access any of the given channels.
 // A nil Role means access control is disabled, so the function will return nil.
 func authorizeAnyChannel(princ Principal, channels base.Set) error {
@@ -10,7 +10,9 @@
 package auth
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/couchbase/sync_gateway/base"
@@ -24,6 +26,65 @@ type LoginSession struct {
 	Username   string        `json:"username"`
 	Expiration time.Time     `json:"expiration"`
 	Ttl        time.Duration `json:"ttl"`
+	Created    time.Time     `json:"created,omitempty"` // Zero for sessions created before this was recorded
+}
+
+// Per-database settings for login sessions and the cookies that carry them.
+type SessionOptions struct {
+	CookieSecure    bool   `json:"cookie_secure,omitempty"`     // Only send the cookie over HTTPS
+	CookieHTTPOnly  bool   `json:"cookie_http_only,omitempty"`  // Hide the cookie from client-side scripts
+	CookieSameSite  string `json:"cookie_same_site,omitempty"`  // "lax", "strict" or "none"; unset omits the attribute
+	CookieDomain    string `json:"cookie_domain,omitempty"`     // Domain the cookie is sent to, e.g. to share it with subdomains
+	CookiePath      string `json:"cookie_path,omitempty"`       // Path the cookie is sent to.  Defaults to the database's path
+	MaxLifetimeSecs uint32 `json:"max_lifetime_secs,omitempty"` // Absolute limit on a session's lifetime, however often it's refreshed
+	MaxPerUser      int    `json:"max_per_user,omitempty"`      // Maximum concurrent sessions per user; the oldest are evicted
+}
+
+// Returns an error if the options contain invalid values.
+func (options *SessionOptions) Validate() error {
+	if _, err := options.sameSite(); err != nil {
+		return err
+	}
+	if strings.EqualFold(options.CookieSameSite, "none") && !options.CookieSecure {
+		return fmt.Errorf("cookie_same_site none requires cookie_secure")
+	}
+	if options.MaxPerUser < 0 {
+		return fmt.Errorf("max_per_user must not be negative")
+	}
+	return nil
+}
+
+// Returns the cookie's SameSite mode.  net/http has no mode for "none" before Go 1.13, and its
+// default mode writes a bare SameSite attribute, so both unset and "none" return the zero mode,
+// which omits the attribute.  SameSite=None is added by SetSessionCookie.
+func (options *SessionOptions) sameSite() (http.SameSite, error) {
+	switch strings.ToLower(options.CookieSameSite) {
+	case "", "none":
+		return http.SameSite(0), nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	default:
+		return http.SameSite(0), fmt.Errorf("invalid cookie_same_site %q, must be lax, strict or none", options.CookieSameSite)
+	}
+}
+
+// Returns the latest time the session may be extended to, or the zero time if there's no limit.
+func (auth *Authenticator) sessionDeadline(session *LoginSession) time.Time {
+	if auth.sessionOptions.MaxLifetimeSecs == 0 || session.Created.IsZero() {
+		return time.Time{}
+	}
+	return session.Created.Add(time.Duration(auth.sessionOptions.MaxLifetimeSecs) * time.Second)
+}
+
+// Returns now plus the session's TTL, capped at the session's absolute deadline.
+func (auth *Authenticator) sessionExpiration(session *LoginSession) time.Time {
+	expiration := time.Now().Add(session.Ttl)
+	if deadline := auth.sessionDeadline(session); !deadline.IsZero() && expiration.After(deadline) {
+		expiration = deadline
+	}
+	return expiration
 }
 
 const DefaultCookieName = "SyncGatewaySession"
@@ -46,6 +107,14 @@ func (auth *Authenticator) AuthenticateCookie(rq *http.Request, response http.Re
 		return nil, err
 	}
 	// Don't need to check session.Expiration, because Couchbase will have nuked the document.
+	// The absolute lifetime limit is checked here though, as it may have been configured after
+	// the session was created.
+	if deadline := auth.sessionDeadline(&session); !deadline.IsZero() && time.Now().After(deadline) {
+		base.Infof(base.KeyAuth, "Session for %s reached its maximum lifetime", base.UD(session.Username))
+		_ = auth.DeleteSession(session.ID)
+		return nil, nil
+	}
+
 	//update the session Expiration if 10% or more of the current expiration time has elapsed
 	//if the session does not contain a Ttl (probably created prior to upgrading SG), use
 	//default value of 24Hours
@@ -55,14 +124,15 @@ func (auth *Authenticator) AuthenticateCookie(rq *http.Request, response http.Re
 	duration := session.Ttl
 	sessionTimeElapsed := int((time.Now().Add(duration).Sub(session.Expiration)).Seconds())
 	tenPercentOfTtl := int(duration.Seconds()) / 10
-	if sessionTimeElapsed > tenPercentOfTtl {
-		session.Expiration = time.Now().Add(duration)
-		if err = auth.bucket.Set(docIDForSession(session.ID), base.DurationToCbsExpiry(duration), session); err != nil {
+	// A session capped at its maximum lifetime can't be extended any further
+	if newExpiration := auth.sessionExpiration(&session); sessionTimeElapsed > tenPercentOfTtl && newExpiration.After(session.Expiration) {
+		session.Expiration = newExpiration
+		if err = auth.bucket.Set(docIDForSession(session.ID), sessionDocExpiry(session.Expiration), session); err != nil {
 			return nil, err
 		}
-		base.AddDbPathToCookie(rq, cookie)
-		cookie.Expires = session.Expiration
-		http.SetCookie(response, cookie)
+		refreshedCookie := auth.MakeSessionCookie(&session)
+		auth.SetSessionCookiePath(rq, refreshedCookie)
+		auth.SetSessionCookie(response, refreshedCookie)
 	}
 
 	user, err := auth.GetUser(session.Username)
@@ -79,12 +149,13 @@ func (auth *Authenticator) CreateSession(username string, ttl time.Duration) (*L
 	}
 
 	session := &LoginSession{
-		ID:         base.GenerateRandomSecret(),
-		Username:   username,
-		Expiration: time.Now().Add(ttl),
-		Ttl:        ttl,
+		ID:       base.GenerateRandomSecret(),
+		Username: username,
+		Ttl:      ttl,
+		Created:  time.Now(),
 	}
-	if err := auth.bucket.Set(docIDForSession(session.ID), base.DurationToCbsExpiry(ttl), session); err != nil {
+	session.Expiration = auth.sessionExpiration(session)
+	if err := auth.bucket.Set(docIDForSession(session.ID), sessionDocExpiry(session.Expiration), session); err != nil {
 		return nil, err
 	}
 	return session, nil
@@ -106,10 +177,37 @@ func (auth *Authenticator) MakeSessionCookie(session *LoginSession) *http.Cookie
 	if session == nil {
 		return nil
 	}
+	sameSite, _ := auth.sessionOptions.sameSite()
 	return &http.Cookie{
-		Name:    auth.sessionCookieName,
-		Value:   session.ID,
-		Expires: session.Expiration,
+		Name:     auth.sessionCookieName,
+		Value:    session.ID,
+		Expires:  session.Expiration,
+		Secure:   auth.sessionOptions.CookieSecure,
+		HttpOnly: auth.sessionOptions.CookieHTTPOnly,
+		SameSite: sameSite,
+		Domain:   auth.sessionOptions.CookieDomain,
+	}
+}
+
+// Adds a session cookie to the response, with the SameSite=None attribute if configured.
+func (auth *Authenticator) SetSessionCookie(response http.ResponseWriter, cookie *http.Cookie) {
+	value := cookie.String()
+	if value == "" {
+		return
+	}
+	if strings.EqualFold(auth.sessionOptions.CookieSameSite, "none") {
+		value += "; SameSite=None"
+	}
+	response.Header().Add("Set-Cookie", value)
+}
+
+// Sets the path of a session cookie: the configured cookie path if any, else the path of the
+// database the request was made to.
+func (auth *Authenticator) SetSessionCookiePath(rq *http.Request, cookie *http.Cookie) {
+	if auth.sessionOptions.CookiePath != "" {
+		cookie.Path = auth.sessionOptions.CookiePath
+	} else {
+		base.AddDbPathToCookie(rq, cookie)
 	}
 }
 
@@ -120,10 +218,10 @@ func (auth Authenticator) DeleteSessionForCookie(rq *http.Request) *http.Cookie
 	}
 	auth.bucket.Delete(docIDForSession(cookie.Value))
 
-	newCookie := *cookie
-	newCookie.Value = ""
-	newCookie.Expires = time.Now()
-	return &newCookie
+	// The attributes of the expired cookie must match those it was set with, for the browser to replace it
+	newCookie := auth.MakeSessionCookie(&LoginSession{Expiration: time.Now()})
+	auth.SetSessionCookiePath(rq, newCookie)
+	return newCookie
 }
 
 func (auth Authenticator) DeleteSession(sessionid string) error {
@@ -132,6 +230,16 @@ func (auth Authenticator) DeleteSession(sessionid string) error {
 
 }
 
+// Returns the expiry for a session document expiring at the given time.  Never returns zero,
+// which would mean the document never expires.
+func sessionDocExpiry(expiration time.Time) uint32 {
+	remaining := time.Until(expiration).Round(time.Second)
+	if remaining < time.Second {
+		remaining = time.Second
+	}
+	return base.DurationToCbsExpiry(remaining)
+}
+
 func docIDForSession(sessionID string) string {
 	return SessionKeyPrefix + sessionID
 }
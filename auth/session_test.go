@@ -0,0 +1,109 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionOptionsValidate(t *testing.T) {
+	assert.NoError(t, (&SessionOptions{}).Validate())
+	assert.NoError(t, (&SessionOptions{CookieSameSite: "Strict"}).Validate())
+	assert.NoError(t, (&SessionOptions{CookieSameSite: "none", CookieSecure: true}).Validate())
+	assert.Error(t, (&SessionOptions{CookieSameSite: "none"}).Validate())
+	assert.Error(t, (&SessionOptions{CookieSameSite: "sometimes"}).Validate())
+	assert.Error(t, (&SessionOptions{MaxPerUser: -1}).Validate())
+}
+
+func TestSessionCookieSameSiteUnset(t *testing.T) {
+	// With no SameSite configured the attribute is omitted entirely
+	for _, sameSite := range []string{"", "none"} {
+		mode, err := (&SessionOptions{CookieSameSite: sameSite}).sameSite()
+		assert.NoError(t, err)
+		assert.Equal(t, http.SameSite(0), mode)
+	}
+	mode, err := (&SessionOptions{CookieSameSite: "sometimes"}).sameSite()
+	assert.Error(t, err)
+	assert.Equal(t, http.SameSite(0), mode)
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	gTestBucket := base.GetTestBucketOrPanic()
+	defer gTestBucket.Close()
+	auth := NewAuthenticator(gTestBucket.Bucket, nil)
+	auth.SetSessionOptions(&SessionOptions{
+		CookieSecure:   true,
+		CookieHTTPOnly: true,
+		CookieSameSite: "none",
+		CookieDomain:   "example.com",
+		CookiePath:     "/",
+	})
+
+	session, err := auth.CreateSession("arthur", time.Hour)
+	assert.NoError(t, err)
+	cookie := auth.MakeSessionCookie(session)
+	rq := httptest.NewRequest("GET", "/db/_session", nil)
+	auth.SetSessionCookiePath(rq, cookie)
+	assert.True(t, cookie.Secure)
+	assert.True(t, cookie.HttpOnly)
+	assert.Equal(t, "example.com", cookie.Domain)
+	assert.Equal(t, "/", cookie.Path)
+
+	// SameSite=None is added to the header by hand, as older versions of net/http don't support it
+	response := httptest.NewRecorder()
+	auth.SetSessionCookie(response, cookie)
+	setCookie := response.Header().Get("Set-Cookie")
+	assert.Contains(t, setCookie, "; SameSite=None")
+	assert.Equal(t, 1, strings.Count(setCookie, "SameSite"))
+
+	// Logging out expires a cookie with the same attributes
+	rq.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: session.ID})
+	expired := auth.DeleteSessionForCookie(rq)
+	assert.Equal(t, "", expired.Value)
+	assert.True(t, expired.Secure)
+	assert.Equal(t, "example.com", expired.Domain)
+	assert.Equal(t, "/", expired.Path)
+}
+
+func TestSessionMaxLifetime(t *testing.T) {
+	gTestBucket := base.GetTestBucketOrPanic()
+	defer gTestBucket.Close()
+	auth := NewAuthenticator(gTestBucket.Bucket, nil)
+	user, _ := auth.NewUser("arthur", "password", nil)
+	assert.NoError(t, auth.Save(user))
+	auth.SetSessionOptions(&SessionOptions{MaxLifetimeSecs: 3600})
+
+	// The session's expiry is capped at its maximum lifetime
+	session, err := auth.CreateSession("arthur", 24*time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, session.Expiration.Before(time.Now().Add(time.Hour+time.Second)))
+
+	rq := httptest.NewRequest("GET", "/db/", nil)
+	rq.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: session.ID})
+	authUser, err := auth.AuthenticateCookie(rq, httptest.NewRecorder())
+	assert.NoError(t, err)
+	assert.NotNil(t, authUser)
+
+	// Once the lifetime has passed, the session is no longer accepted, however recently it was used
+	session.Created = time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, gTestBucket.Bucket.Set(docIDForSession(session.ID), 0, session))
+	authUser, err = auth.AuthenticateCookie(rq, httptest.NewRecorder())
+	assert.NoError(t, err)
+	assert.Nil(t, authUser)
+	deleted, _ := auth.GetSession(session.ID)
+	assert.Nil(t, deleted)
+}
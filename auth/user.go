@@ -15,8 +15,7 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
-
-	"golang.org/x/crypto/bcrypt"
+	"time"
 
 	"github.com/couchbase/sync_gateway/base"
 	ch "github.com/couchbase/sync_gateway/channels"
@@ -26,8 +25,9 @@ import (
 type userImpl struct {
 	roleImpl // userImpl "inherits from" Role
 	userImplBody
-	auth  *Authenticator
-	roles []Role
+	auth           *Authenticator
+	roles          []Role
+	inheritedRoles ch.TimedSet
 }
 
 // Marshalable data is stored in separate struct from userImpl,
@@ -35,11 +35,14 @@ type userImpl struct {
 type userImplBody struct {
 	Email_           string      `json:"email,omitempty"`
 	Disabled_        bool        `json:"disabled,omitempty"`
-	PasswordHash_    []byte      `json:"passwordhash_bcrypt,omitempty"`
-	OldPasswordHash_ interface{} `json:"passwordhash,omitempty"` // For pre-beta compatibility
+	PasswordHash_    []byte      `json:"passwordhash_bcrypt,omitempty"` // May also hold a scrypt or argon2id hash, despite the name
+	OldPasswordHash_ interface{} `json:"passwordhash,omitempty"`        // For pre-beta compatibility
 	ExplicitRoles_   ch.TimedSet `json:"explicit_roles,omitempty"`
 	RolesSince_      ch.TimedSet `json:"rolesSince"`
 
+	PasswordChangedAt_      int64 `json:"password_changed_at,omitempty"`      // Unix time the password was last set
+	PasswordChangeRequired_ bool  `json:"password_change_required,omitempty"` // Password must be changed before the user can do anything else
+
 	OldExplicitRoles_ []string `json:"admin_roles,omitempty"` // obsolete; declared for migration
 }
 
@@ -174,6 +177,7 @@ func (user *userImpl) RoleNames() ch.TimedSet {
 func (user *userImpl) setRolesSince(rolesSince ch.TimedSet) {
 	user.RolesSince_ = rolesSince
 	user.roles = nil // invalidate in-memory cache list of Role objects
+	user.inheritedRoles = nil
 }
 
 func (user *userImpl) ExplicitRoles() ch.TimedSet {
@@ -185,6 +189,10 @@ func (user *userImpl) SetExplicitRoles(roles ch.TimedSet) {
 	user.setRolesSince(nil) // invalidate persistent cache of role names
 }
 
+func (user *userImpl) HasPassword() bool {
+	return user.PasswordHash_ != nil
+}
+
 // Returns true if the given password is correct for this user, and the account isn't disabled.
 func (user *userImpl) Authenticate(password string) bool {
 	if user == nil {
@@ -202,7 +210,7 @@ func (user *userImpl) Authenticate(password string) bool {
 		return false // Password must be reset to use new (bcrypt) password hash
 	}
 
-	// bcrypt hash present
+	// password hash present
 	if user.PasswordHash_ != nil {
 		if !compareHashAndPassword(user.PasswordHash_, []byte(password)) {
 			// incorrect password
@@ -210,7 +218,7 @@ func (user *userImpl) Authenticate(password string) bool {
 		}
 
 		// password was correct, we'll rehash the password if required
-		// e.g: in the case of bcryptCost changes
+		// e.g: in the case of bcryptCost or hash algorithm changes
 		if err := user.auth.rehashPassword(user, password); err != nil {
 			// rehash is best effort, just log a warning on error.
 			base.Warnf(base.KeyAll, "Error when rehashing password for user %s: %v", base.UD(user.Name()), err)
@@ -225,12 +233,23 @@ func (user *userImpl) Authenticate(password string) bool {
 	return true
 }
 
-// Changes a user's password to the given string.
+// Changes a user's password to the given string.  Restarts the password's expiry period, and
+// clears any pending requirement to change it.  An empty password never expires.
 func (user *userImpl) SetPassword(password string) {
+	user.setPasswordHash(password)
+	user.PasswordChangedAt_ = 0
+	if password != "" {
+		user.PasswordChangedAt_ = time.Now().Unix()
+	}
+	user.PasswordChangeRequired_ = false
+}
+
+// Replaces the user's password hash, using the configured hash algorithm.
+func (user *userImpl) setPasswordHash(password string) {
 	if password == "" {
 		user.PasswordHash_ = nil
 	} else {
-		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+		hash, err := hashPassword([]byte(password))
 		if err != nil {
 			panic(fmt.Sprintf("Error hashing password: %v", err))
 		}
@@ -238,6 +257,24 @@ func (user *userImpl) SetPassword(password string) {
 	}
 }
 
+// Returns true if the user was flagged as needing to change their password, or their password has
+// expired under the password policy.
+func (user *userImpl) PasswordChangeRequired() bool {
+	return user.PasswordChangeRequired_ || user.PasswordExpired()
+}
+
+func (user *userImpl) PasswordExpired() bool {
+	return user.auth != nil && user.auth.passwordPolicy.isExpired(user.PasswordChangedAt_)
+}
+
+func (user *userImpl) PasswordChangeFlagged() bool {
+	return user.PasswordChangeRequired_
+}
+
+func (user *userImpl) SetPasswordChangeRequired(required bool) {
+	user.PasswordChangeRequired_ = required
+}
+
 // Returns the sequence number since which the user has been able to access the channel, else zero.  Sets the vb
 // for an admin channel grant, if needed.
 func (user *userImpl) CanSeeChannelSinceVbSeq(channel string, hashFunction VBHashFunction) (base.VbSeq, bool) {
@@ -280,23 +317,19 @@ func (user *userImpl) ValidateGrant(vbSeq *ch.VbSequence, hashFunction VBHashFun
 
 //////// CHANNEL ACCESS:
 
+// Returns the roles the user belongs to, including every ancestor of those roles.
 func (user *userImpl) GetRoles() []Role {
 	if user.roles == nil {
-		roles := make([]Role, 0, len(user.RolesSince_))
-		for name := range user.RolesSince_ {
-			role, err := user.auth.GetRole(name)
-			//base.Infof(base.KeyAccess, "User %s role %q = %v", base.UD(user.Name_), base.UD(name), base.UD(role))
-			if err != nil {
-				panic(fmt.Sprintf("Error getting user role %q: %v", name, err))
-			} else if role != nil {
-				roles = append(roles, role)
-			}
-		}
-		user.roles = roles
+		user.roles, user.inheritedRoles = user.auth.expandRoles(user.RolesSince_)
 	}
 	return user.roles
 }
 
+func (user *userImpl) InheritedRoleNames() ch.TimedSet {
+	user.GetRoles()
+	return user.inheritedRoles
+}
+
 func (user *userImpl) CanSeeChannel(channel string) bool {
 	if user.roleImpl.CanSeeChannel(channel) {
 		return true
@@ -311,8 +344,17 @@ func (user *userImpl) CanSeeChannel(channel string) bool {
 
 func (user *userImpl) CanSeeChannelSince(channel string) uint64 {
 	minSeq := user.roleImpl.CanSeeChannelSince(channel)
+	roleGrants := user.InheritedRoleNames()
 	for _, role := range user.GetRoles() {
-		if seq := role.CanSeeChannelSince(channel); seq > 0 && (seq < minSeq || minSeq == 0) {
+		seq := role.CanSeeChannelSince(channel)
+		if seq == 0 {
+			continue
+		}
+		// Access through a role starts no earlier than the user's (possibly inherited) grant of that role
+		if roleSince := roleGrants[role.Name()].Sequence; roleSince > seq {
+			seq = roleSince
+		}
+		if seq < minSeq || minSeq == 0 {
 			minSeq = seq
 		}
 	}
@@ -327,10 +369,37 @@ func (user *userImpl) AuthorizeAnyChannel(channels base.Set) error {
 	return authorizeAnyChannel(user, channels)
 }
 
+func (user *userImpl) CanWriteChannel(channel string) bool {
+	if user.roleImpl.CanWriteChannel(channel) {
+		return true
+	}
+	for _, role := range user.GetRoles() {
+		if role.CanWriteChannel(channel) {
+			return true
+		}
+	}
+	return false
+}
+
+func (user *userImpl) AuthorizeWriteChannels(channels base.Set) error {
+	return authorizeWriteChannels(user, channels)
+}
+
+func (user *userImpl) InheritedWriteChannels() ch.TimedSet {
+	channels := user.WriteChannels().Copy()
+	roleGrants := user.InheritedRoleNames()
+	for _, role := range user.GetRoles() {
+		roleSince := roleGrants[role.Name()]
+		channels.AddAtSequence(role.WriteChannels(), roleSince.Sequence)
+	}
+	return channels
+}
+
 func (user *userImpl) InheritedChannels() ch.TimedSet {
 	channels := user.Channels().Copy()
+	roleGrants := user.InheritedRoleNames()
 	for _, role := range user.GetRoles() {
-		roleSince := user.RolesSince_[role.Name()]
+		roleSince := roleGrants[role.Name()]
 		channels.AddAtSequence(role.Channels(), roleSince.Sequence)
 	}
 	return channels
@@ -411,8 +480,9 @@ func (user *userImpl) InheritedChannelsForClock(sinceClock base.SequenceClock) (
 		}
 	}
 	// For each role, evaluate role grant vbseq and role channel grant vbseq.
+	roleGrants := user.InheritedRoleNames()
 	for _, role := range user.GetRoles() {
-		roleSince := user.RolesSince_[role.Name()]
+		roleSince := roleGrants[role.Name()]
 		roleGrantValid := user.ValidateGrant(&roleSince, hashFunction)
 		if !roleGrantValid {
 			continue
@@ -483,10 +553,11 @@ func (user *userImpl) CanSeeChannelSinceForClock(channel string, sinceClock base
 		}
 	}
 	// Check for the channel in the user's roles
+	roleGrants := user.InheritedRoleNames()
 	for _, role := range user.GetRoles() {
 		roleChannelSince, ok := role.CanSeeChannelSinceVbSeq(channel, hashFunction)
 		if ok {
-			roleGrant := user.RolesSince_[role.Name()]
+			roleGrant := roleGrants[role.Name()]
 			isValid := user.ValidateGrant(&roleGrant, hashFunction)
 			if !isValid {
 				continue
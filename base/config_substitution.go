@@ -0,0 +1,268 @@
+package base
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Config files can refer to secrets instead of containing them.  In the string values of a config:
+//
+//   ${NAME}            is replaced by the value of the environment variable NAME
+//   ${NAME:-default}   is replaced by the value of NAME, or by "default" if NAME isn't set
+//   ${file:/some/path} is replaced by the contents of the file, without trailing newlines
+//   $${                is replaced by a literal "${"
+//
+// The contents of files, and the values of environment variables substituted into credential
+// properties (see isSecretConfigProperty), are treated as secrets, and are redacted from logs and
+// from the config returned by the admin API.  Other environment variables, such as ports and
+// hostnames, aren't, so a secret substituted into another property, such as a password within a
+// server URL, should be read from a file.  Log messages are redacted as they're written out, by
+// each logger.
+
+// Config properties containing JavaScript functions, which may contain template literals, and so
+// aren't expanded.
+var configCodeProperties = map[string]bool{
+	"sync":          true,
+	"import_filter": true,
+	"filter":        true,
+}
+
+// Matches the names of config properties holding credentials, such as "password", "client_secret",
+// "validation_key" or "token".
+var kSecretConfigPropertyRegexp = regexp.MustCompile(`(?i)(password|secret|token|key)$`)
+
+var kConfigVariableRegexp = regexp.MustCompile(`\$\$\{|\$\{(file:[^}]+|[A-Za-z_][A-Za-z0-9_]*(:-[^}]*)?)\}`)
+
+// Secrets shorter than this aren't redacted, since replacing every occurrence of them would make
+// logs unreadable.
+const minRedactedSecretLength = 4
+
+const redactedSecret = "xxxxx"
+
+var (
+	secretsLock     sync.RWMutex
+	secrets         = map[string]bool{}
+	secretsReplacer *strings.Replacer
+)
+
+// ExpandConfigVariables expands the environment variable and file references in the string values of
+// the given JSON config.  Returns an error if a reference can't be resolved.  Only the strings
+// containing references are changed, so the rest of the config, including its layout, is left as
+// it was, and errors found when parsing it refer to the lines of the original.  Invalid JSON is
+// returned unchanged, for the error to be reported when it's parsed.
+func ExpandConfigVariables(data []byte) ([]byte, error) {
+	if !bytes.Contains(data, []byte("${")) || !json.Valid(data) {
+		return data, nil
+	}
+
+	expanded := make([]byte, 0, len(data))
+	var containers []byte // The enclosing objects and arrays, as their opening brackets
+	expectKey := false
+	key := ""
+	for i := 0; i < len(data); {
+		switch data[i] {
+		case '{':
+			containers = append(containers, '{')
+			expectKey = true
+		case '[':
+			containers = append(containers, '[')
+		case '}', ']':
+			containers = containers[:len(containers)-1]
+		case ',':
+			expectKey = containers[len(containers)-1] == '{'
+		case ':':
+			expectKey = false
+		case '"':
+			end := endOfJSONString(data, i)
+			str := data[i:end]
+			inObject := len(containers) > 0 && containers[len(containers)-1] == '{'
+			if expectKey {
+				if err := json.Unmarshal(str, &key); err != nil {
+					return nil, err
+				}
+			} else if bytes.Contains(str, []byte("${")) && !(inObject && configCodeProperties[key]) {
+				var err error
+				if str, err = expandConfigJSONString(str, isSecretConfigProperty(key)); err != nil {
+					return nil, err
+				}
+			}
+			expanded = append(expanded, str...)
+			i = end
+			continue
+		}
+		expanded = append(expanded, data[i])
+		i++
+	}
+	return expanded, nil
+}
+
+// Returns the index after the end of the JSON string starting at the given index.
+func endOfJSONString(data []byte, start int) int {
+	for i := start + 1; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// Whether the value of a config property is a credential, so environment variables substituted
+// into it are secrets.
+func isSecretConfigProperty(key string) bool {
+	return kSecretConfigPropertyRegexp.MatchString(key)
+}
+
+// Expands the references in a quoted JSON string, returning it quoted again.
+func expandConfigJSONString(quoted []byte, secretProperty bool) ([]byte, error) {
+	var value string
+	if err := json.Unmarshal(quoted, &value); err != nil {
+		return nil, err
+	}
+	expanded, err := expandConfigString(value, secretProperty)
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(expanded); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buffer.Bytes(), "\n"), nil
+}
+
+// Expands the references in a string.  File contents are registered as secrets, as are environment
+// variables if secretProperty is set.
+func expandConfigString(value string, secretProperty bool) (string, error) {
+	var expandErr error
+	expanded := kConfigVariableRegexp.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		ref = ref[2 : len(ref)-1]
+
+		var secret string
+		if strings.HasPrefix(ref, "file:") {
+			path := strings.TrimPrefix(ref, "file:")
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				expandErr = RedactErrorf("Unable to read secret file %s referenced in config: %v", UD(path), err)
+				return ""
+			}
+			secret = strings.TrimRight(string(contents), "\r\n")
+			RegisterSecret(secret)
+		} else {
+			name, defaultValue, hasDefault := ref, "", false
+			if i := strings.Index(ref, ":-"); i >= 0 {
+				name, defaultValue, hasDefault = ref[:i], ref[i+2:], true
+			}
+			envValue, found := os.LookupEnv(name)
+			if !found {
+				if !hasDefault {
+					expandErr = fmt.Errorf("Environment variable %q referenced in config is not set", name)
+					return ""
+				}
+				// Defaults are part of the config file, so aren't secret
+				return defaultValue
+			}
+			secret = envValue
+			if secretProperty {
+				RegisterSecret(secret)
+			}
+		}
+		return secret
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+	return expanded, nil
+}
+
+// RegisterSecret adds a value that will be redacted from logs and from configs returned by the
+// admin API.
+func RegisterSecret(secret string) {
+	if len(secret) < minRedactedSecretLength {
+		return
+	}
+
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	if secrets[secret] {
+		return
+	}
+	secrets[secret] = true
+
+	// Longest first, so that a secret containing another is redacted completely
+	sorted := make([]string, 0, len(secrets))
+	for s := range secrets {
+		sorted = append(sorted, s)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	oldNew := make([]string, 0, 2*len(sorted))
+	for _, s := range sorted {
+		oldNew = append(oldNew, s, redactedSecret)
+	}
+	secretsReplacer = strings.NewReplacer(oldNew...)
+}
+
+// RedactSecrets replaces any registered secrets in the given string.
+func RedactSecrets(s string) string {
+	secretsLock.RLock()
+	replacer := secretsReplacer
+	secretsLock.RUnlock()
+	if replacer == nil {
+		return s
+	}
+	return replacer.Replace(s)
+}
+
+func hasSecrets() bool {
+	secretsLock.RLock()
+	defer secretsLock.RUnlock()
+	return secretsReplacer != nil
+}
+
+// RedactSecretsInValue returns the JSON representation of the given value as a generic value, with
+// any registered secrets in its strings redacted.
+func RedactSecretsInValue(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	if hasSecrets() {
+		generic = redactSecretsInGeneric(generic)
+	}
+	return generic, nil
+}
+
+func redactSecretsInGeneric(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return RedactSecrets(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = redactSecretsInGeneric(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactSecretsInGeneric(item)
+		}
+	}
+	return value
+}
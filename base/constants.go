@@ -94,6 +94,7 @@ const (
 	SyncFnErrorAdminRequired        = "sg admin required"
 	SyncFnErrorWrongUser            = "sg wrong user"
 	SyncFnErrorMissingChannelAccess = "sg missing channel access"
+	SyncFnErrorMissingWriteAccess   = "sg missing channel write access"
 )
 
 var (
@@ -102,6 +103,7 @@ var (
 		SyncFnErrorAdminRequired,
 		SyncFnErrorWrongUser,
 		SyncFnErrorMissingChannelAccess,
+		SyncFnErrorMissingWriteAccess,
 	}
 )
 
@@ -39,6 +39,7 @@ var (
 	ErrIndexAlreadyExists    = &sgError{"Index already exists"}
 	ErrNotFound              = &sgError{"Not Found"}
 	ErrUpdateCancel          = &sgError{"Cancel update"}
+	ErrReadOnly              = &sgError{"Database is read-only"}
 
 	// ErrPartialViewErrors is returned if the view call contains any partial errors.
 	// This is more of a warning, and inspecting ViewResult.Errors is required for detail.
@@ -121,6 +122,8 @@ func ErrorAsHTTPStatus(err error) (int, string) {
 			return http.StatusNotFound, "missing"
 		case ErrEmptyDocument:
 			return http.StatusBadRequest, "Document body is empty"
+		case ErrReadOnly:
+			return http.StatusServiceUnavailable, "Database is read-only - try again later"
 		}
 	case *json.SyntaxError, *json.UnmarshalTypeError:
 		return http.StatusBadRequest, fmt.Sprintf("Invalid JSON: \"%v\"", unwrappedErr)
@@ -60,10 +60,17 @@ const (
 	StatKeyGoMemstatsPauseTotalNs  = "go_memstats_pausetotalns"
 	StatKeyErrorCount              = "error_count"
 	StatKeyWarnCount               = "warn_count"
+	StatKeyMemoryBudgetBytes       = "memory_budget_bytes"
+	StatKeyMemoryUsedBytes         = "memory_used_bytes"
+	StatKeyMemoryChannelCacheBytes = "memory_channel_cache_bytes"
+	StatKeyMemoryRevCacheBytes     = "memory_rev_cache_bytes"
+	StatKeyMemoryPendingBytes      = "memory_pending_bytes"
+	StatKeyMemoryEvictions         = "memory_evictions"
 
 	// StatsCache
 	StatKeyRevisionCacheHits         = "rev_cache_hits"
 	StatKeyRevisionCacheMisses       = "rev_cache_misses"
+	StatKeyRevisionCacheShards       = "rev_cache_shards"
 	StatKeyChannelCacheHits          = "chan_cache_hits"
 	StatKeyChannelCacheMisses        = "chan_cache_misses"
 	StatKeyChannelCacheRevsActive    = "chan_cache_active_revs"
@@ -91,16 +98,26 @@ const (
 	StatKeyOldRevsDocMisses              = "old_revs_doc_misses"
 	StatKeySequenceGets                  = "sequence_gets"
 	StatKeySequenceReserves              = "sequence_reserves"
+	StatKeySequenceReservedCount         = "sequence_reserved_count" // Number of sequences reserved from the counter
+	StatKeySequenceAssignedCount         = "sequence_assigned_count" // Number of reserved sequences assigned to writes
+	StatKeySequenceReleasedCount         = "sequence_released_count" // Number of sequences released unused
+	StatKeySequenceReleaseErrors         = "sequence_release_errors" // Number of unused sequences that couldn't be released, so get skipped
+	StatKeySequenceBatchSize             = "sequence_batch_size"     // Number of sequences reserved at once
 	StatKeyCrc32cMatchCount              = "crc32c_match_count"
+	StatKeyChangesWakeups                = "changes_wakeups"          // Number of times a waiting changes feed was woken by a notification
+	StatKeyChangesSpuriousWakeups        = "changes_spurious_wakeups" // Number of those wakeups that found nothing new for the feed
 
 	// StatsDeltaSync
 	StatKeyNetBandwidthSavings = "net_bandwidth_savings"
 	StatKeyDeltaHitRatio       = "delta_hit_ratio"
 
 	// StatsSharedBucketImport
-	StatKeyImportBacklog    = "import_backlog"
-	StatKeyImportCount      = "import_count"
-	StatKeyImportErrorCount = "import_error_count"
+	StatKeyImportBacklog       = "import_backlog"
+	StatKeyImportCount         = "import_count"
+	StatKeyImportErrorCount    = "import_error_count"
+	StatKeyImportPartitions    = "import_partitions"     // Number of vbuckets this node imports
+	StatKeyImportPending       = "import_pending"        // Number of docs in other nodes' vbuckets awaiting import
+	StatKeyImportTakeoverCount = "import_takeover_count" // Number of docs taken over from other nodes' vbuckets
 
 	// StatsCBLReplicationPush
 	StatKeyWriteProcessingTime  = "write_processing_time"
@@ -212,6 +229,12 @@ func NewStatsResourceUtilization() *expvar.Map {
 	stats.Set(StatKeyGoMemstatsPauseTotalNs, ExpvarIntVal(0))
 	stats.Set(StatKeyErrorCount, ExpvarIntVal(0))
 	stats.Set(StatKeyWarnCount, ExpvarIntVal(0))
+	stats.Set(StatKeyMemoryBudgetBytes, ExpvarIntVal(0))
+	stats.Set(StatKeyMemoryUsedBytes, ExpvarIntVal(0))
+	stats.Set(StatKeyMemoryChannelCacheBytes, ExpvarIntVal(0))
+	stats.Set(StatKeyMemoryRevCacheBytes, ExpvarIntVal(0))
+	stats.Set(StatKeyMemoryPendingBytes, ExpvarIntVal(0))
+	stats.Set(StatKeyMemoryEvictions, ExpvarIntVal(0))
 	return stats
 }
 
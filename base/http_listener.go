@@ -1,6 +1,7 @@
 package base
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
 	"net/http"
@@ -32,6 +33,7 @@ func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *s
 	if err != nil {
 		return err
 	}
+	tl, _ := listener.(*throttledListener)
 	if config != nil {
 		listener = tls.NewListener(listener, config)
 	}
@@ -43,6 +45,8 @@ func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *s
 	if writeTimeout != nil {
 		server.WriteTimeout = time.Duration(*writeTimeout) * time.Second
 	}
+	registerHTTPServer(addr, tl, server)
+	defer unregisterHTTPServer(addr)
 
 	return server.Serve(listener)
 }
@@ -54,13 +58,62 @@ type throttledListener struct {
 	lock   *sync.Cond
 }
 
+// Listeners and servers started by ListenAndServeHTTP, by address, so that their limits can be
+// changed and they can be shut down
+var throttledListeners = map[string]*throttledListener{}
+var httpServers = map[string]*http.Server{}
+var throttledListenersLock sync.Mutex
+
+func registerHTTPServer(addr string, tl *throttledListener, server *http.Server) {
+	throttledListenersLock.Lock()
+	if tl != nil {
+		throttledListeners[addr] = tl
+	}
+	httpServers[addr] = server
+	throttledListenersLock.Unlock()
+}
+
+func unregisterHTTPServer(addr string) {
+	throttledListenersLock.Lock()
+	delete(throttledListeners, addr)
+	delete(httpServers, addr)
+	throttledListenersLock.Unlock()
+}
+
+// Gracefully shuts down the server started by ListenAndServeHTTP on the given address: stops
+// accepting connections, then waits until its active requests have completed or the context is
+// done.  Connections taken over by handlers, such as WebSockets, aren't waited for.  The call to
+// ListenAndServeHTTP returns http.ErrServerClosed.  Returns false if there's no such server.
+func ShutdownHTTPServer(ctx context.Context, addr string) (bool, error) {
+	throttledListenersLock.Lock()
+	server := httpServers[addr]
+	throttledListenersLock.Unlock()
+	if server == nil {
+		return false, nil
+	}
+	return true, server.Shutdown(ctx)
+}
+
+// Changes the maximum number of open connections of the server started by ListenAndServeHTTP on
+// the given address.  A limit of 0 removes the limit.  Returns false if there's no such server.
+func SetHTTPConnLimit(addr string, limit int) bool {
+	throttledListenersLock.Lock()
+	tl := throttledListeners[addr]
+	throttledListenersLock.Unlock()
+	if tl == nil {
+		return false
+	}
+	tl.setLimit(limit)
+	return true
+}
+
 // Equivalent to net.Listen except that the returned listener allows only a limited number of open
 // connections at a time. When the limit is reached it will block until some are closed before
 // accepting any more.
-// If the 'limit' parameter is 0, there is no limit and the behavior is identical to net.Listen.
+// If the 'limit' parameter is 0, there is no limit.
 func ThrottledListen(protocol string, addr string, limit int) (net.Listener, error) {
 	listener, err := net.Listen(protocol, addr)
-	if err != nil || limit <= 0 {
+	if err != nil {
 		return listener, err
 	}
 	return &throttledListener{
@@ -75,7 +128,7 @@ func (tl *throttledListener) Accept() (net.Conn, error) {
 	if err == nil {
 		// Wait until the number of active connections drops below the limit:
 		tl.lock.L.Lock()
-		for tl.active >= tl.limit {
+		for tl.limit > 0 && tl.active >= tl.limit {
 			tl.lock.Wait()
 		}
 		tl.active++
@@ -84,6 +137,14 @@ func (tl *throttledListener) Accept() (net.Conn, error) {
 	return &throttleConn{conn, tl}, err
 }
 
+func (tl *throttledListener) setLimit(limit int) {
+	tl.lock.L.Lock()
+	tl.limit = limit
+	tl.lock.L.Unlock()
+	// Wake up Accept in case the limit was raised
+	tl.lock.Broadcast()
+}
+
 func (tl *throttledListener) connFinished() {
 	tl.lock.L.Lock()
 	tl.active--
@@ -56,11 +56,14 @@ func NewConsoleLogger(config *ConsoleLoggerConfig) (*ConsoleLogger, []DeferredLo
 	return logger, warnings, nil
 }
 
+// logf formats the message, redacting any secrets from the config (see RegisterSecret), and puts
+// it into the collation buffer if it exists, otherwise logs it directly.
 func (l *ConsoleLogger) logf(format string, args ...interface{}) {
+	msg := RedactSecrets(fmt.Sprintf(format, args...))
 	if l.collateBuffer != nil {
-		l.collateBuffer <- fmt.Sprintf(format, args...)
+		l.collateBuffer <- msg
 	} else {
-		l.logger.Printf(format, args...)
+		l.logger.Print(msg)
 	}
 }
 
@@ -92,12 +92,14 @@ func (l FileLogger) String() string {
 }
 
 // logf will put the given message into the collation buffer if it exists,
-// otherwise will log the message directly.
+// otherwise will log the message directly.  Any secrets from the config (see RegisterSecret) are
+// redacted from the message.
 func (l *FileLogger) logf(format string, args ...interface{}) {
+	msg := RedactSecrets(fmt.Sprintf(format, args...))
 	if l.collateBuffer != nil {
-		l.collateBuffer <- fmt.Sprintf(format, args...)
+		l.collateBuffer <- msg
 	} else {
-		l.logger.Printf(format, args...)
+		l.logger.Print(msg)
 	}
 }
 
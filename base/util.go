@@ -26,9 +26,11 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/couchbase/go-couchbase"
@@ -1105,4 +1107,53 @@ func ContainsString(s []string, e string) bool {
 		}
 	}
 	return false
-}
\ No newline at end of file
+}
+
+// Calls fn with each index from 0 to n-1, on up to concurrency goroutines at once, and returns once
+// all the calls have returned.  With a concurrency of 1 or less, the calls are made in order on the
+// calling goroutine.  A panic in fn is recovered on its goroutine and raised again on the calling
+// goroutine once the other calls have returned, so that it's handled there as it would be without
+// concurrency.
+func ForEachConcurrently(n, concurrency int, fn func(i int)) {
+	if concurrency > n {
+		concurrency = n
+	}
+	if concurrency <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	queue := make(chan int, n)
+	for i := 0; i < n; i++ {
+		queue <- i
+	}
+	close(queue)
+	var wg sync.WaitGroup
+	var panicOnce sync.Once
+	var panicValue interface{}
+	panicked := false
+	wg.Add(concurrency)
+	for worker := 0; worker < concurrency; worker++ {
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					Warnf(KeyAll, "PANIC in concurrent call: %v\n%s", r, debug.Stack())
+					panicOnce.Do(func() {
+						panicValue = r
+						panicked = true
+					})
+				}
+			}()
+			for i := range queue {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+	if panicked {
+		panic(panicValue)
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -614,3 +615,18 @@ func TestSetUpTestLogging(t *testing.T) {
 	}()
 	SetUpTestLogging(LevelError, KeyAuth|KeyCRUD)
 }
+
+func TestForEachConcurrentlyPanic(t *testing.T) {
+	// A panic on a worker goroutine is raised again on the calling goroutine
+	var calls int32
+	defer func() {
+		assert.Equal(t, "bad item", recover())
+		assert.Equal(t, int32(10), atomic.LoadInt32(&calls))
+	}()
+	ForEachConcurrently(10, 4, func(i int) {
+		atomic.AddInt32(&calls, 1)
+		if i == 3 {
+			panic("bad item")
+		}
+	})
+}
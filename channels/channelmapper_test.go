@@ -160,6 +160,16 @@ func TestRoleFunction(t *testing.T) {
 	goassert.DeepEquals(t, res.Roles, AccessMap{"bar": SetOf("froods"), "baz": SetOf("froods"), "foo": SetOf("froods")})
 }
 
+// Just verify that the calls to the writeAccess() fn show up in the output. (It shares a common
+// implementation with access(), so most of the above tests also apply to it.)
+func TestWriteAccessFunction(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc) {writeAccess(["foo", "role:froods"], "bar"); access("foo", "baz")}`)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	assert.NoError(t, err, "MapToChannelsAndAccess failed")
+	goassert.DeepEquals(t, res.WriteAccess, AccessMap{"foo": SetOf("bar"), "role:froods": SetOf("bar")})
+	goassert.DeepEquals(t, res.Access, AccessMap{"foo": SetOf("baz")})
+}
+
 // Now just make sure the input comes through intact
 func TestInputParse(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {channel(doc.channel);}`)
@@ -335,10 +345,15 @@ func TestCheckAccessArray(t *testing.T) {
 		requireAccess(doc.channels)
 	}`)
 	var sally = map[string]interface{}{"name": "sally", "roles": []string{"girl", "5yo"}, "channels": []string{"party", "school"}}
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["swim","party"]}`), `{}`, sally)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["party"]}`), `{}`, sally)
 	assert.NoError(t, err, "MapToChannelsAndAccess failed")
 	goassert.DeepEquals(t, res.Rejection, nil)
 
+	// Every channel must be writable, as with enforce_write_access
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["swim","party"]}`), `{}`, sally)
+	assert.NoError(t, err, "MapToChannelsAndAccess failed")
+	goassert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, base.SyncFnErrorMissingWriteAccess))
+
 	var linus = map[string]interface{}{"name": "linus", "roles": []string{"boy", "musician"}, "channels": []string{"party", "school"}}
 	res, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["work"]}`), `{}`, linus)
 	assert.NoError(t, err, "MapToChannelsAndAccess failed")
@@ -349,6 +364,39 @@ func TestCheckAccessArray(t *testing.T) {
 	goassert.DeepEquals(t, res.Rejection, nil)
 }
 
+// Test the userCtx.write_channels parameter
+func TestCheckWriteAccess(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc, oldDoc) {
+		requireWriteAccess(doc.channels)
+	}`)
+	var sally = map[string]interface{}{"name": "sally", "roles": []string{"girl", "5yo"}, "channels": []string{"party", "school"}, "write_channels": []string{"party"}}
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["swim","party"]}`), `{}`, sally)
+	assert.NoError(t, err, "MapToChannelsAndAccess failed")
+	goassert.DeepEquals(t, res.Rejection, nil)
+
+	// Read access to a channel isn't sufficient
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["school"]}`), `{}`, sally)
+	assert.NoError(t, err, "MapToChannelsAndAccess failed")
+	goassert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, base.SyncFnErrorMissingWriteAccess))
+
+	// User with no write channels
+	var linus = map[string]interface{}{"name": "linus", "roles": []string{"boy", "musician"}, "channels": []string{"party", "school"}}
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["party"]}`), `{}`, linus)
+	assert.NoError(t, err, "MapToChannelsAndAccess failed")
+	goassert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, base.SyncFnErrorMissingWriteAccess))
+
+	// Wildcard write access
+	var lucy = map[string]interface{}{"name": "lucy", "roles": []string{}, "channels": []string{}, "write_channels": []string{"*"}}
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["work"]}`), `{}`, lucy)
+	assert.NoError(t, err, "MapToChannelsAndAccess failed")
+	goassert.DeepEquals(t, res.Rejection, nil)
+
+	// Admin
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["magic"]}`), `{}`, nil)
+	assert.NoError(t, err, "MapToChannelsAndAccess failed")
+	goassert.DeepEquals(t, res.Rejection, nil)
+}
+
 // Test changing the function
 func TestSetFunction(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {channel(doc.channels);}`)
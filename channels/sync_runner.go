@@ -48,6 +48,14 @@ const funcWrapper = `
 			return false;
 		}
 
+		function allInArray(all, array) {
+			for (var i = 0; i < all.length; ++i) {
+				if (!inArray(all[i], array))
+					return false;
+			}
+			return true;
+		}
+
 		function anyKeysInArray(any, array) {
 			for (var key in any) {
 				if (inArray(key, array))
@@ -82,6 +90,14 @@ const funcWrapper = `
 					throw({forbidden: "%s"});
 		}
 
+		function requireWriteAccess(channels) {
+				if (!shouldValidate) return;
+				channels = makeArray(channels);
+				var writeChannels = realUserCtx.write_channels || [];
+				if (!inArray("*", writeChannels) && !allInArray(channels, writeChannels))
+					throw({forbidden: "%s"});
+		}
+
 		return function (newDoc, oldDoc, _realUserCtx) {
 			realUserCtx = _realUserCtx;
 
@@ -111,6 +127,7 @@ type SyncRunner struct {
 	output            *ChannelMapperOutput // Results being accumulated while the JS fn runs
 	channels          []string
 	access            map[string][]string // channels granted to users via access() callback
+	writeAccess       map[string][]string // channels granted write access to users via writeAccess() callback
 	roles             map[string][]string // roles granted to users via role() callback
 	expiry            *uint32             // document expiry (in seconds) specified via expiry() callback
 }
@@ -138,6 +155,11 @@ func NewSyncRunner(funcSource string) (*SyncRunner, error) {
 		return runner.addValueForUser(call.Argument(0), call.Argument(1), runner.access)
 	})
 
+	// Implementation of the 'writeAccess()' callback:
+	runner.DefineNativeFunction("writeAccess", func(call otto.FunctionCall) otto.Value {
+		return runner.addValueForUser(call.Argument(0), call.Argument(1), runner.writeAccess)
+	})
+
 	// Implementation of the 'role()' callback:
 	runner.DefineNativeFunction("role", func(call otto.FunctionCall) otto.Value {
 		return runner.addValueForUser(call.Argument(0), call.Argument(1), runner.roles)
@@ -186,6 +208,7 @@ func NewSyncRunner(funcSource string) (*SyncRunner, error) {
 		runner.output = &ChannelMapperOutput{}
 		runner.channels = []string{}
 		runner.access = map[string][]string{}
+		runner.writeAccess = map[string][]string{}
 		runner.roles = map[string][]string{}
 		runner.expiry = nil
 	}
@@ -196,6 +219,9 @@ func NewSyncRunner(funcSource string) (*SyncRunner, error) {
 			output.Channels, err = SetFromArray(runner.channels, ExpandStar)
 			if err == nil {
 				output.Access, err = compileAccessMap(runner.access, "")
+				if err == nil {
+					output.WriteAccess, err = compileAccessMap(runner.writeAccess, "")
+				}
 				if err == nil {
 					output.Roles, err = compileAccessMap(runner.roles, RoleAccessPrefix)
 				}
@@ -275,5 +301,6 @@ func wrappedFuncSource(funcSource string) string {
 		base.SyncFnErrorWrongUser,
 		base.SyncFnErrorMissingRole,
 		base.SyncFnErrorMissingChannelAccess,
+		base.SyncFnErrorMissingWriteAccess,
 	)
 }
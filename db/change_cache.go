@@ -5,10 +5,12 @@ import (
 	"errors"
 	"expvar"
 	"fmt"
+	"net/http"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	sgbucket "github.com/couchbase/sg-bucket"
@@ -58,6 +60,9 @@ type changeCache struct {
 	lateSeqLock     sync.RWMutex             // Coordinates access to late sequence caches
 	options         CacheOptions             // Cache config
 	terminator      chan bool                // Signal termination of background goroutines
+	pendingBytes    int64                    // Approximate size of pendingLogs; accessed atomically
+	pendingMemory   *pendingLogsMemory       // Lets the memory governor evict pendingLogs
+	sequenceTimes   sequenceTimeIndex        // Samples of the stable sequence, for resolving since times
 }
 
 type LogEntry channels.LogEntry
@@ -84,6 +89,7 @@ type CacheOptions struct {
 	CachePendingSeqMaxWait time.Duration // Max wait for pending sequence before skipping
 	CachePendingSeqMaxNum  int           // Max number of pending sequences before skipping
 	CacheSkippedSeqMaxWait time.Duration // Max wait for skipped sequence before abandoning
+	Prewarm                *CachePrewarmOptions
 }
 
 //////// HOUSEKEEPING:
@@ -137,6 +143,17 @@ func (c *changeCache) Init(context *DatabaseContext, notifyChange func(base.Set)
 		if options.ChannelCacheMaxLength > 0 {
 			c.options.ChannelCacheMaxLength = options.ChannelCacheMaxLength
 		}
+
+		if options.Prewarm != nil {
+			prewarm := *options.Prewarm
+			if prewarm.RecordInterval <= 0 {
+				prewarm.RecordInterval = DefaultPrewarmRecordInterval
+			}
+			if prewarm.MaxQueriesPerSec <= 0 {
+				prewarm.MaxQueriesPerSec = DefaultPrewarmMaxQueriesPerSec
+			}
+			c.options.Prewarm = &prewarm
+		}
 	}
 
 	base.Infof(base.KeyCache, "Initializing changes cache with options %+v", c.options)
@@ -151,6 +168,10 @@ func (c *changeCache) Init(context *DatabaseContext, notifyChange func(base.Set)
 	c.backgroundTask("InsertPendingEntries", c.InsertPendingEntries, c.options.CachePendingSeqMaxWait/2)
 	c.backgroundTask("CleanSkippedSequenceQueue", c.CleanSkippedSequenceQueue, c.options.CacheSkippedSeqMaxWait/2)
 	c.backgroundTask("CleanAgedItems", c.CleanAgedItems, c.options.ChannelCacheAge)
+	c.backgroundTask("SampleSequenceTime", c.sampleSequenceTime, sequenceTimeSampleInterval)
+	if c.options.Prewarm != nil && c.options.Prewarm.recordsActiveChannels() {
+		c.backgroundTask("RecordActiveChannels", c.recordActiveChannels, c.options.Prewarm.RecordInterval)
+	}
 
 	// Lock the cache -- not usable until .Start() called.  This fixes the DCP startup race condition documented in SG #3558.
 	c.lock.Lock()
@@ -175,22 +196,41 @@ func (c *changeCache) backgroundTask(name string, task func(), interval time.Dur
 
 func (c *changeCache) Start() error {
 
-	// Unlock the cache after this function returns.
-	defer c.lock.Unlock()
-
 	// Find the current global doc sequence and use that for the initial sequence for the change cache
 	lastSequence, err := c.context.LastSequence()
+	if err == nil {
+		c._setInitialSequence(lastSequence)
+	}
+
+	// Unlock the cache.  Its memory can only be made evictable once it's unlocked, as the memory
+	// governor locks it to evict.
+	c.lock.Unlock()
 	if err != nil {
 		return err
 	}
+	c.pendingMemory = &pendingLogsMemory{cache: c}
+	c.context.Options.MemoryGovernor.register(MemoryChannelCache, c)
+	c.context.Options.MemoryGovernor.register(MemoryPendingSequences, c.pendingMemory)
+
+	// Every change up to the initial sequence was made before now
+	c.loadSequenceTimes()
+	c.sequenceTimes.add(c.stableSequenceSample())
 
-	c._setInitialSequence(lastSequence)
+	// Load the caches of the channels most likely to be requested, without holding up startup
+	if c.options.Prewarm != nil {
+		go c.prewarm()
+	}
 	return nil
 }
 
 // Stops the cache. Clears its state and tells the housekeeping task to stop.
 func (c *changeCache) Stop() {
 
+	if c.pendingMemory != nil {
+		c.context.Options.MemoryGovernor.unregister(c)
+		c.context.Options.MemoryGovernor.unregister(c.pendingMemory)
+	}
+
 	// Signal to background goroutines that the changeCache has been stopped, so they can exit
 	// their loop
 	close(c.terminator)
@@ -221,9 +261,13 @@ func (c *changeCache) Clear() error {
 		return err
 	}
 
+	for _, channelCache := range c.channelCaches {
+		channelCache.releaseMemory()
+	}
 	c.channelCaches = make(map[string]*channelCache, 10)
 	c.pendingLogs = nil
 	heap.Init(&c.pendingLogs)
+	c._addPendingBytes(-atomic.LoadInt64(&c.pendingBytes))
 
 	return nil
 }
@@ -375,6 +419,12 @@ func (c *changeCache) DocChangedSynchronous(event sgbucket.FeedEvent) {
 		return
 	}
 
+	// Has the database been made read-only, or writable again?
+	if docID == readOnlyStateKey {
+		c.context.readOnlyStateChanged(docJSON, event.Opcode == sgbucket.FeedOpDeletion)
+		return
+	}
+
 	// Is this an unused sequence notification?
 	if strings.HasPrefix(docID, UnusedSequenceKeyPrefix) {
 		c.processUnusedSequence(docID)
@@ -421,7 +471,7 @@ func (c *changeCache) DocChangedSynchronous(event sgbucket.FeedEvent) {
 		}
 
 		if syncData == nil || !isSGWrite {
-			if c.context.autoImport {
+			if c.context.autoImport && c.context.importPartitions.shouldImport(event.VbNo, docID) {
 				// If syncData is nil, or if this was not an SG write, attempt to import
 				isDelete := event.Opcode == sgbucket.FeedOpDeletion
 				if isDelete {
@@ -435,6 +485,10 @@ func (c *changeCache) DocChangedSynchronous(event sgbucket.FeedEvent) {
 						base.Debugf(base.KeyImport, "Not importing mutation - document %s has been subsequently updated and will be imported based on that mutation.", base.UD(docID))
 					} else if err == base.ErrImportCancelledFilter {
 						// No logging required - filter info already logged during importDoc
+					} else if err == base.ErrReadOnly {
+						if !c.context.deferredImports.add(docID) {
+							base.Warnf(base.KeyAll, "Too many imports deferred while database is read-only - doc %q will be imported when next read or updated", base.UD(docID))
+						}
 					} else {
 						base.Debugf(base.KeyImport, "Did not import doc %q - external update will not be accessible via Sync Gateway.  Reason: %v", base.UD(docID), err)
 					}
@@ -442,6 +496,9 @@ func (c *changeCache) DocChangedSynchronous(event sgbucket.FeedEvent) {
 			}
 			return
 		}
+		if c.context.autoImport {
+			c.context.importPartitions.imported(event.VbNo, docID)
+		}
 	}
 
 	if !syncData.HasValidSyncData(c.context.writeSequences()) {
@@ -644,6 +701,7 @@ func (c *changeCache) processEntry(change *LogEntry) base.Set {
 	} else if sequence > c.nextSequence {
 		// There's a missing sequence (or several), so put this one on ice until it arrives:
 		heap.Push(&c.pendingLogs, change)
+		c._addPendingBytes(pendingLogEntrySize(change))
 		numPending := len(c.pendingLogs)
 		base.Infof(base.KeyCache, "  Deferring #%d (%d now waiting for #%d...#%d)",
 			sequence, numPending, c.nextSequence, c.pendingLogs[0].Sequence-1)
@@ -739,6 +797,7 @@ func (c *changeCache) _addPendingLogs() base.Set {
 		isNext := change.Sequence == c.nextSequence
 		if isNext {
 			heap.Pop(&c.pendingLogs)
+			c._addPendingBytes(-pendingLogEntrySize(change))
 			changedChannels = changedChannels.Union(c._addToCache(change))
 		} else if len(c.pendingLogs) > c.options.CachePendingSeqMaxNum || time.Since(c.pendingLogs[0].TimeReceived) >= c.options.CachePendingSeqMaxWait {
 			c.context.DbStats.StatsCache().Add(base.StatKeyNumSkippedSeqs, 1)
@@ -855,6 +914,292 @@ func (c *changeCache) getInitialSequence() uint64 {
 	return c.initialSequence
 }
 
+//////// ADMIN API
+
+// The state of a channel's cache
+type ChannelCacheInfo struct {
+	Channel        string    `json:"channel"`
+	Entries        int       `json:"entries"`               // Number of changes cached
+	Bytes          int64     `json:"bytes"`                 // Approximate size of the cached changes
+	ValidFrom      uint64    `json:"valid_from"`            // First sequence the cache is complete from
+	OldestSequence uint64    `json:"oldest_seq,omitempty"`  // Sequence of the oldest cached change
+	NewestSequence uint64    `json:"newest_seq,omitempty"`  // Sequence of the newest cached change
+	Hits           int64     `json:"hits"`                  // Number of requests served from the cache
+	Misses         int64     `json:"misses"`                // Number of requests that needed a query
+	HitRate        float64   `json:"hit_rate"`              // Fraction of requests served from the cache
+	LastAccess     time.Time `json:"last_access,omitempty"` // Time the cache was last read
+}
+
+// The sequences the change cache is waiting for
+type ChangeCacheSequences struct {
+	InitialSequence uint64                `json:"initial_seq"` // Database's last sequence when the cache was started or flushed
+	NextSequence    uint64                `json:"next_seq"`    // Next sequence the cache expects to receive
+	Pending         []PendingSequenceInfo `json:"pending"`     // Changes received ahead of NextSequence, waiting to be cached
+	Skipped         []SkippedSequenceInfo `json:"skipped"`     // Sequences that were given up on, but might still arrive late
+}
+
+type PendingSequenceInfo struct {
+	Sequence uint64    `json:"seq"`
+	DocID    string    `json:"doc_id,omitempty"`
+	RevID    string    `json:"rev_id,omitempty"`
+	Received time.Time `json:"received"`
+}
+
+type SkippedSequenceInfo struct {
+	Sequence uint64    `json:"seq"`
+	Skipped  time.Time `json:"skipped"`
+}
+
+// Returns the in-memory change cache, which isn't used along with a channel index.
+func (context *DatabaseContext) inMemoryChangeCache() (*changeCache, error) {
+	cache, ok := context.changeCache.(*changeCache)
+	if !ok {
+		return nil, base.HTTPErrorf(http.StatusNotImplemented, "No channel cache in use")
+	}
+	return cache, nil
+}
+
+// Returns the state of every cached channel, ordered by channel name.
+func (context *DatabaseContext) AllChannelCacheInfo() ([]ChannelCacheInfo, error) {
+	cache, err := context.inMemoryChangeCache()
+	if err != nil {
+		return nil, err
+	}
+	cache.lock.RLock()
+	channelCaches := make([]*channelCache, 0, len(cache.channelCaches))
+	for _, channelCache := range cache.channelCaches {
+		channelCaches = append(channelCaches, channelCache)
+	}
+	cache.lock.RUnlock()
+
+	infos := make([]ChannelCacheInfo, len(channelCaches))
+	for i, channelCache := range channelCaches {
+		infos[i] = channelCache.info()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Channel < infos[j].Channel })
+	return infos, nil
+}
+
+// Returns the state of a channel's cache.  Returns a 404 error if the channel isn't cached.
+func (context *DatabaseContext) ChannelCacheInfo(channelName string) (ChannelCacheInfo, error) {
+	channelCache, err := context.existingChannelCache(channelName)
+	if err != nil {
+		return ChannelCacheInfo{}, err
+	}
+	return channelCache.info(), nil
+}
+
+// Empties a channel's cache, so that requests for its changes are served by queries until it
+// fills again.
+func (context *DatabaseContext) EvictChannelCache(channelName string) error {
+	channelCache, err := context.existingChannelCache(channelName)
+	if err != nil {
+		return err
+	}
+	channelCache.evict()
+	base.Infof(base.KeyCache, "Evicted cache of channel %q", base.UD(channelName))
+	return nil
+}
+
+// Loads a channel's changes into its cache, up to the cache's max length, so that the first
+// request for them doesn't have to query.
+func (context *DatabaseContext) PrewarmChannelCache(channelName string) (ChannelCacheInfo, error) {
+	cache, err := context.inMemoryChangeCache()
+	if err != nil {
+		return ChannelCacheInfo{}, err
+	}
+	channelCache, _, err := cache.prewarmChannel(channelName)
+	if err != nil {
+		return ChannelCacheInfo{}, err
+	}
+	return channelCache.info(), nil
+}
+
+func (context *DatabaseContext) existingChannelCache(channelName string) (*channelCache, error) {
+	cache, err := context.inMemoryChangeCache()
+	if err != nil {
+		return nil, err
+	}
+	cache.lock.RLock()
+	channelCache := cache.channelCaches[channelName]
+	cache.lock.RUnlock()
+	if channelCache == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "Channel %q isn't cached", channelName)
+	}
+	return channelCache, nil
+}
+
+// Returns the pending and skipped sequences of the change cache.
+func (context *DatabaseContext) ChangeCacheSequences() (*ChangeCacheSequences, error) {
+	cache, err := context.inMemoryChangeCache()
+	if err != nil {
+		return nil, err
+	}
+	sequences := &ChangeCacheSequences{
+		Pending: []PendingSequenceInfo{},
+		Skipped: []SkippedSequenceInfo{},
+	}
+
+	cache.lock.RLock()
+	sequences.InitialSequence = cache.initialSequence
+	sequences.NextSequence = cache.nextSequence
+	for _, entry := range cache.pendingLogs {
+		sequences.Pending = append(sequences.Pending, PendingSequenceInfo{
+			Sequence: entry.Sequence,
+			DocID:    entry.DocID,
+			RevID:    entry.RevID,
+			Received: entry.TimeReceived,
+		})
+	}
+	cache.lock.RUnlock()
+	sort.Slice(sequences.Pending, func(i, j int) bool { return sequences.Pending[i].Sequence < sequences.Pending[j].Sequence })
+
+	cache.skippedSeqLock.RLock()
+	for _, skipped := range cache.skippedSeqs {
+		sequences.Skipped = append(sequences.Skipped, SkippedSequenceInfo{Sequence: skipped.seq, Skipped: skipped.timeAdded})
+	}
+	cache.skippedSeqLock.RUnlock()
+	return sequences, nil
+}
+
+// Stops waiting for a skipped sequence, as if it had been skipped for longer than
+// CacheSkippedSeqMaxWait, so that it no longer holds back the stable sequence of changes feeds.
+// Returns a 404 error if the sequence isn't skipped.
+func (context *DatabaseContext) AbandonSkippedSequence(sequence uint64) error {
+	cache, err := context.inMemoryChangeCache()
+	if err != nil {
+		return err
+	}
+	if err := cache.RemoveSkipped(sequence); err != nil {
+		return base.HTTPErrorf(http.StatusNotFound, "Sequence %d isn't skipped", sequence)
+	}
+	context.DbStats.StatsCache().Add(base.StatKeyAbandonedSeqs, 1)
+	base.Infof(base.KeyCache, "Abandoned skipped sequence %d", sequence)
+	return nil
+}
+
+//////// MEMORY GOVERNOR
+
+// Returns the approximate size of the channel caches.
+func (c *changeCache) memoryUsed() (used int64) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, channelCache := range c.channelCaches {
+		used += atomic.LoadInt64(&channelCache.memoryUsed)
+	}
+	return used
+}
+
+// Returns when the least recently read non-empty channel cache was last read.
+func (c *changeCache) leastRecentlyUsed() (lastAccess time.Time, ok bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if channelCache := c._leastRecentlyUsedChannelCache(); channelCache != nil {
+		return channelCache.lastAccessTime(), true
+	}
+	return time.Time{}, false
+}
+
+// Empties the least recently read non-empty channel caches, in order of when they were last read.
+func (c *changeCache) evictLeastRecentlyUsed(bytes int64, until time.Time) (evicted int) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	candidates := make([]*channelCache, 0, len(c.channelCaches))
+	for _, channelCache := range c.channelCaches {
+		if atomic.LoadInt64(&channelCache.memoryUsed) > 0 {
+			candidates = append(candidates, channelCache)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return atomic.LoadInt64(&candidates[i].lastAccess) < atomic.LoadInt64(&candidates[j].lastAccess)
+	})
+
+	var freed int64
+	for _, channelCache := range candidates {
+		if evicted > 0 && (freed >= bytes || channelCache.lastAccessTime().After(until)) {
+			break
+		}
+		freed += atomic.LoadInt64(&channelCache.memoryUsed)
+		channelCache.evict()
+		evicted++
+	}
+	return evicted
+}
+
+func (c *changeCache) _leastRecentlyUsedChannelCache() (oldest *channelCache) {
+	for _, channelCache := range c.channelCaches {
+		if atomic.LoadInt64(&channelCache.memoryUsed) > 0 &&
+			(oldest == nil || atomic.LoadInt64(&channelCache.lastAccess) < atomic.LoadInt64(&oldest.lastAccess)) {
+			oldest = channelCache
+		}
+	}
+	return oldest
+}
+
+// Records a change in the size of pendingLogs.
+func (c *changeCache) _addPendingBytes(delta int64) {
+	atomic.AddInt64(&c.pendingBytes, delta)
+	c.context.Options.MemoryGovernor.add(MemoryPendingSequences, delta)
+}
+
+// Returns the approximate size of a LogEntry waiting in pendingLogs, including its channels.
+func pendingLogEntrySize(entry *LogEntry) int64 {
+	size := cachedLogEntrySize(entry)
+	for channelName := range entry.Channels {
+		size += int64(logChannelOverhead + len(channelName))
+	}
+	return size
+}
+
+// Lets the memory governor evict a changeCache's pendingLogs, which it can't do through the
+// changeCache itself as that evicts its channel caches.
+type pendingLogsMemory struct {
+	cache *changeCache
+}
+
+func (p *pendingLogsMemory) memoryUsed() int64 {
+	return atomic.LoadInt64(&p.cache.pendingBytes)
+}
+
+// Returns when the entry with the lowest pending sequence was received.
+func (p *pendingLogsMemory) leastRecentlyUsed() (lastAccess time.Time, ok bool) {
+	c := p.cache
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if len(c.pendingLogs) == 0 {
+		return time.Time{}, false
+	}
+	return c.pendingLogs[0].TimeReceived, true
+}
+
+// Stops waiting for the sequences missing before the lowest pending sequence, skipping them as if
+// they'd been pending too long, and adds the pending entries that are then contiguous to the cache.
+// Each entry skipped up to counts as an eviction.
+func (p *pendingLogsMemory) evictLeastRecentlyUsed(bytes int64, until time.Time) (evicted int) {
+	c := p.cache
+	var changedChannels base.Set
+	c.lock.Lock()
+	startBytes := atomic.LoadInt64(&c.pendingBytes)
+	for len(c.pendingLogs) > 0 {
+		if evicted > 0 && (startBytes-atomic.LoadInt64(&c.pendingBytes) >= bytes || c.pendingLogs[0].TimeReceived.After(until)) {
+			break
+		}
+		for ; c.nextSequence < c.pendingLogs[0].Sequence; c.nextSequence++ {
+			c.context.DbStats.StatsCache().Add(base.StatKeyNumSkippedSeqs, 1)
+			c.PushSkipped(c.nextSequence)
+		}
+		changedChannels = changedChannels.Union(c._addPendingLogs())
+		evicted++
+	}
+	c.lock.Unlock()
+
+	// Listeners are notified without the lock, which they may need to read the changes
+	if c.notifyChange != nil && len(changedChannels) > 0 {
+		c.notifyChange(changedChannels)
+	}
+	return evicted
+}
+
 //////// LOG PRIORITY QUEUE -- container/heap callbacks that should not be called directly.   Use heap.Init/Push/etc()
 
 func (h LogPriorityQueue) Len() int           { return len(h) }
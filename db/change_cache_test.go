@@ -1271,3 +1271,32 @@ func TestLateArrivingSequenceTriggersOnChange(t *testing.T) {
 	waitForOnChangeCallback.Wait()
 
 }
+
+func TestAbandonSkippedSequence(t *testing.T) {
+
+	context := testBucketContext()
+	defer context.Close()
+	defer base.DecrNumOpenBuckets(context.Bucket.GetName())
+	cache := context.changeCache.(*changeCache)
+
+	cache.PushSkipped(5)
+	cache.PushSkipped(7)
+	sequences, err := context.ChangeCacheSequences()
+	assert.NoError(t, err)
+	if assert.Len(t, sequences.Skipped, 2) {
+		assert.Equal(t, uint64(5), sequences.Skipped[0].Sequence)
+		assert.Equal(t, uint64(7), sequences.Skipped[1].Sequence)
+	}
+
+	assert.NoError(t, context.AbandonSkippedSequence(5))
+	assert.False(t, cache.WasSkipped(5))
+	assert.True(t, cache.WasSkipped(7))
+	assert.Equal(t, uint64(7), cache.getOldestSkippedSequence())
+
+	err = context.AbandonSkippedSequence(5)
+	assert.Error(t, err)
+	httpErr, ok := err.(*base.HTTPError)
+	if assert.True(t, ok) {
+		assert.Equal(t, 404, httpErr.Status)
+	}
+}
@@ -1,9 +1,12 @@
 package db
 
 import (
+	"expvar"
 	"math"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/auth"
@@ -12,12 +15,15 @@ import (
 )
 
 // A wrapper around a Bucket's TapFeed that allows any number of client goroutines to wait for
-// changes.
+// changes.  Waiting goroutines are registered under the keys (channels, users and roles) they're
+// waiting on, and a notification only wakes the goroutines waiting on the keys it's for.
 type changeListener struct {
 	bucket                base.Bucket
 	bucketName            string                  // Used for logging
 	tapFeed               base.TapFeed            // Observes changes to bucket
-	tapNotifier           *sync.Cond              // Posts notifications when documents are updated
+	notifyLock            sync.Mutex              // Guards the counters, keyCounts, waiters and feedError
+	waiters               map[string]waiterSet    // Notification channels of the goroutines waiting on each key
+	stats                 *expvar.Map             // Per-db stats for wakeups; may be nil
 	FeedArgs              sgbucket.FeedArguments  // The Tap Args (backfill, etc)
 	counter               uint64                  // Event counter; increments on every doc update
 	terminateCheckCounter uint64                  // Termination Event counter; increments on every notifyCheckForTermination
@@ -26,16 +32,38 @@ type changeListener struct {
 	OnDocChanged          DocChangedFunc          // Called when change arrives on feed
 	trackDocs             bool                    // Whether events should be routed to DocChannel passthru
 	terminator            chan bool               // Signal to cause cbdatasource bucketdatasource.Close() to be called, which removes dcp receiver
+	feedStartTime         int64                   // Time the feed was started, in Unix nanoseconds; accessed atomically
+	lastEventTime         int64                   // Time the last feed event was received, in Unix nanoseconds; accessed atomically
+	lastEventLag          int64                   // Delay between the last mutation being written and received, in nanoseconds; accessed atomically
+	feedStopped           int32                   // Non-zero once the feed has stopped or been dropped; accessed atomically
+	feedError             error                   // Error with which the feed was dropped, if any; guarded by notifyLock
+	persistCheckpoint     func(vbNo uint16) bool  // If set, whether to persist DCP checkpoints for a vbucket
 }
 
+// The state of a changeListener's mutation feed, as reported by health checks
+type ChangeFeedStatus struct {
+	Running       bool          // False if the feed has stopped or been dropped
+	Error         error         // Error with which the feed was dropped, if any
+	StartTime     time.Time     // Time the feed was started
+	LastEventTime time.Time     // Time the last feed event was received; zero if there hasn't been one
+	Lag           time.Duration // Delay between the last mutation being written and received; zero if not known
+}
+
+// Mutation CASes are hybrid logical clock values, which are nanoseconds since the epoch.  CASes
+// before this (2015-01-01) aren't timestamps, e.g. those generated by walrus, and can't be used to
+// measure feed lag.
+const minTimestampCas = 1420070400 * int64(time.Second)
+
 type DocChangedFunc func(event sgbucket.FeedEvent)
 
 func (listener *changeListener) Init(name string) {
+	listener.notifyLock.Lock()
+	defer listener.notifyLock.Unlock()
 	listener.bucketName = name
 	listener.counter = 1
 	listener.terminateCheckCounter = 0
 	listener.keyCounts = map[string]uint64{}
-	listener.tapNotifier = sync.NewCond(&sync.Mutex{})
+	listener.waiters = map[string]waiterSet{}
 }
 
 // Starts a changeListener on a given Bucket.
@@ -46,10 +74,22 @@ func (listener *changeListener) Start(bucket base.Bucket, trackDocs bool, backfi
 	listener.bucket = bucket
 	listener.bucketName = bucket.GetName()
 	listener.FeedArgs = sgbucket.FeedArguments{
-		Backfill:   backfillMode,
-		Notify:     bucketStateNotify,
+		Backfill: backfillMode,
+		Notify: func(bucket string, err error) {
+			listener.feedDropped(err)
+			if bucketStateNotify != nil {
+				bucketStateNotify(bucket, err)
+			}
+		},
 		Terminator: listener.terminator,
 	}
+	atomic.StoreInt64(&listener.feedStartTime, time.Now().UnixNano())
+	atomic.StoreInt64(&listener.lastEventTime, 0)
+	atomic.StoreInt64(&listener.lastEventLag, 0)
+	atomic.StoreInt32(&listener.feedStopped, 0)
+	listener.notifyLock.Lock()
+	listener.feedError = nil
+	listener.notifyLock.Unlock()
 
 	if trackDocs {
 		listener.DocChannel = make(chan sgbucket.FeedEvent, 100)
@@ -96,6 +136,7 @@ func (listener *changeListener) StartMutationFeed(bucket base.Bucket) error {
 // ProcessFeedEvent is invoked for each mutate or delete event seen on the server's mutation feed (TAP or DCP).  Uses document
 // key to determine handling, based on whether the incoming mutation is an internal Sync Gateway document.
 func (listener *changeListener) ProcessFeedEvent(event sgbucket.FeedEvent) bool {
+	listener.recordFeedEvent(event)
 	requiresCheckpointPersistence := true
 	if event.Opcode == sgbucket.FeedOpMutation || event.Opcode == sgbucket.FeedOpDeletion {
 		key := string(event.Key)
@@ -105,7 +146,7 @@ func (listener *changeListener) ProcessFeedEvent(event sgbucket.FeedEvent) bool
 				listener.OnDocChanged(event)
 			}
 			listener.Notify(base.SetOf(key))
-		} else if strings.HasPrefix(key, UnusedSequenceKeyPrefix) { // SG unused sequence marker docs
+		} else if strings.HasPrefix(key, UnusedSequenceKeyPrefix) || key == readOnlyStateKey { // SG unused sequence marker docs and read-only state
 			if listener.OnDocChanged != nil {
 				listener.OnDocChanged(event)
 			}
@@ -123,6 +164,9 @@ func (listener *changeListener) ProcessFeedEvent(event sgbucket.FeedEvent) bool
 
 		}
 	}
+	if requiresCheckpointPersistence && listener.persistCheckpoint != nil {
+		requiresCheckpointPersistence = listener.persistCheckpoint(event.VbNo)
+	}
 	return requiresCheckpointPersistence
 }
 
@@ -130,49 +174,87 @@ func (listener *changeListener) ProcessFeedEvent(event sgbucket.FeedEvent) bool
 func (listener *changeListener) Stop() {
 
 	base.Debugf(base.KeyChanges, "changeListener.Stop() called")
+	atomic.StoreInt32(&listener.feedStopped, 1)
 
 	if listener.terminator != nil {
 		close(listener.terminator)
 	}
 
-	if listener.tapNotifier != nil {
-		// Unblock any change listeners blocked on tapNotifier.Wait()
-		listener.tapNotifier.Broadcast()
-	}
+	// Unblock any change listeners blocked in Wait()
+	listener.notifyLock.Lock()
+	listener._notifyAll()
+	listener.notifyLock.Unlock()
 
 	if listener.tapFeed != nil {
 		listener.tapFeed.Close()
 	}
 }
 
-func (listener changeListener) TapFeed() base.TapFeed {
+// Records the arrival of a feed event, for FeedStatus.
+func (listener *changeListener) recordFeedEvent(event sgbucket.FeedEvent) {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&listener.lastEventTime, now)
+	if event.Opcode == sgbucket.FeedOpMutation || event.Opcode == sgbucket.FeedOpDeletion {
+		if cas := int64(event.Cas); cas > minTimestampCas && cas <= now {
+			atomic.StoreInt64(&listener.lastEventLag, now-cas)
+		}
+	}
+}
+
+// Records that the feed was dropped by the server.
+func (listener *changeListener) feedDropped(err error) {
+	atomic.StoreInt32(&listener.feedStopped, 1)
+	listener.notifyLock.Lock()
+	listener.feedError = err
+	listener.notifyLock.Unlock()
+}
+
+// Returns the current state of the mutation feed.
+func (listener *changeListener) FeedStatus() ChangeFeedStatus {
+	status := ChangeFeedStatus{
+		Running: atomic.LoadInt32(&listener.feedStopped) == 0 && atomic.LoadInt64(&listener.feedStartTime) != 0,
+		Lag:     time.Duration(atomic.LoadInt64(&listener.lastEventLag)),
+	}
+	if startTime := atomic.LoadInt64(&listener.feedStartTime); startTime != 0 {
+		status.StartTime = time.Unix(0, startTime)
+	}
+	if eventTime := atomic.LoadInt64(&listener.lastEventTime); eventTime != 0 {
+		status.LastEventTime = time.Unix(0, eventTime)
+	}
+	listener.notifyLock.Lock()
+	status.Error = listener.feedError
+	listener.notifyLock.Unlock()
+	return status
+}
+
+func (listener *changeListener) TapFeed() base.TapFeed {
 	return listener.tapFeed
 }
 
 //////// NOTIFICATIONS:
 
-// Changes the counter, notifying waiting clients.
+// Changes the counter, notifying the clients waiting on the given keys.
 func (listener *changeListener) Notify(keys base.Set) {
 	if len(keys) == 0 {
 		return
 	}
-	listener.tapNotifier.L.Lock()
+	listener.notifyLock.Lock()
 	listener.counter++
 	for key := range keys {
 		listener.keyCounts[key] = listener.counter
 	}
 	base.Debugf(base.KeyChanges, "Notifying that %q changed (keys=%q) count=%d",
 		base.MD(listener.bucketName), base.UD(keys), listener.counter)
-	listener.tapNotifier.Broadcast()
-	listener.tapNotifier.L.Unlock()
+	listener._notifyKeys(keys)
+	listener.notifyLock.Unlock()
 }
 
-// Changes the counter, notifying waiting clients.
+// Changes the terminateCheckCounter, notifying the clients waiting on the given keys.
 func (listener *changeListener) NotifyCheckForTermination(keys base.Set) {
 	if len(keys) == 0 {
 		return
 	}
-	listener.tapNotifier.L.Lock()
+	listener.notifyLock.Lock()
 
 	//Increment terminateCheckCounter, but loop back to zero
 	//if we have reached maximum value for uint64 type
@@ -182,42 +264,123 @@ func (listener *changeListener) NotifyCheckForTermination(keys base.Set) {
 		listener.terminateCheckCounter = 0
 	}
 
-	base.Debugf(base.KeyChanges, "Notifying to check for _changes feed termination")
-	listener.tapNotifier.Broadcast()
-	listener.tapNotifier.L.Unlock()
+	base.Debugf(base.KeyChanges, "Notifying to check for _changes feed termination (keys=%q)", base.UD(keys))
+	listener._notifyKeys(keys)
+	listener.notifyLock.Unlock()
 }
 
 func (listener *changeListener) notifyStopping() {
-	listener.tapNotifier.L.Lock()
+	atomic.StoreInt32(&listener.feedStopped, 1)
+	listener.notifyLock.Lock()
 	listener.counter = 0
 	listener.keyCounts = map[string]uint64{}
 	base.Debugf(base.KeyChanges, "Notifying that changeListener is stopping")
-	listener.tapNotifier.Broadcast()
-	listener.tapNotifier.L.Unlock()
+	listener._notifyAll()
+	listener.notifyLock.Unlock()
+}
+
+// Wakes the goroutines waiting on any of the given keys.  Requires notifyLock.
+func (listener *changeListener) _notifyKeys(keys base.Set) {
+	for key := range keys {
+		for notify := range listener.waiters[key] {
+			wake(notify)
+		}
+	}
+}
+
+// Wakes every waiting goroutine.  Requires notifyLock.
+func (listener *changeListener) _notifyAll() {
+	for _, keyWaiters := range listener.waiters {
+		for notify := range keyWaiters {
+			wake(notify)
+		}
+	}
+}
+
+// The notification channels of the goroutines waiting on a key
+type waiterSet map[chan struct{}]struct{}
+
+// Signals a waiting goroutine's notification channel, unless it's already been signalled.
+func wake(notify chan struct{}) {
+	select {
+	case notify <- struct{}{}:
+	default:
+	}
+}
+
+// Registers a waiting goroutine's notification channel under the keys it's waiting on.  Requires
+// notifyLock.
+func (listener *changeListener) _addWaiter(keys []string, notify chan struct{}) {
+	for _, key := range keys {
+		keyWaiters := listener.waiters[key]
+		if keyWaiters == nil {
+			keyWaiters = waiterSet{}
+			listener.waiters[key] = keyWaiters
+		}
+		keyWaiters[notify] = struct{}{}
+	}
+}
+
+// Unregisters a waiting goroutine's notification channel, discarding any signal it hasn't received.
+// Requires notifyLock.
+func (listener *changeListener) _removeWaiter(keys []string, notify chan struct{}) {
+	for _, key := range keys {
+		if keyWaiters := listener.waiters[key]; keyWaiters != nil {
+			delete(keyWaiters, notify)
+			if len(keyWaiters) == 0 {
+				delete(listener.waiters, key)
+			}
+		}
+	}
+	select {
+	case <-notify:
+	default:
+	}
+}
+
+func (listener *changeListener) addStat(key string, delta int64) {
+	if listener.stats != nil {
+		listener.stats.Add(key, delta)
+	}
 }
 
 // Waits until either the counter, or terminateCheckCounter exceeds the given value. Returns the new counters.
 func (listener *changeListener) Wait(keys []string, counter uint64, terminateCheckCounter uint64) (uint64, uint64) {
-	listener.tapNotifier.L.Lock()
-	defer listener.tapNotifier.L.Unlock()
+	listener.notifyLock.Lock()
+	defer listener.notifyLock.Unlock()
 	base.Debugf(base.KeyChanges, "No new changes to send to change listener.  Waiting for %q's count to pass %d",
 		base.MD(listener.bucketName), counter)
 
+	notify := make(chan struct{}, 1)
+	woken := false
 	for {
 		curCounter := listener._currentCount(keys)
 
 		if curCounter != counter || listener.terminateCheckCounter != terminateCheckCounter {
 			return curCounter, listener.terminateCheckCounter
 		}
+		if woken {
+			// Woken by a notification that didn't change anything this goroutine is waiting on
+			listener.addStat(base.StatKeyChangesSpuriousWakeups, 1)
+		}
 
-		listener.tapNotifier.Wait()
+		terminator := listener.terminator
+		listener._addWaiter(keys, notify)
+		listener.notifyLock.Unlock()
+		select {
+		case <-notify:
+			woken = true
+		case <-terminator:
+		}
+		listener.notifyLock.Lock()
+		listener._removeWaiter(keys, notify)
 
 		// Don't go back through the for loop if this changeListener was terminated
 		select {
-		case <-listener.terminator:
+		case <-terminator:
 			return 0, 0
 		default:
-			// do nothing
+			listener.addStat(base.StatKeyChangesWakeups, 1)
 		}
 
 	}
@@ -225,8 +388,8 @@ func (listener *changeListener) Wait(keys []string, counter uint64, terminateChe
 
 // Returns the max value of the counter for all the given keys
 func (listener *changeListener) CurrentCount(keys []string) uint64 {
-	listener.tapNotifier.L.Lock()
-	defer listener.tapNotifier.L.Unlock()
+	listener.notifyLock.Lock()
+	defer listener.notifyLock.Unlock()
 	return listener._currentCount(keys)
 }
 
@@ -271,7 +434,7 @@ func (listener *changeListener) NewWaiterWithChannels(chans base.Set, user auth.
 	var userKeys []string
 	if user != nil {
 		userKeys = []string{auth.UserKeyPrefix + user.Name()}
-		for role := range user.RoleNames() {
+		for role := range user.InheritedRoleNames() {
 			userKeys = append(userKeys, auth.RoleKeyPrefix+role)
 		}
 		waitKeys = append(waitKeys, userKeys...)
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+)
+
+// Starts waiting on a changeWaiter in a goroutine, returning a channel that receives the result.
+func startWaiting(waiter *changeWaiter) chan uint32 {
+	result := make(chan uint32, 1)
+	go func() {
+		result <- waiter.Wait()
+	}()
+	return result
+}
+
+// Returns the waiter's result, or false if it doesn't return within the timeout.
+func waitResult(result chan uint32, timeout time.Duration) (uint32, bool) {
+	select {
+	case response := <-result:
+		return response, true
+	case <-time.After(timeout):
+		return 0, false
+	}
+}
+
+func TestChangeListenerTargetedNotify(t *testing.T) {
+	var listener changeListener
+	listener.Init("bucket")
+	listener.terminator = make(chan bool)
+	listener.stats = new(expvar.Map)
+
+	waiterA := startWaiting(listener.NewWaiter([]string{"A"}))
+	waiterB := startWaiting(listener.NewWaiter([]string{"B", "user:bob"}))
+	waiterAB := startWaiting(listener.NewWaiter([]string{"A", "B"}))
+
+	// Give the waiters time to start waiting
+	time.Sleep(50 * time.Millisecond)
+
+	// Only the waiters on A are woken
+	listener.Notify(base.SetOf("A"))
+	response, ok := waitResult(waiterA, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, WaiterHasChanges, response)
+	response, ok = waitResult(waiterAB, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, WaiterHasChanges, response)
+	_, ok = waitResult(waiterB, 50*time.Millisecond)
+	assert.False(t, ok)
+
+	assert.Equal(t, "2", listener.stats.Get(base.StatKeyChangesWakeups).String())
+	assert.Nil(t, listener.stats.Get(base.StatKeyChangesSpuriousWakeups))
+
+	// A termination check for a user only wakes that user's waiter
+	listener.NotifyCheckForTermination(base.SetOf("user:bob"))
+	response, ok = waitResult(waiterB, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, WaiterCheckTerminated, response)
+
+	// Nothing is left registered
+	listener.notifyLock.Lock()
+	assert.Len(t, listener.waiters, 0)
+	listener.notifyLock.Unlock()
+}
+
+func TestChangeListenerStopWakesWaiters(t *testing.T) {
+	var listener changeListener
+	listener.Init("bucket")
+	listener.terminator = make(chan bool)
+
+	waiterA := startWaiting(listener.NewWaiter([]string{"A"}))
+	waiterB := startWaiting(listener.NewWaiter([]string{"B"}))
+	time.Sleep(50 * time.Millisecond)
+
+	listener.Stop()
+	for _, waiter := range []chan uint32{waiterA, waiterB} {
+		response, ok := waitResult(waiter, time.Second)
+		assert.True(t, ok)
+		assert.Equal(t, WaiterClosed, response)
+	}
+}
@@ -164,20 +164,16 @@ func (db *Database) AddDocInstanceToChangeEntry(entry *ChangeEntry, doc *documen
 	}
 }
 
-// Creates a Go-channel of all the changes made on a channel.
+// Creates a Go-channel of the changes made on a channel, given the channel's change log.
 // Does NOT handle the Wait option. Does NOT check authorization.
-func (db *Database) changesFeed(channel string, options ChangesOptions, to string) (<-chan *ChangeEntry, error) {
-	log, err := db.changeCache.GetChanges(channel, options)
+func (db *Database) changesFeed(channel string, log []*LogEntry, options ChangesOptions, to string) <-chan *ChangeEntry {
 	base.Debugf(base.KeyChanges, "[changesFeed] Found %d changes for channel %s", len(log), base.UD(channel))
-	if err != nil {
-		return nil, err
-	}
 
 	if len(log) == 0 {
 		// There are no entries newer than 'since'. Return an empty feed:
 		feed := make(chan *ChangeEntry)
 		close(feed)
-		return feed, nil
+		return feed
 	}
 
 	feed := make(chan *ChangeEntry, 1)
@@ -212,7 +208,7 @@ func (db *Database) changesFeed(channel string, options ChangesOptions, to strin
 			}
 		}
 	}()
-	return feed, nil
+	return feed
 }
 
 func makeChangeEntry(logEntry *LogEntry, seqID SequenceID, channelName string) ChangeEntry {
@@ -442,6 +438,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 			// with access to both channels would see two versions on the feed.
 
 			deferredBackfill = false
+			requests := make([]*channelChangesRequest, 0, len(channelsSince))
 			for name, vbSeqAddedAt := range channelsSince {
 				chanOpts := options
 				seqAddedAt := vbSeqAddedAt.Sequence
@@ -484,13 +481,20 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 					chanOpts.Since = SequenceID{Seq: options.Since.TriggeredBy}
 				}
 
-				feed, err := db.changesFeed(name, chanOpts, to)
-				if err != nil {
-					base.Warnf(base.KeyAll, "MultiChangesFeed got error reading changes feed %q: %v", base.UD(name), err)
+				requests = append(requests, &channelChangesRequest{channelName: name, options: chanOpts})
+			}
+
+			// Read the channels' changes, backfilling uncached ones in parallel
+			db.getChannelChanges(requests)
+			for _, request := range requests {
+				name := request.channelName
+				if request.err != nil {
+					base.Warnf(base.KeyAll, "MultiChangesFeed got error reading changes feed %q: %v", base.UD(name), request.err)
 					change := makeErrorEntry("Error reading changes feed - terminating changes feed")
 					output <- &change
 					return
 				}
+				feed := db.changesFeed(name, request.log, request.options, to)
 				feeds = append(feeds, feed)
 				names = append(names, name)
 
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// When a changes feed covers many channels whose changes aren't cached, the queries to backfill them
+// are run in parallel, up to a limit.  Optionally, the channels can instead be backfilled with a
+// single query, which is faster when each of them has few changes.
+
+const DefaultChangesBackfillConcurrency = 8 // Default max number of channel queries run in parallel by a changes feed
+
+// The changes of one of the channels of a changes feed
+type channelChangesRequest struct {
+	channelName string
+	options     ChangesOptions
+	queried     *channelQueryResults // Results of a multi-channel query covering the channel, if any
+	log         []*LogEntry
+	err         error
+}
+
+// The results of a query for a channel's changes, within a range of sequences
+type channelQueryResults struct {
+	entries  LogEntries // Changes in the range, in sequence order
+	startSeq uint64     // First sequence of the range
+	endSeq   uint64     // Last sequence of the range
+}
+
+// Whether the results include all of a channel's changes between two sequences.
+func (r *channelQueryResults) covers(startSeq, endSeq uint64) bool {
+	return r != nil && r.startSeq <= startSeq && r.endSeq >= endSeq
+}
+
+// Returns the changes between two sequences, inclusive.
+func (r *channelQueryResults) between(startSeq, endSeq uint64) LogEntries {
+	start := sort.Search(len(r.entries), func(i int) bool { return r.entries[i].Sequence >= startSeq })
+	end := sort.Search(len(r.entries), func(i int) bool { return r.entries[i].Sequence > endSeq })
+	if start == end {
+		return nil
+	}
+	return r.entries[start:end]
+}
+
+// Gets the changes of each channel, setting the requests' log or err.  The changes are read from the
+// channel caches, falling back to queries run in parallel, at most BackfillConcurrency at a
+// time.  If at least CombinedQueryMinChannels channels aren't cached, they're all queried at once.
+func (db *Database) getChannelChanges(requests []*channelChangesRequest) {
+	cache, isChangeCache := db.changeCache.(*changeCache)
+	if isChangeCache && db.Options.CombinedQueryMinChannels > 0 && !db.Options.UseViews {
+		cache.queryUncachedChannels(requests, db.Options.CombinedQueryMinChannels)
+	}
+
+	getChanges := func(request *channelChangesRequest) {
+		if request.queried != nil {
+			if cache.IsStopped() {
+				request.err = base.HTTPErrorf(503, "Database closed")
+				return
+			}
+			request.log, request.err = cache.getChannelCache(request.channelName).getChanges(request.options, request.queried)
+			return
+		}
+		request.log, request.err = db.changeCache.GetChanges(request.channelName, request.options)
+	}
+
+	concurrency := db.Options.BackfillConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultChangesBackfillConcurrency
+	}
+	base.ForEachConcurrently(len(requests), concurrency, func(i int) {
+		getChanges(requests[i])
+	})
+}
+
+// Finds the channels whose requested changes aren't all cached, and if there are at least
+// minChannels of them, gets their changes with a single query, setting the requests' queried results.
+// Requests with a limit aren't included, as the query can't apply a limit to each channel.
+func (c *changeCache) queryUncachedChannels(requests []*channelChangesRequest, minChannels int) {
+	var uncached []*channelChangesRequest
+	var startSeq, endSeq uint64
+	for _, request := range requests {
+		if request.options.Limit > 0 || request.channelName == "*" {
+			continue
+		}
+		requestStartSeq := request.options.Since.SafeSequence() + 1
+		validFrom := c.getChannelCache(request.channelName).getValidFrom()
+		if validFrom <= requestStartSeq {
+			continue
+		}
+		if len(uncached) == 0 || requestStartSeq < startSeq {
+			startSeq = requestStartSeq
+		}
+		if validFrom > endSeq {
+			endSeq = validFrom
+		}
+		uncached = append(uncached, request)
+	}
+	if len(uncached) < minChannels {
+		return
+	}
+
+	channelNames := make([]string, len(uncached))
+	for i, request := range uncached {
+		channelNames[i] = request.channelName
+	}
+	entries, err := c.context.getChangesInChannelsFromQuery(channelNames, startSeq, endSeq)
+	if err != nil {
+		// Each channel falls back to being queried individually
+		base.Warnf(base.KeyCache, "Error querying the changes of %d channels at once: %v", len(channelNames), err)
+		return
+	}
+	for _, request := range uncached {
+		request.queried = &channelQueryResults{
+			entries:  entries[request.channelName],
+			startSeq: startSeq,
+			endSeq:   endSeq,
+		}
+	}
+}
+
+// Queries the changes of several channels within a range of sequences, inclusive.  Returns each
+// channel's changes in sequence order.
+func (context *DatabaseContext) getChangesInChannelsFromQuery(channelNames []string, startSeq, endSeq uint64) (map[string]LogEntries, error) {
+	start := time.Now()
+	base.Infof(base.KeyCache, "  Querying changes of %d channels (start=#%d, end=#%d)", len(channelNames), startSeq, endSeq)
+	queryResults, err := context.QueryMultiChannel(channelNames, startSeq, endSeq)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]LogEntries, len(channelNames))
+	for _, channelName := range channelNames {
+		entries[channelName] = nil
+	}
+	rowCount := 0
+	var queryRow QueryMultiChannelRow
+	for queryResults.Next(&queryRow) {
+		// The query returns the changes of any other channels within the range of names, and those
+		// outside the range of sequences
+		channelEntries, found := entries[queryRow.Channel]
+		if found && queryRow.Sequence >= startSeq && queryRow.Sequence <= endSeq {
+			entries[queryRow.Channel] = append(channelEntries, queryRow.logEntry())
+			rowCount++
+		}
+		queryRow = QueryMultiChannelRow{}
+	}
+	if err := queryResults.Close(); err != nil {
+		return nil, err
+	}
+
+	for _, channelEntries := range entries {
+		sort.Slice(channelEntries, func(i, j int) bool { return channelEntries[i].Sequence < channelEntries[j].Sequence })
+	}
+	base.Infof(base.KeyCache, "    Got %d rows from query for %d channels in %v", rowCount, len(channelNames), time.Since(start))
+	changeCacheExpvars.Add("view_queries", 1)
+	return entries, nil
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelQueryResults(t *testing.T) {
+	results := &channelQueryResults{
+		entries:  LogEntries{e(2, "doc1", "1-a"), e(5, "doc2", "1-a"), e(12, "doc3", "1-a")},
+		startSeq: 1,
+		endSeq:   20,
+	}
+	assert.True(t, results.covers(1, 20))
+	assert.True(t, results.covers(3, 10))
+	assert.False(t, results.covers(0, 10))
+	assert.False(t, results.covers(3, 21))
+	var noResults *channelQueryResults
+	assert.False(t, noResults.covers(3, 10))
+
+	assert.Equal(t, []uint64{2, 5}, logSequences(results.between(1, 10)))
+	assert.Equal(t, []uint64{5, 12}, logSequences(results.between(5, 12)))
+	assert.Len(t, results.between(6, 11), 0)
+}
+
+func logSequences(entries LogEntries) []uint64 {
+	sequences := make([]uint64, len(entries))
+	for i, entry := range entries {
+		sequences[i] = entry.Sequence
+	}
+	return sequences
+}
+
+func TestChannelCacheGetChangesFromQueryResults(t *testing.T) {
+
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyCache)()
+
+	context := testBucketContext()
+	defer context.Close()
+	defer base.DecrNumOpenBuckets(context.Bucket.GetName())
+
+	// The bucket has no docs, so the changes can only come from the given results
+	cache := newChannelCache(context, "A", 10)
+	queried := &channelQueryResults{
+		entries:  LogEntries{e(2, "doc1", "1-a"), e(5, "doc2", "1-a"), e(12, "doc3", "1-a")},
+		startSeq: 1,
+		endSeq:   20,
+	}
+	entries, err := cache.getChanges(ChangesOptions{Since: SequenceID{Seq: 0}}, queried)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{2, 5}, logSequences(entries))
+
+	// The changes were cached
+	_, entries = cache.getCachedChanges(ChangesOptions{Since: SequenceID{Seq: 0}})
+	assert.Equal(t, []uint64{2, 5}, logSequences(entries))
+
+	// Results that don't cover the missing changes are ignored, and the channel queried
+	cache = newChannelCache(context, "B", 10)
+	queried.startSeq = 3
+	entries, err = cache.getChanges(ChangesOptions{Since: SequenceID{Seq: 0}}, queried)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
+
+func TestGetChannelChangesInParallel(t *testing.T) {
+
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+	db.Options.BackfillConcurrency = 4
+
+	for i := 0; i < 20; i++ {
+		_, err := db.Put(fmt.Sprintf("doc%d", i), Body{"channels": []string{fmt.Sprintf("ch%d", i%10)}})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, db.WaitForPendingChanges())
+	assert.NoError(t, db.FlushChannelCache())
+
+	requests := make([]*channelChangesRequest, 10)
+	for i := range requests {
+		requests[i] = &channelChangesRequest{channelName: fmt.Sprintf("ch%d", i)}
+	}
+	db.getChannelChanges(requests)
+	for i, request := range requests {
+		assert.NoError(t, request.err)
+		assert.Equal(t, []uint64{uint64(i + 1), uint64(i + 11)}, logSequences(request.log), "Unexpected changes in %s", request.channelName)
+		assert.Equal(t, int64(1), db.changeCache.(*changeCache).getChannelCache(request.channelName).info().Misses)
+	}
+}
@@ -53,6 +53,11 @@ func nextChannelQueryEntry(results sgbucket.QueryResultIterator) (*LogEntry, boo
 	if !found {
 		return nil, false
 	}
+	return queryRow.logEntry(), true
+
+}
+
+func (queryRow *QueryChannelsRow) logEntry() *LogEntry {
 	entry := &LogEntry{
 		Sequence:     queryRow.Sequence,
 		DocID:        queryRow.Id,
@@ -69,8 +74,7 @@ func nextChannelQueryEntry(results sgbucket.QueryResultIterator) (*LogEntry, boo
 			entry.SetRemoved()
 		}
 	}
-	return entry, true
-
+	return entry
 }
 
 // Queries the 'channels' view to get a range of sequences of a single channel as LogEntries.
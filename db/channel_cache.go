@@ -3,6 +3,7 @@ package db
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/couchbase/sync_gateway/base"
@@ -95,10 +96,15 @@ type channelCache struct {
 	lateLogLock      sync.RWMutex         // Controls access to lateLogs
 	options          *ChannelCacheOptions // Cache size/expiry settings
 	cachedDocIDs     map[string]struct{}
+	memoryUsed       int64 // Approximate size of logs, counted against the memory governor; accessed atomically
+	lastAccess       int64 // Time logs were last read, in Unix nanoseconds; accessed atomically
+	hits             int64 // Number of GetChanges requests served from the cache; accessed atomically
+	misses           int64 // Number of GetChanges requests that needed a query; accessed atomically
 }
 
 func newChannelCache(context *DatabaseContext, channelName string, validFrom uint64) *channelCache {
 	cache := &channelCache{context: context, channelName: channelName, validFrom: validFrom}
+	cache.touch()
 	cache.initializeLateLogs()
 	cache.cachedDocIDs = make(map[string]struct{})
 	cache.options = &ChannelCacheOptions{
@@ -268,9 +274,17 @@ func (c *channelCache) pruneCacheAge() {
 func (c *channelCache) getCachedChanges(options ChangesOptions) (validFrom uint64, result []*LogEntry) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
+	c.touch()
 	return c._getCachedChanges(options)
 }
 
+// Returns the sequence from which the cache holds all of the channel's changes.
+func (c *channelCache) getValidFrom() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.validFrom
+}
+
 func (c *channelCache) _getCachedChanges(options ChangesOptions) (validFrom uint64, result []*LogEntry) {
 	// Find the first entry in the log to return:
 	log := c.logs
@@ -310,6 +324,12 @@ func (c *channelCache) _getCachedChanges(options ChangesOptions) (validFrom uint
 // view should be queried, because we don't want the view query to outrun the chanceCache's
 // nextSequence.
 func (c *channelCache) GetChanges(options ChangesOptions) ([]*LogEntry, error) {
+	return c.getChanges(options, nil)
+}
+
+// Like GetChanges, but if the changes aren't all cached, uses the results of a query that's already
+// been made where they cover the missing changes.
+func (c *channelCache) getChanges(options ChangesOptions, queried *channelQueryResults) ([]*LogEntry, error) {
 	// Use the cache, and return if it fulfilled the entire request:
 	cacheValidFrom, resultFromCache := c.getCachedChanges(options)
 	numFromCache := len(resultFromCache)
@@ -323,6 +343,7 @@ func (c *channelCache) GetChanges(options ChangesOptions) ([]*LogEntry, error) {
 	startSeq := options.Since.SafeSequence() + 1
 	if cacheValidFrom <= startSeq {
 		c.context.DbStats.StatsCache().Add(base.StatKeyChannelCacheHits, 1)
+		atomic.AddInt64(&c.hits, 1)
 		return resultFromCache, nil
 	}
 
@@ -340,16 +361,24 @@ func (c *channelCache) GetChanges(options ChangesOptions) ([]*LogEntry, error) {
 	}
 	if cacheValidFrom <= startSeq {
 		c.context.DbStats.StatsCache().Add(base.StatKeyChannelCacheHits, 1)
+		atomic.AddInt64(&c.hits, 1)
 		return resultFromCache, nil
 	}
 
 	// Now query the view. We set the max sequence equal to cacheValidFrom, so we'll get one
 	// overlap, which helps confirm that we've got everything.
 	c.context.DbStats.StatsCache().Add(base.StatKeyChannelCacheMisses, 1)
-	resultFromView, err := c.context.getChangesInChannelFromQuery(c.channelName, cacheValidFrom,
-		options)
-	if err != nil {
-		return nil, err
+	atomic.AddInt64(&c.misses, 1)
+	var resultFromView LogEntries
+	if queried.covers(startSeq, cacheValidFrom) {
+		resultFromView = queried.between(startSeq, cacheValidFrom)
+	} else {
+		var err error
+		resultFromView, err = c.context.getChangesInChannelFromQuery(c.channelName, cacheValidFrom,
+			options)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Cache some of the view results, if there's room in the cache:
@@ -428,6 +457,55 @@ func (c *channelCache) UpdateCacheUtilization(entry *LogEntry, delta int64) {
 	} else {
 		c.context.DbStats.StatsCache().Add(base.StatKeyChannelCacheRevsActive, delta)
 	}
+	c.addMemoryUsed(delta * cachedLogEntrySize(entry))
+}
+
+// Records a change in the size of logs.
+func (c *channelCache) addMemoryUsed(delta int64) {
+	atomic.AddInt64(&c.memoryUsed, delta)
+	c.context.Options.MemoryGovernor.add(MemoryChannelCache, delta)
+}
+
+// Records that the cache has been read, for least recently used eviction.
+func (c *channelCache) touch() {
+	atomic.StoreInt64(&c.lastAccess, time.Now().UnixNano())
+}
+
+// Returns when the cache was last read, or the zero time if it's only been prewarmed.
+func (c *channelCache) lastAccessTime() time.Time {
+	lastAccess := atomic.LoadInt64(&c.lastAccess)
+	if lastAccess == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, lastAccess)
+}
+
+// Empties the cache to free memory.  The cache remains valid from after its last entry, so later
+// requests for earlier changes are served by a view query.
+func (c *channelCache) evict() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.logs) == 0 {
+		return
+	}
+	for _, entry := range c.logs {
+		c.UpdateCacheUtilization(entry, -1)
+	}
+	c.validFrom = c.logs[len(c.logs)-1].Sequence + 1
+	c.logs = make(LogEntries, 0, c.options.ChannelCacheMaxLength)
+	c.cachedDocIDs = make(map[string]struct{})
+	base.Debugf(base.KeyCache, "Evicted cache of %q to free memory, now valid from #%d", base.UD(c.channelName), c.validFrom)
+}
+
+// Stops counting the cache's memory against the memory governor, when the cache's being discarded.
+func (c *channelCache) releaseMemory() {
+	c.context.Options.MemoryGovernor.add(MemoryChannelCache, -atomic.SwapInt64(&c.memoryUsed, 0))
+}
+
+// Returns the approximate size of a LogEntry in a channel cache.  Entries' channels are dropped
+// before they're cached.
+func cachedLogEntrySize(entry *LogEntry) int64 {
+	return int64(logEntryOverhead + len(entry.DocID) + len(entry.RevID))
 }
 
 // Insert out-of-sequence entry into the cache.  If the docId is already present in a later
@@ -519,6 +597,9 @@ func (c *channelCache) prependChanges(changes LogEntries, changesValidFrom uint6
 		}
 		c.validFrom = changesValidFrom
 		c.addDocIDs(changes)
+		for _, change := range changes {
+			c.addMemoryUsed(cachedLogEntrySize(change))
+		}
 		return len(changes)
 
 	} else if len(changes) == 0 {
@@ -590,6 +671,30 @@ func (c *channelCache) GetSize() int {
 	return len(c.logs)
 }
 
+// Returns the state of the cache, for the admin API.
+func (c *channelCache) info() ChannelCacheInfo {
+	c.lock.RLock()
+	info := ChannelCacheInfo{
+		Channel:   c.channelName,
+		Entries:   len(c.logs),
+		ValidFrom: c.validFrom,
+	}
+	if len(c.logs) > 0 {
+		info.OldestSequence = c.logs[0].Sequence
+		info.NewestSequence = c.logs[len(c.logs)-1].Sequence
+	}
+	c.lock.RUnlock()
+
+	info.Bytes = atomic.LoadInt64(&c.memoryUsed)
+	info.Hits = atomic.LoadInt64(&c.hits)
+	info.Misses = atomic.LoadInt64(&c.misses)
+	if requests := info.Hits + info.Misses; requests > 0 {
+		info.HitRate = float64(info.Hits) / float64(requests)
+	}
+	info.LastAccess = c.lastAccessTime()
+	return info
+}
+
 type lateLogEntry struct {
 	logEntry      *LogEntry
 	arrived       time.Time    // Time arrived in late log - for diagnostics tracking
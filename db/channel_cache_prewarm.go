@@ -0,0 +1,235 @@
+package db
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Channel cache prewarming loads the caches of selected channels in the background when the
+// change cache starts, so that clients reconnecting after a restart don't all have their changes
+// served by view queries.  Channels can be named explicitly, or chosen from the most recently
+// active channels, which are periodically recorded in the bucket.
+//
+// A channel's recent changes are found by querying sequence ranges of doubling size, going back
+// from the current sequence until the cache is full, rather than querying its whole history.
+// Prewarming doesn't count as reading a cache, so a channel that isn't read afterwards isn't
+// recorded as active again, and its cache is the first evicted by the memory governor.
+
+const (
+	DefaultPrewarmRecordInterval   = 5 * time.Minute // How often the most recently active channels are recorded
+	DefaultPrewarmMaxQueriesPerSec = 10              // Max rate of the queries used to prewarm
+	maxRecordedActiveChannels      = 1000            // Max number of channels recorded, for matching against patterns
+	prewarmProgressInterval        = 10 * time.Second
+	activeChannelsKey              = KSyncKeyPrefix + "activeChannels"
+)
+
+// Options for prewarming channel caches
+type CachePrewarmOptions struct {
+	Channels         []string      // Channels to prewarm.  Names containing '*' are patterns matched against recently active channels
+	RecentChannels   int           // Number of most recently active channels to prewarm
+	RecordInterval   time.Duration // How often the most recently active channels are recorded in the bucket
+	MaxQueriesPerSec int           // Max rate of the queries used to prewarm
+}
+
+// The most recently active channels, most recent first.  Shared by all nodes, so it holds those
+// of whichever node recorded last.
+type activeChannelsDoc struct {
+	Channels []string  `json:"channels"`
+	Updated  time.Time `json:"updated"`
+}
+
+func (options *CachePrewarmOptions) patterns() (patterns []string) {
+	for _, channel := range options.Channels {
+		if strings.Contains(channel, "*") {
+			patterns = append(patterns, channel)
+		}
+	}
+	return patterns
+}
+
+// Whether the most recently active channels need recording, to choose from at the next startup.
+func (options *CachePrewarmOptions) recordsActiveChannels() bool {
+	return options.RecentChannels > 0 || len(options.patterns()) > 0
+}
+
+// Records the most recently read channels in the bucket.
+func (c *changeCache) recordActiveChannels() {
+	c.lock.RLock()
+	channelCaches := make([]*channelCache, 0, len(c.channelCaches))
+	for _, channelCache := range c.channelCaches {
+		channelCaches = append(channelCaches, channelCache)
+	}
+	c.lock.RUnlock()
+	if len(channelCaches) == 0 {
+		return
+	}
+
+	// Caches that have only been prewarmed haven't been read
+	lastAccess := make(map[*channelCache]int64, len(channelCaches))
+	read := channelCaches[:0]
+	for _, channelCache := range channelCaches {
+		if access := atomic.LoadInt64(&channelCache.lastAccess); access != 0 {
+			lastAccess[channelCache] = access
+			read = append(read, channelCache)
+		}
+	}
+	channelCaches = read
+	if len(channelCaches) == 0 {
+		return
+	}
+	sort.Slice(channelCaches, func(i, j int) bool { return lastAccess[channelCaches[i]] > lastAccess[channelCaches[j]] })
+
+	limit := maxRecordedActiveChannels
+	if c.options.Prewarm.RecentChannels > limit {
+		limit = c.options.Prewarm.RecentChannels
+	}
+	if len(channelCaches) > limit {
+		channelCaches = channelCaches[:limit]
+	}
+	doc := activeChannelsDoc{Channels: make([]string, len(channelCaches)), Updated: time.Now()}
+	for i, channelCache := range channelCaches {
+		doc.Channels[i] = channelCache.channelName
+	}
+	if err := c.context.Bucket.Set(activeChannelsKey, 0, doc); err != nil {
+		base.Warnf(base.KeyCache, "Database %s: Unable to record active channels: %v", base.UD(c.context.Name), err)
+		return
+	}
+	base.Debugf(base.KeyCache, "Database %s: Recorded %d active channels", base.UD(c.context.Name), len(doc.Channels))
+}
+
+// Returns the most recently active channels recorded in the bucket, most recent first.
+func (c *changeCache) recordedActiveChannels() []string {
+	var doc activeChannelsDoc
+	if _, err := c.context.Bucket.Get(activeChannelsKey, &doc); err != nil {
+		if !base.IsDocNotFoundError(err) {
+			base.Warnf(base.KeyCache, "Database %s: Unable to read recorded active channels: %v", base.UD(c.context.Name), err)
+		}
+		return nil
+	}
+	return doc.Channels
+}
+
+// Returns the channels to prewarm: those named in the options, then the most recently active
+// ones, then the other recently active ones matching the options' patterns.
+func (c *changeCache) channelsToPrewarm() []string {
+	options := c.options.Prewarm
+	var channelNames []string
+	found := map[string]bool{}
+	add := func(channelName string) {
+		if !found[channelName] {
+			found[channelName] = true
+			channelNames = append(channelNames, channelName)
+		}
+	}
+
+	for _, channelName := range options.Channels {
+		if !strings.Contains(channelName, "*") {
+			add(channelName)
+		}
+	}
+	if !options.recordsActiveChannels() {
+		return channelNames
+	}
+
+	recorded := c.recordedActiveChannels()
+	for i, channelName := range recorded {
+		if i >= options.RecentChannels {
+			break
+		}
+		add(channelName)
+	}
+	patterns := options.patterns()
+	for _, channelName := range recorded {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, channelName); matched {
+				add(channelName)
+				break
+			}
+		}
+	}
+	return channelNames
+}
+
+// Loads a channel's most recent changes into its cache, up to the cache's max length.  Queries
+// ranges of sequences of doubling size, starting at the cache's max length, back from the sequence
+// the cache is valid from, until enough changes are found or the start of the channel is reached.  A cache created to be
+// prewarmed isn't marked as read.  Returns the cache and the number of queries made.
+func (c *changeCache) prewarmChannel(channelName string) (cache *channelCache, queries int, err error) {
+	c.lock.Lock()
+	cache = c.channelCaches[channelName]
+	if cache == nil {
+		cache = c._getChannelCache(channelName)
+		atomic.StoreInt64(&cache.lastAccess, 0)
+	}
+	c.lock.Unlock()
+
+	// Like GetChanges, don't query concurrently with readers of the cache
+	cache.viewLock.Lock()
+	defer cache.viewLock.Unlock()
+
+	maxLength := cache.options.ChannelCacheMaxLength
+	window := uint64(maxLength)
+	var entries LogEntries
+	endSeq := cache.getValidFrom()
+	for {
+		startSeq := uint64(1)
+		if endSeq > window {
+			startSeq = endSeq - window + 1
+		}
+		queried, err := c.context.getChangesInChannelFromQuery(channelName, endSeq, ChangesOptions{Since: SequenceID{Seq: startSeq - 1}})
+		queries++
+		if err != nil {
+			return cache, queries, err
+		}
+		entries = append(queried, entries...)
+		if len(entries) >= maxLength || startSeq <= 1 {
+			cache.prependChanges(entries, startSeq, true)
+			return cache, queries, nil
+		}
+		endSeq = startSeq - 1
+		window *= 2
+	}
+}
+
+// Prewarms the caches of the channels chosen by the prewarm options, no faster than the max
+// query rate.  Gives up if the cache is stopped.
+func (c *changeCache) prewarm() {
+	channelNames := c.channelsToPrewarm()
+	if len(channelNames) == 0 {
+		return
+	}
+	base.Infof(base.KeyCache, "Database %s: Prewarming %d channel caches", base.UD(c.context.Name), len(channelNames))
+
+	interval := time.Second / time.Duration(c.options.Prewarm.MaxQueriesPerSec)
+	startTime := time.Now()
+	lastProgress := startTime
+	failed := 0
+	var wait time.Duration
+	for i, channelName := range channelNames {
+		if i > 0 {
+			select {
+			case <-time.After(wait):
+			case <-c.terminator:
+				base.Infof(base.KeyCache, "Database %s: Stopped prewarming channel caches after %d of %d", base.UD(c.context.Name), i, len(channelNames))
+				return
+			}
+		}
+		_, queries, err := c.prewarmChannel(channelName)
+		wait = interval * time.Duration(queries)
+		if err != nil {
+			base.Warnf(base.KeyCache, "Database %s: Unable to prewarm cache of channel %s: %v", base.UD(c.context.Name), base.UD(channelName), err)
+			failed++
+		}
+		if time.Since(lastProgress) >= prewarmProgressInterval {
+			base.Infof(base.KeyCache, "Database %s: Prewarmed %d of %d channel caches", base.UD(c.context.Name), i+1, len(channelNames))
+			lastProgress = time.Now()
+		}
+	}
+	base.Infof(base.KeyCache, "Database %s: Finished prewarming %d channel caches in %v (%d failed)",
+		base.UD(c.context.Name), len(channelNames), time.Since(startTime), failed)
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the names of the channels with caches, once the given number of them have been prewarmed.
+func waitForPrewarmedChannels(cache *changeCache, count int) (channelNames []string) {
+	for i := 0; i < 100; i++ {
+		channelNames = channelNames[:0]
+		cache.lock.RLock()
+		for channelName, channelCache := range cache.channelCaches {
+			if channelCache.getValidFrom() <= 1 {
+				channelNames = append(channelNames, channelName)
+			}
+		}
+		cache.lock.RUnlock()
+		if len(channelNames) >= count {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sort.Strings(channelNames)
+	return channelNames
+}
+
+func TestRecordActiveChannels(t *testing.T) {
+
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyCache)()
+
+	tBucket := testBucket()
+	context, err := NewDatabaseContext("db", tBucket.Bucket, false, DatabaseContextOptions{
+		CacheOptions: &CacheOptions{Prewarm: &CachePrewarmOptions{RecentChannels: 2}},
+	})
+	assert.NoError(t, err)
+	defer tBucket.Close()
+	defer context.Close()
+	cache := context.changeCache.(*changeCache)
+
+	// Nothing's recorded until a channel is cached
+	cache.recordActiveChannels()
+	assert.Nil(t, cache.recordedActiveChannels())
+
+	for _, channelName := range []string{"A", "B", "C"} {
+		cache.getChannelCache(channelName)
+		time.Sleep(time.Millisecond)
+	}
+	cache.GetCachedChanges("A", ChangesOptions{})
+
+	cache.recordActiveChannels()
+	assert.Equal(t, []string{"A", "C", "B"}, cache.recordedActiveChannels())
+}
+
+func TestPrewarmChannelCaches(t *testing.T) {
+
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyCache)()
+
+	tBucket := testBucket()
+	defer tBucket.Close()
+	assert.NoError(t, tBucket.Bucket.Set(activeChannelsKey, 0, activeChannelsDoc{Channels: []string{"C", "D", "B1", "E"}}))
+
+	// Prewarms the named channel, the most recently active one, and those matching the pattern
+	context, err := NewDatabaseContext("db", tBucket.Bucket, false, DatabaseContextOptions{
+		CacheOptions: &CacheOptions{Prewarm: &CachePrewarmOptions{
+			Channels:         []string{"A", "B*"},
+			RecentChannels:   1,
+			MaxQueriesPerSec: 1000,
+		}},
+	})
+	assert.NoError(t, err)
+	defer context.Close()
+	cache := context.changeCache.(*changeCache)
+
+	assert.Equal(t, []string{"A", "B1", "C"}, waitForPrewarmedChannels(cache, 3))
+
+	// Prewarming doesn't count as reading the caches
+	for _, channelName := range []string{"A", "B1", "C"} {
+		info := cache.getChannelCache(channelName).info()
+		assert.Equal(t, int64(0), info.Hits)
+		assert.Equal(t, int64(0), info.Misses)
+		assert.True(t, cache.getChannelCache(channelName).lastAccessTime().IsZero())
+	}
+	cache.recordActiveChannels()
+	assert.Equal(t, []string{"C", "D", "B1", "E"}, cache.recordedActiveChannels())
+}
+
+func TestPrewarmChannelQueryWindows(t *testing.T) {
+
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyCache)()
+
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	// A channel's only changes are early in a longer history
+	_, err := db.Put("doc1", Body{"channels": []string{"A"}})
+	assert.NoError(t, err)
+	_, err = db.Put("doc2", Body{"channels": []string{"A"}})
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = db.Put(fmt.Sprintf("other%d", i), Body{"channels": []string{"B"}})
+		assert.NoError(t, err)
+	}
+	db.changeCache.waitForSequence(12, base.DefaultWaitForSequenceTesting)
+
+	// As if the cache had just been started
+	cache := db.changeCache.(*changeCache)
+	cache.lock.Lock()
+	delete(cache.channelCaches, "A")
+	cache.initialSequence = 12
+	cache.options.ChannelCacheMaxLength = 3
+	cache.lock.Unlock()
+
+	// Windows of 3, 6 and 12 sequences are queried back from the current sequence, until the start of the channel
+	channelCache, queries, err := cache.prewarmChannel("A")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, queries)
+	assert.Equal(t, uint64(1), channelCache.getValidFrom())
+	_, entries := channelCache.getCachedChanges(ChangesOptions{})
+	assert.Len(t, entries, 2)
+}
@@ -182,44 +182,55 @@ func (db *DatabaseContext) OnDemandImportForGet(docid string, rawDoc []byte, raw
 
 // This is the RevisionCacheLoaderFunc callback for the context's RevisionCache.
 // Its job is to load a revision from the bucket when there's a cache miss.
-func (context *DatabaseContext) revCacheLoader(id IDAndRev) (body Body, history Revisions, channels base.Set, attachments AttachmentsMeta, expiry *time.Time, err error) {
+func (context *DatabaseContext) revCacheLoader(id IDAndRev) (docRev DocumentRevision, err error) {
 	var doc *document
-	if doc, err = context.GetDocument(id.DocID, DocUnmarshalAll); doc == nil {
-		return body, history, channels, attachments, expiry, err
+	if doc, err = context.GetDocument(id.DocID, DocUnmarshalSync); doc == nil {
+		return docRev, err
 	}
 	return context.revCacheLoaderForDocument(doc, id.RevID)
 
 }
 
 // Common revCacheLoader functionality used either during a cache miss (from revCacheLoader), or directly when retrieving current rev from cache
-func (context *DatabaseContext) revCacheLoaderForDocument(doc *document, revid string) (body Body, history Revisions, channels base.Set, attachments AttachmentsMeta, expiry *time.Time, err error) {
+func (context *DatabaseContext) revCacheLoaderForDocument(doc *document, revid string) (docRev DocumentRevision, err error) {
 
-	if body, err = context.getRevision(doc, revid); err != nil {
+	var bodyBytes []byte
+	if bodyBytes, err = context.getRevisionJSON(doc, revid); err != nil {
 		// If we can't find the revision (either as active or conflicted body from the document, or as old revision body backup), check whether
 		// the revision was a channel removal.  If so, we want to store as removal in the revision cache
 		removalBody, removalHistory, removalChannels, isRemoval, isRemovalErr := doc.IsChannelRemoval(revid)
 		if isRemovalErr != nil {
-			return body, history, channels, nil, nil, isRemovalErr
+			return docRev, isRemovalErr
 		}
 		if isRemoval {
-			return removalBody, removalHistory, removalChannels, nil, nil, nil
+			deleted, _ := removalBody[BodyDeleted].(bool)
+			return DocumentRevision{
+				BodyBytes: []byte("{}"),
+				History:   removalHistory,
+				Channels:  removalChannels,
+				Deleted:   deleted,
+				Removed:   true,
+			}, nil
 		} else {
-			// If this wasn't a removal, return the original error from getRevision
-			return body, history, channels, nil, nil, err
+			// If this wasn't a removal, return the original error from getRevisionJSON
+			return docRev, err
 		}
 	}
-	if doc.History[revid].Deleted {
-		body[BodyDeleted] = true
+	if docRev.BodyBytes, err = stripRevCacheSpecialProperties(bodyBytes); err != nil {
+		return DocumentRevision{}, err
 	}
+	docRev.Deleted = doc.History[revid].Deleted
 
 	validatedHistory, getHistoryErr := doc.History.getHistory(revid)
 	if getHistoryErr != nil {
-		return body, history, channels, nil, nil, getHistoryErr
+		return DocumentRevision{}, getHistoryErr
 	}
-	history = encodeRevisions(validatedHistory)
-	channels = doc.History[revid].Channels
+	docRev.History = encodeRevisions(validatedHistory)
+	docRev.Channels = doc.History[revid].Channels
+	docRev.Attachments = doc.Attachments
+	docRev.Expiry = doc.Expiry
 
-	return body, history, channels, doc.Attachments, doc.Expiry, err
+	return docRev, nil
 }
 
 // Returns the body of the current revision of a document
@@ -245,8 +256,58 @@ func (db *Database) GetRev(docid, revid string, history bool, attachmentsSince [
 //   revisions for which the client already has attachments and doesn't need bodies. Any attachment
 //   that hasn't changed since one of those revisions will be returned as a stub.
 func (db *Database) GetRevWithHistory(docid, revid string, maxHistory int, historyFrom []string, attachmentsSince []string, showExp bool) (Body, error) {
-	var err error
-	var revision DocumentRevision
+	revision, requestedHistory, err := db.GetDocumentRevision(docid, revid, maxHistory, historyFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := revision.MutableBody()
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range revisionMetadata(revision, requestedHistory, showExp) {
+		body[key] = value
+	}
+
+	// Add attachment bodies if requested:
+	if attachmentsSince != nil && len(GetBodyAttachments(body)) > 0 {
+		minRevpos := 1
+		if len(attachmentsSince) > 0 {
+			ancestor := revision.History.findAncestor(attachmentsSince)
+			if ancestor != "" {
+				minRevpos, _ = ParseRevID(ancestor)
+				minRevpos++
+			}
+		}
+		body, err = db.loadBodyAttachments(body, minRevpos, docid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return body, nil
+}
+
+// Returns the JSON body of a revision of a document, and the revision's ID.  Like
+// GetRevWithHistory, but never includes attachment bodies, which means the body can be taken
+// from the revision cache without being unmarshalled.
+func (db *Database) GetRevJSONWithHistory(docid, revid string, maxHistory int, historyFrom []string, showExp bool) (bodyBytes []byte, revID string, err error) {
+	revision, requestedHistory, err := db.GetDocumentRevision(docid, revid, maxHistory, historyFrom)
+	if err != nil {
+		return nil, "", err
+	}
+	bodyBytes, err = InjectJSONProperties(revision.BodyBytes, revisionMetadata(revision, requestedHistory, showExp))
+	if err != nil {
+		return nil, "", err
+	}
+	return bodyBytes, revision.RevID, nil
+}
+
+// Returns a revision of a document from the revision cache, checking the user's access to it.  The
+// revid may be "", meaning the current revision.  maxHistory and historyFrom determine the requested
+// history returned alongside the revision, as for GetRevWithHistory; it's nil if maxHistory is 0.
+// If the user can't access a specific revision, it's returned without its body.
+func (db *Database) GetDocumentRevision(docid, revid string, maxHistory int, historyFrom []string) (revision DocumentRevision, requestedHistory Revisions, err error) {
 	revIDGiven := (revid != "")
 	if revIDGiven {
 		// Get a specific revision body and history from the revision cache
@@ -255,21 +316,18 @@ func (db *Database) GetRevWithHistory(docid, revid string, maxHistory int, histo
 	} else {
 		// No rev ID given, so load active revision
 		revision, err = db.revisionCache.GetActive(docid, db.DatabaseContext)
-		if revision.Body != nil {
-			revid = revision.RevID
-		}
 	}
 
-	if revision.Body == nil {
+	if revision.BodyBytes == nil {
 		if err == nil {
 			err = base.HTTPErrorf(404, "missing")
 		}
-		return nil, err
+		return DocumentRevision{}, nil, err
 	}
 
 	// RequestedHistory is the _revisions returned in the body.  Avoids mutating revision.History, in case it's needed
-	// during attachment processing below
-	requestedHistory := revision.History
+	// during attachment processing
+	requestedHistory = revision.History
 	if maxHistory == 0 {
 		requestedHistory = nil
 	}
@@ -281,62 +339,88 @@ func (db *Database) GetRevWithHistory(docid, revid string, maxHistory int, histo
 	if db.user != nil {
 		if err := db.user.AuthorizeAnyChannel(revision.Channels); err != nil {
 			if !revIDGiven {
-				return nil, base.HTTPErrorf(403, "forbidden")
+				return DocumentRevision{}, nil, base.HTTPErrorf(403, "forbidden")
 			}
 			// On access failure, return (only) the doc history and deletion/removal
 			// status instead of returning an error. For justification see the comment in
 			// the getRevFromDoc method, below
-			deleted, _ := revision.Body[BodyDeleted].(bool)
-			redactedBody := Body{BodyId: docid, BodyRev: revid}
-			if deleted {
-				redactedBody[BodyDeleted] = true
-			} else {
-				redactedBody["_removed"] = true
+			redacted := DocumentRevision{
+				DocID:     docid,
+				RevID:     revision.RevID,
+				BodyBytes: []byte("{}"),
+				History:   revision.History,
+				Deleted:   revision.Deleted,
+				Removed:   !revision.Deleted,
 			}
-			if requestedHistory != nil {
-				redactedBody[BodyRevisions] = requestedHistory
-			}
-			return redactedBody, nil
+			return redacted, requestedHistory, nil
 		}
 	}
 
-	if !revIDGiven {
-		if deleted, _ := revision.Body[BodyDeleted].(bool); deleted {
-			return nil, base.HTTPErrorf(404, "deleted")
-		}
+	if !revIDGiven && revision.Deleted {
+		return DocumentRevision{}, nil, base.HTTPErrorf(404, "deleted")
 	}
 
-	// Add revision metadata:
-	if requestedHistory != nil {
-		revision.Body[BodyRevisions] = requestedHistory
-	}
+	return revision, requestedHistory, nil
+}
 
-	if showExp && revision.Expiry != nil && !revision.Expiry.IsZero() {
-		revision.Body["_exp"] = revision.Expiry.Format(time.RFC3339)
+// Loads the documents of the given revisions that aren't in the revision cache with a single
+// multi-get, and adds the revisions to the cache, so that getting them afterwards doesn't read the
+// bucket again.  Does nothing with xattrs, which a multi-get can't read; the revisions are then
+// loaded individually when they're requested, as are any that couldn't be preloaded.  Only current
+// revisions are preloaded: any other needs a read of its old revision body, which is left to
+// whoever requests it, so that those reads can be made in parallel.
+func (db *DatabaseContext) PreloadRevisions(ids []IDAndRev) {
+	if db.UseXattrs() {
+		return
 	}
-
-	// Stamp attachment metadata back into the body
-	if revision.Attachments != nil {
-		revision.Body[BodyAttachments] = revision.Attachments
+	var keys []string
+	revids := make(map[string][]string)
+	for _, id := range ids {
+		if id.RevID == "" || realDocID(id.DocID) == "" || db.revisionCache.contains(id.DocID, id.RevID) {
+			continue
+		}
+		if _, found := revids[id.DocID]; !found {
+			keys = append(keys, id.DocID)
+		}
+		revids[id.DocID] = append(revids[id.DocID], id.RevID)
+	}
+	if len(keys) < 2 {
+		return
 	}
 
-	// Add attachment bodies if requested:
-	if attachmentsSince != nil && len(GetBodyAttachments(revision.Body)) > 0 {
-		minRevpos := 1
-		if len(attachmentsSince) > 0 {
-			ancestor := revision.History.findAncestor(attachmentsSince)
-			if ancestor != "" {
-				minRevpos, _ = ParseRevID(ancestor)
-				minRevpos++
-			}
+	results, err := db.Bucket.GetBulkRaw(keys)
+	if err != nil {
+		base.Infof(base.KeyCRUD, "Unable to preload %d docs, loading them individually: %v", len(keys), err)
+		return
+	}
+	for docid, data := range results {
+		doc, err := unmarshalDocument(docid, data)
+		if err != nil || !doc.HasValidSyncData(db.writeSequences()) {
+			continue
 		}
-		revision.Body, err = db.loadBodyAttachments(revision.Body, minRevpos, docid)
-		if err != nil {
-			return nil, err
+		for _, revid := range revids[docid] {
+			if revid == doc.CurrentRev {
+				_, _ = db.revisionCache.getForDoc(doc, revid, db)
+			}
 		}
 	}
+}
 
-	return revision.Body, nil
+// Returns the revision metadata to add to a revision's body: its IDs and deletion or removal
+// status, the requested history, expiry if showExp is set, and attachment metadata.
+func revisionMetadata(revision DocumentRevision, requestedHistory Revisions, showExp bool) Body {
+	metadata := revision.specialProperties()
+	if requestedHistory != nil {
+		metadata[BodyRevisions] = requestedHistory
+	}
+	if showExp && revision.Expiry != nil && !revision.Expiry.IsZero() {
+		metadata[BodyExpiry] = revision.Expiry.Format(time.RFC3339)
+	}
+	// Stamp attachment metadata back into the body
+	if revision.Attachments != nil {
+		metadata[BodyAttachments] = revision.Attachments
+	}
+	return metadata
 }
 
 // Returns the body of the active revision of a document, as well as the document's current channels
@@ -423,6 +507,24 @@ func (db *DatabaseContext) getRevision(doc *document, revid string) (Body, error
 	return body, nil
 }
 
+// Gets a revision of a document as JSON, for the revision cache.  Unlike getRevisionBodyJSON,
+// doesn't unmarshal or re-marshal the current revision's body if it's still raw.
+// Does not add _id or _rev properties.
+func (db *DatabaseContext) getRevisionJSON(doc *document, revid string) ([]byte, error) {
+	if revid == doc.CurrentRev {
+		if doc._body != nil || len(doc.rawBody) > 0 {
+			return doc.BodyBytes()
+		}
+	} else if bodyBytes, found := doc.History.getRevisionBody(revid, db.RevisionBodyLoader); found && len(bodyBytes) > 0 {
+		return bodyBytes, nil
+	}
+	// No inline body, so look for separate doc:
+	if !doc.History.contains(revid) {
+		return nil, base.HTTPErrorf(404, "missing")
+	}
+	return db.getOldRevisionJSON(doc.ID, revid)
+}
+
 // Gets a revision of a document as raw JSON.
 // If it's obsolete it will be loaded from the database if possible.
 // Does not add _id or _rev properties.
@@ -820,6 +922,9 @@ func (db *Database) updateAndReturnDoc(
 	if key == "" {
 		return nil, "", base.HTTPErrorf(400, "Invalid doc ID")
 	}
+	if db.IsReadOnly() {
+		return nil, "", base.ErrReadOnly
+	}
 
 	// Added annotation to the following variable declarations for reference during future refactoring of documentUpdateFunc into a standalone function
 	var doc *document                                // Passed to documentUpdateFunc as pointer, may be possible to define in documentUpdateFunc
@@ -904,11 +1009,16 @@ func (db *Database) updateAndReturnDoc(
 
 		// Run the sync function, to validate the update and compute its channels/access:
 		body[BodyId] = doc.ID
-		channelSet, access, roles, syncExpiry, oldBody, err := db.getChannelsAndAccess(doc, body, newRevID)
+		channelSet, access, roles, writeAccess, syncExpiry, oldBody, err := db.getChannelsAndAccess(doc, body, newRevID)
 		if err != nil {
 			return
 		}
 
+		// Enforce channel write permissions before anything is committed:
+		if err = db.authorizeWriteChannels(doc, channelSet); err != nil {
+			return
+		}
+
 		//Assign old revision body to variable in method scope
 		oldBodyJSON = oldBody
 
@@ -998,7 +1108,7 @@ func (db *Database) updateAndReturnDoc(
 				if curBody, err = db.getAvailableRev(doc, doc.CurrentRev); curBody != nil {
 					base.Debugf(base.KeyCRUD, "updateDoc(%q): Rev %q causes %q to become current again",
 						base.UD(docid), newRevID, doc.CurrentRev)
-					channelSet, access, roles, syncExpiry, oldBody, err = db.getChannelsAndAccess(doc, curBody, doc.CurrentRev)
+					channelSet, access, roles, writeAccess, syncExpiry, oldBody, err = db.getChannelsAndAccess(doc, curBody, doc.CurrentRev)
 
 					//Assign old revision body to variable in method scope
 					oldBodyJSON = oldBody
@@ -1012,6 +1122,7 @@ func (db *Database) updateAndReturnDoc(
 					channelSet = nil
 					access = nil
 					roles = nil
+					writeAccess = nil
 				}
 			}
 
@@ -1019,6 +1130,7 @@ func (db *Database) updateAndReturnDoc(
 			// (This uses the new sequence # so has to be done after updating doc.Sequence)
 			doc.updateChannels(channelSet) //FIX: Incorrect if new rev is not current!
 			changedPrincipals = doc.Access.updateAccess(doc, access)
+			changedPrincipals = base.MergeStringArrays(changedPrincipals, doc.WriteAccess.updateAccess(doc, writeAccess))
 			changedRoleUsers = doc.RoleAccess.updateAccess(doc, roles)
 
 			if len(changedPrincipals) > 0 || len(changedRoleUsers) > 0 {
@@ -1166,17 +1278,23 @@ func (db *Database) updateAndReturnDoc(
 			return nil, "", getHistoryErr
 		}
 
-		if doc.History[newRevID].Deleted {
+		deleted := doc.History[newRevID].Deleted
+		if deleted {
 			body[BodyDeleted] = true
 		}
 		revChannels := doc.History[newRevID].Channels
+		storedBodyBytes, marshalErr := revCacheBodyBytes(storedBody)
+		if marshalErr != nil {
+			return nil, "", marshalErr
+		}
 		documentRevision := DocumentRevision{
 			RevID:       newRevID,
-			Body:        storedBody,
+			BodyBytes:   storedBodyBytes,
 			History:     encodeRevisions(history),
 			Channels:    revChannels,
 			Attachments: doc.Attachments,
 			Expiry:      doc.Expiry,
+			Deleted:     deleted,
 		}
 		db.revisionCache.Put(doc.ID, documentRevision)
 
@@ -1217,7 +1335,7 @@ func (db *Database) MarkPrincipalsChanged(docid string, newRevID string, changed
 				// If role changed, check if active user has been granted the role
 				changedPrincipalName, isRole := channels.AccessNameToPrincipalName(changedAccessPrincipalName)
 				if isRole {
-					for roleName := range db.user.RoleNames() {
+					for roleName := range db.user.InheritedRoleNames() {
 						if roleName == changedPrincipalName {
 							base.Debugf(base.KeyAccess, "Active user belongs to role %q with modified channel access - user %q will be reloaded.", base.UD(roleName), base.UD(db.user.Name()))
 							reloadActiveUser = true
@@ -1286,6 +1404,9 @@ func (db *Database) DeleteDoc(docid string, revid string) (string, error) {
 // Purges a document from the bucket (no tombstone)
 func (db *Database) Purge(key string) error {
 
+	if db.IsReadOnly() {
+		return base.ErrReadOnly
+	}
 	if db.UseXattrs() {
 		return db.Bucket.DeleteWithXattr(key, KSyncXattrName)
 	} else {
@@ -1301,6 +1422,7 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string)
 	result base.Set,
 	access channels.AccessMap,
 	roles channels.AccessMap,
+	writeAccess channels.AccessMap,
 	expiry *uint32,
 	oldJson string,
 	err error) {
@@ -1322,6 +1444,7 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string)
 			result = output.Channels
 			access = output.Access
 			roles = output.Roles
+			writeAccess = output.WriteAccess
 			expiry = output.Expiry
 			err = output.Rejection
 			if err != nil {
@@ -1330,7 +1453,7 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string)
 				if isAccessError(err) {
 					db.DbStats.StatsSecurity().Add(base.StatKeyNumAccessErrors, 1)
 				}
-			} else if !validateAccessMap(access) || !validateRoleAccessMap(roles) {
+			} else if !validateAccessMap(access) || !validateRoleAccessMap(roles) || !validateAccessMap(writeAccess) {
 				err = base.HTTPErrorf(500, "Error in JS sync function")
 			}
 
@@ -1347,7 +1470,32 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string)
 			result, err = channels.SetFromArray(array, channels.KeepStar)
 		}
 	}
-	return result, access, roles, expiry, oldJson, err
+	return result, access, roles, writeAccess, expiry, oldJson, err
+}
+
+// When write access enforcement is enabled, verifies that the active user is allowed to write to every
+// channel the new revision is assigned to, as well as every channel the document currently belongs to
+// (so that a user can't remove a document from a channel they're only able to read).  Admin (nil user)
+// writes are always allowed.
+func (db *Database) authorizeWriteChannels(doc *document, newChannels base.Set) error {
+	if db.user == nil || !db.Options.EnforceWriteAccess {
+		return nil
+	}
+
+	currentChannels := make([]string, 0, len(doc.Channels))
+	for channel, removal := range doc.Channels {
+		if removal == nil {
+			currentChannels = append(currentChannels, channel)
+		}
+	}
+	requiredChannels := newChannels.Union(base.SetFromArray(currentChannels))
+	if err := db.user.AuthorizeWriteChannels(requiredChannels); err != nil {
+		base.Infof(base.KeyAccess, "User %q denied write of doc %q: %v", base.UD(db.user.Name()), base.UD(doc.ID), err)
+		db.DbStats.StatsSecurity().Add(base.StatKeyNumDocsRejected, 1)
+		db.DbStats.StatsSecurity().Add(base.StatKeyNumAccessErrors, 1)
+		return err
+	}
+	return nil
 }
 
 // Creates a userCtx object to be passed to the sync function
@@ -1356,9 +1504,10 @@ func makeUserCtx(user auth.User) map[string]interface{} {
 		return nil
 	}
 	return map[string]interface{}{
-		"name":     user.Name(),
-		"roles":    user.RoleNames(),
-		"channels": user.InheritedChannels().AllChannels(),
+		"name":           user.Name(),
+		"roles":          user.InheritedRoleNames(),
+		"channels":       user.InheritedChannels().AllChannels(),
+		"write_channels": user.InheritedWriteChannels().AllChannels(),
 	}
 }
 
@@ -1459,6 +1608,34 @@ func (context *DatabaseContext) ComputeVbSequenceChannelsForPrincipal(princ auth
 	return channelSet, nil
 }
 
+// Recomputes the set of channels a User/Role has been granted write access to by sync() functions.
+// This is part of the ChannelComputer interface defined by the Authenticator.
+func (context *DatabaseContext) ComputeWriteChannelsForPrincipal(princ auth.Principal) (channels.TimedSet, error) {
+	key := princ.Name()
+	if _, ok := princ.(auth.User); !ok {
+		key = channels.RoleAccessPrefix + key // Roles are identified in write_access view by a "role:" prefix
+	}
+
+	results, err := context.QueryWriteAccess(key)
+	if err != nil {
+		base.Warnf(base.KeyAll, "QueryWriteAccess returned error: %v", err)
+		return nil, err
+	}
+
+	var accessRow QueryAccessRow
+	channelSet := channels.TimedSet{}
+	for results.Next(&accessRow) {
+		channelSet.Add(accessRow.Value)
+	}
+
+	closeErr := results.Close()
+	if closeErr != nil {
+		return nil, closeErr
+	}
+
+	return channelSet, nil
+}
+
 // Recomputes the set of channels a User/Role has been granted access to by sync() functions.
 // This is part of the ChannelComputer interface defined by the Authenticator.
 func (context *DatabaseContext) ComputeRolesForUser(user auth.User) (channels.TimedSet, error) {
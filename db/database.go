@@ -15,6 +15,7 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -32,6 +33,7 @@ const (
 	DBOnline
 	DBStopping
 	DBResyncing
+	DBReadOnly // Online, but rejecting document writes
 )
 
 var RunStateString = []string{
@@ -40,8 +42,27 @@ var RunStateString = []string{
 	DBOnline:    "Online",
 	DBStopping:  "Stopping",
 	DBResyncing: "Resyncing",
+	DBReadOnly:  "ReadOnly",
 }
 
+// Default time that clients are asked to wait before retrying writes to a read-only database
+const DefaultReadOnlyRetryAfter = 60 * time.Second
+
+// Key of the document recording that a database is read-only, so that every node sharing the
+// bucket is, including after a restart or reload.  Nodes learn of changes to it from the feed.
+const readOnlyStateKey = KSyncKeyPrefix + "readOnly"
+
+type readOnlyStateDoc struct {
+	RetryAfter int64 `json:"retry_after"` // Seconds clients should wait before retrying writes
+}
+
+// Default max number of docs of a _bulk_docs or _bulk_get request processed in parallel.  Before
+// getting them, _bulk_get preloads the requested revisions with a single multi-get (see
+// PreloadRevisions), with two limits: nothing is preloaded with xattrs (shared bucket access), as
+// a multi-get can't read them, and revisions that aren't the current one are left to be read from
+// their old revision bodies.  In both cases bulk_concurrency is the only parallelism.
+const DefaultBulkConcurrency = 8
+
 const (
 	DefaultRevsLimit     = 1000
 	DefaultPurgeInterval = 30               // Default metadata purge interval, in days.  Used if server's purge interval is unavailable
@@ -79,6 +100,9 @@ type DatabaseContext struct {
 	PurgeInterval      int                     // Metadata purge interval, in hours
 	serverUUID         string                  // UUID of the server, if available
 	DbStats            *DatabaseStats          // stats that correspond to this database context
+	importPartitions   *importPartitions       // Vbuckets whose mutations this node imports
+	deferredImports    deferredImports         // Feed imports rejected while the database was read-only
+	readOnlyRetryAfter int64                   // Time clients should wait before retrying writes while read-only, in ns; accessed atomically
 }
 
 type DatabaseContextOptions struct {
@@ -86,6 +110,8 @@ type DatabaseContextOptions struct {
 	IndexOptions              *ChannelIndexOptions
 	SequenceHashOptions       *SequenceHashOptions
 	RevisionCacheCapacity     uint32
+	RevisionCacheShardCount   uint16 // Number of shards the revision cache is split into; 0 for the default
+	RevisionCacheMaxBytes     int64  // Max total size of the revision cache's bodies; 0 for no limit
 	OldRevExpirySeconds       uint32
 	AdminInterface            *string
 	UnsupportedOptions        UnsupportedOptions
@@ -99,6 +125,15 @@ type DatabaseContextOptions struct {
 	AllowConflicts            *bool  // False forbids creating conflicts
 	SendWWWAuthenticateHeader *bool  // False disables setting of 'WWW-Authenticate' header
 	UseViews                  bool   // Force use of views
+	EnforceWriteAccess        bool   // Reject user writes to channels the user hasn't been granted write access to
+	AllowSelfService          bool   // Allow users to manage their own password, email and sessions via the public API
+	PasswordPolicy            *auth.PasswordPolicy
+	SessionOptions            *auth.SessionOptions
+	MemoryGovernor            *MemoryGovernor // Node-wide budget for cache memory; nil for no limit
+	BackfillConcurrency       int             // Max number of channel queries run in parallel by a changes feed; 0 for the default
+	CombinedQueryMinChannels  int             // Min number of uncached channels a changes feed queries at once; 0 to always query them separately
+	MaxSequenceBatchSize      uint64          // Max number of sequences reserved from the counter at once; 0 for the default
+	BulkConcurrency           int             // Max number of docs of a bulk request processed in parallel; 0 for the default
 }
 
 type OidcTestProviderOptions struct {
@@ -178,6 +213,15 @@ func ConnectToBucket(spec base.BucketSpec, callback sgbucket.BucketNotifyFn) (bu
 	return ibucket.(base.Bucket), nil
 }
 
+func (options *DatabaseContextOptions) revisionCacheOptions() *RevisionCacheOptions {
+	return &RevisionCacheOptions{
+		Size:       options.RevisionCacheCapacity,
+		ShardCount: options.RevisionCacheShardCount,
+		MaxBytes:   options.RevisionCacheMaxBytes,
+		Governor:   options.MemoryGovernor,
+	}
+}
+
 // Function type for something that calls NewDatabaseContext and wants a callback when the DB is detected
 // to come back online. A rest.ServerContext package cannot be passed since it would introduce a circular dependency
 type DBOnlineCallback func(dbContext *DatabaseContext)
@@ -201,10 +245,12 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 		autoImport: autoImport,
 		Options:    options,
 		DbStats:    dbStats,
+
+		importPartitions: newImportPartitions(),
 	}
 
-	context.revisionCache = NewRevisionCache(
-		options.RevisionCacheCapacity,
+	context.revisionCache = NewShardedRevisionCache(
+		options.revisionCacheOptions(),
 		context.revCacheLoader,
 		context.DbStats.StatsCache(),
 	)
@@ -216,6 +262,10 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 	if err != nil {
 		return nil, err
 	}
+	context.sequences.setMaxBatchSize(options.MaxSequenceBatchSize)
+	if options.CacheOptions != nil {
+		context.sequences.setPendingSeqMaxWait(options.CacheOptions.CachePendingSeqMaxWait)
+	}
 
 	if options.IndexOptions == nil {
 		// In-memory channel cache
@@ -249,11 +299,14 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 
 	// Initialize the tap Listener for notify handling
 	context.mutationListener.Init(bucket.GetName())
+	context.mutationListener.stats = dbStats.StatsDatabase()
 
 	// If this is an xattr import node, resume DCP feed where we left off.  Otherwise only listen for new changes (FeedNoBackfill)
 	feedMode := uint64(sgbucket.FeedNoBackfill)
 	if context.UseXattrs() && context.autoImport {
 		feedMode = sgbucket.FeedResume
+		// Each vbucket's checkpoint is persisted by the node importing it
+		context.mutationListener.persistCheckpoint = context.importPartitions.owns
 	}
 
 	// If not using channel index or using channel index and tracking docs, start the tap feed
@@ -483,16 +536,25 @@ func (context *DatabaseContext) UseGlobalSequence() bool {
 	return context.SequenceType != ClockSequenceType
 }
 
-func (context *DatabaseContext) TapListener() changeListener {
-	return context.mutationListener
+func (context *DatabaseContext) TapListener() *changeListener {
+	return &context.mutationListener
+}
+
+// Returns the state of the database's mutation feed (TAP or DCP).
+func (context *DatabaseContext) FeedStatus() ChangeFeedStatus {
+	return context.mutationListener.FeedStatus()
 }
 
 func (context *DatabaseContext) Close() {
+	// Releasing unused sequences writes to the bucket, so is done before locking it
+	context.sequences.stop()
+
 	context.BucketLock.Lock()
 	defer context.BucketLock.Unlock()
 
 	context.mutationListener.Stop()
 	context.changeCache.Stop()
+	context.Options.MemoryGovernor.unregister(context.revisionCache)
 	context.Shadower.Stop()
 	context.Bucket.Close()
 	context.Bucket = nil
@@ -540,9 +602,7 @@ func (context *DatabaseContext) RemoveObsoleteIndexes(previewOnly bool) (removed
 	return removeObsoleteIndexes(context.Bucket, previewOnly, context.UseXattrs())
 }
 
-// Trigger terminate check handling for connected continuous replications.
-// TODO: The underlying code (NotifyCheckForTermination) doesn't actually leverage the specific username - should be refactored
-//    to remove
+// Trigger terminate check handling for the user's connected continuous replications.
 func (context *DatabaseContext) NotifyTerminatedChanges(username string) {
 	context.mutationListener.NotifyCheckForTermination(base.SetOf(auth.UserKeyPrefix + username))
 }
@@ -556,7 +616,7 @@ func (dc *DatabaseContext) TakeDbOffline(reason string) error {
 		return nil
 	}
 
-	if atomic.CompareAndSwapUint32(&dc.State, DBOnline, DBStopping) {
+	if atomic.CompareAndSwapUint32(&dc.State, DBOnline, DBStopping) || atomic.CompareAndSwapUint32(&dc.State, DBReadOnly, DBStopping) {
 
 		//notify all active _changes feeds to close
 		close(dc.ExitChanges)
@@ -580,6 +640,114 @@ func (dc *DatabaseContext) TakeDbOffline(reason string) error {
 	}
 }
 
+// Puts an online database into read-only mode, for maintenance such as bucket migrations.  Reads,
+// changes feeds and replication pulls continue to be served, but document writes, including
+// imports, are rejected with ErrReadOnly until the database is taken online again.  The state is
+// recorded in the bucket, so that it applies to every node.
+func (dc *DatabaseContext) TakeDbReadOnly(reason string, retryAfter time.Duration) error {
+	if state := atomic.LoadUint32(&dc.State); state != DBOnline && state != DBReadOnly {
+		msg := "Unable to make Database read-only, database must be in Online state"
+		base.Infof(base.KeyCRUD, msg)
+		return base.HTTPErrorf(http.StatusServiceUnavailable, msg)
+	}
+
+	stateDoc := readOnlyStateDoc{RetryAfter: int64(retryAfter / time.Second)}
+	if err := dc.Bucket.Set(readOnlyStateKey, 0, stateDoc); err != nil {
+		return err
+	}
+	dc.setReadOnly(reason, retryAfter)
+	return nil
+}
+
+// Allows writes to a read-only database again, on every node.
+func (dc *DatabaseContext) EndDbReadOnly(reason string) error {
+	if !dc.IsReadOnly() {
+		msg := "Unable to make Database writable, database must be in ReadOnly state"
+		base.Infof(base.KeyCRUD, msg)
+		return base.HTTPErrorf(http.StatusServiceUnavailable, msg)
+	}
+
+	if err := dc.Bucket.Delete(readOnlyStateKey); err != nil && !base.IsDocNotFoundError(err) {
+		return err
+	}
+	dc.endReadOnly(reason)
+	return nil
+}
+
+// Makes this node's database read-only, if it's online.  If it's already read-only, only the retry
+// time is updated.
+func (dc *DatabaseContext) setReadOnly(reason string, retryAfter time.Duration) {
+	atomic.StoreInt64(&dc.readOnlyRetryAfter, int64(retryAfter))
+	if !atomic.CompareAndSwapUint32(&dc.State, DBOnline, DBReadOnly) {
+		return
+	}
+
+	base.Infof(base.KeyCRUD, "Database %v is read-only: %s", base.MD(dc.Name), reason)
+	if dc.EventMgr.HasHandlerForEvent(DBStateChange) {
+		dc.EventMgr.RaiseDBStateChangeEvent(dc.Name, "readonly", reason, *dc.Options.AdminInterface)
+	}
+}
+
+// Makes this node's database writable, if it's read-only, and imports the documents whose import
+// was rejected meanwhile.
+func (dc *DatabaseContext) endReadOnly(reason string) {
+	if !atomic.CompareAndSwapUint32(&dc.State, DBReadOnly, DBOnline) {
+		return
+	}
+
+	base.Infof(base.KeyCRUD, "Database %v is writable again: %s", base.MD(dc.Name), reason)
+	if dc.EventMgr.HasHandlerForEvent(DBStateChange) {
+		dc.EventMgr.RaiseDBStateChangeEvent(dc.Name, "online", reason, *dc.Options.AdminInterface)
+	}
+
+	if docIDs := dc.deferredImports.take(); len(docIDs) > 0 {
+		base.Infof(base.KeyImport, "Importing %d documents whose import was deferred while the database was read-only", len(docIDs))
+		dc.importInBackground(docIDs)
+	}
+}
+
+// Applies a change to the read-only state document, received from the feed.
+func (dc *DatabaseContext) readOnlyStateChanged(docJSON []byte, deleted bool) {
+	if deleted {
+		dc.endReadOnly("Read-only state removed from bucket")
+		return
+	}
+	var stateDoc readOnlyStateDoc
+	if err := json.Unmarshal(docJSON, &stateDoc); err != nil {
+		base.Warnf(base.KeyAll, "Unable to read the read-only state of database %v: %v", base.MD(dc.Name), err)
+		return
+	}
+	dc.setReadOnly("Read-only state recorded in bucket", time.Duration(stateDoc.RetryAfter)*time.Second)
+}
+
+// Returns true if the database has been made read-only, as recorded in the bucket, and restores its
+// retry time.  Used when the database is loaded, to decide its initial state.
+func (dc *DatabaseContext) LoadReadOnlyState() bool {
+	var stateDoc readOnlyStateDoc
+	if _, err := dc.Bucket.Get(readOnlyStateKey, &stateDoc); err != nil {
+		if !base.IsDocNotFoundError(err) {
+			base.Warnf(base.KeyAll, "Unable to read the read-only state of database %v: %v", base.MD(dc.Name), err)
+		}
+		return false
+	}
+	atomic.StoreInt64(&dc.readOnlyRetryAfter, int64(time.Duration(stateDoc.RetryAfter)*time.Second))
+	return true
+}
+
+// Returns true if the database is rejecting document writes.
+func (dc *DatabaseContext) IsReadOnly() bool {
+	return atomic.LoadUint32(&dc.State) == DBReadOnly
+}
+
+// Returns the time clients should wait before retrying writes rejected because the database is
+// read-only.
+func (dc *DatabaseContext) ReadOnlyRetryAfter() time.Duration {
+	if retryAfter := atomic.LoadInt64(&dc.readOnlyRetryAfter); retryAfter > 0 {
+		return time.Duration(retryAfter)
+	}
+	return DefaultReadOnlyRetryAfter
+}
+
 func (context *DatabaseContext) Authenticator() *auth.Authenticator {
 	context.BucketLock.RLock()
 	defer context.BucketLock.RUnlock()
@@ -589,6 +757,8 @@ func (context *DatabaseContext) Authenticator() *auth.Authenticator {
 	if context.Options.SessionCookieName != "" {
 		authenticator.SetSessionCookieName(context.Options.SessionCookieName)
 	}
+	authenticator.SetPasswordPolicy(context.Options.PasswordPolicy)
+	authenticator.SetSessionOptions(context.Options.SessionOptions)
 	return authenticator
 }
 
@@ -782,6 +952,51 @@ func (db *DatabaseContext) DeleteUserSessions(userName string) error {
 	return results.Close()
 }
 
+// Creates a login session for a user.  If the user already has the maximum number of concurrent
+// sessions allowed by the session options, their oldest sessions are deleted first.
+func (db *DatabaseContext) CreateUserSession(userName string, ttl time.Duration) (*auth.LoginSession, error) {
+	if db.Options.SessionOptions != nil && db.Options.SessionOptions.MaxPerUser > 0 {
+		sessions, err := db.GetUserSessions(userName)
+		if err != nil {
+			return nil, err
+		}
+		// Sessions created before creation times were recorded sort first, as they're the oldest
+		sort.Slice(sessions, func(i, j int) bool {
+			return sessions[i].Created.Before(sessions[j].Created)
+		})
+		for len(sessions) >= db.Options.SessionOptions.MaxPerUser {
+			base.Infof(base.KeyAuth, "Evicting oldest session for user %s, who has reached the maximum of %d sessions",
+				base.UD(userName), db.Options.SessionOptions.MaxPerUser)
+			if err := db.Authenticator().DeleteSession(sessions[0].ID); err != nil && !base.IsDocNotFoundError(err) {
+				return nil, err
+			}
+			sessions = sessions[1:]
+		}
+	}
+	return db.Authenticator().CreateSession(userName, ttl)
+}
+
+// Returns the login sessions belonging to a user
+func (db *DatabaseContext) GetUserSessions(userName string) ([]*auth.LoginSession, error) {
+
+	results, err := db.QuerySessions(userName)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*auth.LoginSession, 0)
+	var sessionsRow QueryIdRow
+	for results.Next(&sessionsRow) {
+		session, err := db.Authenticator().GetSession(strings.TrimPrefix(sessionsRow.Id, auth.SessionKeyPrefix))
+		if err != nil {
+			base.Warnf(base.KeyAll, "Error getting session %q: %v", base.UD(sessionsRow.Id), err)
+		} else if session != nil {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, results.Close()
+}
+
 // Trigger tombstone compaction from view and/or GSI indexes.  Several Sync Gateway indexes server tombstones (deleted documents with an xattr).
 // There currently isn't a mechanism for server to remove these docs from the index when the tombstone is purged by the server during
 // metadata purge, because metadata purge doesn't trigger a DCP event.
@@ -940,11 +1155,12 @@ func (db *Database) UpdateAllDocChannels() (int, error) {
 			changed := 0
 			doc.History.forEachLeaf(func(rev *RevInfo) {
 				body, _ := db.getRevFromDoc(doc, rev.ID, false)
-				channels, access, roles, syncExpiry, _, err := db.getChannelsAndAccess(doc, body, rev.ID)
+				channels, access, roles, writeAccess, syncExpiry, _, err := db.getChannelsAndAccess(doc, body, rev.ID)
 				if err != nil {
 					// Probably the validator rejected the doc
 					base.Warnf(base.KeyAll, "Error calling sync() on doc %q: %v", base.UD(docid), err)
 					access = nil
+					writeAccess = nil
 					channels = nil
 				}
 				rev.Channels = channels
@@ -952,6 +1168,7 @@ func (db *Database) UpdateAllDocChannels() (int, error) {
 				if rev.ID == doc.CurrentRev {
 					changed = len(doc.Access.updateAccess(doc, access)) +
 						len(doc.RoleAccess.updateAccess(doc, roles)) +
+						len(doc.WriteAccess.updateAccess(doc, writeAccess)) +
 						len(doc.updateChannels(channels))
 					// Only update document expiry based on the current (active) rev
 					if syncExpiry != nil {
@@ -1122,8 +1339,9 @@ func (context *DatabaseContext) SetUserViewsEnabled(value bool) {
 // For test usage
 func (context *DatabaseContext) FlushRevisionCache() {
 
-	context.revisionCache = NewRevisionCache(
-		context.Options.RevisionCacheCapacity,
+	context.Options.MemoryGovernor.unregister(context.revisionCache)
+	context.revisionCache = NewShardedRevisionCache(
+		context.Options.revisionCacheOptions(),
 		context.revCacheLoader,
 		context.DbStats.StatsCache(),
 	)
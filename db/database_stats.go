@@ -111,13 +111,23 @@ func initEmptyStatsMap(key string) *expvar.Map {
 		result.Set(base.StatKeyOldRevsDocMisses, base.ExpvarIntVal(0))
 		result.Set(base.StatKeySequenceGets, base.ExpvarIntVal(0))
 		result.Set(base.StatKeySequenceReserves, base.ExpvarIntVal(0))
+		result.Set(base.StatKeySequenceReservedCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeySequenceAssignedCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeySequenceReleasedCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeySequenceReleaseErrors, base.ExpvarIntVal(0))
+		result.Set(base.StatKeySequenceBatchSize, base.ExpvarIntVal(1))
 		result.Set(base.StatKeyAbandonedSeqs, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyCrc32cMatchCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyChangesWakeups, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyChangesSpuriousWakeups, base.ExpvarIntVal(0))
 	case base.StatsGroupKeyDeltaSync:
 		result.Set(base.StatKeyNetBandwidthSavings, base.ExpvarFloatVal(0))
 		result.Set(base.StatKeyDeltaHitRatio, base.ExpvarFloatVal(0))
 	case base.StatsGroupKeySharedBucketImport:
 		result.Set(base.StatKeyImportBacklog, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyImportPartitions, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyImportPending, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyImportTakeoverCount, base.ExpvarIntVal(0))
 	case base.StatsGroupKeyCblReplicationPush:
 		result.Set(base.StatKeyWriteProcessingTime, base.ExpvarFloatVal(0))
 		result.Set(base.StatKeySyncTime, base.ExpvarFloatVal(0))
@@ -1146,6 +1146,53 @@ func TestAccessFunctionDb(t *testing.T) {
 	goassert.DeepEquals(t, user.InheritedChannels(), expected)
 }
 
+func TestWriteAccessEnforcement(t *testing.T) {
+
+	db, testBucket := setupTestDBWithCacheOptions(t, CacheOptions{})
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	db.Options.EnforceWriteAccess = true
+	authenticator := auth.NewAuthenticator(db.Bucket, db)
+
+	var err error
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc){channel(doc.channels); writeAccess(doc.writers, doc.writeChannels);}`)
+
+	// Admin write granting naomi write access to the drafts channel
+	body := Body{"writers": []string{"naomi"}, "writeChannels": []string{"drafts"}}
+	_, err = db.Put("grantDoc", body)
+	assert.NoError(t, err, "")
+
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("drafts", "published"))
+	user.SetExplicitWriteChannels(channels.AtSequence(channels.SetOf("notes"), 1))
+	assert.NoError(t, authenticator.Save(user), "Save")
+
+	user, err = authenticator.GetUser("naomi")
+	assert.NoError(t, err, "GetUser")
+	goassert.DeepEquals(t, user.WriteChannels().AsSet(), channels.SetOf("drafts", "notes"))
+	db.user = user
+
+	// Writes to channels with write access succeed
+	body = Body{"channels": []string{"drafts", "notes"}}
+	rev1, err := db.Put("doc1", body)
+	assert.NoError(t, err, "")
+
+	// Read access alone isn't sufficient to write
+	body = Body{"channels": []string{"published"}}
+	_, err = db.Put("doc2", body)
+	assertHTTPError(t, err, 403)
+
+	// Can't move a doc out of a channel without write access to it
+	db.user = nil
+	body = Body{BodyRev: rev1, "channels": []string{"published"}}
+	rev2, err := db.Put("doc1", body)
+	assert.NoError(t, err, "")
+	db.user = user
+	body = Body{BodyRev: rev2, "channels": []string{"drafts"}}
+	_, err = db.Put("doc1", body)
+	assertHTTPError(t, err, 403)
+}
+
 // Disabled until https://github.com/couchbase/sync_gateway/issues/3413 is fixed
 func TestAccessFunctionWithVbuckets(t *testing.T) {
 
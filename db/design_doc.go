@@ -17,14 +17,14 @@ import (
 // ViewVersion should be incremented every time any view definition changes.
 // Currently both Sync Gateway design docs share the same view version, but this is
 // subject to change if the update schedule diverges
-const DesignDocVersion = "2.1"
+const DesignDocVersion = "2.2"
 const DesignDocFormat = "%s_%s" // Design doc prefix, view version
 
 // DesignDocPreviousVersions defines the set of versions included during removal of obsolete
 // design docs.  Must be updated whenever DesignDocVersion is incremented.
 // Uses a hardcoded list instead of version comparison to simpify the processing
 // (particularly since there aren't expected to be many view versions before moving to GSI).
-var DesignDocPreviousVersions = []string{""}
+var DesignDocPreviousVersions = []string{"", "2.1"}
 
 const (
 	DesignDocSyncGatewayPrefix      = "sync_gateway"
@@ -35,6 +35,7 @@ const (
 	ViewAccessVbSeq                 = "access_vbseq"
 	ViewRoleAccess                  = "role_access"
 	ViewRoleAccessVbSeq             = "role_access_vbseq"
+	ViewWriteAccess                 = "write_access"
 	ViewAllDocs                     = "all_docs"
 	ViewImport                      = "import"
 	ViewSessions                    = "sessions"
@@ -467,6 +468,21 @@ func installViews(bucket base.Bucket) error {
 		               }`
 	access_vbSeq_map = fmt.Sprintf(access_vbSeq_map, syncData)
 
+	// Channel write access view, used by ComputeWriteChannelsForPrincipal()
+	// Key is username; value is dictionary channelName->firstSequence (compatible with TimedSet)
+	writeAccess_map := `function (doc, meta) {
+	                    %s
+	                    if (sync === undefined || meta.id.substring(0,6) == "_sync:")
+	                        return;
+	                    var access = sync.write_access;
+	                    if (access) {
+	                        for (var name in access) {
+	                            emit(name, access[name]);
+	                        }
+	                    }
+	               }`
+	writeAccess_map = fmt.Sprintf(writeAccess_map, syncData)
+
 	// Role access view, used by ComputeRolesForUser()
 	// Key is username; value is array of role names
 	roleAccess_map := `function (doc, meta) {
@@ -515,6 +531,7 @@ func installViews(bucket base.Bucket) error {
 			ViewRoleAccess:      sgbucket.ViewDef{Map: roleAccess_map},
 			ViewAccessVbSeq:     sgbucket.ViewDef{Map: access_vbSeq_map},
 			ViewRoleAccessVbSeq: sgbucket.ViewDef{Map: roleAccess_vbSeq_map},
+			ViewWriteAccess:     sgbucket.ViewDef{Map: writeAccess_map},
 			ViewPrincipals:      sgbucket.ViewDef{Map: principals_map},
 		},
 		Options: &sgbucket.DesignDocOptions{
@@ -56,6 +56,7 @@ type syncData struct {
 	Channels        channels.ChannelMap `json:"channels,omitempty"`
 	Access          UserAccessMap       `json:"access,omitempty"`
 	RoleAccess      UserAccessMap       `json:"role_access,omitempty"`
+	WriteAccess     UserAccessMap       `json:"write_access,omitempty"`
 	Expiry          *time.Time          `json:"exp,omitempty"`           // Document expiry.  Information only - actual expiry/delete handling is done by bucket storage.  Needs to be pointer for omitempty to work (see https://github.com/golang/go/issues/4357)
 	Cas             string              `json:"cas"`                     // String representation of a cas value, populated via macro expansion
 	Crc32c          string              `json:"value_crc32c"`            // String representation of crc32c hash of doc body, populated via macro expansion
@@ -115,6 +116,15 @@ func (doc *document) Body() Body {
 	return doc._body
 }
 
+// Returns the body of the current revision as JSON.  If the body hasn't been unmarshalled, the raw
+// body is returned as-is, and must not be modified.
+func (doc *document) BodyBytes() ([]byte, error) {
+	if doc._body == nil && doc.rawBody != nil {
+		return doc.rawBody, nil
+	}
+	return doc.MarshalBody()
+}
+
 func (doc *document) RemoveBody() {
 	doc._body = nil
 	doc.rawBody = nil
@@ -677,6 +687,8 @@ func (accessMap *UserAccessMap) updateAccess(doc *document, newAccess channels.A
 		what := "channel"
 		if accessMap == &doc.RoleAccess {
 			what = "role"
+		} else if accessMap == &doc.WriteAccess {
+			what = "channel write"
 		}
 		base.Infof(base.KeyAccess, "Doc %q grants %s access: %v", base.UD(doc.ID), what, base.UD(*accessMap))
 	}
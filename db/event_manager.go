@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/couchbase/sync_gateway/base"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,6 +12,7 @@ import (
 // eventChannel to minimize time spent blocking whatever process is raising the event.
 // The event queue worker goroutine works the event channel and sends events to the appropriate handlers
 type EventManager struct {
+	pendingEvents      int64 // Number of async events queued or being processed; accessed atomically.  First for 64-bit alignment.
 	activeEventTypes   map[EventType]bool
 	eventHandlers      map[EventType][]EventHandler
 	asyncEventChannel  chan Event
@@ -67,7 +69,10 @@ func (em *EventManager) Start(maxProcesses uint, waitTime int) {
 
 // Concurrent processing of all async event handlers registered for the event type
 func (em *EventManager) ProcessEvent(event Event) {
-	defer func() { <-em.activeCountChannel }()
+	defer func() {
+		<-em.activeCountChannel
+		atomic.AddInt64(&em.pendingEvents, -1)
+	}()
 	// Send event to all registered handlers concurrently.  WaitGroup blocks
 	// until all are finished
 	var wg sync.WaitGroup
@@ -84,6 +89,19 @@ func (em *EventManager) ProcessEvent(event Event) {
 	wg.Wait()
 }
 
+// Waits until all queued async events have been processed, or the timeout has passed.  Returns
+// false if events were still pending at the timeout.
+func (em *EventManager) Flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&em.pendingEvents) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
 // Register a new event handler to the EventManager.  The event manager will route events of
 // type eventType to the handler.
 func (em *EventManager) RegisterEventHandler(handler EventHandler, eventType EventType) {
@@ -102,10 +120,12 @@ func (em *EventManager) raiseEvent(event Event) error {
 	if !event.Synchronous() {
 		// When asyncEventChannel is full, the raiseEvent method will block for (waitTime).
 		// Default value of (waitTime) is 5 ms.
+		atomic.AddInt64(&em.pendingEvents, 1)
 		select {
 		case em.asyncEventChannel <- event:
 		case <-time.After(time.Duration(em.waitTime) * time.Millisecond):
 			// Event queue channel is full - ignore event and log error
+			atomic.AddInt64(&em.pendingEvents, -1)
 			base.Warnf(base.KeyAll, "Event queue full - discarding event: %s", base.UD(event.String()))
 			return errors.New("Event queue full")
 		}
@@ -1,10 +1,10 @@
 package db
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
+	"sync"
 
 	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
@@ -20,6 +20,50 @@ const (
 	ImportOnDemand                    // On-demand import. Reattempt import on cas write failure of the imported doc until either the import succeeds, or existing doc is an SG write.
 )
 
+// Documents whose import from the feed was rejected because the database was read-only.  The feed
+// has moved past their mutations, so they're imported when the database is writable again.
+type deferredImports struct {
+	lock   sync.Mutex
+	docIDs map[string]struct{}
+}
+
+// Records a document to import later.  Returns false if too many are already recorded.
+func (d *deferredImports) add(docID string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.docIDs == nil {
+		d.docIDs = map[string]struct{}{}
+	}
+	if _, found := d.docIDs[docID]; !found && len(d.docIDs) >= kMaxPendingImports {
+		return false
+	}
+	d.docIDs[docID] = struct{}{}
+	return true
+}
+
+// Returns the documents to import, and forgets them.
+func (d *deferredImports) take() (docIDs []string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for docID := range d.docIDs {
+		docIDs = append(docIDs, docID)
+	}
+	d.docIDs = nil
+	return docIDs
+}
+
+// Imports the given documents in a goroutine, if they haven't been imported already.
+func (context *DatabaseContext) importInBackground(docIDs []string) {
+	go func() {
+		for _, docID := range docIDs {
+			// Reading the document imports it, if it hasn't been imported already
+			if _, err := context.GetDocument(docID, DocUnmarshalSync); err != nil {
+				base.Debugf(base.KeyImport, "Did not import doc %q awaiting import: %v", base.UD(docID), err)
+			}
+		}
+	}()
+}
+
 // Imports a document that was written by someone other than sync gateway, given the existing state of the doc in raw bytes
 func (db *Database) ImportDocRaw(docid string, value []byte, xattrValue []byte, isDelete bool, cas uint64, expiry *uint32, mode ImportMode) (docOut *document, err error) {
 
@@ -310,11 +354,20 @@ func (db *Database) backupPreImportRevision(docid, revid string) error {
 		return fmt.Errorf("Cache error: %v", err)
 	}
 
-	if previousRev.Body == nil {
+	if previousRev.BodyBytes == nil {
 		return nil
 	}
 
-	bodyJson, marshalErr := json.Marshal(stripSpecialProperties(previousRev.Body))
+	// The cached body is shared with the cache, and setOldRevisionJSON modifies the body it's given,
+	// so it's copied
+	properties := Body{}
+	if previousRev.Deleted {
+		properties[BodyDeleted] = true
+	}
+	if previousRev.Attachments != nil {
+		properties[BodyAttachments] = previousRev.Attachments
+	}
+	bodyJson, marshalErr := InjectJSONProperties(append([]byte(nil), previousRev.BodyBytes...), properties)
 	if marshalErr != nil {
 		return fmt.Errorf("Marshal error: %v", marshalErr)
 	}
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// When several nodes import documents from the same bucket, the bucket's vbuckets are partitioned
+// between them, and each node only imports the mutations in its own vbuckets.  Every node still
+// receives the whole mutation feed, since it's needed for caching.
+//
+// Until partitions are assigned, a node imports every mutation.  A node also remembers the
+// documents it has seen written in other nodes' vbuckets and not yet imported by them, so that if
+// one of those vbuckets is reassigned to it, because its owner has gone away, it can import them.
+// DCP checkpoints are only persisted for the vbuckets a node owns.  If too many documents are
+// awaiting import by other nodes to remember another, the node imports it itself instead, since it
+// couldn't import it on taking over the vbucket.
+//
+// A document the owner doesn't write back, because its import filter rejected it or it was deleted
+// before ever being imported, is forgotten once it has been awaiting import for longer than it
+// takes a departed owner's vbuckets to be reassigned.  By then either the owner has handled it, or
+// a node has already taken over the vbucket.
+//
+// Partitions are assigned from the node registry kept up to date by the node heartbeat (see
+// node_heartbeat_interval_secs), so with the heartbeat disabled, every node imports every mutation.
+
+// Maximum number of documents remembered as awaiting import by other nodes
+const kMaxPendingImports = 100000
+
+type importPartitions struct {
+	lock         sync.RWMutex
+	partitioned  bool                            // False until partitions are assigned, when every vbucket is imported
+	owned        map[uint16]bool                 // Vbuckets whose mutations this node imports
+	pendingLock  sync.Mutex                      // Protects the fields below
+	pending      map[uint16]map[string]time.Time // Docs in other nodes' vbuckets awaiting import, by vbucket, with when they were last written
+	pendingCount int
+}
+
+func newImportPartitions() *importPartitions {
+	return &importPartitions{
+		owned:   map[uint16]bool{},
+		pending: map[uint16]map[string]time.Time{},
+	}
+}
+
+// Returns true if this node imports mutations in the given vbucket.
+func (p *importPartitions) owns(vbNo uint16) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return !p.partitioned || p.owned[vbNo]
+}
+
+// Returns true if this node should import a mutation of a document.  If the document's vbucket is
+// owned by another node, it's remembered until the other node imports it, or imported by this node
+// too if there are already too many to remember.
+func (p *importPartitions) shouldImport(vbNo uint16, docID string) bool {
+	if p.owns(vbNo) {
+		return true
+	}
+	p.pendingLock.Lock()
+	defer p.pendingLock.Unlock()
+	docs := p.pending[vbNo]
+	if docs == nil {
+		docs = map[string]time.Time{}
+		p.pending[vbNo] = docs
+	}
+	if _, found := docs[docID]; !found {
+		if p.pendingCount >= kMaxPendingImports {
+			base.Debugf(base.KeyImport, "Too many documents awaiting import by other nodes, importing %s locally", base.UD(docID))
+			return true
+		}
+		p.pendingCount++
+	}
+	docs[docID] = time.Now()
+	return false
+}
+
+// Records that a document has been imported, or written by Sync Gateway.
+func (p *importPartitions) imported(vbNo uint16, docID string) {
+	p.pendingLock.Lock()
+	defer p.pendingLock.Unlock()
+	if _, found := p.pending[vbNo][docID]; found {
+		delete(p.pending[vbNo], docID)
+		p.pendingCount--
+	}
+}
+
+// Assigns the vbuckets this node imports, and forgets the documents that have been awaiting import
+// by other nodes for longer than maxPendingAge.  Returns the documents awaiting import in the
+// vbuckets that this node didn't previously own.
+func (p *importPartitions) setOwned(vbNos []uint16, maxPendingAge time.Duration) (gainedDocIDs []string) {
+	owned := make(map[uint16]bool, len(vbNos))
+	for _, vbNo := range vbNos {
+		owned[vbNo] = true
+	}
+	p.lock.Lock()
+	previouslyOwned := p.owned
+	wasPartitioned := p.partitioned
+	p.owned = owned
+	p.partitioned = true
+	p.lock.Unlock()
+
+	p.pendingLock.Lock()
+	defer p.pendingLock.Unlock()
+	for vbNo := range owned {
+		if wasPartitioned && previouslyOwned[vbNo] {
+			continue
+		}
+		for docID := range p.pending[vbNo] {
+			gainedDocIDs = append(gainedDocIDs, docID)
+		}
+		p.pendingCount -= len(p.pending[vbNo])
+		delete(p.pending, vbNo)
+	}
+
+	expiredBefore := time.Now().Add(-maxPendingAge)
+	expired := 0
+	for _, docs := range p.pending {
+		for docID, written := range docs {
+			if written.Before(expiredBefore) {
+				delete(docs, docID)
+				expired++
+			}
+		}
+	}
+	if expired > 0 {
+		p.pendingCount -= expired
+		base.Debugf(base.KeyImport, "Forgot %d documents awaiting import by other nodes for longer than %v", expired, maxPendingAge)
+	}
+	return gainedDocIDs
+}
+
+// Returns the vbuckets this node imports, and whether they've been assigned.
+func (p *importPartitions) ownedVbuckets() (vbNos []uint16, partitioned bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	vbNos = make([]uint16, 0, len(p.owned))
+	for vbNo := range p.owned {
+		vbNos = append(vbNos, vbNo)
+	}
+	sort.Slice(vbNos, func(i, j int) bool { return vbNos[i] < vbNos[j] })
+	return vbNos, p.partitioned
+}
+
+// Returns the number of documents awaiting import by other nodes.
+func (p *importPartitions) pendingImports() int {
+	p.pendingLock.Lock()
+	defer p.pendingLock.Unlock()
+	return p.pendingCount
+}
+
+// Returns true if this node imports documents written directly to the bucket.
+func (context *DatabaseContext) ImportEnabled() bool {
+	return context.UseXattrs() && context.autoImport
+}
+
+// Assigns the vbuckets whose mutations this node imports, and imports the documents it has seen
+// written in newly assigned vbuckets that their previous owners haven't imported.  Documents
+// awaiting import by other nodes for longer than maxPendingAge are forgotten; it should exceed the
+// time taken to reassign the vbuckets of a node that has gone away.
+func (context *DatabaseContext) SetImportPartitions(vbNos []uint16, maxPendingAge time.Duration) {
+	gainedDocIDs := context.importPartitions.setOwned(vbNos, maxPendingAge)
+	importStats := context.DbStats.SharedBucketImport()
+	importStats.Set(base.StatKeyImportPartitions, base.ExpvarIntVal(len(vbNos)))
+	importStats.Set(base.StatKeyImportPending, base.ExpvarIntVal(context.importPartitions.pendingImports()))
+	if len(gainedDocIDs) == 0 {
+		return
+	}
+
+	base.Infof(base.KeyImport, "Importing %d documents awaiting import in vbuckets newly assigned to this node", len(gainedDocIDs))
+	importStats.Add(base.StatKeyImportTakeoverCount, int64(len(gainedDocIDs)))
+	context.importInBackground(gainedDocIDs)
+}
+
+// Returns the vbuckets whose mutations this node imports, whether they've been assigned, and the
+// number of documents in other nodes' vbuckets awaiting import.
+func (context *DatabaseContext) ImportPartitions() (vbNos []uint16, partitioned bool, pending int) {
+	vbNos, partitioned = context.importPartitions.ownedVbuckets()
+	return vbNos, partitioned, context.importPartitions.pendingImports()
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportPartitions(t *testing.T) {
+
+	partitions := newImportPartitions()
+
+	// Until partitions are assigned, every vbucket is imported
+	assert.True(t, partitions.shouldImport(1, "doc1"))
+	assert.True(t, partitions.owns(2))
+
+	gained := partitions.setOwned([]uint16{1, 3}, time.Hour)
+	assert.Len(t, gained, 0)
+	assert.True(t, partitions.shouldImport(1, "doc1"))
+	assert.True(t, partitions.owns(3))
+	assert.False(t, partitions.owns(2))
+
+	// Docs in other nodes' vbuckets are tracked until they're imported
+	assert.False(t, partitions.shouldImport(2, "doc2"))
+	assert.False(t, partitions.shouldImport(2, "doc2"))
+	assert.False(t, partitions.shouldImport(2, "doc3"))
+	assert.False(t, partitions.shouldImport(4, "doc4"))
+	assert.Equal(t, 3, partitions.pendingImports())
+	partitions.imported(2, "doc3")
+	assert.Equal(t, 2, partitions.pendingImports())
+
+	// Taking over a vbucket returns the docs awaiting import in it
+	gained = partitions.setOwned([]uint16{1, 2, 3}, time.Hour)
+	assert.Equal(t, []string{"doc2"}, gained)
+	assert.Equal(t, 1, partitions.pendingImports())
+
+	vbNos, partitioned := partitions.ownedVbuckets()
+	assert.True(t, partitioned)
+	assert.Equal(t, []uint16{1, 2, 3}, vbNos)
+
+	// Once too many docs are awaiting import elsewhere, untracked docs are imported locally
+	partitions.pendingCount = kMaxPendingImports
+	assert.True(t, partitions.shouldImport(4, "doc5"))
+	assert.False(t, partitions.shouldImport(4, "doc4"))
+	assert.Equal(t, kMaxPendingImports, partitions.pendingImports())
+
+	// Docs that are never written back by their owner, e.g. rejected by its import filter, are
+	// forgotten once they've been awaiting import for too long
+	partitions.pendingCount = 1
+	assert.False(t, partitions.shouldImport(5, "doc6"))
+	assert.Equal(t, 2, partitions.pendingImports())
+	partitions.pending[4]["doc4"] = time.Now().Add(-2 * time.Minute)
+	gained = partitions.setOwned([]uint16{1, 2, 3}, time.Minute)
+	assert.Len(t, gained, 0)
+	assert.Equal(t, 1, partitions.pendingImports())
+	assert.False(t, partitions.shouldImport(4, "doc4"))
+	assert.Equal(t, 2, partitions.pendingImports())
+}
@@ -37,6 +37,7 @@ const (
 	IndexAllDocs
 	IndexTombstones
 	IndexSyncDocs
+	IndexWriteAccess
 	indexTypeCount // Used for iteration
 )
 
@@ -50,22 +51,24 @@ const (
 var (
 	// Simple index names - input to indexNameFormat
 	indexNames = map[SGIndexType]string{
-		IndexAccess:     "access",
-		IndexRoleAccess: "roleAccess",
-		IndexChannels:   "channels",
-		IndexAllDocs:    "allDocs",
-		IndexTombstones: "tombstones",
-		IndexSyncDocs:   "syncDocs",
+		IndexAccess:      "access",
+		IndexRoleAccess:  "roleAccess",
+		IndexChannels:    "channels",
+		IndexAllDocs:     "allDocs",
+		IndexTombstones:  "tombstones",
+		IndexSyncDocs:    "syncDocs",
+		IndexWriteAccess: "writeAccess",
 	}
 
 	// Index versions - must be incremented when index definition changes
 	indexVersions = map[SGIndexType]int{
-		IndexAccess:     1,
-		IndexRoleAccess: 1,
-		IndexChannels:   1,
-		IndexAllDocs:    1,
-		IndexTombstones: 1,
-		IndexSyncDocs:   1,
+		IndexAccess:      1,
+		IndexRoleAccess:  1,
+		IndexChannels:    1,
+		IndexAllDocs:     1,
+		IndexTombstones:  1,
+		IndexSyncDocs:    1,
+		IndexWriteAccess: 1,
 	}
 
 	// Expressions used to create index.
@@ -75,9 +78,10 @@ var (
 		IndexRoleAccess: "ALL (ARRAY (op.name) FOR op IN OBJECT_PAIRS($sync.role_access) END)",
 		IndexChannels: "ALL (ARRAY [op.name, LEAST($sync.sequence,op.val.seq), IFMISSING(op.val.rev,null), IFMISSING(op.val.del,null)] FOR op IN OBJECT_PAIRS($sync.channels) END), " +
 			"$sync.rev, $sync.sequence, $sync.flags",
-		IndexAllDocs:    "$sync.sequence, $sync.rev, $sync.flags, $sync.deleted",
-		IndexTombstones: "$sync.tombstoned_at",
-		IndexSyncDocs:   "META().id",
+		IndexAllDocs:     "$sync.sequence, $sync.rev, $sync.flags, $sync.deleted",
+		IndexTombstones:  "$sync.tombstoned_at",
+		IndexSyncDocs:    "META().id",
+		IndexWriteAccess: "ALL (ARRAY (op.name) FOR op IN OBJECT_PAIRS($sync.write_access) END)",
 	}
 
 	indexFilterExpressions = map[SGIndexType]string{
@@ -87,11 +91,12 @@ var (
 
 	// Index flags - used to identify any custom handling
 	indexFlags = map[SGIndexType]SGIndexFlags{
-		IndexAccess:     IdxFlagIndexTombstones,
-		IndexRoleAccess: IdxFlagIndexTombstones,
-		IndexChannels:   IdxFlagIndexTombstones,
-		IndexAllDocs:    IdxFlagIndexTombstones,
-		IndexTombstones: IdxFlagXattrOnly | IdxFlagIndexTombstones,
+		IndexAccess:      IdxFlagIndexTombstones,
+		IndexRoleAccess:  IdxFlagIndexTombstones,
+		IndexChannels:    IdxFlagIndexTombstones,
+		IndexAllDocs:     IdxFlagIndexTombstones,
+		IndexTombstones:  IdxFlagXattrOnly | IdxFlagIndexTombstones,
+		IndexWriteAccess: IdxFlagIndexTombstones,
 	}
 
 	// Queries used to check readiness on startup.  Only required for critical indexes.
@@ -0,0 +1,229 @@
+package db
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// A MemoryGovernor keeps the memory used by the caches of all of a node's databases within a
+// budget.  The channel caches, revision caches and pending sequence queues each report the
+// approximate number of bytes they hold.  When the total goes over the budget, the governor
+// repeatedly has whichever of them holds the least recently used data evict it, until the total
+// is back within the budget.  Each consumer evicts a batch at once, up to data more recently used
+// than the next consumer's, so that the consumers aren't all searched again for every eviction.
+//
+// Sizes are estimates of the bytes held by cached entries, not of the overall heap, so the budget
+// should leave headroom for everything else Sync Gateway allocates.
+
+// Kinds of memory tracked by a MemoryGovernor
+type MemoryKind int
+
+const (
+	MemoryChannelCache     MemoryKind = iota // Entries in channel caches
+	MemoryRevisionCache                      // Revision bodies in revision caches
+	MemoryPendingSequences                   // Entries waiting in the change cache for earlier sequences
+	numMemoryKinds
+)
+
+var memoryKindStatKeys = [numMemoryKinds]string{
+	base.StatKeyMemoryChannelCacheBytes,
+	base.StatKeyMemoryRevCacheBytes,
+	base.StatKeyMemoryPendingBytes,
+}
+
+// Approximate sizes of the structures holding a LogEntry, other than its strings
+const (
+	logEntryOverhead    = 160 // The LogEntry itself, and the slice, map and heap slots referring to it
+	logChannelOverhead  = 48  // Each entry in a LogEntry's channel map
+	minEvictionInterval = 100 * time.Millisecond
+)
+
+// Something holding memory counted against a MemoryGovernor's budget.
+type memoryConsumer interface {
+	// Returns the approximate number of bytes used.
+	memoryUsed() int64
+	// Returns when the least recently used evictable data was last accessed, or false if there's
+	// nothing to evict.
+	leastRecentlyUsed() (lastAccess time.Time, ok bool)
+	// Evicts the least recently used data, then more of it as long as it was last accessed no
+	// later than until, until about the given number of bytes are freed.  Returns the number of
+	// items evicted, which is 0 if there was nothing to evict.
+	evictLeastRecentlyUsed(bytes int64, until time.Time) (evicted int)
+}
+
+type MemoryGovernor struct {
+	budget      int64                 // Max total bytes
+	used        [numMemoryKinds]int64 // Bytes used by each kind of memory; accessed atomically
+	evictions   int64                 // Number of evictions; accessed atomically
+	lock        sync.Mutex            // Protects consumers
+	consumers   map[memoryConsumer]MemoryKind
+	evictNotify chan struct{} // Signals the eviction goroutine that the budget's been exceeded
+	terminator  chan struct{} // Closed by Stop
+}
+
+// Utilisation of a MemoryGovernor's budget
+type MemoryGovernorStats struct {
+	BudgetBytes       int64 `json:"budget_bytes"`
+	UsedBytes         int64 `json:"used_bytes"`
+	ChannelCacheBytes int64 `json:"channel_cache_bytes"`
+	RevCacheBytes     int64 `json:"rev_cache_bytes"`
+	PendingBytes      int64 `json:"pending_bytes"`
+	Evictions         int64 `json:"evictions"`
+}
+
+// Creates a MemoryGovernor with the given budget in bytes, and starts its eviction goroutine.
+// Its utilisation is published in the resource utilization stats.
+func NewMemoryGovernor(budget int64) *MemoryGovernor {
+	g := &MemoryGovernor{
+		budget:      budget,
+		consumers:   map[memoryConsumer]MemoryKind{},
+		evictNotify: make(chan struct{}, 1),
+		terminator:  make(chan struct{}),
+	}
+	go g.evictionLoop()
+
+	stats := base.StatsResourceUtilization()
+	stats.Set(base.StatKeyMemoryBudgetBytes, base.ExpvarInt64Val(budget))
+	stats.Set(base.StatKeyMemoryUsedBytes, expvar.Func(func() interface{} { return g.Used() }))
+	for kind, key := range memoryKindStatKeys {
+		kind := MemoryKind(kind)
+		stats.Set(key, expvar.Func(func() interface{} { return atomic.LoadInt64(&g.used[kind]) }))
+	}
+	stats.Set(base.StatKeyMemoryEvictions, expvar.Func(func() interface{} { return atomic.LoadInt64(&g.evictions) }))
+
+	base.Infof(base.KeyAll, "Limiting cache memory to %d bytes", budget)
+	return g
+}
+
+// Stops the eviction goroutine.
+func (g *MemoryGovernor) Stop() {
+	if g == nil {
+		return
+	}
+	close(g.terminator)
+}
+
+// Lets the governor evict a consumer's data when the budget's exceeded.  The consumer reports the
+// memory it uses via add.
+func (g *MemoryGovernor) register(kind MemoryKind, consumer memoryConsumer) {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	g.consumers[consumer] = kind
+	g.lock.Unlock()
+}
+
+// Stops counting a consumer's memory against the budget, releasing what it's using.
+func (g *MemoryGovernor) unregister(consumer memoryConsumer) {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	kind, found := g.consumers[consumer]
+	delete(g.consumers, consumer)
+	g.lock.Unlock()
+	if found {
+		g.add(kind, -consumer.memoryUsed())
+	}
+}
+
+// Records a change in the memory used by a consumer.  If the budget's exceeded, signals the
+// eviction goroutine rather than evicting directly, as consumers call this with their own locks
+// held.
+func (g *MemoryGovernor) add(kind MemoryKind, delta int64) {
+	if g == nil || delta == 0 {
+		return
+	}
+	atomic.AddInt64(&g.used[kind], delta)
+	if delta > 0 && g.Used() > g.budget {
+		select {
+		case g.evictNotify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Returns the total number of bytes used.
+func (g *MemoryGovernor) Used() (used int64) {
+	for kind := range g.used {
+		used += atomic.LoadInt64(&g.used[kind])
+	}
+	return used
+}
+
+// Returns the utilisation of the budget.
+func (g *MemoryGovernor) Stats() MemoryGovernorStats {
+	return MemoryGovernorStats{
+		BudgetBytes:       g.budget,
+		UsedBytes:         g.Used(),
+		ChannelCacheBytes: atomic.LoadInt64(&g.used[MemoryChannelCache]),
+		RevCacheBytes:     atomic.LoadInt64(&g.used[MemoryRevisionCache]),
+		PendingBytes:      atomic.LoadInt64(&g.used[MemoryPendingSequences]),
+		Evictions:         atomic.LoadInt64(&g.evictions),
+	}
+}
+
+func (g *MemoryGovernor) evictionLoop() {
+	for {
+		select {
+		case <-g.evictNotify:
+			g.evict()
+			// Let a burst of additions accumulate before checking again
+			time.Sleep(minEvictionInterval)
+		case <-g.terminator:
+			return
+		}
+	}
+}
+
+// Evicts least recently used data across all consumers until the memory used is within the budget.
+func (g *MemoryGovernor) evict() {
+	evicted := 0
+	for used := g.Used(); used > g.budget; used = g.Used() {
+		consumer, until := g.leastRecentlyUsedConsumer()
+		var n int
+		if consumer != nil {
+			n = consumer.evictLeastRecentlyUsed(used-g.budget, until)
+		}
+		if n == 0 {
+			base.Warnf(base.KeyAll, "Cache memory use of %d bytes is over the budget of %d bytes, but there's nothing left to evict", used, g.budget)
+			break
+		}
+		atomic.AddInt64(&g.evictions, int64(n))
+		evicted += n
+	}
+	if evicted > 0 {
+		base.Debugf(base.KeyCache, "Evicted %d cache entries to bring memory use within the budget of %d bytes", evicted, g.budget)
+	}
+}
+
+// Returns the consumer holding the least recently used evictable data, or nil if none has any,
+// and when the least recently used data of the other consumers was last accessed.  That's far in
+// the future if no other consumer has any.
+func (g *MemoryGovernor) leastRecentlyUsedConsumer() (oldest memoryConsumer, nextOldestAccess time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	var oldestAccess time.Time
+	nextOldestAccess = time.Now().Add(24 * time.Hour)
+	for consumer := range g.consumers {
+		lastAccess, ok := consumer.leastRecentlyUsed()
+		if !ok {
+			continue
+		}
+		if oldest == nil || lastAccess.Before(oldestAccess) {
+			if oldest != nil {
+				nextOldestAccess = oldestAccess
+			}
+			oldest = consumer
+			oldestAccess = lastAccess
+		} else if lastAccess.Before(nextOldestAccess) {
+			nextOldestAccess = lastAccess
+		}
+	}
+	return oldest, nextOldestAccess
+}
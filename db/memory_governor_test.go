@@ -0,0 +1,190 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/stretchr/testify/assert"
+)
+
+// Creates a governor without its eviction goroutine, so that tests can evict synchronously.
+func newTestMemoryGovernor(budget int64) *MemoryGovernor {
+	return &MemoryGovernor{
+		budget:      budget,
+		consumers:   map[memoryConsumer]MemoryKind{},
+		evictNotify: make(chan struct{}, 1),
+		terminator:  make(chan struct{}),
+	}
+}
+
+func TestMemoryGovernorRevisionCache(t *testing.T) {
+	governor := newTestMemoryGovernor(1 << 30)
+	cache := NewShardedRevisionCache(&RevisionCacheOptions{Size: 100, ShardCount: 4, Governor: governor}, nil, nil)
+
+	for i := 0; i < 5; i++ {
+		cache.Put(fmt.Sprintf("doc%d", i), DocumentRevision{
+			RevID:     "1-a",
+			BodyBytes: []byte(`{"value":"0123456789012345678901234567890123456789"}`),
+			History:   Revisions{RevisionsStart: 1},
+		})
+		time.Sleep(time.Millisecond)
+	}
+	used := governor.Used()
+	assert.Equal(t, used, governor.Stats().RevCacheBytes)
+	assert.Equal(t, used, cache.memoryUsed())
+
+	// Reading doc0 makes doc1 the least recently used
+	docRev, err := cache.GetCached("doc0", "1-a")
+	assert.NoError(t, err)
+	assert.NotNil(t, docRev.BodyBytes)
+
+	// Room for all but two revisions
+	governor.budget = used * 3 / 5
+	governor.evict()
+	assert.True(t, governor.Used() <= governor.budget)
+	assert.Equal(t, int64(2), governor.Stats().Evictions)
+	for docID, cached := range map[string]bool{"doc0": true, "doc1": false, "doc2": false, "doc3": true, "doc4": true} {
+		docRev, err := cache.GetCached(docID, "1-a")
+		assert.NoError(t, err)
+		assert.Equal(t, cached, docRev.BodyBytes != nil, "Unexpected cache state for %s", docID)
+	}
+
+	// Unregistering releases the cache's memory
+	governor.register(MemoryRevisionCache, cache)
+	governor.unregister(cache)
+	assert.Equal(t, int64(0), governor.Used())
+}
+
+func TestMemoryGovernorEvictsAcrossCaches(t *testing.T) {
+
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyCache)()
+
+	governor := newTestMemoryGovernor(1 << 30)
+	context, err := NewDatabaseContext("db", testBucket().Bucket, false, DatabaseContextOptions{MemoryGovernor: governor})
+	assert.NoError(t, err)
+	defer context.Close()
+	defer base.DecrNumOpenBuckets(context.Bucket.GetName())
+	cache := context.changeCache.(*changeCache)
+
+	channelA := cache.getChannelCache("A")
+	channelA.addToCache(e(1, "doc1", "1-a"), false)
+	channelA.addToCache(e(2, "doc2", "1-a"), false)
+	channelA.addToCache(e(3, "doc3", "1-a"), false)
+	time.Sleep(time.Millisecond)
+
+	context.revisionCache.Put("doc1", DocumentRevision{RevID: "1-a", BodyBytes: []byte(`{"value":1}`), History: Revisions{RevisionsStart: 1}})
+	time.Sleep(time.Millisecond)
+
+	channelB := cache.getChannelCache("B")
+	channelB.addToCache(e(4, "doc4", "1-a"), false)
+	channelB.addToCache(e(5, "doc5", "1-a"), false)
+	_, entries := cache.GetCachedChanges("B", ChangesOptions{})
+	assert.Len(t, entries, 2)
+
+	stats := governor.Stats()
+	assert.Equal(t, 5*cachedLogEntrySize(e(1, "doc1", "1-a")), stats.ChannelCacheBytes)
+	assert.Equal(t, int64(len(`{"value":1}`)), stats.RevCacheBytes)
+	assert.Equal(t, stats.ChannelCacheBytes+stats.RevCacheBytes, stats.UsedBytes)
+
+	// Going just over the budget evicts the least recently read channel cache
+	governor.budget = stats.UsedBytes - 1
+	governor.evict()
+	assert.Equal(t, int64(1), governor.Stats().Evictions)
+	assert.Equal(t, 0, channelA.GetSize())
+	assert.Equal(t, 2, channelB.GetSize())
+	docRev, err := context.revisionCache.GetCached("doc1", "1-a")
+	assert.NoError(t, err)
+	assert.NotNil(t, docRev.BodyBytes)
+
+	// The evicted cache is only valid after its last entry, so earlier changes get queried
+	validFrom, entries := cache.GetCachedChanges("A", ChangesOptions{})
+	assert.Len(t, entries, 0)
+	assert.Equal(t, uint64(4), validFrom)
+
+	// Evicting everything leaves nothing counted
+	governor.budget = 0
+	governor.evict()
+	assert.Equal(t, 0, channelB.GetSize())
+	assert.Equal(t, int64(0), governor.Used())
+}
+
+func TestMemoryGovernorPendingSequences(t *testing.T) {
+
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyCache)()
+
+	governor := newTestMemoryGovernor(1 << 30)
+	context, err := NewDatabaseContext("db", testBucket().Bucket, false, DatabaseContextOptions{MemoryGovernor: governor})
+	assert.NoError(t, err)
+	defer context.Close()
+	defer base.DecrNumOpenBuckets(context.Bucket.GetName())
+	cache := context.changeCache.(*changeCache)
+
+	// An entry arriving ahead of the next sequence waits in pendingLogs
+	nextSequence := cache.getNextSequence()
+	entry := e(nextSequence+2, "doc1", "1-a")
+	entry.Channels = channels.ChannelMap{"A": nil}
+	entrySize := pendingLogEntrySize(entry)
+	cache.processEntry(entry)
+	assert.Equal(t, entrySize, governor.Stats().PendingBytes)
+
+	lastAccess, ok := cache.pendingMemory.leastRecentlyUsed()
+	assert.True(t, ok)
+	assert.Equal(t, entry.TimeReceived, lastAccess)
+
+	// Evicting it skips the missing sequences, moving it into the channel caches
+	assert.Equal(t, 1, cache.pendingMemory.evictLeastRecentlyUsed(entrySize, time.Now()))
+	assert.Equal(t, int64(0), governor.Stats().PendingBytes)
+	assert.True(t, cache.WasSkipped(nextSequence))
+	assert.True(t, cache.WasSkipped(nextSequence+1))
+	assert.Equal(t, nextSequence+3, cache.getNextSequence())
+	assert.Equal(t, 1, cache.getChannelCache("A").GetSize())
+	assert.Equal(t, governor.Stats().ChannelCacheBytes, governor.Used())
+
+	// Nothing's left to evict from pendingLogs
+	_, ok = cache.pendingMemory.leastRecentlyUsed()
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.pendingMemory.evictLeastRecentlyUsed(entrySize, time.Now()))
+}
+
+func TestMemoryGovernorEvictsInBatches(t *testing.T) {
+
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyCache)()
+
+	governor := newTestMemoryGovernor(1 << 30)
+	context, err := NewDatabaseContext("db", testBucket().Bucket, false, DatabaseContextOptions{MemoryGovernor: governor})
+	assert.NoError(t, err)
+	defer context.Close()
+	defer base.DecrNumOpenBuckets(context.Bucket.GetName())
+	cache := context.changeCache.(*changeCache)
+
+	// Three channels read before the revision cache, and one after it
+	var channelCaches []*channelCache
+	for i := 1; i <= 3; i++ {
+		channelName := fmt.Sprintf("ch%d", i)
+		channelCache := cache.getChannelCache(channelName)
+		channelCache.addToCache(e(uint64(i), fmt.Sprintf("doc%d", i), "1-a"), false)
+		cache.GetCachedChanges(channelName, ChangesOptions{})
+		channelCaches = append(channelCaches, channelCache)
+		time.Sleep(time.Millisecond)
+	}
+	context.revisionCache.Put("doc1", DocumentRevision{RevID: "1-a", BodyBytes: []byte(`{"value":1}`), History: Revisions{RevisionsStart: 1}})
+	time.Sleep(time.Millisecond)
+	lastChannel := cache.getChannelCache("ch4")
+	lastChannel.addToCache(e(4, "doc4", "1-a"), false)
+	cache.GetCachedChanges("ch4", ChangesOptions{})
+
+	// The channel caches older than the revision are evicted together, and no others
+	consumer, until := governor.leastRecentlyUsedConsumer()
+	assert.Equal(t, memoryConsumer(cache), consumer)
+	assert.Equal(t, 3, cache.evictLeastRecentlyUsed(1<<30, until))
+	for _, channelCache := range channelCaches {
+		assert.Equal(t, 0, channelCache.GetSize())
+	}
+	assert.Equal(t, 1, lastChannel.GetSize())
+	docRev, err := context.revisionCache.GetCached("doc1", "1-a")
+	assert.NoError(t, err)
+	assert.NotNil(t, docRev.BodyBytes)
+}
@@ -21,8 +21,10 @@ type QueryIdRow struct {
 const (
 	QueryTypeAccess       = "access"
 	QueryTypeRoleAccess   = "roleAccess"
+	QueryTypeWriteAccess  = "writeAccess"
 	QueryTypeChannels     = "channels"
 	QueryTypeChannelsStar = "channelsStar"
+	QueryTypeMultiChannel = "multiChannel"
 	QueryTypePrincipals   = "principals"
 	QueryTypeSessions     = "sessions"
 	QueryTypeTombstones   = "tombstones"
@@ -63,7 +65,17 @@ var QueryRoleAccess = SGQuery{
 	adhoc: true,
 }
 
-// QueryAccessRow used for response from both QueryAccess and QueryRoleAccess
+var QueryWriteAccess = SGQuery{
+	name: QueryTypeWriteAccess,
+	statement: fmt.Sprintf(
+		"SELECT $sync.write_access.`$userName` as `value` "+
+			"FROM `%s` "+
+			"WHERE any op in object_pairs($sync.write_access) satisfies op.name = '$userName' end;",
+		base.BucketQueryToken),
+	adhoc: true,
+}
+
+// QueryAccessRow used for response from QueryAccess, QueryRoleAccess and QueryWriteAccess
 type QueryAccessRow struct {
 	Value channels.TimedSet
 }
@@ -84,6 +96,30 @@ var QueryChannels = SGQuery{
 	adhoc: false,
 }
 
+// Like QueryChannels, but for a set of channels, whose names are included in the results.  The WHERE
+// clause is completed by buildMultiChannelQuery with a range of the channels index for each channel,
+// so only the requested channels are scanned.
+var QueryMultiChannel = SGQuery{
+	name: QueryTypeMultiChannel,
+	statement: fmt.Sprintf(
+		"SELECT op.name AS channel, "+
+			"[op.name, LEAST($sync.sequence, op.val.seq),IFMISSING(op.val.rev,null),IFMISSING(op.val.del,null)][1] AS seq, "+
+			"[op.name, LEAST($sync.sequence, op.val.seq),IFMISSING(op.val.rev,null),IFMISSING(op.val.del,null)][2] AS rRev, "+
+			"[op.name, LEAST($sync.sequence, op.val.seq),IFMISSING(op.val.rev,null),IFMISSING(op.val.del,null)][3] AS rDel, "+
+			"$sync.rev AS rev, "+
+			"$sync.flags AS flags, "+
+			"META(`%s`).id AS id "+
+			"FROM `%s` "+
+			"UNNEST OBJECT_PAIRS($sync.channels) AS op "+
+			"WHERE ",
+		base.BucketQueryToken, base.BucketQueryToken),
+	adhoc: true, // The statement depends on the number of channels, so isn't worth preparing
+}
+
+// The range of the channels index of one of the channels of QueryMultiChannel, given the name of the
+// channel's query parameter
+const multiChannelRangeFormat = "([op.name, LEAST($sync.sequence, op.val.seq),IFMISSING(op.val.rev,null),IFMISSING(op.val.del,null)]  BETWEEN  [$%[1]s, $startSeq] AND [$%[1]s, $endSeq])"
+
 var QueryStarChannel = SGQuery{
 	name: QueryTypeChannelsStar,
 	statement: fmt.Sprintf(
@@ -107,6 +143,12 @@ type QueryChannelsRow struct {
 	RemovalDel bool   `json:"rDel,omitempty"`
 }
 
+// QueryMultiChannelRow used for response from QueryMultiChannel
+type QueryMultiChannelRow struct {
+	QueryChannelsRow
+	Channel string `json:"channel"`
+}
+
 var QueryPrincipals = SGQuery{
 	name: QueryTypePrincipals,
 	statement: fmt.Sprintf(
@@ -185,6 +227,7 @@ const (
 	QueryParamEndSeq      = "endSeq"
 	QueryParamUserName    = "userName"
 	QueryParamOlderThan   = "olderThan"
+	QueryParamChannelN    = "channel%d" // Name of the nth channel of QueryMultiChannel
 )
 
 // N1QlQueryWithStats is a wrapper for gocbBucket.Query that performs additional diagnostic processing (expvars, slow query logging)
@@ -278,6 +321,32 @@ func (context *DatabaseContext) buildRoleAccessQuery(username string) string {
 	return statement
 }
 
+// Query to compute the set of channels the specified user has been granted write access to via the Sync Function
+func (context *DatabaseContext) QueryWriteAccess(username string) (sgbucket.QueryResultIterator, error) {
+
+	// View Query
+	if context.Options.UseViews {
+		opts := map[string]interface{}{"stale": false, "key": username}
+		return context.ViewQueryWithStats(DesignDocSyncGateway(), ViewWriteAccess, opts)
+	}
+
+	// N1QL Query
+	if username == "" {
+		base.Warnf(base.KeyAll, "QueryWriteAccess called with empty username - returning empty result iterator")
+		return &EmptyResultIterator{}, nil
+	}
+	accessQueryStatement := context.buildWriteAccessQuery(username)
+	// Can't use prepared query because username is in select clause
+	return context.N1QLQueryWithStats(QueryWriteAccess.name, accessQueryStatement, nil, gocb.RequestPlus, QueryWriteAccess.adhoc)
+}
+
+// Builds the query statement for a writeAccess N1QL query.
+func (context *DatabaseContext) buildWriteAccessQuery(username string) string {
+	statement := replaceSyncTokensQuery(QueryWriteAccess.statement, context.UseXattrs())
+	statement = strings.Replace(statement, "$"+QueryParamUserName, username, -1)
+	return statement
+}
+
 // Query to compute the set of documents assigned to the specified channel within the sequence range
 func (context *DatabaseContext) QueryChannels(channelName string, startSeq uint64, endSeq uint64, limit int) (sgbucket.QueryResultIterator, error) {
 
@@ -326,6 +395,39 @@ func (context *DatabaseContext) buildChannelsQuery(channelName string, startSeq
 	return channelQueryStatement, params
 }
 
+// Query to compute the sets of documents assigned to several channels within the sequence range.  The
+// caller has to filter out rows of other channels in the range of channel names, and rows outside the
+// sequence range it needs for each channel.  Not supported when using views.
+func (context *DatabaseContext) QueryMultiChannel(channelNames []string, startSeq uint64, endSeq uint64) (sgbucket.QueryResultIterator, error) {
+	if context.Options.UseViews {
+		return nil, errors.New("Multi-channel queries aren't supported when using views")
+	}
+	statement, params := context.buildMultiChannelQuery(channelNames, startSeq, endSeq)
+	return context.N1QLQueryWithStats(QueryMultiChannel.name, statement, params, gocb.RequestPlus, QueryMultiChannel.adhoc)
+}
+
+// Builds the query statement and query parameters for a multi-channel N1QL query.  The statement
+// ORs together a range for each channel, so depends on the number of channels.
+func (context *DatabaseContext) buildMultiChannelQuery(channelNames []string, startSeq uint64, endSeq uint64) (statement string, params map[string]interface{}) {
+	params = make(map[string]interface{}, len(channelNames)+2)
+	ranges := make([]string, len(channelNames))
+	for i, channelName := range channelNames {
+		param := fmt.Sprintf(QueryParamChannelN, i)
+		params[param] = channelName
+		ranges[i] = fmt.Sprintf(multiChannelRangeFormat, param)
+	}
+	statement = QueryMultiChannel.statement + strings.Join(ranges, " OR ")
+	statement = replaceSyncTokensQuery(statement, context.UseXattrs())
+	params[QueryParamStartSeq] = startSeq
+	if endSeq == 0 {
+		endSeq = math.MaxUint64
+	} else {
+		endSeq++
+	}
+	params[QueryParamEndSeq] = endSeq
+	return statement, params
+}
+
 func (context *DatabaseContext) QueryResync() (sgbucket.QueryResultIterator, error) {
 
 	if context.Options.UseViews {
@@ -123,6 +123,13 @@ func TestCoveringQueries(t *testing.T) {
 	covered = isCovered(plan)
 	assert.True(t, covered, "Star channel query isn't covered by index")
 
+	// multi-channel
+	multiChannelStatement, params := db.buildMultiChannelQuery([]string{"ABC", "PBS"}, 0, 10)
+	plan, explainErr = gocbBucket.ExplainQuery(multiChannelStatement, params)
+	assert.NoError(t, explainErr, "Error generating explain for multi-channel query")
+	covered = isCovered(plan)
+	assert.True(t, covered, "Multi-channel query isn't covered by index")
+
 	// Access and roleAccess currently aren't covering, because of the need to target the user property by name
 	// in the SELECT.
 	// Including here for ease-of-conversion when we get an indexing enhancement to support covered queries.
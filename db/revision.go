@@ -16,6 +16,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 
 	"github.com/couchbase/sync_gateway/base"
 )
@@ -29,6 +30,8 @@ const (
 	BodyId          = "_id"
 	BodyRevisions   = "_revisions"
 	BodyAttachments = "_attachments"
+	BodyExpiry      = "_exp"
+	BodyRemoved     = "_removed"
 )
 
 // A revisions property found within a Body.  Expected to be of the form:
@@ -279,6 +282,51 @@ func canonicalEncoding(body Body) []byte {
 	return encoded
 }
 
+// Adds properties to a JSON object without unmarshalling it.  The properties are inserted at the
+// start of the object in sorted order, matching the order json.Marshal gives a Body's special
+// properties.  The properties must not already be present in the object.
+func InjectJSONProperties(data []byte, properties Body) ([]byte, error) {
+	if len(properties) == 0 {
+		return data, nil
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) < 2 || data[0] != '{' || data[len(data)-1] != '}' {
+		return nil, errors.New("Can't inject properties into JSON that isn't an object")
+	}
+
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buffer bytes.Buffer
+	buffer.Grow(len(data) + 64*len(keys))
+	buffer.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		keyJSON, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		valueJSON, err := json.Marshal(properties[key])
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(keyJSON)
+		buffer.WriteByte(':')
+		buffer.Write(valueJSON)
+	}
+	remainder := bytes.TrimSpace(data[1:])
+	if remainder[0] != '}' {
+		buffer.WriteByte(',')
+	}
+	buffer.Write(remainder)
+	return buffer.Bytes(), nil
+}
+
 func GetStringArrayProperty(body map[string]interface{}, property string) ([]string, error) {
 	if raw, exists := body[property]; !exists {
 		return nil, nil
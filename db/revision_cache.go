@@ -1,8 +1,12 @@
 package db
 
 import (
+	"bytes"
 	"container/list"
+	"encoding/json"
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"expvar"
@@ -13,55 +17,165 @@ import (
 // Number of recently-accessed doc revisions to cache in RAM
 var KDefaultRevisionCacheCapacity uint32 = 5000
 
-// An LRU cache of document revision bodies, together with their channel access.
+// Number of shards the revision cache is split into, each with its own lock and LRU list
+const DefaultRevisionCacheShardCount = 16
+
+// Max number of revisions evicted from a shard at once by the memory governor
+const revCacheEvictionBatch = 64
+
+// Options for the revision cache
+type RevisionCacheOptions struct {
+	Size       uint32          // Max number of revisions to cache; 0 for the default
+	ShardCount uint16          // Number of shards; 0 for the default
+	MaxBytes   int64           // Max total size of the cached revision bodies, in bytes; 0 for no limit
+	Governor   *MemoryGovernor // Node-wide memory budget the cached bodies count against; nil for none
+}
+
+// An LRU cache of document revision bodies, together with their channel access.  Bodies are kept as
+// JSON, so that they can be written out to clients without being re-marshalled, and are only
+// unmarshalled by callers that need to modify them.  Revisions are
+// spread across shards by doc ID, so that concurrent lookups of different docs rarely contend for
+// the same lock.  Each shard evicts its least recently used revisions once it holds more than its
+// share of the cache's size or byte budget.
 type RevisionCache struct {
-	cache      map[IDAndRev]*list.Element // Fast lookup of list element by doc/rev ID
-	lruList    *list.List                 // List ordered by most recent access (Front is newest)
-	capacity   uint32                     // Max number of revisions to cache
-	loaderFunc RevisionCacheLoaderFunc    // Function which does actual loading of something from rev cache
-	lock       sync.Mutex                 // For thread-safety
-	statsCache *expvar.Map                // Per-db stats related to cache
+	shards     []*revisionCacheShard
+	loaderFunc RevisionCacheLoaderFunc // Function which does actual loading of something from rev cache
+	statsCache *expvar.Map             // Per-db stats related to cache
+	governor   *MemoryGovernor         // Node-wide memory budget, or nil
+}
+
+// One shard of a RevisionCache
+type revisionCacheShard struct {
+	cache     map[IDAndRev]*list.Element // Fast lookup of list element by doc/rev ID
+	lruList   *list.List                 // List ordered by most recent access (Front is newest)
+	capacity  uint32                     // Max number of revisions to cache
+	maxBytes  int64                      // Max total size of the cached bodies; 0 for no limit
+	bytes     int64                      // Total size of the cached bodies
+	governor  *MemoryGovernor            // Node-wide memory budget, or nil
+	lock      sync.Mutex                 // For thread-safety
+	hits      int64                      // Accessed atomically
+	misses    int64                      // Accessed atomically
+	evictions int64                      // Accessed atomically
+}
+
+// Stats of one shard of a RevisionCache
+type RevisionCacheShardStats struct {
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
 }
 
 // Revision information as returned by the rev cache
 type DocumentRevision struct {
+	DocID       string
 	RevID       string
-	Body        Body
+	BodyBytes   []byte // JSON body, without special properties.  Shared with the cache, so must not be modified
 	History     Revisions
 	Channels    base.Set
 	Expiry      *time.Time
 	Attachments AttachmentsMeta
+	Deleted     bool
+	Removed     bool // True if the revision removed the doc from channels, and its body isn't available
 }
 
-// Callback function signature for loading something from the rev cache
-type RevisionCacheLoaderFunc func(id IDAndRev) (body Body, history Revisions, channels base.Set, attachments AttachmentsMeta, expiry *time.Time, err error)
+// Callback function signature for loading something from the rev cache.  The returned BodyBytes
+// must not include special properties.
+type RevisionCacheLoaderFunc func(id IDAndRev) (docRev DocumentRevision, err error)
 
 // The cache payload data. Stored as the Value of a list Element.
 type revCacheValue struct {
 	key         IDAndRev        // doc/rev IDs
-	body        Body            // Revision body (a pristine shallow copy)
+	bodyBytes   []byte          // Revision body as JSON, without special properties
 	history     Revisions       // Rev history encoded like a "_revisions" property
 	channels    base.Set        // Set of channels that have access
 	expiry      *time.Time      // Document expiry
 	attachments AttachmentsMeta // Document _attachments property
+	deleted     bool            // True if the revision is a tombstone
+	removed     bool            // True if the revision is a channel removal
 	err         error           // Error from loaderFunc if it failed
 	lock        sync.Mutex      // Synchronizes access to this struct
+	size        int64           // Size of the body counted against the shard's byte budget; guarded by the shard's lock
+	accessed    time.Time       // Time of the most recent lookup; guarded by the shard's lock
 }
 
-// Creates a revision cache with the given capacity and an optional loader function.
+// Creates an unsharded revision cache with the given capacity and an optional loader function.
 func NewRevisionCache(capacity uint32, loaderFunc RevisionCacheLoaderFunc, statsCache *expvar.Map) *RevisionCache {
+	return NewShardedRevisionCache(&RevisionCacheOptions{Size: capacity, ShardCount: 1}, loaderFunc, statsCache)
+}
 
+// Creates a revision cache with the given options and an optional loader function.
+func NewShardedRevisionCache(options *RevisionCacheOptions, loaderFunc RevisionCacheLoaderFunc, statsCache *expvar.Map) *RevisionCache {
+
+	capacity := options.Size
 	if capacity == 0 {
 		capacity = KDefaultRevisionCacheCapacity
 	}
+	shardCount := uint32(options.ShardCount)
+	if shardCount == 0 {
+		shardCount = DefaultRevisionCacheShardCount
+	}
+	if shardCount > capacity {
+		shardCount = capacity
+	}
+	if shardCount == 0 {
+		// A zero capacity disables caching
+		shardCount = 1
+	}
 
-	return &RevisionCache{
-		cache:      map[IDAndRev]*list.Element{},
-		lruList:    list.New(),
-		capacity:   capacity,
+	rc := &RevisionCache{
+		shards:     make([]*revisionCacheShard, shardCount),
 		loaderFunc: loaderFunc,
 		statsCache: statsCache,
+		governor:   options.Governor,
+	}
+	for i := range rc.shards {
+		// Spread the remainder of the capacity over the first shards
+		shardCapacity := capacity / shardCount
+		if uint32(i) < capacity%shardCount {
+			shardCapacity++
+		}
+		rc.shards[i] = &revisionCacheShard{
+			cache:    map[IDAndRev]*list.Element{},
+			lruList:  list.New(),
+			capacity: shardCapacity,
+			maxBytes: options.MaxBytes / int64(shardCount),
+			governor: options.Governor,
+		}
+	}
+	options.Governor.register(MemoryRevisionCache, rc)
+	if statsCache != nil {
+		statsCache.Set(base.StatKeyRevisionCacheShards, expvar.Func(func() interface{} {
+			return rc.ShardStats()
+		}))
+	}
+	return rc
+}
+
+// Returns the shard holding the revisions of a document.
+func (rc *RevisionCache) getShard(docid string) *revisionCacheShard {
+	if len(rc.shards) == 1 {
+		return rc.shards[0]
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(docid))
+	return rc.shards[hash.Sum32()%uint32(len(rc.shards))]
+}
+
+// Returns the stats of each shard.
+func (rc *RevisionCache) ShardStats() []RevisionCacheShardStats {
+	stats := make([]RevisionCacheShardStats, len(rc.shards))
+	for i, shard := range rc.shards {
+		shard.lock.Lock()
+		stats[i].Entries = len(shard.cache)
+		stats[i].Bytes = shard.bytes
+		shard.lock.Unlock()
+		stats[i].Hits = atomic.LoadInt64(&shard.hits)
+		stats[i].Misses = atomic.LoadInt64(&shard.misses)
+		stats[i].Evictions = atomic.LoadInt64(&shard.evictions)
 	}
+	return stats
 }
 
 // Looks up a revision from the cache.
@@ -69,20 +183,28 @@ func NewRevisionCache(capacity uint32, loaderFunc RevisionCacheLoaderFunc, stats
 // If the cache has a loaderFunction, it will be called if the revision isn't in the cache;
 // any error returned by the loaderFunction will be returned from Get.
 func (rc *RevisionCache) Get(docid, revid string) (DocumentRevision, error) {
-	value := rc.getValue(docid, revid, rc.loaderFunc != nil)
+	shard := rc.getShard(docid)
+	value := shard.getValue(docid, revid, rc.loaderFunc != nil)
 	if value == nil {
 		return DocumentRevision{}, nil
 	}
 	docRev, statEvent, err := value.load(rc.loaderFunc)
-	rc.statsRecorderFunc(statEvent)
+	rc.statsRecorderFunc(shard, statEvent)
 
 	if err != nil {
-		rc.removeValue(value) // don't keep failed loads in the cache
+		shard.removeValue(value) // don't keep failed loads in the cache
+	} else if !statEvent {
+		shard.updateSize(value, int64(len(docRev.BodyBytes)))
 	}
 	return docRev, err
 }
 
-func (rc *RevisionCache) statsRecorderFunc(cacheHit bool) {
+func (rc *RevisionCache) statsRecorderFunc(shard *revisionCacheShard, cacheHit bool) {
+	if cacheHit {
+		atomic.AddInt64(&shard.hits, 1)
+	} else {
+		atomic.AddInt64(&shard.misses, 1)
+	}
 	if rc.statsCache == nil {
 		return
 	}
@@ -96,15 +218,18 @@ func (rc *RevisionCache) statsRecorderFunc(cacheHit bool) {
 // Looks up a revision from the cache-only.  Will not fall back to loader function if not
 // present in the cache.
 func (rc *RevisionCache) GetCached(docid, revid string) (DocumentRevision, error) {
-	value := rc.getValue(docid, revid, false)
+	shard := rc.getShard(docid)
+	value := shard.getValue(docid, revid, false)
 	if value == nil {
 		return DocumentRevision{}, nil
 	}
 	docRev, statEvent, err := value.load(rc.loaderFunc)
-	rc.statsRecorderFunc(statEvent)
+	rc.statsRecorderFunc(shard, statEvent)
 
 	if err != nil {
-		rc.removeValue(value) // don't keep failed loads in the cache
+		shard.removeValue(value) // don't keep failed loads in the cache
+	} else if !statEvent {
+		shard.updateSize(value, int64(len(docRev.BodyBytes)))
 	}
 	return docRev, err
 }
@@ -126,57 +251,163 @@ func (rc *RevisionCache) GetActive(docid string, context *DatabaseContext) (docR
 	}
 
 	// Retrieve from or add to rev cache
-	value := rc.getValue(docid, bucketDoc.CurrentRev, true)
-	docRev, statEvent, err := value.loadForDoc(bucketDoc, context)
-	rc.statsRecorderFunc(statEvent)
+	return rc.getForDoc(bucketDoc, bucketDoc.CurrentRev, context)
+}
+
+// Retrieves a revision of a document already read from the bucket from the cache, adding it to the
+// cache from the document if it isn't there.
+func (rc *RevisionCache) getForDoc(doc *document, revid string, context *DatabaseContext) (docRev DocumentRevision, err error) {
+	shard := rc.getShard(doc.ID)
+	value := shard.getValue(doc.ID, revid, true)
+	docRev, statEvent, err := value.loadForDoc(doc, context)
+	rc.statsRecorderFunc(shard, statEvent)
 
 	if err != nil {
-		rc.removeValue(value) // don't keep failed loads in the cache
+		shard.removeValue(value) // don't keep failed loads in the cache
+	} else if !statEvent {
+		shard.updateSize(value, int64(len(docRev.BodyBytes)))
 	}
 	return docRev, err
 }
 
+// Whether a revision is in the cache, or being loaded into it.
+func (rc *RevisionCache) contains(docid, revid string) bool {
+	return rc.getShard(docid).getValue(docid, revid, false) != nil
+}
+
 // Adds a revision to the cache.
 func (rc *RevisionCache) Put(docid string, docRev DocumentRevision) {
 	if docRev.History == nil {
 		panic("Missing history for RevisionCache.Put")
 	}
-	value := rc.getValue(docid, docRev.RevID, true)
-	value.store(docRev)
+	shard := rc.getShard(docid)
+	value := shard.getValue(docid, docRev.RevID, true)
+	if value.store(docRev) {
+		shard.updateSize(value, int64(len(docRev.BodyBytes)))
+	}
 }
 
-func (rc *RevisionCache) getValue(docid, revid string, create bool) (value *revCacheValue) {
+func (shard *revisionCacheShard) getValue(docid, revid string, create bool) (value *revCacheValue) {
 	if docid == "" || revid == "" {
 		panic("RevisionCache: invalid empty doc/rev id")
 	}
 	key := IDAndRev{DocID: docid, RevID: revid}
-	rc.lock.Lock()
-	defer rc.lock.Unlock()
-	if elem := rc.cache[key]; elem != nil {
-		rc.lruList.MoveToFront(elem)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if elem := shard.cache[key]; elem != nil {
+		shard.lruList.MoveToFront(elem)
 		value = elem.Value.(*revCacheValue)
 	} else if create {
 		value = &revCacheValue{key: key}
-		rc.cache[key] = rc.lruList.PushFront(value)
-		for len(rc.cache) > int(rc.capacity) {
-			rc.purgeOldest_()
+		shard.cache[key] = shard.lruList.PushFront(value)
+		for len(shard.cache) > int(shard.capacity) {
+			shard.purgeOldest_()
 		}
 	}
+	if value != nil {
+		value.accessed = time.Now()
+	}
 	return
 }
 
-func (rc *RevisionCache) removeValue(value *revCacheValue) {
-	rc.lock.Lock()
-	if element := rc.cache[value.key]; element != nil && element.Value == value {
-		rc.lruList.Remove(element)
-		delete(rc.cache, value.key)
+// Counts the size of a newly loaded body against the shard's byte budget and the memory governor,
+// evicting the least recently used revisions if the shard's budget is exceeded.  The most recently
+// used revision is always kept.
+func (shard *revisionCacheShard) updateSize(value *revCacheValue, size int64) {
+	if shard.maxBytes <= 0 && shard.governor == nil {
+		return
+	}
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if element := shard.cache[value.key]; element == nil || element.Value != value {
+		// Already evicted
+		return
+	}
+	shard.bytes += size - value.size
+	shard.governor.add(MemoryRevisionCache, size-value.size)
+	value.size = size
+	for shard.maxBytes > 0 && shard.bytes > shard.maxBytes && shard.lruList.Len() > 1 {
+		shard.purgeOldest_()
+	}
+}
+
+func (shard *revisionCacheShard) removeValue(value *revCacheValue) {
+	shard.lock.Lock()
+	if element := shard.cache[value.key]; element != nil && element.Value == value {
+		shard.lruList.Remove(element)
+		delete(shard.cache, value.key)
+		shard.bytes -= value.size
+		shard.governor.add(MemoryRevisionCache, -value.size)
+	}
+	shard.lock.Unlock()
+}
+
+func (shard *revisionCacheShard) purgeOldest_() {
+	value := shard.lruList.Remove(shard.lruList.Back()).(*revCacheValue)
+	delete(shard.cache, value.key)
+	shard.bytes -= value.size
+	shard.governor.add(MemoryRevisionCache, -value.size)
+	atomic.AddInt64(&shard.evictions, 1)
+}
+
+// Returns the total size of the cached bodies, as counted against the memory governor.
+func (rc *RevisionCache) memoryUsed() (used int64) {
+	for _, shard := range rc.shards {
+		shard.lock.Lock()
+		used += shard.bytes
+		shard.lock.Unlock()
+	}
+	return used
+}
+
+// Returns the last access time of the least recently used revision across all shards.
+func (rc *RevisionCache) leastRecentlyUsed() (lastAccess time.Time, ok bool) {
+	_, lastAccess, ok = rc.leastRecentlyUsedShard()
+	return lastAccess, ok
+}
+
+// Evicts the least recently used revisions across all shards.  Up to revCacheEvictionBatch are
+// evicted from the oldest shard before looking for the oldest shard again.
+func (rc *RevisionCache) evictLeastRecentlyUsed(bytes int64, until time.Time) (evicted int) {
+	var freed int64
+	for evicted == 0 || freed < bytes {
+		shard, _, ok := rc.leastRecentlyUsedShard()
+		if !ok {
+			break
+		}
+		shardEvicted := 0
+		shard.lock.Lock()
+		for shardEvicted < revCacheEvictionBatch && shard.lruList.Len() > 0 && (evicted == 0 || freed < bytes) {
+			oldest := shard.lruList.Back().Value.(*revCacheValue)
+			if evicted > 0 && oldest.accessed.After(until) {
+				break
+			}
+			freed += oldest.size
+			shard.purgeOldest_()
+			shardEvicted++
+			evicted++
+		}
+		shard.lock.Unlock()
+		if shardEvicted == 0 {
+			break
+		}
 	}
-	rc.lock.Unlock()
+	return evicted
 }
 
-func (rc *RevisionCache) purgeOldest_() {
-	value := rc.lruList.Remove(rc.lruList.Back()).(*revCacheValue)
-	delete(rc.cache, value.key)
+// Returns the shard whose least recently used revision is the oldest.
+func (rc *RevisionCache) leastRecentlyUsedShard() (oldest *revisionCacheShard, lastAccess time.Time, ok bool) {
+	for _, shard := range rc.shards {
+		shard.lock.Lock()
+		if back := shard.lruList.Back(); back != nil {
+			accessed := back.Value.(*revCacheValue).accessed
+			if oldest == nil || accessed.Before(lastAccess) {
+				oldest, lastAccess = shard, accessed
+			}
+		}
+		shard.lock.Unlock()
+	}
+	return oldest, lastAccess, oldest != nil
 }
 
 // Gets the body etc. out of a revCacheValue. If they aren't present already, the loader func
@@ -189,22 +420,16 @@ func (value *revCacheValue) load(loaderFunc RevisionCacheLoaderFunc) (DocumentRe
 
 	cacheHit := true
 
-	if value.body == nil && value.err == nil {
+	if value.bodyBytes == nil && value.err == nil {
 		cacheHit = false
 		if loaderFunc != nil {
-			value.body, value.history, value.channels, value.attachments, value.expiry, value.err = loaderFunc(value.key)
+			var docRev DocumentRevision
+			docRev, value.err = loaderFunc(value.key)
+			value.set(docRev)
 		}
 	}
 
-	docRev := DocumentRevision{
-		RevID:       value.key.RevID,
-		Body:        value.body.ShallowCopy(), // Never let the caller mutate the stored body
-		History:     value.history,
-		Channels:    value.channels,
-		Expiry:      value.expiry,
-		Attachments: value.attachments.ShallowCopy(), // Avoid caller mutating the stored attachments
-	}
-	return docRev, cacheHit, value.err
+	return value.asDocumentRevision(), cacheHit, value.err
 }
 
 // Retrieves the body etc. out of a revCacheValue.  If they aren't already present, loads into the cache value using
@@ -215,37 +440,113 @@ func (value *revCacheValue) loadForDoc(doc *document, context *DatabaseContext)
 
 	cacheHit := true
 
-	if value.body == nil && value.err == nil {
+	if value.bodyBytes == nil && value.err == nil {
 		cacheHit = false
-		value.body, value.history, value.channels, value.attachments, value.expiry, value.err = context.revCacheLoaderForDocument(doc, value.key.RevID)
+		var docRev DocumentRevision
+		docRev, value.err = context.revCacheLoaderForDocument(doc, value.key.RevID)
+		value.set(docRev)
+	}
+
+	return value.asDocumentRevision(), cacheHit, value.err
+}
 
+// Stores a body etc. into a revCacheValue if there isn't one already.  Returns true if it was
+// stored.
+func (value *revCacheValue) store(docRev DocumentRevision) (stored bool) {
+	value.lock.Lock()
+	if value.bodyBytes == nil {
+		stored = true
+		value.set(docRev)
+		value.attachments = docRev.Attachments.ShallowCopy() // Don't store attachments the caller might later mutate
+		value.err = nil
 	}
+	value.lock.Unlock()
+	return stored
+}
 
-	// Never let the caller mutate the stored body, attachments
-	docRev := DocumentRevision{
+// Copies a revision's body etc. into a revCacheValue.  Requires the value's lock.
+func (value *revCacheValue) set(docRev DocumentRevision) {
+	value.bodyBytes = docRev.BodyBytes
+	value.history = docRev.History
+	value.channels = docRev.Channels
+	value.expiry = docRev.Expiry
+	value.attachments = docRev.Attachments
+	value.deleted = docRev.Deleted
+	value.removed = docRev.Removed
+}
+
+// Returns the revision stored in a revCacheValue.  Requires the value's lock.
+func (value *revCacheValue) asDocumentRevision() DocumentRevision {
+	return DocumentRevision{
+		DocID:       value.key.DocID,
 		RevID:       value.key.RevID,
-		Body:        value.body.ShallowCopy(), // Never let the caller mutate the stored body
+		BodyBytes:   value.bodyBytes, // Never modified, so can be shared with the caller
 		History:     value.history,
 		Channels:    value.channels,
 		Expiry:      value.expiry,
 		Attachments: value.attachments.ShallowCopy(), // Avoid caller mutating the stored attachments
+		Deleted:     value.deleted,
+		Removed:     value.removed,
 	}
+}
 
-	return docRev, cacheHit, value.err
+// Returns a newly unmarshalled copy of the revision's body, with its _id, _rev, and _deleted or
+// _removed properties.  The caller is free to modify it.
+func (docRev *DocumentRevision) MutableBody() (Body, error) {
+	var body Body
+	if err := body.Unmarshal(docRev.BodyBytes); err != nil {
+		return nil, err
+	}
+	if body == nil {
+		body = Body{}
+	}
+	for key, value := range docRev.specialProperties() {
+		body[key] = value
+	}
+	return body, nil
 }
 
-// Stores a body etc. into a revCacheValue if there isn't one already.
-func (value *revCacheValue) store(docRev DocumentRevision) {
-	value.lock.Lock()
-	if value.body == nil {
-		value.body = docRev.Body.ShallowCopy() // Don't store a body the caller might later mutate
-		value.body[BodyId] = value.key.DocID   // Rev cache includes id and rev in the body.  Ensure they are set in case callers aren't passing
-		value.body[BodyRev] = value.key.RevID
-		value.history = docRev.History
-		value.channels = docRev.Channels
-		value.expiry = docRev.Expiry
-		value.attachments = docRev.Attachments.ShallowCopy() // Don't store attachments the caller might later mutate
-		value.err = nil
+// Returns the special properties of the revision that aren't stored in its BodyBytes.
+func (docRev *DocumentRevision) specialProperties() Body {
+	properties := Body{BodyId: docRev.DocID, BodyRev: docRev.RevID}
+	if docRev.Deleted {
+		properties[BodyDeleted] = true
 	}
-	value.lock.Unlock()
+	if docRev.Removed {
+		properties[BodyRemoved] = true
+	}
+	return properties
+}
+
+// Returns a revision body as JSON for storage in the revision cache, without the special
+// properties that the cache stores separately.
+func revCacheBodyBytes(body Body) ([]byte, error) {
+	stripped := make(Body, len(body))
+	for key, value := range body {
+		if !isRevCacheSpecialProperty(key) {
+			stripped[key] = value
+		}
+	}
+	return json.Marshal(stripped)
+}
+
+// Removes the special properties that the revision cache stores separately from a revision body
+// read from the bucket.  Bodies are only unmarshalled if they may contain one.
+func stripRevCacheSpecialProperties(bodyBytes []byte) ([]byte, error) {
+	if !bytes.Contains(bodyBytes, []byte(`"_`)) {
+		return bodyBytes, nil
+	}
+	var body Body
+	if err := body.Unmarshal(bodyBytes); err != nil {
+		return nil, err
+	}
+	return revCacheBodyBytes(body)
+}
+
+func isRevCacheSpecialProperty(key string) bool {
+	switch key {
+	case BodyId, BodyRev, BodyDeleted, BodyRemoved, BodyRevisions, BodyAttachments, BodyExpiry:
+		return true
+	}
+	return false
 }
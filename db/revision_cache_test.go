@@ -1,6 +1,7 @@
 package db
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
 	"time"
@@ -11,9 +12,10 @@ import (
 )
 
 func testDocRev(revId string, body Body, history Revisions, channels base.Set, expiry *time.Time, attachments AttachmentsMeta) DocumentRevision {
+	bodyBytes, _ := revCacheBodyBytes(body)
 	return DocumentRevision{
 		RevID:       revId,
-		Body:        body,
+		BodyBytes:   bodyBytes,
 		History:     history,
 		Channels:    channels,
 		Expiry:      expiry,
@@ -35,11 +37,13 @@ func TestRevisionCache(t *testing.T) {
 		history := Revisions{RevisionsStart: i}
 		return body, history, nil
 	}
-	verify := func(body Body, history Revisions, channels base.Set, i int) {
-		if body == nil {
+	verify := func(docRev DocumentRevision, i int) {
+		if docRev.BodyBytes == nil {
 			t.Fatalf("nil body at #%d", i)
 		}
-		goassert.True(t, body != nil)
+		body, err := docRev.MutableBody()
+		assert.NoError(t, err)
+		history, channels := docRev.History, docRev.Channels
 		goassert.Equals(t, body[BodyId], ids[i])
 		goassert.True(t, history != nil)
 		goassert.Equals(t, history[RevisionsStart], i)
@@ -55,7 +59,7 @@ func TestRevisionCache(t *testing.T) {
 
 	for i := 0; i < 10; i++ {
 		getDocRev, _ := cache.Get(ids[i], "x")
-		verify(getDocRev.Body, getDocRev.History, getDocRev.Channels, i)
+		verify(getDocRev, i)
 	}
 
 	for i := 10; i < 13; i++ {
@@ -66,53 +70,50 @@ func TestRevisionCache(t *testing.T) {
 
 	for i := 0; i < 3; i++ {
 		docRev, _ := cache.Get(ids[i], "x")
-		goassert.True(t, docRev.Body == nil)
+		goassert.True(t, docRev.BodyBytes == nil)
 	}
 	for i := 3; i < 13; i++ {
 		docRev, _ := cache.Get(ids[i], "x")
-		verify(docRev.Body, docRev.History, docRev.Channels, i)
+		verify(docRev, i)
 	}
 }
 
 func TestLoaderFunction(t *testing.T) {
 	var callsToLoader = 0
-	loader := func(id IDAndRev) (body Body, history Revisions, channels base.Set, attachments AttachmentsMeta, expiry *time.Time, err error) {
+	loader := func(id IDAndRev) (docRev DocumentRevision, err error) {
 		callsToLoader++
 		if id.DocID[0] != 'J' {
 			err = base.HTTPErrorf(404, "missing")
 		} else {
-			body = Body{
-				BodyId:  id.DocID,
-				BodyRev: id.RevID,
-			}
-			history = Revisions{RevisionsStart: 1}
-			channels = base.SetOf("*")
+			docRev.BodyBytes = []byte(`{}`)
+			docRev.History = Revisions{RevisionsStart: 1}
+			docRev.Channels = base.SetOf("*")
 		}
 		return
 	}
 	cache := NewRevisionCache(10, loader, nil)
 
 	docRev, err := cache.Get("Jens", "1")
-	goassert.Equals(t, docRev.Body[BodyId], "Jens")
+	goassert.Equals(t, docRev.DocID, "Jens")
 	goassert.True(t, docRev.History != nil)
 	goassert.True(t, docRev.Channels != nil)
 	goassert.Equals(t, err, error(nil))
 	goassert.Equals(t, callsToLoader, 1)
 
 	docRev, err = cache.Get("Peter", "1")
-	goassert.DeepEquals(t, docRev.Body, Body(nil))
+	goassert.DeepEquals(t, docRev.BodyBytes, []byte(nil))
 	goassert.DeepEquals(t, err, base.HTTPErrorf(404, "missing"))
 	goassert.Equals(t, callsToLoader, 2)
 
 	docRev, err = cache.Get("Jens", "1")
-	goassert.Equals(t, docRev.Body[BodyId], "Jens")
+	goassert.Equals(t, docRev.DocID, "Jens")
 	goassert.True(t, docRev.History != nil)
 	goassert.True(t, docRev.Channels != nil)
 	goassert.Equals(t, err, error(nil))
 	goassert.Equals(t, callsToLoader, 2)
 
 	docRev, err = cache.Get("Peter", "1")
-	goassert.DeepEquals(t, docRev.Body, Body(nil))
+	goassert.DeepEquals(t, docRev.BodyBytes, []byte(nil))
 	goassert.DeepEquals(t, err, base.HTTPErrorf(404, "missing"))
 	goassert.Equals(t, callsToLoader, 3)
 }
@@ -163,3 +164,155 @@ func TestRevisionCacheInternalProperties(t *testing.T) {
 	_, idsOk := validRevisionsMap[RevisionsIds]
 	goassert.True(t, idsOk)
 }
+
+func TestShardedRevisionCache(t *testing.T) {
+	cache := NewShardedRevisionCache(&RevisionCacheOptions{Size: 100, ShardCount: 4}, nil, nil)
+	assert.Len(t, cache.shards, 4)
+
+	history := Revisions{RevisionsStart: 1}
+	for i := 0; i < 50; i++ {
+		cache.Put(fmt.Sprintf("doc%d", i), testDocRev("1-a", Body{"value": i}, history, nil, nil, nil))
+	}
+	for i := 0; i < 50; i++ {
+		docRev, err := cache.Get(fmt.Sprintf("doc%d", i), "1-a")
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(`{"value":%d}`, i), string(docRev.BodyBytes))
+	}
+
+	// Every revision is in the shard for its doc, and is counted there
+	entries, hits := 0, int64(0)
+	for _, shardStats := range cache.ShardStats() {
+		entries += shardStats.Entries
+		hits += shardStats.Hits
+		assert.Equal(t, int64(0), shardStats.Evictions)
+	}
+	assert.Equal(t, 50, entries)
+	assert.Equal(t, int64(50), hits)
+}
+
+func TestRevisionCacheMaxBytes(t *testing.T) {
+	var callsToLoader = 0
+	loader := func(id IDAndRev) (DocumentRevision, error) {
+		callsToLoader++
+		return DocumentRevision{BodyBytes: []byte(`{"value":"0123456789012345678901234567890123456789"}`), History: Revisions{RevisionsStart: 1}}, nil
+	}
+
+	// Room for a couple of revisions in the single shard
+	cache := NewShardedRevisionCache(&RevisionCacheOptions{Size: 100, ShardCount: 1, MaxBytes: 120}, loader, nil)
+	for i := 0; i < 5; i++ {
+		_, err := cache.Get(fmt.Sprintf("doc%d", i), "1-a")
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 5, callsToLoader)
+
+	stats := cache.ShardStats()[0]
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, int64(3), stats.Evictions)
+	assert.True(t, stats.Bytes <= 120)
+
+	// The most recent revisions are still cached, the oldest have to be reloaded
+	_, err := cache.Get("doc4", "1-a")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, callsToLoader)
+	_, err = cache.Get("doc0", "1-a")
+	assert.NoError(t, err)
+	assert.Equal(t, 6, callsToLoader)
+}
+
+func TestRevisionCacheBodyBytes(t *testing.T) {
+
+	db, testBucket := setupTestDBWithCacheOptions(t, CacheOptions{})
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	rev1id, err := db.Put("doc1", Body{"value": 1234, BodyExpiry: 100})
+	assert.NoError(t, err, "Put")
+	rev2id, err := db.DeleteDoc("doc1", rev1id)
+	assert.NoError(t, err, "DeleteDoc")
+
+	// The cache holds bodies as JSON without special properties, which are stored separately
+	docRev, err := db.revisionCache.Get("doc1", rev1id)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"value":1234}`, string(docRev.BodyBytes))
+	assert.False(t, docRev.Deleted)
+	docRev, err = db.revisionCache.Get("doc1", rev2id)
+	assert.NoError(t, err)
+	assert.Equal(t, `{}`, string(docRev.BodyBytes))
+	assert.True(t, docRev.Deleted)
+
+	// Mutable bodies have the special properties added back, and can be modified
+	body, err := docRev.MutableBody()
+	assert.NoError(t, err)
+	assert.Equal(t, Body{BodyId: "doc1", BodyRev: rev2id, BodyDeleted: true}, body)
+	body["modified"] = true
+	docRev, err = db.revisionCache.Get("doc1", rev2id)
+	assert.NoError(t, err)
+	assert.Equal(t, `{}`, string(docRev.BodyBytes))
+
+	// Revisions read from the bucket are stripped of special properties too
+	db.DatabaseContext.revisionCache = NewRevisionCache(KDefaultRevisionCacheCapacity, db.DatabaseContext.revCacheLoader, nil)
+	docRev, err = db.revisionCache.Get("doc1", rev1id)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"value":1234}`, string(docRev.BodyBytes))
+
+	// The JSON returned to clients matches the unmarshalled body
+	bodyBytes, revID, err := db.GetRevJSONWithHistory("doc1", rev1id, 0, nil, false)
+	assert.NoError(t, err)
+	assert.Equal(t, rev1id, revID)
+	body, err = db.GetRevWithHistory("doc1", rev1id, 0, nil, nil, false)
+	assert.NoError(t, err)
+	expected, _ := json.Marshal(body)
+	assert.Equal(t, string(expected), string(bodyBytes))
+}
+
+func TestPreloadRevisions(t *testing.T) {
+
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+	if db.UseXattrs() {
+		t.Skip("Revisions aren't preloaded with xattrs")
+	}
+
+	ids := make([]IDAndRev, 0, 6)
+	for i := 0; i < 5; i++ {
+		docid := fmt.Sprintf("doc%d", i)
+		revid, err := db.Put(docid, Body{"value": i})
+		assert.NoError(t, err)
+		ids = append(ids, IDAndRev{DocID: docid, RevID: revid})
+	}
+	ids = append(ids, IDAndRev{DocID: "missing", RevID: "1-a"})
+	rev1id, err := db.Put("updated", Body{"value": 1})
+	assert.NoError(t, err)
+	rev2id, err := db.Put("updated", Body{"value": 2, BodyRev: rev1id})
+	assert.NoError(t, err)
+
+	loads := 0
+	loader := func(id IDAndRev) (DocumentRevision, error) {
+		loads++
+		return db.DatabaseContext.revCacheLoader(id)
+	}
+	db.DatabaseContext.revisionCache = NewRevisionCache(KDefaultRevisionCacheCapacity, loader, nil)
+
+	// The revisions are cached with a single multi-get, so getting them doesn't load them again
+	db.PreloadRevisions(ids)
+	for i, id := range ids[:5] {
+		body, err := db.GetRevWithHistory(id.DocID, id.RevID, 0, nil, nil, false)
+		assert.NoError(t, err)
+		assert.Equal(t, json.Number(fmt.Sprint(i)), body["value"])
+	}
+	assert.Equal(t, 0, loads)
+
+	_, err = db.GetRevWithHistory("missing", "1-a", 0, nil, nil, false)
+	assert.Error(t, err)
+	assert.Equal(t, 1, loads)
+
+	// Revisions that aren't current are left to be loaded when they're requested
+	db.PreloadRevisions([]IDAndRev{{DocID: "updated", RevID: rev1id}, {DocID: "updated", RevID: rev2id}, {DocID: "missing2", RevID: "1-a"}})
+	_, err = db.GetRevWithHistory("updated", rev2id, 0, nil, nil, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, loads)
+	_, err = db.GetRevWithHistory("updated", rev1id, 0, nil, nil, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, loads)
+}
@@ -70,3 +70,27 @@ func TestBodyUnmarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestInjectJSONProperties(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		properties Body
+		expected   string
+	}{
+		{"no properties", `{"test":true}`, nil, `{"test":true}`},
+		{"empty object", ` { } `, Body{BodyId: "doc1"}, `{"_id":"doc1"}`},
+		{"sorted", `{"test":true}`, Body{BodyRev: "1-a", BodyId: "doc1"}, `{"_id":"doc1","_rev":"1-a","test":true}`},
+		{"nested", `{"a":{"b":[1,2]}}`, Body{BodyDeleted: true}, `{"_deleted":true,"a":{"b":[1,2]}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(ts *testing.T) {
+			output, err := InjectJSONProperties([]byte(test.input), test.properties)
+			assert.NoError(ts, err)
+			assert.Equal(ts, test.expected, string(output))
+		})
+	}
+
+	_, err := InjectJSONProperties([]byte(`[1,2]`), Body{BodyId: "doc1"})
+	assert.Error(t, err)
+}
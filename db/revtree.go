@@ -731,7 +731,11 @@ func ParseRevisions(body Body) []string {
 		oneRev = append(oneRev, revid)
 		return oneRev
 	}
-	revisions := Revisions(revisionsMap)
+	return Revisions(revisionsMap).ParseRevisions()
+}
+
+// Returns the rev IDs in an encoded revision list, newest first.
+func (revisions Revisions) ParseRevisions() []string {
 	start, ids := splitRevisionList(revisions)
 	if ids == nil {
 		return nil
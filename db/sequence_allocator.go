@@ -11,6 +11,7 @@ package db
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -25,12 +26,38 @@ const (
 	SyncSeqKey              = "_sync:seq"        // Key for sequence counter doc
 )
 
+var errSequenceAllocatorStopped = errors.New("Sequence allocator has been stopped")
+
+const (
+	// Default max number of sequences reserved at once.  Batching is opt-in: reserved sequences that
+	// end up unused are only released once allocation goes idle or the batch ages out, and until
+	// then the change cache of every node sharing the counter holds back later sequences waiting
+	// for them.  It also stops sequences being allocated in counter order across nodes.
+	DefaultMaxSequenceBatchSize   = 1
+	sequenceBatchIncreaseInterval = time.Second             // A batch used up within this time is followed by a bigger one
+	releaseSequenceWait           = 1500 * time.Millisecond // Time after the last allocation that unused reserved sequences are released
+)
+
+// Allocates sequences from the bucket's counter.  Sequences are reserved from the counter in
+// batches, whose size doubles while batches are used up quickly, up to maxBatchSize, and halves
+// while they're used up slowly, or when allocation goes idle before a batch is used up.  The
+// unused sequences of a batch are then released, so that the change cache doesn't wait for them
+// and skip them.  They're also released once the batch has been open for maxBatchAge, so that
+// steady but slow allocation doesn't hold them past the change cache's max wait for a pending
+// sequence.
 type sequenceAllocator struct {
-	bucket  base.Bucket    // Bucket whose counter to use
-	dbStats *DatabaseStats // For updating per-db stats
-	mutex   sync.Mutex     // Makes this object thread-safe
-	last    uint64         // Last sequence # assigned
-	max     uint64         // Max sequence # reserved
+	bucket         base.Bucket    // Bucket whose counter to use
+	dbStats        *DatabaseStats // For updating per-db stats
+	mutex          sync.Mutex     // Makes this object thread-safe
+	last           uint64         // Last sequence # assigned
+	max            uint64         // Max sequence # reserved
+	maxBatchSize   uint64         // Max number of sequences to reserve at once
+	maxBatchAge    time.Duration  // Max time after a batch is reserved that its unused sequences are released
+	batchSize      uint64         // Number of sequences to reserve next
+	lastReserve    time.Time      // When sequences were last reserved for allocation
+	lastAllocation time.Time      // When a sequence was last allocated
+	releaseTimer   *time.Timer    // Releases unused sequences once allocation is idle
+	stopped        bool           // Set by stop(), after which no more sequences are reserved
 }
 
 func newSequenceAllocator(bucket base.Bucket, dbStats *DatabaseStats) (*sequenceAllocator, error) {
@@ -40,12 +67,39 @@ func newSequenceAllocator(bucket base.Bucket, dbStats *DatabaseStats) (*sequence
 	}
 
 	s := &sequenceAllocator{
-		bucket:  bucket,
-		dbStats: dbStats,
+		bucket:       bucket,
+		dbStats:      dbStats,
+		maxBatchSize: DefaultMaxSequenceBatchSize,
+		maxBatchAge:  DefaultCachePendingSeqMaxWait / 2,
+		batchSize:    1,
 	}
 	return s, s.reserveSequences(0) // just reads latest sequence from bucket
 }
 
+// Sets the max number of sequences reserved at once.  A size of 0 sets the default.
+func (s *sequenceAllocator) setMaxBatchSize(maxBatchSize uint64) {
+	if maxBatchSize == 0 {
+		maxBatchSize = DefaultMaxSequenceBatchSize
+	}
+	s.mutex.Lock()
+	s.maxBatchSize = maxBatchSize
+	if s.batchSize > maxBatchSize {
+		s.batchSize = maxBatchSize
+	}
+	s.mutex.Unlock()
+}
+
+// Sets the max time unused sequences are held, from the change cache's max wait for a pending
+// sequence.  Half of the wait is left for the released sequences to reach the change cache.
+func (s *sequenceAllocator) setPendingSeqMaxWait(pendingSeqMaxWait time.Duration) {
+	if pendingSeqMaxWait == 0 {
+		pendingSeqMaxWait = DefaultCachePendingSeqMaxWait
+	}
+	s.mutex.Lock()
+	s.maxBatchAge = pendingSeqMaxWait / 2
+	s.mutex.Unlock()
+}
+
 func (s *sequenceAllocator) lastSequence() (uint64, error) {
 	s.dbStats.StatsDatabase().Add(base.StatKeySequenceGets, 1)
 	last, err := s.incrWithRetry(SyncSeqKey, 0)
@@ -59,20 +113,112 @@ func (s *sequenceAllocator) nextSequence() (uint64, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	if s.last >= s.max {
-		if err := s._reserveSequences(1); err != nil {
+		if err := s._reserveSequences(s._nextBatchSize()); err != nil {
 			return 0, err
 		}
 	}
 	s.last++
+	s.lastAllocation = time.Now()
+	s.dbStats.StatsDatabase().Add(base.StatKeySequenceAssignedCount, 1)
+
+	// Release any sequences left in the batch if no more are allocated for a while, or once the
+	// batch is too old
+	if s.last < s.max {
+		wait := releaseSequenceWait
+		if untilMaxAge := s.maxBatchAge - time.Since(s.lastReserve); untilMaxAge < wait {
+			wait = untilMaxAge
+		}
+		if s.releaseTimer == nil {
+			s.releaseTimer = time.AfterFunc(wait, s.releaseUnusedSequences)
+		} else {
+			s.releaseTimer.Reset(wait)
+		}
+	}
 	return s.last, nil
 }
 
+// Returns the number of sequences to reserve for allocation, doubling the batch size if the last
+// batch was used up quickly, and halving it if it took longer than sequenceBatchIncreaseInterval.
+func (s *sequenceAllocator) _nextBatchSize() uint64 {
+	now := time.Now()
+	elapsed := now.Sub(s.lastReserve)
+	if elapsed < sequenceBatchIncreaseInterval && s.batchSize < s.maxBatchSize {
+		s.batchSize *= 2
+		if s.batchSize > s.maxBatchSize {
+			s.batchSize = s.maxBatchSize
+		}
+		s.dbStats.StatsDatabase().Set(base.StatKeySequenceBatchSize, base.ExpvarUInt64Val(s.batchSize))
+		base.Debugf(base.KeyCRUD, "Increased sequence batch size to %d", s.batchSize)
+	} else if elapsed > sequenceBatchIncreaseInterval && s.batchSize > 1 {
+		s.batchSize /= 2
+		s.dbStats.StatsDatabase().Set(base.StatKeySequenceBatchSize, base.ExpvarUInt64Val(s.batchSize))
+		base.Debugf(base.KeyCRUD, "Decreased sequence batch size to %d", s.batchSize)
+	}
+	s.lastReserve = now
+	return s.batchSize
+}
+
+// Releases the reserved sequences that haven't been allocated, unless a sequence has been allocated
+// recently and the batch isn't too old, and halves the batch size.
+func (s *sequenceAllocator) releaseUnusedSequences() {
+	s.mutex.Lock()
+	if time.Since(s.lastAllocation) < releaseSequenceWait && time.Since(s.lastReserve) < s.maxBatchAge {
+		s.mutex.Unlock()
+		return
+	}
+	first, last := s._takeUnusedSequences()
+	if first <= last && s.batchSize > 1 {
+		s.batchSize /= 2
+		s.dbStats.StatsDatabase().Set(base.StatKeySequenceBatchSize, base.ExpvarUInt64Val(s.batchSize))
+	}
+	s.mutex.Unlock()
+	s.releaseSequenceRange(first, last)
+}
+
+// Returns the range of reserved sequences that haven't been allocated, and stops them being
+// allocated.  The range is empty if first > last.
+func (s *sequenceAllocator) _takeUnusedSequences() (first, last uint64) {
+	first, last = s.last+1, s.max
+	s.last = s.max
+	return first, last
+}
+
+func (s *sequenceAllocator) releaseSequenceRange(first, last uint64) {
+	if first > last {
+		return
+	}
+	base.Debugf(base.KeyCRUD, "Releasing unused sequences #%d - #%d", first, last)
+	for sequence := first; sequence <= last; sequence++ {
+		if err := s.releaseSequence(sequence); err != nil {
+			base.Warnf(base.KeyAll, "Error releasing unused sequence #%d - it will be skipped: %v", sequence, err)
+		}
+	}
+}
+
+// Stops the release timer, and releases the reserved sequences that haven't been allocated.  No
+// more sequences can be allocated afterwards.  Writes one document per released sequence, so
+// shouldn't be called while holding locks that other requests wait for.
+func (s *sequenceAllocator) stop() {
+	s.mutex.Lock()
+	s.stopped = true
+	if s.releaseTimer != nil {
+		s.releaseTimer.Stop()
+	}
+	first, last := s._takeUnusedSequences()
+	s.mutex.Unlock()
+	s.releaseSequenceRange(first, last)
+}
+
 func (s *sequenceAllocator) _reserveSequences(numToReserve uint64) error {
 	if s.last < s.max {
 		return nil // Already have some sequences left; don't be greedy and waste them
 		//OPT: Could remember multiple discontiguous ranges of free sequences
 	}
+	if s.stopped {
+		return errSequenceAllocatorStopped
+	}
 	s.dbStats.StatsDatabase().Add(base.StatKeySequenceReserves, 1)
+	s.dbStats.StatsDatabase().Add(base.StatKeySequenceReservedCount, int64(numToReserve))
 
 	max, err := s.incrWithRetry(SyncSeqKey, numToReserve)
 	if err != nil {
@@ -129,6 +275,11 @@ func (s *sequenceAllocator) releaseSequence(sequence uint64) error {
 	body := make([]byte, 8)
 	binary.LittleEndian.PutUint64(body, sequence)
 	_, err := s.bucket.AddRaw(key, UnusedSequenceTTL, body)
+	if err != nil {
+		s.dbStats.StatsDatabase().Add(base.StatKeySequenceReleaseErrors, 1)
+		return err
+	}
+	s.dbStats.StatsDatabase().Add(base.StatKeySequenceReleasedCount, 1)
 	base.Debugf(base.KeyCRUD, "Released unused sequence #%d", sequence)
-	return err
+	return nil
 }
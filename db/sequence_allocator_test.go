@@ -0,0 +1,132 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSequenceAllocatorAdaptiveBatch(t *testing.T) {
+
+	testBucket := testBucket()
+	defer testBucket.Close()
+	stats := NewDatabaseStats()
+	allocator, err := newSequenceAllocator(testBucket.Bucket, stats)
+	assert.NoError(t, err)
+	allocator.setMaxBatchSize(4)
+
+	// Batches double while they're used up quickly
+	for expected := uint64(1); expected <= 4; expected++ {
+		sequence, err := allocator.nextSequence()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, sequence)
+	}
+	assert.Equal(t, uint64(4), allocator.batchSize)
+	assert.Equal(t, uint64(7), allocator.max)
+	assert.Equal(t, "4", stats.StatsDatabase().Get(base.StatKeySequenceBatchSize).String())
+	assert.Equal(t, "7", stats.StatsDatabase().Get(base.StatKeySequenceReservedCount).String())
+
+	// Once idle, the rest of the batch is released, and the batch size halved
+	allocator.mutex.Lock()
+	allocator.lastAllocation = time.Now().Add(-releaseSequenceWait)
+	allocator.mutex.Unlock()
+	allocator.releaseUnusedSequences()
+	assert.Equal(t, uint64(2), allocator.batchSize)
+	assert.Equal(t, "3", stats.StatsDatabase().Get(base.StatKeySequenceReleasedCount).String())
+	for sequence := 5; sequence <= 7; sequence++ {
+		_, _, err := testBucket.Bucket.GetRaw(fmt.Sprintf("%s%d", UnusedSequenceKeyPrefix, sequence))
+		assert.NoError(t, err, "Sequence %d wasn't released", sequence)
+	}
+
+	// Stopping releases the rest of the batch
+	sequence, err := allocator.nextSequence()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(8), sequence)
+	allocator.stop()
+	_, _, err = testBucket.Bucket.GetRaw(fmt.Sprintf("%s%d", UnusedSequenceKeyPrefix, 9))
+	assert.NoError(t, err)
+	assert.Equal(t, "5", stats.StatsDatabase().Get(base.StatKeySequenceAssignedCount).String())
+
+	last, err := allocator.lastSequence()
+	assert.NoError(t, err)
+	assert.Equal(t, allocator.max, last)
+
+	// Once stopped, no more sequences are allocated
+	_, err = allocator.nextSequence()
+	assert.Equal(t, errSequenceAllocatorStopped, err)
+	assert.Equal(t, last, allocator.max)
+}
+
+func TestSequenceAllocatorShrinkingBatch(t *testing.T) {
+
+	testBucket := testBucket()
+	defer testBucket.Close()
+	allocator, err := newSequenceAllocator(testBucket.Bucket, NewDatabaseStats())
+	assert.NoError(t, err)
+	allocator.setMaxBatchSize(8)
+	allocator.batchSize = 8
+
+	// A batch that takes longer than the increase interval to use up is followed by a smaller one
+	allocator.mutex.Lock()
+	allocator.lastReserve = time.Now().Add(-2 * sequenceBatchIncreaseInterval)
+	assert.Equal(t, uint64(4), allocator._nextBatchSize())
+	allocator.lastReserve = time.Now().Add(-2 * sequenceBatchIncreaseInterval)
+	assert.Equal(t, uint64(2), allocator._nextBatchSize())
+
+	// A batch used up quickly is followed by a bigger one again
+	assert.Equal(t, uint64(4), allocator._nextBatchSize())
+	allocator.mutex.Unlock()
+}
+
+func TestSequenceAllocatorBatchMaxAge(t *testing.T) {
+
+	testBucket := testBucket()
+	defer testBucket.Close()
+	stats := NewDatabaseStats()
+	allocator, err := newSequenceAllocator(testBucket.Bucket, stats)
+	assert.NoError(t, err)
+	allocator.setMaxBatchSize(4)
+	allocator.setPendingSeqMaxWait(10 * time.Second)
+	assert.Equal(t, 5*time.Second, allocator.maxBatchAge)
+
+	for expected := uint64(1); expected <= 4; expected++ {
+		sequence, err := allocator.nextSequence()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, sequence)
+	}
+
+	// While sequences are allocated regularly, the rest of the batch is held until it's too old
+	allocator.releaseUnusedSequences()
+	assert.Equal(t, uint64(4), allocator.last)
+	allocator.mutex.Lock()
+	allocator.lastReserve = time.Now().Add(-allocator.maxBatchAge)
+	allocator.mutex.Unlock()
+	allocator.releaseUnusedSequences()
+	assert.Equal(t, allocator.max, allocator.last)
+	assert.Equal(t, "3", stats.StatsDatabase().Get(base.StatKeySequenceReleasedCount).String())
+	for sequence := 5; sequence <= 7; sequence++ {
+		_, _, err := testBucket.Bucket.GetRaw(fmt.Sprintf("%s%d", UnusedSequenceKeyPrefix, sequence))
+		assert.NoError(t, err, "Sequence %d wasn't released", sequence)
+	}
+	allocator.stop()
+}
+
+func TestSequenceAllocatorDefaultBatch(t *testing.T) {
+
+	testBucket := testBucket()
+	defer testBucket.Close()
+	allocator, err := newSequenceAllocator(testBucket.Bucket, NewDatabaseStats())
+	assert.NoError(t, err)
+
+	// By default, sequences are reserved one at a time, so none are left to release
+	for expected := uint64(1); expected <= 3; expected++ {
+		sequence, err := allocator.nextSequence()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, sequence)
+		assert.Equal(t, sequence, allocator.max)
+	}
+	assert.Nil(t, allocator.releaseTimer)
+}
@@ -112,9 +112,19 @@ func (s SequenceID) clockSeqToString() string {
 }
 
 // Currently accepts a plain string, but in the future might accept generic JSON objects.
-// Calling this with a JSON string will result in an error.
+// Calling this with a JSON string will result in an error.  Also accepts a time (see IsTimeSince),
+// which is resolved to the sequence to get the changes made after it from.
 func (dbc *DatabaseContext) ParseSequenceID(str string) (s SequenceID, err error) {
 
+	if IsTimeSince(str) {
+		if dbc.SequenceHasher != nil {
+			return SequenceID{}, base.HTTPErrorf(400, "A since time isn't supported with a channel index")
+		}
+		s.SeqType = IntSequenceType
+		s.Seq, err = dbc.SequenceForTime(str)
+		return s, err
+	}
+
 	// If there's a sequence hasher defined, we're expecting clock-based sequences
 	if dbc.SequenceHasher != nil {
 		return parseClockSequenceID(str, dbc.SequenceHasher)
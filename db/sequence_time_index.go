@@ -0,0 +1,180 @@
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// A changes feed's since can be a time instead of a sequence, to get the changes made after that
+// time.  Times are resolved to sequences using samples of the change cache's stable sequence, taken
+// periodically by every node and merged into a document in the bucket.  A sample of sequence S at
+// time T means every change up to S was made by T, so a feed since a time after T can safely skip
+// them.  Changes made between the last sample before the time and the time itself are still sent.
+
+const (
+	SinceNow                   = "now"              // Since value for changes made from now on
+	sequenceTimeSampleInterval = 5 * time.Minute    // How often the stable sequence is sampled
+	sequenceTimeRetention      = 7 * 24 * time.Hour // How long samples are kept
+	maxSequenceTimeSamples     = 4096
+	sequenceTimesKey           = KSyncKeyPrefix + "seqTimes"
+)
+
+// A sample of the stable sequence
+type sequenceTimeSample struct {
+	sequence uint64
+	time     int64 // Unix seconds
+}
+
+// Samples of the stable sequence, in time and sequence order.
+type sequenceTimeIndex struct {
+	lock    sync.RWMutex
+	samples []sequenceTimeSample
+}
+
+// The samples of all nodes, as stored in the bucket
+type sequenceTimesDoc struct {
+	Sequences []uint64 `json:"seqs"`
+	Times     []int64  `json:"times"` // Unix seconds
+}
+
+// Whether a since value is a time rather than a sequence.
+func IsTimeSince(since string) bool {
+	if since == SinceNow {
+		return true
+	}
+	_, err := time.Parse(time.RFC3339, since)
+	return err == nil
+}
+
+// Adds samples, keeping the list ordered and dropping those made redundant by a later sample of a
+// higher sequence, or older than the retention period.
+func mergeSequenceTimeSamples(samples []sequenceTimeSample, added ...sequenceTimeSample) []sequenceTimeSample {
+	merged := make([]sequenceTimeSample, 0, len(samples)+len(added))
+	merged = append(merged, samples...)
+	merged = append(merged, added...)
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].time != merged[j].time {
+			return merged[i].time < merged[j].time
+		}
+		return merged[i].sequence > merged[j].sequence
+	})
+
+	oldest := time.Now().Add(-sequenceTimeRetention).Unix()
+	result := merged[:0]
+	for _, sample := range merged {
+		if sample.time < oldest {
+			continue
+		}
+		if n := len(result); n > 0 && (sample.time == result[n-1].time || sample.sequence <= result[n-1].sequence) {
+			continue
+		}
+		result = append(result, sample)
+	}
+	if len(result) > maxSequenceTimeSamples {
+		result = result[len(result)-maxSequenceTimeSamples:]
+	}
+	return result
+}
+
+func (doc *sequenceTimesDoc) samples() []sequenceTimeSample {
+	samples := make([]sequenceTimeSample, 0, len(doc.Sequences))
+	for i := 0; i < len(doc.Sequences) && i < len(doc.Times); i++ {
+		samples = append(samples, sequenceTimeSample{sequence: doc.Sequences[i], time: doc.Times[i]})
+	}
+	return samples
+}
+
+func newSequenceTimesDoc(samples []sequenceTimeSample) *sequenceTimesDoc {
+	doc := &sequenceTimesDoc{Sequences: make([]uint64, len(samples)), Times: make([]int64, len(samples))}
+	for i, sample := range samples {
+		doc.Sequences[i] = sample.sequence
+		doc.Times[i] = sample.time
+	}
+	return doc
+}
+
+// Adds samples to the index.
+func (index *sequenceTimeIndex) add(samples ...sequenceTimeSample) {
+	index.lock.Lock()
+	index.samples = mergeSequenceTimeSamples(index.samples, samples...)
+	index.lock.Unlock()
+}
+
+// Returns the highest sequence sampled at or before the given time, or 0 if there's none.
+func (index *sequenceTimeIndex) sequenceAt(t time.Time) uint64 {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+	unix := t.Unix()
+	i := sort.Search(len(index.samples), func(i int) bool { return index.samples[i].time > unix })
+	if i == 0 {
+		return 0
+	}
+	return index.samples[i-1].sequence
+}
+
+// Returns a sample of the current stable sequence.  Its time is rounded up to the next second, so
+// that it's no earlier than the changes it covers.
+func (c *changeCache) stableSequenceSample() sequenceTimeSample {
+	sequence := c.GetStableSequence("").Seq
+	return sequenceTimeSample{sequence: sequence, time: time.Now().Unix() + 1}
+}
+
+// Samples the stable sequence, and merges the index with those of the other nodes in the bucket.
+func (c *changeCache) sampleSequenceTime() {
+	c.sequenceTimes.add(c.stableSequenceSample())
+
+	var merged []sequenceTimeSample
+	_, err := c.context.Bucket.Update(sequenceTimesKey, 0, func(current []byte) ([]byte, *uint32, error) {
+		var doc sequenceTimesDoc
+		if current != nil {
+			if err := json.Unmarshal(current, &doc); err != nil {
+				base.Warnf(base.KeyCache, "Database %s: Replacing invalid sequence times: %v", base.UD(c.context.Name), err)
+			}
+		}
+		c.sequenceTimes.lock.RLock()
+		merged = mergeSequenceTimeSamples(c.sequenceTimes.samples, doc.samples()...)
+		c.sequenceTimes.lock.RUnlock()
+		updated, err := json.Marshal(newSequenceTimesDoc(merged))
+		return updated, nil, err
+	})
+	if err != nil {
+		base.Warnf(base.KeyCache, "Database %s: Unable to persist sequence times: %v", base.UD(c.context.Name), err)
+		return
+	}
+	c.sequenceTimes.add(merged...)
+}
+
+// Loads the samples persisted in the bucket by any node.
+func (c *changeCache) loadSequenceTimes() {
+	var doc sequenceTimesDoc
+	if _, err := c.context.Bucket.Get(sequenceTimesKey, &doc); err != nil {
+		if !base.IsDocNotFoundError(err) {
+			base.Warnf(base.KeyCache, "Database %s: Unable to load sequence times: %v", base.UD(c.context.Name), err)
+		}
+		return
+	}
+	c.sequenceTimes.add(doc.samples()...)
+}
+
+// Returns the sequence to get the changes made after a time from, which is either SinceNow or an
+// RFC3339 timestamp.  Changes made shortly before the time may be included, but none after it
+// are excluded.
+func (context *DatabaseContext) SequenceForTime(since string) (uint64, error) {
+	cache, ok := context.changeCache.(*changeCache)
+	if !ok {
+		return 0, base.HTTPErrorf(http.StatusBadRequest, "A since time isn't supported with a channel index")
+	}
+	if since == SinceNow {
+		return cache.GetStableSequence("").Seq, nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return 0, base.HTTPErrorf(http.StatusBadRequest, "Invalid since time %q", since)
+	}
+	return cache.sequenceTimes.sequenceAt(t), nil
+}
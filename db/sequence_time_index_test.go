@@ -0,0 +1,75 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeSequenceTimeSamples(t *testing.T) {
+	now := time.Now().Unix()
+	samples := mergeSequenceTimeSamples(nil,
+		sequenceTimeSample{sequence: 20, time: now - 60},
+		sequenceTimeSample{sequence: 10, time: now - 120},
+		sequenceTimeSample{sequence: 5, time: now - int64(sequenceTimeRetention/time.Second) - 1},
+	)
+	assert.Equal(t, []sequenceTimeSample{{sequence: 10, time: now - 120}, {sequence: 20, time: now - 60}}, samples)
+
+	// Another node's samples are interleaved, dropping those that don't add anything
+	samples = mergeSequenceTimeSamples(samples,
+		sequenceTimeSample{sequence: 15, time: now - 90},
+		sequenceTimeSample{sequence: 12, time: now - 30},
+		sequenceTimeSample{sequence: 25, time: now - 60},
+	)
+	assert.Equal(t, []sequenceTimeSample{
+		{sequence: 10, time: now - 120},
+		{sequence: 15, time: now - 90},
+		{sequence: 25, time: now - 60},
+	}, samples)
+
+	index := sequenceTimeIndex{samples: samples}
+	assert.Equal(t, uint64(0), index.sequenceAt(time.Unix(now-121, 0)))
+	assert.Equal(t, uint64(10), index.sequenceAt(time.Unix(now-120, 0)))
+	assert.Equal(t, uint64(15), index.sequenceAt(time.Unix(now-61, 0)))
+	assert.Equal(t, uint64(25), index.sequenceAt(time.Unix(now, 0)))
+}
+
+func TestSequenceForTime(t *testing.T) {
+
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+	cache := db.changeCache.(*changeCache)
+
+	before := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	_, err := db.Put("doc1", Body{"channels": []string{"A"}})
+	assert.NoError(t, err)
+	_, err = db.Put("doc2", Body{"channels": []string{"A"}})
+	assert.NoError(t, err)
+	assert.NoError(t, db.WaitForPendingChanges())
+	cache.sampleSequenceTime()
+
+	// Times before the first sample get every change
+	since, err := db.ParseSequenceID(before)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), since.Seq)
+
+	after := time.Now().Add(2 * time.Second).Format(time.RFC3339)
+	since, err = db.ParseSequenceID(after)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), since.Seq)
+
+	since, err = db.ParseSequenceID(SinceNow)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), since.Seq)
+
+	// The samples were persisted, so are loaded by other nodes
+	var doc sequenceTimesDoc
+	_, err = db.Bucket.Get(sequenceTimesKey, &doc)
+	assert.NoError(t, err)
+	assert.Contains(t, doc.Sequences, uint64(2))
+
+	_, err = db.ParseSequenceID("2019-13-45T00:00:00Z")
+	assert.Error(t, err)
+}
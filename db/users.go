@@ -12,13 +12,22 @@ import (
 // Also used in the rest package as a JSON object that defines a User/Role within a DbConfig
 // and structures the request/response body in the admin REST API for /db/_user/*
 type PrincipalConfig struct {
-	Name             *string  `json:"name,omitempty"`
-	ExplicitChannels base.Set `json:"admin_channels,omitempty"`
-	Channels         base.Set `json:"all_channels"`
+	Name                  *string  `json:"name,omitempty"`
+	ExplicitChannels      base.Set `json:"admin_channels,omitempty"`
+	Channels              base.Set `json:"all_channels"`
+	ExplicitWriteChannels base.Set `json:"admin_write_channels,omitempty"`
+	WriteChannels         base.Set `json:"all_write_channels,omitempty"`
+	// Only applies to Roles, not Users:
+	ParentRoleNames []string `json:"parent_roles,omitempty"`
 	// Fields below only apply to Users, not Roles:
-	Email             string   `json:"email,omitempty"`
-	Disabled          bool     `json:"disabled,omitempty"`
-	Password          *string  `json:"password,omitempty"`
+	Email    string  `json:"email,omitempty"`
+	Disabled bool    `json:"disabled,omitempty"`
+	Password *string `json:"password,omitempty"`
+	// Whether an admin requires the user to change their password before doing anything else
+	PasswordChangeRequired bool `json:"password_change_required,omitempty"`
+	// Whether the password has expired under the password policy, which also requires it to be
+	// changed.  Read-only
+	PasswordExpired   bool     `json:"password_expired,omitempty"`
 	ExplicitRoleNames []string `json:"admin_roles,omitempty"`
 	RoleNames         []string `json:"roles,omitempty"`
 }
@@ -70,14 +79,22 @@ func (dbc *DatabaseContext) GetPrincipal(name string, isUser bool) (info *Princi
 	info = new(PrincipalConfig)
 	info.Name = &name
 	info.ExplicitChannels = princ.ExplicitChannels().AsSet()
+	info.ExplicitWriteChannels = princ.ExplicitWriteChannels().AsSet()
 	if user, ok := princ.(auth.User); ok {
 		info.Channels = user.InheritedChannels().AsSet()
+		info.WriteChannels = user.InheritedWriteChannels().AsSet()
 		info.Email = user.Email()
 		info.Disabled = user.Disabled()
+		info.PasswordChangeRequired = user.PasswordChangeFlagged()
+		info.PasswordExpired = user.PasswordExpired()
 		info.ExplicitRoleNames = user.ExplicitRoles().AllChannels()
 		info.RoleNames = user.RoleNames().AllChannels()
 	} else {
 		info.Channels = princ.Channels().AsSet()
+		info.WriteChannels = princ.WriteChannels().AsSet()
+		if role, ok := princ.(auth.Role); ok {
+			info.ParentRoleNames = role.ParentRoles().AllChannels()
+		}
 	}
 	return
 }
@@ -87,6 +104,7 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 	// Get the existing principal, or if this is a POST make sure there isn't one:
 	var princ auth.Principal
 	var user auth.User
+	var role auth.Role
 	authenticator := dbc.Authenticator()
 
 	// Retry handling for cas failure during principal update.  Limiting retry attempts
@@ -96,7 +114,8 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 			user, err = authenticator.GetUser(*newInfo.Name)
 			princ = user
 		} else {
-			princ, err = authenticator.GetRole(*newInfo.Name)
+			role, err = authenticator.GetRole(*newInfo.Name)
+			princ = role
 		}
 		if err != nil {
 			return replaced, err
@@ -112,10 +131,16 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 					err = base.HTTPErrorf(http.StatusBadRequest, reason)
 					return replaced, err
 				}
+				if newInfo.Password != nil {
+					if err = authenticator.ValidatePassword(*newInfo.Password); err != nil {
+						return replaced, err
+					}
+				}
 				user, err = authenticator.NewUser(*newInfo.Name, "", nil)
 				princ = user
 			} else {
-				princ, err = authenticator.NewRole(*newInfo.Name, nil)
+				role, err = authenticator.NewRole(*newInfo.Name, nil)
+				princ = role
 			}
 			if err != nil {
 				return replaced, err
@@ -130,6 +155,9 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 				err = base.HTTPErrorf(http.StatusBadRequest, reason)
 				return replaced, err
 			}
+			if err = authenticator.ValidatePassword(*newInfo.Password); err != nil {
+				return replaced, err
+			}
 		}
 
 		updatedChannels := princ.ExplicitChannels()
@@ -140,7 +168,15 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 			changed = true
 		}
 
-		var updatedRoles ch.TimedSet
+		updatedWriteChannels := princ.ExplicitWriteChannels()
+		if updatedWriteChannels == nil {
+			updatedWriteChannels = ch.TimedSet{}
+		}
+		if !updatedWriteChannels.Equals(newInfo.ExplicitWriteChannels) {
+			changed = true
+		}
+
+		var updatedRoles, updatedParentRoles ch.TimedSet
 
 		// Then the user-specific fields like roles:
 		if isUser {
@@ -156,6 +192,10 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 				user.SetDisabled(newInfo.Disabled)
 				changed = true
 			}
+			if newInfo.PasswordChangeRequired != user.PasswordChangeFlagged() {
+				user.SetPasswordChangeRequired(newInfo.PasswordChangeRequired)
+				changed = true
+			}
 
 			updatedRoles = user.ExplicitRoles()
 			if updatedRoles == nil {
@@ -164,6 +204,14 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 			if !updatedRoles.Equals(base.SetFromArray(newInfo.ExplicitRoleNames)) {
 				changed = true
 			}
+		} else {
+			updatedParentRoles = role.ParentRoles()
+			if updatedParentRoles == nil {
+				updatedParentRoles = ch.TimedSet{}
+			}
+			if !updatedParentRoles.Equals(base.SetFromArray(newInfo.ParentRoleNames)) {
+				changed = true
+			}
 		}
 
 		// And finally save the Principal:
@@ -186,11 +234,16 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 		if updatedChannels.UpdateAtSequence(newInfo.ExplicitChannels, nextSeq) {
 			princ.SetExplicitChannels(updatedChannels)
 		}
+		if updatedWriteChannels.UpdateAtSequence(newInfo.ExplicitWriteChannels, nextSeq) {
+			princ.SetExplicitWriteChannels(updatedWriteChannels)
+		}
 
 		if isUser {
 			if updatedRoles.UpdateAtSequence(base.SetFromArray(newInfo.ExplicitRoleNames), nextSeq) {
 				user.SetExplicitRoles(updatedRoles)
 			}
+		} else if updatedParentRoles.UpdateAtSequence(base.SetFromArray(newInfo.ParentRoleNames), nextSeq) {
+			role.SetParentRoles(updatedParentRoles)
 		}
 		err = authenticator.Save(princ)
 		// On cas error, retry.  Otherwise break out of loop
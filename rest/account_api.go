@@ -0,0 +1,182 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Self-service account management for the logged-in user, enabled per database by the
+// allow_self_service config property.
+
+// Returns an error unless self-service is enabled for the database and the request was made
+// by a logged-in (non-guest) user.
+func (h *handler) checkSelfService() error {
+	if !h.db.Options.AllowSelfService {
+		return base.HTTPErrorf(http.StatusForbidden, "Self-service account management is not enabled")
+	}
+	if h.user == nil || h.user.Name() == "" {
+		return base.HTTPErrorf(http.StatusUnauthorized, "Login required")
+	}
+	return nil
+}
+
+// Returns the identifier a session is listed and revoked with.  The session ID itself is the
+// cookie value that authenticates the session, so it's never returned to clients.
+func sessionHandle(sessionID string) string {
+	hash := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(hash[:8])
+}
+
+// Returns the ID of the session the request was authenticated with, if any.
+func (h *handler) currentSessionID() string {
+	cookie, _ := h.rq.Cookie(h.db.Authenticator().SessionCookieName())
+	if cookie == nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// PUT /_account/password changes the user's password, given the current one.  The user's other
+// sessions are revoked, as they are when an admin changes the password.  Users without a password,
+// such as those created through OIDC, can't set one, as there's no current password to check.
+// A user who must change their password can do so even if self-service isn't enabled, as they
+// can't do anything else.
+func (h *handler) handleAccountPasswordPUT() error {
+	if h.user == nil || !h.user.PasswordChangeRequired() {
+		if err := h.checkSelfService(); err != nil {
+			return err
+		}
+	}
+
+	var params struct {
+		OldPassword string  `json:"old_password"`
+		NewPassword *string `json:"new_password"`
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+	if !h.user.HasPassword() {
+		return base.HTTPErrorf(http.StatusForbidden, "User has no password to change")
+	}
+	if !h.user.Authenticate(params.OldPassword) {
+		return base.HTTPErrorf(http.StatusForbidden, "Incorrect password")
+	}
+
+	name := h.user.Name()
+	newInfo := db.PrincipalConfig{Name: &name, Password: params.NewPassword}
+	if isValid, reason := newInfo.IsPasswordValid(h.db.AllowEmptyPassword); !isValid {
+		return base.HTTPErrorf(http.StatusBadRequest, reason)
+	}
+	if err := h.db.Authenticator().ValidatePassword(*params.NewPassword); err != nil {
+		return err
+	}
+	if err := h.db.Authenticator().UpdateUserPassword(h.user, *params.NewPassword); err != nil {
+		return err
+	}
+	base.Infof(base.KeyAuth, "User %s changed their password", base.UD(name))
+
+	return h.deleteAccountSessions(h.currentSessionID())
+}
+
+// PUT /_account/email changes the user's email address.  An empty email removes it.
+func (h *handler) handleAccountEmailPUT() error {
+	if err := h.checkSelfService(); err != nil {
+		return err
+	}
+
+	var params struct {
+		Email string `json:"email"`
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+	return h.db.Authenticator().UpdateUserEmail(h.user, params.Email)
+}
+
+// GET /_account/sessions lists the user's login sessions, identified by their handles.
+func (h *handler) handleAccountSessionsGET() error {
+	if err := h.checkSelfService(); err != nil {
+		return err
+	}
+
+	sessions, err := h.db.GetUserSessions(h.user.Name())
+	if err != nil {
+		return err
+	}
+
+	type sessionInfo struct {
+		Handle  string    `json:"handle"`
+		Expires time.Time `json:"expires"`
+		Current bool      `json:"current,omitempty"`
+	}
+	currentID := h.currentSessionID()
+	response := make([]sessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, sessionInfo{
+			Handle:  sessionHandle(session.ID),
+			Expires: session.Expiration,
+			Current: session.ID == currentID,
+		})
+	}
+	h.writeJSON(response)
+	return nil
+}
+
+// DELETE /_account/sessions/{handle} revokes one of the user's sessions, given its handle.
+func (h *handler) handleAccountSessionDELETE() error {
+	if err := h.checkSelfService(); err != nil {
+		return err
+	}
+
+	handle := h.PathVar("handle")
+	sessions, err := h.db.GetUserSessions(h.user.Name())
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if sessionHandle(session.ID) == handle {
+			return h.db.Authenticator().DeleteSession(session.ID)
+		}
+	}
+	return kNotFoundError
+}
+
+// DELETE /_account/sessions revokes all of the user's sessions, other than the one used to
+// make the request.
+func (h *handler) handleAccountSessionsDELETE() error {
+	if err := h.checkSelfService(); err != nil {
+		return err
+	}
+	return h.deleteAccountSessions(h.currentSessionID())
+}
+
+// Deletes all of the user's sessions except the one with the given ID.
+func (h *handler) deleteAccountSessions(keepSessionID string) error {
+	sessions, err := h.db.GetUserSessions(h.user.Name())
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.ID == keepSessionID {
+			continue
+		}
+		if err := h.db.Authenticator().DeleteSession(session.ID); err != nil {
+			base.Warnf(base.KeyAll, "Error deleting session for user %s: %v", base.UD(h.user.Name()), err)
+		}
+	}
+	return nil
+}
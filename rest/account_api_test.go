@@ -0,0 +1,224 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountSelfServiceDisabled(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"password":"letmein"}`)
+	assertStatus(t, response, 201)
+
+	response = rt.Send(requestByUser("PUT", "/db/_account/password", `{"old_password":"letmein", "new_password":"secret"}`, "bernard"))
+	assertStatus(t, response, 403)
+	response = rt.Send(requestByUser("GET", "/db/_account/sessions", "", "bernard"))
+	assertStatus(t, response, 403)
+}
+
+func TestAccountSelfService(t *testing.T) {
+
+	rt := RestTester{DatabaseConfig: &DbConfig{AllowSelfService: true}}
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"password":"letmein"}`)
+	assertStatus(t, response, 201)
+	response = rt.SendAdminRequest("PUT", "/db/_user/manny", `{"password":"letmein"}`)
+	assertStatus(t, response, 201)
+
+	// The guest user can't manage an account
+	response = rt.SendRequest("PUT", "/db/_account/email", `{"email":"guest@example.com"}`)
+	assertStatus(t, response, 401)
+
+	// Email
+	response = rt.Send(requestByUser("PUT", "/db/_account/email", `{"email":"bernard@example.com"}`, "bernard"))
+	assertStatus(t, response, 200)
+	response = rt.Send(requestByUser("PUT", "/db/_account/email", `{"email":"not an email"}`, "bernard"))
+	assertStatus(t, response, 400)
+	response = rt.SendAdminRequest("GET", "/db/_user/bernard", "")
+	assertStatus(t, response, 200)
+	var userInfo map[string]interface{}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &userInfo))
+	assert.Equal(t, "bernard@example.com", userInfo["email"])
+
+	// Another user's email can't be taken, as it identifies them to social logins
+	response = rt.Send(requestByUser("PUT", "/db/_account/email", `{"email":"bernard@example.com"}`, "manny"))
+	assertStatus(t, response, 409)
+	authenticator := rt.ServerContext().Database("db").Authenticator()
+	user, err := authenticator.GetUserByEmail("bernard@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "bernard", user.Name())
+
+	// Changing the email frees the old one
+	response = rt.Send(requestByUser("PUT", "/db/_account/email", `{"email":"bernard@example.org"}`, "bernard"))
+	assertStatus(t, response, 200)
+	user, err = authenticator.GetUserByEmail("bernard@example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, user)
+	response = rt.Send(requestByUser("PUT", "/db/_account/email", `{"email":"bernard@example.com"}`, "manny"))
+	assertStatus(t, response, 200)
+
+	// Sessions
+	currentSession := rt.createSession(t, "bernard")
+	otherSession := rt.createSession(t, "bernard")
+	mannySession := rt.createSession(t, "manny")
+	reqHeaders := map[string]string{"Cookie": "SyncGatewaySession=" + currentSession}
+
+	response = rt.SendRequestWithHeaders("GET", "/db/_account/sessions", "", reqHeaders)
+	assertStatus(t, response, 200)
+	var sessions []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &sessions))
+	assert.Len(t, sessions, 2)
+	// Sessions are listed by handle, as their IDs would allow them to be used
+	assert.NotContains(t, response.Body.String(), currentSession)
+	for _, session := range sessions {
+		assert.Equal(t, session["handle"] == sessionHandle(currentSession), session["current"] == true)
+	}
+
+	// Can't revoke another user's session, or a session by its ID
+	response = rt.SendRequestWithHeaders("DELETE", fmt.Sprintf("/db/_account/sessions/%s", sessionHandle(mannySession)), "", reqHeaders)
+	assertStatus(t, response, 404)
+	assertStatus(t, rt.SendAdminRequest("GET", fmt.Sprintf("/db/_session/%s", mannySession), ""), 200)
+	response = rt.SendRequestWithHeaders("DELETE", fmt.Sprintf("/db/_account/sessions/%s", otherSession), "", reqHeaders)
+	assertStatus(t, response, 404)
+
+	response = rt.SendRequestWithHeaders("DELETE", fmt.Sprintf("/db/_account/sessions/%s", sessionHandle(otherSession)), "", reqHeaders)
+	assertStatus(t, response, 200)
+	assertStatus(t, rt.SendAdminRequest("GET", fmt.Sprintf("/db/_session/%s", otherSession), ""), 404)
+
+	// Password change requires the current password, and revokes every session except the current one
+	otherSession = rt.createSession(t, "bernard")
+	response = rt.SendRequestWithHeaders("PUT", "/db/_account/password", `{"old_password":"wrong", "new_password":"secret"}`, reqHeaders)
+	assertStatus(t, response, 403)
+	response = rt.SendRequestWithHeaders("PUT", "/db/_account/password", `{"old_password":"letmein", "new_password":""}`, reqHeaders)
+	assertStatus(t, response, 400)
+	response = rt.SendRequestWithHeaders("PUT", "/db/_account/password", `{"old_password":"letmein", "new_password":"secret"}`, reqHeaders)
+	assertStatus(t, response, 200)
+
+	assertStatus(t, rt.SendAdminRequest("GET", fmt.Sprintf("/db/_session/%s", currentSession), ""), 200)
+	assertStatus(t, rt.SendAdminRequest("GET", fmt.Sprintf("/db/_session/%s", otherSession), ""), 404)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "bernard", "letmein"), 401)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "bernard", "secret"), 200)
+
+	// Revoke all remaining sessions
+	response = rt.SendUserRequestWithHeaders("DELETE", "/db/_account/sessions", "", nil, "bernard", "secret")
+	assertStatus(t, response, 200)
+	assertStatus(t, rt.SendAdminRequest("GET", fmt.Sprintf("/db/_session/%s", currentSession), ""), 404)
+}
+
+func TestPasswordPolicyAndForcedChange(t *testing.T) {
+
+	rt := RestTester{DatabaseConfig: &DbConfig{
+		AllowSelfService: true,
+		PasswordPolicy:   &auth.PasswordPolicy{MinLength: 8, RequireDigit: true},
+	}}
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"password":"letmein"}`)
+	assertStatus(t, response, 400)
+	response = rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"password":"letmein99", "password_change_required":true}`)
+	assertStatus(t, response, 201)
+
+	// Until the password is changed, only the password change endpoint is available
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "bernard", "letmein99"), 403)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/_session", "", nil, "bernard", "letmein99"), 200)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/doc/_session", "", nil, "bernard", "letmein99"), 403)
+
+	response = rt.SendUserRequestWithHeaders("PUT", "/db/_account/password", `{"old_password":"letmein99", "new_password":"weak"}`, nil, "bernard", "letmein99")
+	assertStatus(t, response, 400)
+	response = rt.SendUserRequestWithHeaders("PUT", "/db/_account/password", `{"old_password":"letmein99", "new_password":"str0nger1"}`, nil, "bernard", "letmein99")
+	assertStatus(t, response, 200)
+
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "bernard", "str0nger1"), 200)
+	response = rt.SendAdminRequest("GET", "/db/_user/bernard", "")
+	assertStatus(t, response, 200)
+	var userInfo map[string]interface{}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &userInfo))
+	assert.Nil(t, userInfo["password_change_required"])
+}
+
+func TestAccountPasswordWithoutPassword(t *testing.T) {
+
+	rt := RestTester{DatabaseConfig: &DbConfig{AllowSelfService: true}}
+	defer rt.Close()
+
+	// A user without a password, as created through OIDC, can't set one with an empty old password
+	a := rt.ServerContext().Database("db").Authenticator()
+	user, err := a.NewUser("oidc_user", "", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, a.Save(user))
+	session := rt.createSession(t, "oidc_user")
+	reqHeaders := map[string]string{"Cookie": "SyncGatewaySession=" + session}
+
+	response := rt.SendRequestWithHeaders("PUT", "/db/_account/password", `{"old_password":"", "new_password":"secret"}`, reqHeaders)
+	assertStatus(t, response, 403)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "oidc_user", "secret"), 401)
+}
+
+func TestForcedPasswordChangeWithoutSelfService(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"password":"letmein", "password_change_required":true}`)
+	assertStatus(t, response, 201)
+
+	// The password change is allowed, so that the user isn't locked out
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "bernard", "letmein"), 403)
+	response = rt.SendUserRequestWithHeaders("PUT", "/db/_account/password", `{"old_password":"letmein", "new_password":"secret"}`, nil, "bernard", "letmein")
+	assertStatus(t, response, 200)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "bernard", "secret"), 200)
+
+	// Once it's changed, the rest of self-service is still unavailable
+	response = rt.SendUserRequestWithHeaders("PUT", "/db/_account/password", `{"old_password":"secret", "new_password":"another"}`, nil, "bernard", "secret")
+	assertStatus(t, response, 403)
+}
+
+func TestExpiredPasswordNotFlagged(t *testing.T) {
+
+	rt := RestTester{DatabaseConfig: &DbConfig{PasswordPolicy: &auth.PasswordPolicy{MaxAgeDays: 30}}}
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"password":"letmein"}`)
+	assertStatus(t, response, 201)
+
+	// Backdate the password change, so that the password has expired
+	var userDoc map[string]interface{}
+	_, err := rt.Bucket().Get(auth.UserKeyPrefix+"bernard", &userDoc)
+	assert.NoError(t, err)
+	userDoc["password_changed_at"] = time.Now().Add(-31 * 24 * time.Hour).Unix()
+	assert.NoError(t, rt.Bucket().Set(auth.UserKeyPrefix+"bernard", 0, userDoc))
+
+	// Expiry is reported separately from the flag set by an admin
+	response = rt.SendAdminRequest("GET", "/db/_user/bernard", "")
+	assertStatus(t, response, 200)
+	var userInfo map[string]interface{}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &userInfo))
+	assert.Nil(t, userInfo["password_change_required"])
+	assert.Equal(t, true, userInfo["password_expired"])
+
+	// So writing back what was read doesn't flag the user
+	response = rt.SendAdminRequest("PUT", "/db/_user/bernard", response.Body.String())
+	assertStatus(t, response, 200)
+	user, err := rt.ServerContext().Database("db").Authenticator().GetUser("bernard")
+	assert.NoError(t, err)
+	assert.False(t, user.PasswordChangeFlagged())
+	assert.True(t, user.PasswordExpired())
+}
@@ -40,7 +40,12 @@ func (h *handler) handleCreateDB() error {
 	if err := config.setup(dbName); err != nil {
 		return err
 	}
-	if _, err := h.server.AddDatabaseFromConfig(config); err != nil {
+	// Use the bucket's persisted config, if another node has stored one.  The refresh only reloads
+	// the database if the persisted config couldn't be read before opening it.
+	if _, err := h.server.addDatabaseWithPersistedConfig(config); err != nil {
+		return err
+	}
+	if _, err := h.server.refreshPersistedDbConfig(dbName); err != nil {
 		return err
 	}
 	return base.HTTPErrorf(http.StatusCreated, "created")
@@ -60,6 +65,11 @@ func (h *handler) handleDbOnline() error {
 		return base.HTTPErrorf(http.StatusServiceUnavailable, "Database _resync is in progress, this may take some time, try again later")
 	}
 
+	//A read-only DB is already running, so only needs to start accepting writes again
+	if dbState == db.DBReadOnly {
+		return h.db.EndDbReadOnly("ADMIN Request")
+	}
+
 	body, err := h.readBody()
 	if err != nil {
 		return err
@@ -96,19 +106,64 @@ func (h *handler) handleDbOffline() error {
 	return err
 }
 
+//Make a DB read-only
+func (h *handler) handleDbReadOnly() error {
+	h.assertAdminOnly()
+	body, err := h.readBody()
+	if err != nil {
+		return err
+	}
+
+	var input struct {
+		RetryAfter *int `json:"retry_after"` // Seconds clients should wait before retrying writes
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &input); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid request body: %v", err)
+		}
+	}
+	retryAfter := db.DefaultReadOnlyRetryAfter
+	if input.RetryAfter != nil {
+		if *input.RetryAfter <= 0 {
+			return base.HTTPErrorf(http.StatusBadRequest, "retry_after must be a positive number of seconds")
+		}
+		retryAfter = time.Duration(*input.RetryAfter) * time.Second
+	}
+
+	if err = h.db.TakeDbReadOnly("ADMIN Request", retryAfter); err != nil {
+		base.Infof(base.KeyCRUD, "Unable to make Database : %v, read-only", base.MD(h.db.Name))
+	}
+	return err
+}
+
 // Get admin database info
 func (h *handler) handleGetDbConfig() error {
-	h.writeJSON(h.server.GetDatabaseConfig(h.db.Name))
-	return nil
+	if cas := h.server.PersistedDbConfigCas(h.db.Name); cas != 0 {
+		h.setHeader("Etag", formatDbConfigEtag(cas))
+	}
+	return h.writeRedactedConfig(h.server.GetDatabaseConfig(h.db.Name))
 }
 
 // Get admin config info
 func (h *handler) handleGetConfig() error {
-	h.writeJSON(h.server.GetConfig())
+	return h.writeRedactedConfig(h.server.GetConfig())
+}
+
+// Writes a config as the response, with any secrets read from the environment or from secret
+// files redacted.
+func (h *handler) writeRedactedConfig(config interface{}) error {
+	redacted, err := base.RedactSecretsInValue(config)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(redacted)
 	return nil
 }
 
-// PUT a new database config
+// PUT a new database config.  The config is persisted in the database's bucket, so that it's
+// picked up by every node using the bucket, and the database is reloaded with it.  The bucket
+// connection settings of the existing config are kept.  An If-Match header containing the ETag
+// of a previous GET or PUT makes the update fail with a 409 if the config has changed since.
 func (h *handler) handlePutDbConfig() error {
 	h.assertAdminOnly()
 	dbName := h.db.Name
@@ -119,10 +174,24 @@ func (h *handler) handlePutDbConfig() error {
 	if err := config.setup(dbName); err != nil {
 		return err
 	}
-	h.server.lock.Lock()
-	defer h.server.lock.Unlock()
-	h.server.config.Databases[dbName] = config
+	if err := config.validate(); err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "%v", err)
+	}
+
+	var expectedCas *uint64
+	if ifMatch := h.rq.Header.Get("If-Match"); ifMatch != "" {
+		cas, err := parseDbConfigEtag(ifMatch)
+		if err != nil {
+			return err
+		}
+		expectedCas = &cas
+	}
 
+	cas, err := h.server.PutPersistedDbConfig(dbName, config, expectedCas)
+	if err != nil {
+		return err
+	}
+	h.setHeader("Etag", formatDbConfigEtag(cas))
 	return base.HTTPErrorf(http.StatusCreated, "created")
 }
 
@@ -464,17 +533,25 @@ func externalUserName(name string) string {
 func marshalPrincipal(princ auth.Principal) ([]byte, error) {
 	name := externalUserName(princ.Name())
 	info := db.PrincipalConfig{
-		Name:             &name,
-		ExplicitChannels: princ.ExplicitChannels().AsSet(),
+		Name:                  &name,
+		ExplicitChannels:      princ.ExplicitChannels().AsSet(),
+		ExplicitWriteChannels: princ.ExplicitWriteChannels().AsSet(),
 	}
 	if user, ok := princ.(auth.User); ok {
 		info.Channels = user.InheritedChannels().AsSet()
+		info.WriteChannels = user.InheritedWriteChannels().AsSet()
 		info.Email = user.Email()
 		info.Disabled = user.Disabled()
+		info.PasswordChangeRequired = user.PasswordChangeFlagged()
+		info.PasswordExpired = user.PasswordExpired()
 		info.ExplicitRoleNames = user.ExplicitRoles().AllChannels()
 		info.RoleNames = user.RoleNames().AllChannels()
 	} else {
 		info.Channels = princ.Channels().AsSet()
+		info.WriteChannels = princ.WriteChannels().AsSet()
+		if role, ok := princ.(auth.Role); ok {
+			info.ParentRoleNames = role.ParentRoles().AllChannels()
+		}
 	}
 	return json.Marshal(info)
 }
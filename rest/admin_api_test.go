@@ -918,6 +918,26 @@ func TestSessionAPI(t *testing.T) {
 
 }
 
+func TestSessionMaxPerUser(t *testing.T) {
+
+	rt := RestTester{DatabaseConfig: &DbConfig{SessionOptions: &auth.SessionOptions{MaxPerUser: 2}}}
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("POST", "/db/_user/", `{"name":"user1", "password":"1234"}`)
+	assertStatus(t, response, 201)
+
+	sessions := make([]string, 3)
+	for i := range sessions {
+		sessions[i] = rt.createSession(t, "user1")
+		time.Sleep(10 * time.Millisecond) // ensure distinct creation times
+	}
+
+	// Creating the third session evicted the oldest
+	assertStatus(t, rt.SendAdminRequest("GET", fmt.Sprintf("/db/_session/%s", sessions[0]), ""), 404)
+	assertStatus(t, rt.SendAdminRequest("GET", fmt.Sprintf("/db/_session/%s", sessions[1]), ""), 200)
+	assertStatus(t, rt.SendAdminRequest("GET", fmt.Sprintf("/db/_session/%s", sessions[2]), ""), 200)
+}
+
 func TestFlush(t *testing.T) {
 
 	if !base.UnitTestUrlIsWalrus() {
@@ -1053,6 +1073,80 @@ func TestDBOffline503Response(t *testing.T) {
 	assertStatus(t, rt.SendRequest("GET", "/db/doc1", ""), 503)
 }
 
+//Make DB read-only and ensure reads succeed while writes are rejected
+func TestDBReadOnly(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"foo": "bar"}`), 201)
+
+	response := rt.SendAdminRequest("POST", "/db/_readonly", `{"retry_after": 30}`)
+	assertStatus(t, response, 200)
+	response = rt.SendAdminRequest("GET", "/db/", "")
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	goassert.Equals(t, body["state"], "ReadOnly")
+
+	// Reads still work
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/doc1", ""), 200)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_changes", ""), 200)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_bulk_get", `{"docs": [{"id": "doc1"}]}`), 200)
+
+	// Writes are rejected, with a Retry-After
+	response = rt.SendAdminRequest("PUT", "/db/doc2", `{"foo": "bar"}`)
+	assertStatus(t, response, 503)
+	goassert.Equals(t, response.Header().Get("Retry-After"), "30")
+	response = rt.SendAdminRequest("DELETE", "/db/doc1?rev=1-cd809becc169215072fd567eebd8b8de", "")
+	assertStatus(t, response, 503)
+	response = rt.SendAdminRequest("POST", "/db/_bulk_docs", `{"docs": [{"_id": "doc3"}]}`)
+	assertStatus(t, response, 503)
+	goassert.Equals(t, response.Header().Get("Retry-After"), "30")
+
+	// Taking the DB online allows writes again
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_online", ""), 200)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"foo": "bar"}`), 201)
+
+	// Only an online DB can be made read-only
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_offline", ""), 200)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_readonly", ""), 503)
+}
+
+// Read-only state is recorded in the bucket, so survives reloads and applies to other nodes
+func TestDBReadOnlyPersisted(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_readonly", `{"retry_after": 30}`), 200)
+
+	// Reloading the DB, as the config poller does, leaves it read-only
+	sc := rt.ServerContext()
+	reloaded, err := sc.ReloadDatabaseFromConfig("db", false)
+	assert.NoError(t, err)
+	assert.True(t, reloaded.IsReadOnly())
+	assert.Equal(t, 30*time.Second, reloaded.ReadOnlyRetryAfter())
+
+	// Another node loading the same bucket is read-only too
+	sc2 := NewServerContext(&ServerConfig{
+		Facebook:       &FacebookConfig{},
+		AdminInterface: &DefaultAdminInterface,
+	})
+	defer sc2.Close()
+	dbConfigCopy, err := rt.DatabaseConfig.DeepCopy()
+	assert.NoError(t, err)
+	dbc2, err := sc2.AddDatabaseFromConfig(dbConfigCopy)
+	assert.NoError(t, err)
+	assert.True(t, dbc2.IsReadOnly())
+
+	// Taking it online removes the state, so later reloads are writable
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_online", ""), 200)
+	reloaded, err = sc.ReloadDatabaseFromConfig("db", false)
+	assert.NoError(t, err)
+	assert.False(t, reloaded.IsReadOnly())
+	assert.False(t, reloaded.LoadReadOnlyState())
+}
+
 //Take DB offline and ensure can put db config
 func TestDBOfflinePutDbConfig(t *testing.T) {
 
@@ -839,6 +839,80 @@ func TestBulkDocsIDGeneration(t *testing.T) {
 	goassert.True(t, docs[1]["id"] != "")
 }
 
+func TestBulkDocsConcurrent(t *testing.T) {
+	concurrency := 4
+	rt := RestTester{DatabaseConfig: &DbConfig{BulkConcurrency: &concurrency}}
+	defer rt.Close()
+
+	// Docs with the same ID are saved in the order given, so the second "dup" conflicts
+	docs := make([]string, 0, 22)
+	for i := 0; i < 20; i++ {
+		docs = append(docs, fmt.Sprintf(`{"_id": "doc%d", "n": %d}`, i, i))
+		if i == 5 {
+			docs = append(docs, `{"_id": "dup", "n": 1}`)
+		} else if i == 15 {
+			docs = append(docs, `{"_id": "dup", "n": 2}`)
+		}
+	}
+	response := rt.SendRequest("POST", "/db/_bulk_docs", `{"docs": [`+strings.Join(docs, ",")+`]}`)
+	assertStatus(t, response, 201)
+	var results []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &results))
+	assert.Len(t, results, 22)
+	revs := make(map[interface{}]interface{}, len(results))
+	for i, result := range results {
+		var doc map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(docs[i]), &doc))
+		assert.Equal(t, doc[db.BodyId], result["id"])
+		revs[result["id"]] = result["rev"]
+	}
+	assert.NotNil(t, results[6]["rev"])
+	assert.Equal(t, float64(http.StatusConflict), results[17]["status"])
+
+	response = rt.SendRequest("GET", "/db/dup", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &body))
+	assert.Equal(t, float64(1), body["n"])
+
+	// Revisions are returned in the requested order, including those that can't be got
+	items := make([]string, 0, 22)
+	for i := 19; i >= 0; i-- {
+		id := fmt.Sprintf("doc%d", i)
+		items = append(items, fmt.Sprintf(`{"id": "%s", "rev": "%s"}`, id, revs[id]))
+	}
+	items = append(items, `{"id": "missing"}`, `{"id": "doc0", "rev": "9-a"}`)
+	response = rt.SendRequest("POST", "/db/_bulk_get", `{"docs": [`+strings.Join(items, ",")+`]}`)
+	assertStatus(t, response, 200)
+	_, attrs, err := mime.ParseMediaType(response.Header().Get("Content-Type"))
+	assert.NoError(t, err)
+	reader := multipart.NewReader(response.Body, attrs["boundary"])
+	var ids []interface{}
+	var statuses []interface{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		var partJSON map[string]interface{}
+		assert.NoError(t, json.NewDecoder(part).Decode(&partJSON))
+		if id, found := partJSON[db.BodyId]; found {
+			ids = append(ids, id)
+		} else {
+			ids = append(ids, partJSON["id"])
+		}
+		statuses = append(statuses, partJSON["status"])
+	}
+	assert.Len(t, ids, 22)
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, fmt.Sprintf("doc%d", 19-i), ids[i])
+		assert.Nil(t, statuses[i])
+	}
+	assert.Equal(t, []interface{}{"missing", "doc0"}, ids[20:])
+	assert.Equal(t, []interface{}{float64(http.StatusNotFound), float64(http.StatusNotFound)}, statuses[20:])
+}
+
 func TestBulkDocsUnusedSequences(t *testing.T) {
 
 	//We want a sync function that will reject some docs
@@ -886,6 +960,54 @@ func TestBulkDocsUnusedSequences(t *testing.T) {
 	goassert.Equals(t, lastSequence, uint64(5))
 }
 
+func TestBulkDocsUnusedSequencesConcurrent(t *testing.T) {
+
+	//Docs are saved in parallel at the default bulk_concurrency, so sequences aren't assigned in input order
+	rt := RestTester{SyncFn: `function(doc) {if(doc.type == "invalid") {throw("Rejecting invalid doc")}}`}
+	defer rt.Close()
+
+	docs := make([]string, 0, 10)
+	for i := 0; i < 10; i++ {
+		if i%3 == 1 {
+			docs = append(docs, fmt.Sprintf(`{"_id": "bulk%d", "n": %d, "type": "invalid"}`, i, i))
+		} else {
+			docs = append(docs, fmt.Sprintf(`{"_id": "bulk%d", "n": %d}`, i, i))
+		}
+	}
+	response := rt.SendRequest("POST", "/db/_bulk_docs", `{"docs": [`+strings.Join(docs, ",")+`]}`)
+	assertStatus(t, response, 201)
+
+	//The saved docs use the first sequences reserved for the request, in some order
+	var sequences []int
+	for i := 0; i < 10; i++ {
+		syncData, err := rt.GetDatabase().GetDocSyncData(fmt.Sprintf("bulk%d", i))
+		if i%3 == 1 {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err, "GetDocSyncData error")
+		sequences = append(sequences, int(syncData.Sequence))
+	}
+	sort.Ints(sequences)
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 7}, sequences)
+
+	//Enough sequences were reserved for every doc, and those of the rejected docs are released once allocation is idle
+	lastSequence, err := rt.GetDatabase().LastSequence()
+	assert.NoError(t, err, "LastSequence error")
+	goassert.Equals(t, lastSequence, uint64(10))
+	for _, sequence := range []int{8, 9, 10} {
+		key := fmt.Sprintf("%s%d", db.UnusedSequenceKeyPrefix, sequence)
+		var released bool
+		for i := 0; i < 50 && !released; i++ {
+			_, _, err = rt.Bucket().GetRaw(key)
+			if released = err == nil; !released {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		assert.True(t, released, "Unused sequence %d wasn't released", sequence)
+	}
+}
+
 func TestBulkDocsUnusedSequencesMultipleSG(t *testing.T) {
 
 	//We want a sync function that will reject some docs, create two to simulate two SG instances
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"regexp"
 	"runtime/debug"
@@ -46,11 +47,13 @@ type blipSyncContext struct {
 	channels            base.Set
 	lock                sync.Mutex
 	allowedAttachments  map[string]int
-	handlerSerialNumber uint64    // Each handler within a context gets a unique serial number for logging
-	terminator          chan bool // Closed during blipSyncContext.close(). Ensures termination of async goroutines.
-	hasActiveSubChanges bool      // Track whether there is a subChanges subscription currently active
-	useDeltas           bool      // Whether deltas can be used for this connection - This should be set via setUseDeltas()
-	sgCanUseDeltas      bool      // Whether deltas can be used by Sync Gateway for this connection
+	handlerSerialNumber uint64          // Each handler within a context gets a unique serial number for logging
+	terminator          chan bool       // Closed during blipSyncContext.close(). Ensures termination of async goroutines.
+	hasActiveSubChanges bool            // Track whether there is a subChanges subscription currently active
+	useDeltas           bool            // Whether deltas can be used for this connection - This should be set via setUseDeltas()
+	sgCanUseDeltas      bool            // Whether deltas can be used by Sync Gateway for this connection
+	drain               <-chan struct{} // Closed when the server starts draining, ending the changes feed
+	inFlight            int32           // Requests being handled, plus sent changes whose revs haven't been sent yet; accessed atomically
 }
 
 type blipHandler struct {
@@ -114,6 +117,7 @@ func (h *handler) handleBLIPSync() error {
 		user:              h.user,
 		effectiveUsername: h.currentEffectiveUserName(),
 		terminator:        make(chan bool),
+		drain:             h.server.drainChannel(),
 	}
 	defer ctx.close()
 
@@ -138,10 +142,26 @@ func (h *handler) handleBLIPSync() error {
 	defaultHandler := server.Handler
 	server.Handler = func(conn *websocket.Conn) {
 		h.logStatus(101, fmt.Sprintf("[%s] Upgraded to BLIP+WebSocket protocol. User:%s.", blipContext.ID, ctx.effectiveUsername))
+		defer h.server.trackWebSocket()()
 		defer func() {
 			conn.Close() // in case it wasn't closed already
 			ctx.Logf(base.LevelDebug, base.KeyHTTP, "#%03d:    --> BLIP+WebSocket connection closed", h.serialNumber)
 		}()
+
+		// When the server drains, close the connection (with a WebSocket close frame) once the
+		// changes already sent have been handled
+		connClosed := make(chan struct{})
+		defer close(connClosed)
+		go func() {
+			select {
+			case <-ctx.drain:
+				ctx.waitForInFlight(connClosed)
+				ctx.Logf(base.LevelInfo, base.KeyHTTP, "#%03d:    --> Closing BLIP+WebSocket connection, server is draining", h.serialNumber)
+				conn.Close()
+			case <-connClosed:
+			}
+		}()
+
 		defaultHandler(conn)
 	}
 
@@ -156,6 +176,9 @@ func (ctx *blipSyncContext) register(profile string, handlerFn func(*blipHandler
 	// Wrap the handler function with a function that adds handling needed by all handlers
 	handlerFnWrapper := func(rq *blip.Message) {
 
+		atomic.AddInt32(&ctx.inFlight, 1)
+		defer atomic.AddInt32(&ctx.inFlight, -1)
+
 		startTime := time.Now()
 
 		db, _ := db.GetDatabase(ctx.dbc, ctx.user)
@@ -188,6 +211,20 @@ func (ctx *blipSyncContext) close() {
 	close(ctx.terminator)
 }
 
+// Waits until there are no requests being handled or changes awaiting their revs, or until the
+// given channel is closed.
+func (ctx *blipSyncContext) waitForInFlight(closed <-chan struct{}) {
+	ticker := time.NewTicker(kDrainPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&ctx.inFlight) > 0 {
+		select {
+		case <-ticker.C:
+		case <-closed:
+			return
+		}
+	}
+}
+
 // Handler for unknown requests
 func (ctx *blipSyncContext) notFound(rq *blip.Message) {
 	ctx.Logf(base.LevelInfo, base.KeySync, "%s Type:%q User:%s", rq, rq.Profile(), ctx.effectiveUsername)
@@ -365,7 +402,7 @@ func (bh *blipHandler) sendChanges(sender *blip.Sender, params *subChangesParams
 		}
 	}
 
-	_, forceClose := generateBlipSyncChanges(bh.db, channelSet, options, params.docIDs(), func(changes []*db.ChangeEntry) error {
+	_, forceClose := generateBlipSyncChanges(bh.db, channelSet, options, params.docIDs(), bh.drain, func(changes []*db.ChangeEntry) error {
 		bh.Logf(base.LevelDebug, base.KeySync, "    Sending %d changes. User:%s", len(changes), base.UD(bh.effectiveUsername))
 		for _, change := range changes {
 
@@ -403,6 +440,7 @@ func (bh *blipHandler) sendBatchOfChanges(sender *blip.Sender, changeArray [][]i
 	outrq.SetJSONBody(changeArray)
 	if len(changeArray) > 0 {
 		// Spawn a goroutine to await the client's response:
+		atomic.AddInt32(&bh.inFlight, 1)
 		sender.Send(outrq)
 		go bh.handleChangesResponse(sender, outrq.Response(), changeArray)
 	} else {
@@ -419,6 +457,7 @@ func (bh *blipHandler) sendBatchOfChanges(sender *blip.Sender, changeArray [][]i
 
 // Handles the response to a pushed "changes" message, i.e. the list of revisions the client wants
 func (bh *blipHandler) handleChangesResponse(sender *blip.Sender, response *blip.Message, changeArray [][]interface{}) {
+	defer atomic.AddInt32(&bh.inFlight, -1)
 	defer func() {
 		if panicked := recover(); panicked != nil {
 			base.Warnf(base.KeyAll, "[%s] PANIC handling 'changes' response: %v\n%s", bh.blipContext.ID, panicked, debug.Stack())
@@ -630,11 +669,11 @@ func (bh *blipHandler) sendDelta(delta []byte, deltaSrcRevID string, sender *bli
 
 func (bh *blipHandler) sendRevOrNorev(sender *blip.Sender, seq db.SequenceID, docID string, revID string, knownRevs map[string]bool, maxHistory int) {
 
-	body, err := bh.db.GetRev(docID, revID, true, nil)
+	revision, history, err := bh.db.GetDocumentRevision(docID, revID, math.MaxInt32, nil)
 	if err != nil {
 		bh.sendNoRev(err, sender, seq, docID, revID)
 	} else {
-		bh.sendRevision(body, sender, seq, docID, revID, knownRevs, maxHistory)
+		bh.sendRevision(revision, history, sender, seq, docID, revID, knownRevs, maxHistory)
 	}
 }
 
@@ -657,19 +696,59 @@ func (bh *blipHandler) sendNoRev(err error, sender *blip.Sender, seq db.Sequence
 
 }
 
-// Pushes a revision body to the client
-func (bh *blipHandler) sendRevision(body db.Body, sender *blip.Sender, seq db.SequenceID, docID string, revID string, knownRevs map[string]bool, maxHistory int) {
-	bh.sendRevisionWithProperties(body, sender, seq, docID, revID, knownRevs, maxHistory, nil)
+// Pushes a revision from the revision cache to the client.  The revision's JSON body is sent as-is,
+// other than adding the properties the client expects to find in it.
+func (bh *blipHandler) sendRevision(revision db.DocumentRevision, revisions db.Revisions, sender *blip.Sender, seq db.SequenceID, docID string, revID string, knownRevs map[string]bool, maxHistory int) {
+
+	bodyProperties := db.Body{}
+	if revision.Removed {
+		bodyProperties[db.BodyRemoved] = true
+	}
+	if len(revision.Attachments) > 0 {
+		bodyProperties[db.BodyAttachments] = revision.Attachments
+	}
+	bodyBytes, err := db.InjectJSONProperties(revision.BodyBytes, bodyProperties)
+	if err != nil {
+		bh.sendNoRev(err, sender, seq, docID, revID)
+		return
+	}
+
+	// Get the revision's history as a descending array of ancestor revIDs:
+	var history []string
+	if revIDs := revisions.ParseRevisions(); len(revIDs) > 1 {
+		history = revIDs[1:]
+	}
+
+	bh.sendRevisionMessage(bodyBytes, history, revision.Deleted, revision.Attachments, sender, seq, docID, revID, knownRevs, maxHistory, nil)
 }
 
 // Pushes a revision body to the client
 func (bh *blipHandler) sendRevisionWithProperties(body db.Body, sender *blip.Sender, seq db.SequenceID, docID string, revID string, knownRevs map[string]bool, maxHistory int, properties blip.Properties) {
 
-	bh.Logf(base.LevelDebug, base.KeySync, "Sending rev %q %s based on %d known.  User:%s", base.UD(docID), revID, len(knownRevs), base.UD(bh.effectiveUsername))
-
 	// Get the revision's history as a descending array of ancestor revIDs:
 	history := db.ParseRevisions(body)[1:]
-	delete(body, "_revisions")
+	deleted, _ := body[db.BodyDeleted].(bool)
+
+	delete(body, db.BodyRevisions)
+	delete(body, db.BodyId)
+	delete(body, db.BodyRev)
+	delete(body, db.BodyDeleted)
+
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		bh.sendNoRev(err, sender, seq, docID, revID)
+		return
+	}
+
+	bh.sendRevisionMessage(bodyBytes, history, deleted, db.GetBodyAttachments(body), sender, seq, docID, revID, knownRevs, maxHistory, properties)
+}
+
+// Sends a "rev" message containing a revision's JSON body, without special properties other than
+// _attachments, and the revision's history.
+func (bh *blipHandler) sendRevisionMessage(bodyBytes []byte, history []string, deleted bool, atts db.AttachmentsMeta, sender *blip.Sender, seq db.SequenceID, docID string, revID string, knownRevs map[string]bool, maxHistory int, properties blip.Properties) {
+
+	bh.Logf(base.LevelDebug, base.KeySync, "Sending rev %q %s based on %d known.  User:%s", base.UD(docID), revID, len(knownRevs), base.UD(bh.effectiveUsername))
+
 	for i, rev := range history {
 		if knownRevs[rev] || (maxHistory > 0 && i+1 >= maxHistory) {
 			history = history[0 : i+1]
@@ -682,8 +761,8 @@ func (bh *blipHandler) sendRevisionWithProperties(body db.Body, sender *blip.Sen
 	outrq := NewRevMessage()
 	outrq.setId(docID)
 	outrq.setRev(revID)
-	if del, _ := body[db.BodyDeleted].(bool); del {
-		outrq.setDeleted(del)
+	if deleted {
+		outrq.setDeleted(deleted)
 	}
 	outrq.setSequence(seq)
 	outrq.setHistory(history)
@@ -691,12 +770,8 @@ func (bh *blipHandler) sendRevisionWithProperties(body db.Body, sender *blip.Sen
 	// add additional properties passed through
 	outrq.setProperties(properties)
 
-	delete(body, db.BodyId)
-	delete(body, db.BodyRev)
-	delete(body, db.BodyDeleted)
-
-	outrq.SetJSONBody(body)
-	if atts := db.GetBodyAttachments(body); atts != nil {
+	outrq.SetBody(bodyBytes)
+	if atts != nil {
 		// Allow client to download attachments in 'atts', but only while pulling this rev
 		bh.addAllowedAttachments(atts)
 		sender.Send(outrq.Message)
@@ -17,6 +17,7 @@ import (
 	"math"
 	"mime/multipart"
 	"net/http"
+	"runtime/debug"
 	"strings"
 
 	"github.com/couchbase/sync_gateway/base"
@@ -361,68 +362,128 @@ func (h *handler) handleBulkGet() error {
 		return base.HTTPErrorf(http.StatusBadRequest, "missing 'docs' property")
 	}
 
-	return h.writeMultipart("mixed", func(writer *multipart.Writer) error {
-		for _, item := range docs {
-			var body db.Body
-			var revsFrom, attsSince []string
-			var docRevsLimit int
-			var err error
+	// Gets a requested revision, or the error to report for it in the response
+	getRevision := func(item interface{}) (body db.Body, err error) {
+		var revsFrom, attsSince []string
+		var docRevsLimit int
+
+		doc, _ := item.(map[string]interface{})
+		docid, _ := doc["id"].(string)
+		revid := ""
+		revok := true
+		if doc["rev"] != nil {
+			revid, revok = doc["rev"].(string)
+		}
+		if docid == "" || !revok {
+			err = base.HTTPErrorf(http.StatusBadRequest, "Invalid doc/rev ID in _bulk_get")
+		} else {
+			attsSince, err = db.GetStringArrayProperty(doc, "atts_since")
 
-			doc := item.(map[string]interface{})
-			docid, _ := doc["id"].(string)
-			revid := ""
-			revok := true
-			if doc["rev"] != nil {
-				revid, revok = doc["rev"].(string)
-			}
-			if docid == "" || !revok {
-				err = base.HTTPErrorf(http.StatusBadRequest, "Invalid doc/rev ID in _bulk_get")
-			} else {
-				attsSince, err = db.GetStringArrayProperty(doc, "atts_since")
-
-				if showRevs {
-					docRevsLimit = globalRevsLimit
-
-					// Try to pull out a per-doc revs limit that can override the global one.
-					if raw, isSet := doc["revs_limit"]; isSet {
-						if val, ok := base.ToInt64(raw); ok && val >= 0 {
-							docRevsLimit = int(val)
-						} else {
-							err = base.HTTPErrorf(http.StatusBadRequest, "Invalid revs_limit for doc: %s in _bulk_get", docid)
-						}
-					}
+			if showRevs {
+				docRevsLimit = globalRevsLimit
 
-					if docRevsLimit > 0 {
-						revsFrom, err = db.GetStringArrayProperty(doc, "revs_from")
-						if revsFrom == nil {
-							revsFrom = attsSince // revs_from defaults to same value as atts_since
-						}
+				// Try to pull out a per-doc revs limit that can override the global one.
+				if raw, isSet := doc["revs_limit"]; isSet {
+					if val, ok := base.ToInt64(raw); ok && val >= 0 {
+						docRevsLimit = int(val)
+					} else {
+						err = base.HTTPErrorf(http.StatusBadRequest, "Invalid revs_limit for doc: %s in _bulk_get", docid)
 					}
 				}
 
-				if !includeAttachments {
-					attsSince = nil
-				} else if attsSince == nil {
-					attsSince = []string{}
+				if docRevsLimit > 0 {
+					revsFrom, err = db.GetStringArrayProperty(doc, "revs_from")
+					if revsFrom == nil {
+						revsFrom = attsSince // revs_from defaults to same value as atts_since
+					}
 				}
+			}
 
+			if !includeAttachments {
+				attsSince = nil
+			} else if attsSince == nil {
+				attsSince = []string{}
 			}
 
-			if err == nil {
-				body, err = h.db.GetRevWithHistory(docid, revid, docRevsLimit, revsFrom, attsSince, showExp)
+		}
+
+		if err == nil {
+			body, err = h.db.GetRevWithHistory(docid, revid, docRevsLimit, revsFrom, attsSince, showExp)
+		}
+
+		if err != nil {
+			// Report error in the response for this doc:
+			status, reason := base.ErrorAsHTTPStatus(err)
+			errStr := base.CouchHTTPErrorName(status)
+			body = db.Body{"id": docid, "error": errStr, "reason": reason, "status": status}
+			if revid != "" {
+				body["rev"] = revid
 			}
+		}
+		return body, err
+	}
 
-			if err != nil {
-				// Report error in the response for this doc:
-				status, reason := base.ErrorAsHTTPStatus(err)
-				errStr := base.CouchHTTPErrorName(status)
-				body = db.Body{"id": docid, "error": errStr, "reason": reason, "status": status}
-				if revid != "" {
-					body["rev"] = revid
+	// The specific revisions requested that aren't cached are read from the bucket at once
+	preload := make([]db.IDAndRev, 0, len(docs))
+	for _, item := range docs {
+		if doc, ok := item.(map[string]interface{}); ok {
+			docid, _ := doc["id"].(string)
+			revid, _ := doc["rev"].(string)
+			preload = append(preload, db.IDAndRev{DocID: docid, RevID: revid})
+		}
+	}
+	h.db.PreloadRevisions(preload)
+
+	// The revisions are got in parallel, and written in the requested order as they're ready
+	type bulkGetResult struct {
+		body  db.Body
+		err   error
+		ready chan struct{}
+	}
+	results := make([]bulkGetResult, len(docs))
+	for i := range results {
+		results[i].ready = make(chan struct{})
+	}
+	// Once the response stops being written, the revisions not yet got are skipped
+	cancelled := make(chan struct{})
+	defer close(cancelled)
+	go base.ForEachConcurrently(len(docs), h.bulkConcurrency(), func(i int) {
+		defer close(results[i].ready)
+		// A panic only fails its own revision, as nothing above this goroutine can recover it
+		defer func() {
+			if panicked := recover(); panicked != nil {
+				base.Warnf(base.KeyAll, "PANIC getting revision for _bulk_get: %v\n%s", panicked, debug.Stack())
+				results[i].err = base.HTTPErrorf(http.StatusInternalServerError, "Internal error")
+				results[i].body = db.Body{"error": base.CouchHTTPErrorName(http.StatusInternalServerError), "reason": "Internal error", "status": http.StatusInternalServerError}
+				if doc, ok := docs[i].(map[string]interface{}); ok {
+					results[i].body["id"] = doc["id"]
 				}
 			}
+		}()
+		select {
+		case <-cancelled:
+		default:
+			results[i].body, results[i].err = getRevision(docs[i])
+		}
+	})
+
+	var closeNotify <-chan bool
+	if cn, ok := h.response.(http.CloseNotifier); ok {
+		closeNotify = cn.CloseNotify()
+	}
 
-			h.db.WriteRevisionAsPart(body, err != nil, canCompressParts, writer)
+	return h.writeMultipart("mixed", func(writer *multipart.Writer) error {
+		for i := range results {
+			select {
+			case <-results[i].ready:
+			case <-closeNotify:
+				base.Infof(base.KeyHTTP, "Connection lost from client during _bulk_get: %v", h.currentEffectiveUserNameAsUser())
+				return nil
+			}
+			if err := h.db.WriteRevisionAsPart(results[i].body, results[i].err != nil, canCompressParts, writer); err != nil {
+				base.Infof(base.KeyHTTP, "Error writing _bulk_get response: %v", err)
+				return nil
+			}
 		}
 		return nil
 	})
@@ -430,6 +491,10 @@ func (h *handler) handleBulkGet() error {
 
 // HTTP handler for a POST to _bulk_docs
 func (h *handler) handleBulkDocs() error {
+	// Rejected as a whole, rather than failing each doc
+	if h.db.IsReadOnly() {
+		return base.ErrReadOnly
+	}
 
 	body, err := h.readJSON()
 	if err != nil {
@@ -470,45 +535,29 @@ func (h *handler) handleBulkDocs() error {
 
 	h.db.ReserveSequences(uint64(len(docs)))
 
-	result := make([]db.Body, 0, len(docs))
-	for _, item := range docs {
-		doc := item.(map[string]interface{})
-		docid, _ := doc[db.BodyId].(string)
-		var err error
-		var revid string
-		if newEdits {
-			if docid != "" {
-				revid, err = h.db.Put(docid, doc)
-			} else {
-				docid, revid, err = h.db.Post(doc)
-			}
-		} else {
-			revisions := db.ParseRevisions(doc)
-			if revisions == nil {
-				err = base.HTTPErrorf(http.StatusBadRequest, "Bad _revisions")
-			} else {
-				revid = revisions[0]
-				err = h.db.PutExistingRev(docid, doc, revisions, false)
-			}
+	// Docs are saved in parallel, except that those with the same ID are saved in the order given,
+	// by the same worker.  Each doc's status is at its index in the response.
+	var docGroups [][]int
+	groupIndexes := make(map[string]int, len(docs))
+	for i, item := range docs {
+		docid, _ := item.(map[string]interface{})[db.BodyId].(string)
+		if group, found := groupIndexes[docid]; found {
+			docGroups[group] = append(docGroups[group], i)
+			continue
 		}
-
-		status := db.Body{}
 		if docid != "" {
-			status["id"] = docid
-		}
-		if err != nil {
-			code, msg := base.ErrorAsHTTPStatus(err)
-			status["status"] = code
-			status["error"] = base.CouchHTTPErrorName(code)
-			status["reason"] = msg
-			base.Infof(base.KeyAll, "\tBulkDocs: Doc %q --> %d %s (%v)", base.UD(docid), code, msg, err)
-			err = nil // wrote it to output already; not going to return it
-		} else {
-			status["rev"] = revid
+			groupIndexes[docid] = len(docGroups)
 		}
-		result = append(result, status)
+		docGroups = append(docGroups, []int{i})
 	}
 
+	result := make([]db.Body, len(docs), len(docs)+len(localDocs))
+	base.ForEachConcurrently(len(docGroups), h.bulkConcurrency(), func(group int) {
+		for _, i := range docGroups[group] {
+			result[i] = h.saveBulkDoc(docs[i].(map[string]interface{}), newEdits)
+		}
+	})
+
 	for _, item := range localDocs {
 		doc := item.(map[string]interface{})
 		for k, v := range doc {
@@ -538,3 +587,48 @@ func (h *handler) handleBulkDocs() error {
 	h.writeJSONStatus(http.StatusCreated, result)
 	return nil
 }
+
+// Saves a doc of a _bulk_docs request, returning its status for the response.
+func (h *handler) saveBulkDoc(doc db.Body, newEdits bool) db.Body {
+	docid, _ := doc[db.BodyId].(string)
+	var err error
+	var revid string
+	if newEdits {
+		if docid != "" {
+			revid, err = h.db.Put(docid, doc)
+		} else {
+			docid, revid, err = h.db.Post(doc)
+		}
+	} else {
+		revisions := db.ParseRevisions(doc)
+		if revisions == nil {
+			err = base.HTTPErrorf(http.StatusBadRequest, "Bad _revisions")
+		} else {
+			revid = revisions[0]
+			err = h.db.PutExistingRev(docid, doc, revisions, false)
+		}
+	}
+
+	status := db.Body{}
+	if docid != "" {
+		status["id"] = docid
+	}
+	if err != nil {
+		code, msg := base.ErrorAsHTTPStatus(err)
+		status["status"] = code
+		status["error"] = base.CouchHTTPErrorName(code)
+		status["reason"] = msg
+		base.Infof(base.KeyAll, "\tBulkDocs: Doc %q --> %d %s (%v)", base.UD(docid), code, msg, err)
+	} else {
+		status["rev"] = revid
+	}
+	return status
+}
+
+// Returns the max number of docs of a bulk request to process in parallel.
+func (h *handler) bulkConcurrency() int {
+	if concurrency := h.db.Options.BulkConcurrency; concurrency > 0 {
+		return concurrency
+	}
+	return db.DefaultBulkConcurrency
+}
@@ -0,0 +1,71 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// HTTP handler for GET /db/_cache/channels
+func (h *handler) handleGetChannelCaches() error {
+	infos, err := h.db.AllChannelCacheInfo()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(infos)
+	return nil
+}
+
+// HTTP handler for GET /db/_cache/channels/{channel}
+func (h *handler) handleGetChannelCache() error {
+	info, err := h.db.ChannelCacheInfo(h.PathVar("channel"))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(info)
+	return nil
+}
+
+// HTTP handler for DELETE /db/_cache/channels/{channel}
+func (h *handler) handleEvictChannelCache() error {
+	return h.db.EvictChannelCache(h.PathVar("channel"))
+}
+
+// HTTP handler for POST /db/_cache/channels/{channel}/_prewarm
+func (h *handler) handlePrewarmChannelCache() error {
+	info, err := h.db.PrewarmChannelCache(h.PathVar("channel"))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(info)
+	return nil
+}
+
+// HTTP handler for GET /db/_cache/sequences
+func (h *handler) handleGetCacheSequences() error {
+	sequences, err := h.db.ChangeCacheSequences()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(sequences)
+	return nil
+}
+
+// HTTP handler for DELETE /db/_cache/skipped/{seq}
+func (h *handler) handleAbandonSkippedSequence() error {
+	sequence, err := strconv.ParseUint(h.PathVar("seq"), 10, 64)
+	if err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid sequence %q", h.PathVar("seq"))
+	}
+	return h.db.AbandonSkippedSequence(sequence)
+}
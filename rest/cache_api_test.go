@@ -0,0 +1,82 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelCacheAdminAPI(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"channels":["A"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"channels":["A"]}`), 201)
+	assert.NoError(t, rt.WaitForPendingChanges())
+
+	getChannel := func(channel string) (info db.ChannelCacheInfo) {
+		response := rt.SendAdminRequest("GET", "/db/_cache/channels/"+channel, "")
+		assertStatus(t, response, 200)
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &info))
+		return info
+	}
+
+	// List the cached channels
+	response := rt.SendAdminRequest("GET", "/db/_cache/channels", "")
+	assertStatus(t, response, 200)
+	var infos []db.ChannelCacheInfo
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &infos))
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Channel
+	}
+	assert.Contains(t, names, "A")
+
+	info := getChannel("A")
+	assert.Equal(t, 2, info.Entries)
+	assert.Equal(t, uint64(1), info.OldestSequence)
+	assert.Equal(t, uint64(2), info.NewestSequence)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_cache/channels/Z", ""), 404)
+
+	// Evicting empties the cache, which is then only valid after its last entry
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_cache/channels/A", ""), 200)
+	info = getChannel("A")
+	assert.Equal(t, 0, info.Entries)
+	assert.Equal(t, uint64(3), info.ValidFrom)
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_cache/channels/Z", ""), 404)
+
+	// Prewarming reloads it from a query
+	response = rt.SendAdminRequest("POST", "/db/_cache/channels/A/_prewarm", "")
+	assertStatus(t, response, 200)
+	info = db.ChannelCacheInfo{}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &info))
+	assert.Equal(t, 2, info.Entries)
+	assert.Equal(t, int64(1), info.Misses)
+
+	// Nothing is pending or skipped
+	response = rt.SendAdminRequest("GET", "/db/_cache/sequences", "")
+	assertStatus(t, response, 200)
+	var sequences db.ChangeCacheSequences
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &sequences))
+	assert.Equal(t, uint64(3), sequences.NextSequence)
+	assert.Len(t, sequences.Pending, 0)
+	assert.Len(t, sequences.Skipped, 0)
+
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_cache/skipped/5", ""), 404)
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_cache/skipped/five", ""), 400)
+
+	// Only available on the admin API
+	assertStatus(t, rt.SendRequest("GET", "/db/_cache/channels", ""), 404)
+}
@@ -401,6 +401,10 @@ func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions
 				message = "OK DB has gone offline"
 				forceClose = true
 				break loop
+			case <-h.server.drainChannel():
+				message = "OK (server draining)"
+				forceClose = true
+				break loop
 			}
 			if err != nil {
 				logStatus(599, fmt.Sprintf("Write error: %v", err))
@@ -422,17 +426,17 @@ func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions
 func (h *handler) generateContinuousChanges(inChannels base.Set, options db.ChangesOptions, send func([]*db.ChangeEntry) error) (error, bool) {
 	// Ensure continuous is set, since generateChanges now supports both continuous and one-shot
 	options.Continuous = true
-	err, forceClose := generateChanges(h.db, inChannels, options, nil, h, send)
+	err, forceClose := generateChanges(h.db, inChannels, options, nil, h, h.server.drainChannel(), send)
 	h.logStatus(http.StatusOK, "OK (continuous feed closed)")
 	return err, forceClose
 }
 
 // Used by BLIP connections for changes.  Supports both one-shot and continuous changes.
-func generateBlipSyncChanges(database *db.Database, inChannels base.Set, options db.ChangesOptions, docIDFilter []string, send func([]*db.ChangeEntry) error) (err error, forceClose bool) {
+func generateBlipSyncChanges(database *db.Database, inChannels base.Set, options db.ChangesOptions, docIDFilter []string, drain <-chan struct{}, send func([]*db.ChangeEntry) error) (err error, forceClose bool) {
 
 	// Store one-shot here to protect
 	isOneShot := !options.Continuous
-	err, forceClose = generateChanges(database, inChannels, options, docIDFilter, nil, send)
+	err, forceClose = generateChanges(database, inChannels, options, docIDFilter, nil, drain, send)
 
 	// For one-shot changes, invoke the callback w/ nil to trigger the 'caught up' changes message.  (For continuous changes, this
 	// is done by MultiChangesFeed prior to going into Wait mode)
@@ -444,8 +448,9 @@ func generateBlipSyncChanges(database *db.Database, inChannels base.Set, options
 
 // Shell of the continuous changes feed -- calls out to a `send` function to deliver the change.
 // This is called from BLIP connections as well as HTTP handlers, which is why this is not a
-// method on `handler`. (In the BLIP case the `h` parameter will be nil.)
-func generateChanges(database *db.Database, inChannels base.Set, options db.ChangesOptions, docIDFilter []string, h *handler, send func([]*db.ChangeEntry) error) (err error, forceClose bool) {
+// method on `handler`. (In the BLIP case the `h` parameter will be nil.)  The feed ends when the
+// `drain` channel is closed.
+func generateChanges(database *db.Database, inChannels base.Set, options db.ChangesOptions, docIDFilter []string, h *handler, drain <-chan struct{}, send func([]*db.ChangeEntry) error) (err error, forceClose bool) {
 	// Set up heartbeat/timeout
 	var timeoutInterval time.Duration
 	var timer *time.Timer
@@ -592,6 +597,9 @@ loop:
 		case <-options.Terminator:
 			forceClose = true
 			break loop
+		case <-drain:
+			forceClose = true
+			break loop
 		}
 		if err != nil {
 			if h != nil {
@@ -611,7 +619,8 @@ func (h *handler) sendContinuousChangesByHTTP(inChannels base.Set, options db.Ch
 	h.setHeader("Content-Type", "application/octet-stream")
 	h.setHeader("Cache-Control", "private, max-age=0, no-cache, no-store")
 	h.logStatus(http.StatusOK, "sending continuous feed")
-	return h.generateContinuousChanges(inChannels, options, func(changes []*db.ChangeEntry) error {
+	lastSeq := options.Since
+	err, forceClose := h.generateContinuousChanges(inChannels, options, func(changes []*db.ChangeEntry) error {
 		var err error
 		if changes != nil {
 			for _, change := range changes {
@@ -622,6 +631,7 @@ func (h *handler) sendContinuousChangesByHTTP(inChannels base.Set, options db.Ch
 				if _, err = h.response.Write([]byte("\n")); err != nil {
 					break
 				}
+				lastSeq = change.Seq
 			}
 		} else {
 			_, err = h.response.Write([]byte("\n"))
@@ -629,6 +639,13 @@ func (h *handler) sendContinuousChangesByHTTP(inChannels base.Set, options db.Ch
 		h.flush()
 		return err
 	})
+
+	// When draining, end the feed the way CouchDB does, so the client knows where to resume from
+	if err == nil && h.server.IsDraining() {
+		h.response.Write([]byte(fmt.Sprintf("{\"last_seq\":%q}\n", lastSeq.String())))
+		h.flush()
+	}
+	return err, forceClose
 }
 
 func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options db.ChangesOptions) (error, bool) {
@@ -636,6 +653,7 @@ func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options
 	forceClose := false
 	handler := func(conn *websocket.Conn) {
 		h.logStatus(101, "Upgraded to WebSocket protocol")
+		defer h.server.trackWebSocket()()
 		defer func() {
 			if err := conn.Close(); err != nil {
 				base.Warnf(base.KeyAll, "WebSocket connection (#%03d) closed with error %v",
@@ -710,32 +728,46 @@ func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options
 	return nil, forceClose
 }
 
-func (h *handler) readChangesOptionsFromJSON(jsonData []byte) (feed string, options db.ChangesOptions, filter string, channelsArray []string, docIdsArray []string, compress bool, err error) {
-	var input struct {
-		Feed           string        `json:"feed"`
-		Since          db.SequenceID `json:"since"`
-		Limit          int           `json:"limit"`
-		Style          string        `json:"style"`
-		IncludeDocs    bool          `json:"include_docs"`
-		Filter         string        `json:"filter"`
-		Channels       string        `json:"channels"` // a filter query param, so it has to be a string
-		DocIds         []string      `json:"doc_ids"`
-		HeartbeatMs    *uint64       `json:"heartbeat"`
-		TimeoutMs      *uint64       `json:"timeout"`
-		AcceptEncoding string        `json:"accept_encoding"`
-		ActiveOnly     bool          `json:"active_only"` // Return active revisions only
+// Parses the since property of a JSON request body, which is either a sequence or a time.
+func (h *handler) parseJSONSince(rawSince json.RawMessage) (since db.SequenceID, err error) {
+	var sinceTime string
+	if h.db != nil && json.Unmarshal(rawSince, &sinceTime) == nil && db.IsTimeSince(sinceTime) {
+		return h.db.ParseSequenceID(sinceTime)
 	}
 
 	// Initialize since clock and hasher ahead of unmarshalling sequence
 	if h.db != nil {
-		input.Since = h.db.CreateZeroSinceValue()
+		since = h.db.CreateZeroSinceValue()
+	}
+	if len(rawSince) > 0 {
+		err = json.Unmarshal(rawSince, &since)
+	}
+	return since, err
+}
+
+func (h *handler) readChangesOptionsFromJSON(jsonData []byte) (feed string, options db.ChangesOptions, filter string, channelsArray []string, docIdsArray []string, compress bool, err error) {
+	var input struct {
+		Feed           string          `json:"feed"`
+		Since          json.RawMessage `json:"since"` // a sequence, or a time
+		Limit          int             `json:"limit"`
+		Style          string          `json:"style"`
+		IncludeDocs    bool            `json:"include_docs"`
+		Filter         string          `json:"filter"`
+		Channels       string          `json:"channels"` // a filter query param, so it has to be a string
+		DocIds         []string        `json:"doc_ids"`
+		HeartbeatMs    *uint64         `json:"heartbeat"`
+		TimeoutMs      *uint64         `json:"timeout"`
+		AcceptEncoding string          `json:"accept_encoding"`
+		ActiveOnly     bool            `json:"active_only"` // Return active revisions only
 	}
 
 	if err = json.Unmarshal(jsonData, &input); err != nil {
 		return
 	}
 	feed = input.Feed
-	options.Since = input.Since
+	if options.Since, err = h.parseJSONSince(input.Since); err != nil {
+		return
+	}
 	options.Limit = input.Limit
 
 	options.Conflicts = input.Style == "all_docs"
@@ -2614,3 +2614,38 @@ func WriteDirectWithKey(testDb *db.DatabaseContext, key string, channelArray []s
 
 	testDb.Bucket.Add(key, 0, db.Body{"_sync": syncData, "key": key})
 }
+
+func TestChangesSinceTime(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+
+	before := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"channels":["A"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"channels":["A"]}`), 201)
+	assert.NoError(t, rt.WaitForPendingChanges())
+
+	getChanges := func(method, path, body string) (changes changesResults) {
+		response := rt.SendAdminRequest(method, path, body)
+		assertStatus(t, response, 200)
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &changes))
+		return changes
+	}
+
+	// A time before the database started gets every change
+	changes := getChanges("GET", "/db/_changes?since="+before, "")
+	assert.Len(t, changes.Results, 2)
+	changes = getChanges("POST", "/db/_changes", fmt.Sprintf(`{"since":%q}`, before))
+	assert.Len(t, changes.Results, 2)
+
+	// Now gets only the changes made from now on
+	changes = getChanges("GET", "/db/_changes?since=now", "")
+	assert.Len(t, changes.Results, 0)
+	assert.Equal(t, "2", fmt.Sprint(changes.Last_Seq))
+	changes = getChanges("POST", "/db/_changes", `{"since":"now"}`)
+	assert.Len(t, changes.Results, 0)
+
+	// Sequences still work in a POST body
+	changes = getChanges("POST", "/db/_changes", `{"since":1}`)
+	assert.Len(t, changes.Results, 1)
+}
@@ -18,9 +18,11 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/couchbase/sync_gateway/auth"
@@ -70,40 +72,55 @@ const (
 
 // JSON object that defines the server configuration.
 type ServerConfig struct {
-	Interface                  *string                  `json:",omitempty"`                        // Interface to bind REST API to, default ":4984"
-	SSLCert                    *string                  `json:",omitempty"`                        // Path to SSL cert file, or nil
-	SSLKey                     *string                  `json:",omitempty"`                        // Path to SSL private key file, or nil
-	ServerReadTimeout          *int                     `json:",omitempty"`                        // maximum duration.Second before timing out read of the HTTP(S) request
-	ServerWriteTimeout         *int                     `json:",omitempty"`                        // maximum duration.Second before timing out write of the HTTP(S) response
-	AdminInterface             *string                  `json:",omitempty"`                        // Interface to bind admin API to, default "localhost:4985"
-	AdminUI                    *string                  `json:",omitempty"`                        // Path to Admin HTML page, if omitted uses bundled HTML
-	ProfileInterface           *string                  `json:",omitempty"`                        // Interface to bind Go profile API to (no default)
-	ConfigServer               *string                  `json:",omitempty"`                        // URL of config server (for dynamic db discovery)
-	Facebook                   *FacebookConfig          `json:",omitempty"`                        // Configuration for Facebook validation
-	Google                     *GoogleConfig            `json:",omitempty"`                        // Configuration for Google validation
-	CORS                       *CORSConfig              `json:",omitempty"`                        // Configuration for allowing CORS
-	DeprecatedLog              []string                 `json:"log,omitempty"`                     // Log keywords to enable
-	DeprecatedLogFilePath      *string                  `json:"logFilePath,omitempty"`             // Path to log file, if missing write to stderr
-	Logging                    *base.LoggingConfig      `json:",omitempty"`                        // Configuration for logging with optional log file rotation
-	Pretty                     bool                     `json:",omitempty"`                        // Pretty-print JSON responses?
-	DeploymentID               *string                  `json:",omitempty"`                        // Optional customer/deployment ID for stats reporting
-	StatsReportInterval        *float64                 `json:",omitempty"`                        // Optional stats report interval (0 to disable)
-	MaxCouchbaseConnections    *int                     `json:",omitempty"`                        // Max # of sockets to open to a Couchbase Server node
-	MaxCouchbaseOverflow       *int                     `json:",omitempty"`                        // Max # of overflow sockets to open
-	CouchbaseKeepaliveInterval *int                     `json:",omitempty"`                        // TCP keep-alive interval between SG and Couchbase server
-	SlowQueryWarningThreshold  *int                     `json:",omitempty"`                        // Log warnings if N1QL queries take this many ms
-	MaxIncomingConnections     *int                     `json:",omitempty"`                        // Max # of incoming HTTP connections to accept
-	MaxFileDescriptors         *uint64                  `json:",omitempty"`                        // Max # of open file descriptors (RLIMIT_NOFILE)
-	CompressResponses          *bool                    `json:",omitempty"`                        // If false, disables compression of HTTP responses
-	Databases                  DbConfigMap              `json:",omitempty"`                        // Pre-configured databases, mapped by name
-	Replications               []*ReplicationConfig     `json:",omitempty"`                        // sg-replicate replication definitions
-	MaxHeartbeat               uint64                   `json:",omitempty"`                        // Max heartbeat value for _changes request (seconds)
-	ClusterConfig              *ClusterConfig           `json:"cluster_config,omitempty"`          // Bucket and other config related to CBGT
-	SkipRunmodeValidation      bool                     `json:"skip_runmode_validation,omitempty"` // If this is true, skips any config validation regarding accel vs normal mode
-	Unsupported                *UnsupportedServerConfig `json:"unsupported,omitempty"`             // Config for unsupported features
-	RunMode                    SyncGatewayRunMode       `json:"runmode,omitempty"`                 // Whether this is an SG reader or an SG Accelerator
-	ReplicatorCompression      *int                     `json:"replicator_compression,omitempty"`  // BLIP data compression level (0-9)
-	BcryptCost                 int                      `json:"bcrypt_cost,omitempty"`             // bcrypt cost to use for password hashes - Default: bcrypt.DefaultCost
+	Interface                  *string                  `json:",omitempty"`                             // Interface to bind REST API to, default ":4984"
+	SSLCert                    *string                  `json:",omitempty"`                             // Path to SSL cert file, or nil
+	SSLKey                     *string                  `json:",omitempty"`                             // Path to SSL private key file, or nil
+	ServerReadTimeout          *int                     `json:",omitempty"`                             // maximum duration.Second before timing out read of the HTTP(S) request
+	ServerWriteTimeout         *int                     `json:",omitempty"`                             // maximum duration.Second before timing out write of the HTTP(S) response
+	AdminInterface             *string                  `json:",omitempty"`                             // Interface to bind admin API to, default "localhost:4985"
+	AdminUI                    *string                  `json:",omitempty"`                             // Path to Admin HTML page, if omitted uses bundled HTML
+	ProfileInterface           *string                  `json:",omitempty"`                             // Interface to bind Go profile API to (no default)
+	ConfigServer               *string                  `json:",omitempty"`                             // URL of config server (for dynamic db discovery)
+	Facebook                   *FacebookConfig          `json:",omitempty"`                             // Configuration for Facebook validation
+	Google                     *GoogleConfig            `json:",omitempty"`                             // Configuration for Google validation
+	CORS                       *CORSConfig              `json:",omitempty"`                             // Configuration for allowing CORS
+	DeprecatedLog              []string                 `json:"log,omitempty"`                          // Log keywords to enable
+	DeprecatedLogFilePath      *string                  `json:"logFilePath,omitempty"`                  // Path to log file, if missing write to stderr
+	Logging                    *base.LoggingConfig      `json:",omitempty"`                             // Configuration for logging with optional log file rotation
+	Pretty                     bool                     `json:",omitempty"`                             // Pretty-print JSON responses?
+	DeploymentID               *string                  `json:",omitempty"`                             // Optional customer/deployment ID for stats reporting
+	StatsReportInterval        *float64                 `json:",omitempty"`                             // Optional stats report interval (0 to disable)
+	MaxCouchbaseConnections    *int                     `json:",omitempty"`                             // Max # of sockets to open to a Couchbase Server node
+	MaxCouchbaseOverflow       *int                     `json:",omitempty"`                             // Max # of overflow sockets to open
+	CouchbaseKeepaliveInterval *int                     `json:",omitempty"`                             // TCP keep-alive interval between SG and Couchbase server
+	SlowQueryWarningThreshold  *int                     `json:",omitempty"`                             // Log warnings if N1QL queries take this many ms
+	MaxIncomingConnections     *int                     `json:",omitempty"`                             // Max # of incoming HTTP connections to accept
+	MaxFileDescriptors         *uint64                  `json:",omitempty"`                             // Max # of open file descriptors (RLIMIT_NOFILE)
+	CompressResponses          *bool                    `json:",omitempty"`                             // If false, disables compression of HTTP responses
+	Databases                  DbConfigMap              `json:",omitempty"`                             // Pre-configured databases, mapped by name
+	Replications               []*ReplicationConfig     `json:",omitempty"`                             // sg-replicate replication definitions
+	MaxHeartbeat               uint64                   `json:",omitempty"`                             // Max heartbeat value for _changes request (seconds)
+	ClusterConfig              *ClusterConfig           `json:"cluster_config,omitempty"`               // Bucket and other config related to CBGT
+	SkipRunmodeValidation      bool                     `json:"skip_runmode_validation,omitempty"`      // If this is true, skips any config validation regarding accel vs normal mode
+	Unsupported                *UnsupportedServerConfig `json:"unsupported,omitempty"`                  // Config for unsupported features
+	RunMode                    SyncGatewayRunMode       `json:"runmode,omitempty"`                      // Whether this is an SG reader or an SG Accelerator
+	ReplicatorCompression      *int                     `json:"replicator_compression,omitempty"`       // BLIP data compression level (0-9)
+	BcryptCost                 int                      `json:"bcrypt_cost,omitempty"`                  // bcrypt cost to use for password hashes - Default: bcrypt.DefaultCost
+	PasswordHashAlgorithm      string                   `json:"password_hash_algorithm,omitempty"`      // Algorithm for new password hashes: bcrypt, scrypt or argon2id - Default: bcrypt
+	DbConfigPollIntervalSecs   *int                     `json:"db_config_poll_interval_secs,omitempty"` // How often to check buckets for db configs persisted by other nodes (0 to disable) - Default: 10
+	ConfigWatchIntervalSecs    *int                     `json:"config_watch_interval_secs,omitempty"`   // How often to check the config files for changes, reloading the config if they've changed (0 to disable) - Default: 0
+	HealthMaxFeedLagSecs       *int                     `json:"health_max_feed_lag_secs,omitempty"`     // Mutation feed lag above which /_health reports a database as unhealthy (0 to disable) - Default: 60
+	ShutdownTimeoutSecs        *int                     `json:"shutdown_timeout_secs,omitempty"`        // How long draining connections can take on shutdown before the process exits anyway - Default: 30
+	NodeHeartbeatIntervalSecs  *int                     `json:"node_heartbeat_interval_secs,omitempty"` // How often to refresh this node's registration in its buckets (0 to disable) - Default: 10
+	ReplicationLeaseSecs       *int                     `json:"replication_lease_secs,omitempty"`       // How often to renew the leases of the replications run by this node, if replication_lease_db is set (0 disables leases) - Default: 10
+	ReplicationLeaseDb         *string                  `json:"replication_lease_db,omitempty"`         // Database whose bucket holds the replication leases, which enables them.  Must be the same on every node - Default: none, every node runs every replication
+	MemoryBudgetBytes          *int64                   `json:"memory_budget_bytes,omitempty"`          // Approx max size of all databases' channel caches, revision caches and pending sequences, evicting the least recently used data above it (0 for no limit) - Default: 0
+
+	// Kept so that the config files can be re-read when the config is reloaded
+	configFilePaths           []string                   // The config files named on the command line
+	strictConfig              bool                       // Whether the config files are validated strictly (see ValidateServerConfigData) whenever they're read
+	applyCommandLineOverrides func(config *ServerConfig) // Applies the command line flags overriding the config files
+	fileConfig                *ServerConfig              // Copy of the config as read, before logging was set up, which reloads are compared with
 }
 
 // Bucket configuration elements - used by db, shadow, index
@@ -186,6 +203,8 @@ type DbConfig struct {
 	CacheConfig               *CacheConfig                   `json:"cache,omitempty"`                        // Cache settings
 	ChannelIndex              *ChannelIndexConfig            `json:"channel_index,omitempty"`                // Channel index settings
 	RevCacheSize              *uint32                        `json:"rev_cache_size,omitempty"`               // Maximum number of revisions to store in the revision cache
+	RevCacheShards            *uint16                        `json:"rev_cache_shards,omitempty"`             // Number of shards the revision cache is split into, to reduce lock contention - Default: 16
+	RevCacheMaxBytes          *int64                         `json:"rev_cache_max_bytes,omitempty"`          // Maximum total size of the revision bodies in the revision cache - Default: no limit
 	StartOffline              bool                           `json:"offline,omitempty"`                      // start the DB in the offline state, defaults to false
 	Unsupported               db.UnsupportedOptions          `json:"unsupported,omitempty"`                  // Config for unsupported features
 	Deprecated                DeprecatedOptions              `json:"deprecated,omitempty"`                   // Config for Deprecated features
@@ -201,6 +220,14 @@ type DbConfig struct {
 	SendWWWAuthenticateHeader *bool                          `json:"send_www_authenticate_header,omitempty"` // If false, disables setting of 'WWW-Authenticate' header in 401 responses
 	BucketOpTimeoutMs         *uint32                        `json:"bucket_op_timeout_ms,omitempty"`         // // How long bucket ops should block returning "operation timed out". If nil, uses GoCB default.  GoCB buckets only.
 	DeltaSync                 DeltaSyncConfig                `json:"delta_sync,omitempty"`
+	EnforceWriteAccess        bool                           `json:"enforce_write_access,omitempty"`                // Require users to have write access to a document's channels in order to update it
+	AllowSelfService          bool                           `json:"allow_self_service,omitempty"`                  // Allow users to manage their own password, email and sessions via the public API
+	PasswordPolicy            *auth.PasswordPolicy           `json:"password_policy,omitempty"`                     // Rules that user passwords must satisfy
+	SessionOptions            *auth.SessionOptions           `json:"session_options,omitempty"`                     // Login session limits and cookie attributes
+	BackfillConcurrency       *int                           `json:"changes_backfill_concurrency,omitempty"`        // Max number of channel queries run in parallel by a changes feed - Default: 8
+	CombinedQueryMinChannels  *int                           `json:"changes_combined_query_min_channels,omitempty"` // Min number of uncached channels a changes feed queries at once, with GSI - Default: 0 (never)
+	MaxSequenceBatchSize      *uint64                        `json:"max_sequence_batch_size,omitempty"`             // Max number of sequences reserved at once, adapting to the write rate.  Opt-in, as unused reserved sequences delay other nodes' change caches until released - Default: 1
+	BulkConcurrency           *int                           `json:"bulk_concurrency,omitempty"`                    // Max number of docs of a _bulk_docs or _bulk_get request processed in parallel (_bulk_get preloading is skipped with xattrs) - Default: 8
 }
 
 type DeltaSyncConfig struct {
@@ -253,13 +280,23 @@ type EventConfig struct {
 }
 
 type CacheConfig struct {
-	CachePendingSeqMaxWait *uint32 `json:"max_wait_pending,omitempty"` // Max wait for pending sequence before skipping
-	CachePendingSeqMaxNum  *int    `json:"max_num_pending,omitempty"`  // Max number of pending sequences before skipping
-	CacheSkippedSeqMaxWait *uint32 `json:"max_wait_skipped,omitempty"` // Max wait for skipped sequence before abandoning
-	EnableStarChannel      *bool   `json:"enable_star_channel"`        // Enable star channel
-	ChannelCacheMaxLength  *int    `json:"channel_cache_max_length"`   // Maximum number of entries maintained in cache per channel
-	ChannelCacheMinLength  *int    `json:"channel_cache_min_length"`   // Minimum number of entries maintained in cache per channel
-	ChannelCacheAge        *int    `json:"channel_cache_expiry"`       // Time (seconds) to keep entries in cache beyond the minimum retained
+	CachePendingSeqMaxWait *uint32             `json:"max_wait_pending,omitempty"` // Max wait for pending sequence before skipping
+	CachePendingSeqMaxNum  *int                `json:"max_num_pending,omitempty"`  // Max number of pending sequences before skipping
+	CacheSkippedSeqMaxWait *uint32             `json:"max_wait_skipped,omitempty"` // Max wait for skipped sequence before abandoning
+	EnableStarChannel      *bool               `json:"enable_star_channel"`        // Enable star channel
+	ChannelCacheMaxLength  *int                `json:"channel_cache_max_length"`   // Maximum number of entries maintained in cache per channel
+	ChannelCacheMinLength  *int                `json:"channel_cache_min_length"`   // Minimum number of entries maintained in cache per channel
+	ChannelCacheAge        *int                `json:"channel_cache_expiry"`       // Time (seconds) to keep entries in cache beyond the minimum retained
+	Prewarm                *CachePrewarmConfig `json:"prewarm,omitempty"`          // Channels to load into the cache on startup
+}
+
+// Channels whose caches are loaded in the background when the database starts, so that clients
+// reconnecting after a restart don't all have their changes served by queries.
+type CachePrewarmConfig struct {
+	Channels           []string `json:"channels,omitempty"`             // Channels to prewarm.  Names containing '*' are patterns matched against recently active channels
+	RecentChannels     *int     `json:"recent_channels,omitempty"`      // Number of most recently active channels to record, and prewarm - Default: 0
+	RecordIntervalSecs *int     `json:"record_interval_secs,omitempty"` // How often the most recently active channels are recorded in the bucket - Default: 300
+	MaxQueriesPerSec   *int     `json:"max_queries_per_sec,omitempty"`  // Max rate of the queries used to prewarm - Default: 10
 }
 
 type ChannelIndexConfig struct {
@@ -402,6 +439,46 @@ func (dbConfig DbConfig) validate() error {
 		}
 	}
 
+	if dbConfig.SessionOptions != nil {
+		if err := dbConfig.SessionOptions.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if dbConfig.RevCacheMaxBytes != nil && *dbConfig.RevCacheMaxBytes < 0 {
+		return fmt.Errorf("rev_cache_max_bytes must not be negative")
+	}
+
+	if dbConfig.BackfillConcurrency != nil && *dbConfig.BackfillConcurrency < 0 {
+		return fmt.Errorf("changes_backfill_concurrency must not be negative")
+	}
+
+	if dbConfig.CombinedQueryMinChannels != nil && *dbConfig.CombinedQueryMinChannels < 0 {
+		return fmt.Errorf("changes_combined_query_min_channels must not be negative")
+	}
+
+	if dbConfig.BulkConcurrency != nil && *dbConfig.BulkConcurrency < 0 {
+		return fmt.Errorf("bulk_concurrency must not be negative")
+	}
+
+	if dbConfig.CacheConfig != nil && dbConfig.CacheConfig.Prewarm != nil {
+		prewarm := dbConfig.CacheConfig.Prewarm
+		if prewarm.RecentChannels != nil && *prewarm.RecentChannels < 0 {
+			return fmt.Errorf("cache.prewarm.recent_channels must not be negative")
+		}
+		if prewarm.RecordIntervalSecs != nil && *prewarm.RecordIntervalSecs <= 0 {
+			return fmt.Errorf("cache.prewarm.record_interval_secs must be positive")
+		}
+		if prewarm.MaxQueriesPerSec != nil && *prewarm.MaxQueriesPerSec <= 0 {
+			return fmt.Errorf("cache.prewarm.max_queries_per_sec must be positive")
+		}
+		for _, channel := range prewarm.Channels {
+			if _, err := path.Match(channel, ""); err != nil {
+				return fmt.Errorf("Invalid cache.prewarm.channels pattern %q: %v", channel, err)
+			}
+		}
+	}
+
 	// Error if Delta Sync is explicitly enabled in CE
 	if *dbConfig.DeltaSync.Enable && !base.IsEnterpriseEdition() {
 		return fmt.Errorf("Delta sync not supported in CE - disable via config with delta_sync.enable: false")
@@ -526,6 +603,10 @@ func (clusterConfig *ClusterConfig) GetCredentials() (string, string, string) {
 func ReadServerConfigFromData(runMode SyncGatewayRunMode, data []byte) (*ServerConfig, error) {
 
 	data = base.ConvertBackQuotedStrings(data)
+	data, err := base.ExpandConfigVariables(data)
+	if err != nil {
+		return nil, err
+	}
 	var config *ServerConfig
 	if err := json.Unmarshal(data, &config); err != nil {
 		return nil, err
@@ -579,6 +660,10 @@ func ReadServerConfigFromFile(runMode SyncGatewayRunMode, path string) (*ServerC
 		return nil, err
 	}
 	data = base.ConvertBackQuotedStrings(data)
+	data, err = base.ExpandConfigVariables(data)
+	if err != nil {
+		return nil, err
+	}
 	var config *ServerConfig
 	if err := json.Unmarshal(data, &config); err != nil {
 		return nil, err
@@ -596,6 +681,10 @@ func ReadServerConfigFromFile(runMode SyncGatewayRunMode, path string) (*ServerC
 }
 
 func (config *ServerConfig) setupAndValidateDatabases() error {
+	if config.ReplicationLeaseSecs != nil && *config.ReplicationLeaseSecs > 0 && config.ReplicationLeaseDb == nil {
+		return fmt.Errorf("replication_lease_secs requires replication_lease_db, naming the database whose bucket holds the leases")
+	}
+
 	for name, dbConfig := range config.Databases {
 
 		if err := dbConfig.setup(name); err != nil {
@@ -740,6 +829,29 @@ func (self *ServerConfig) MergeWith(other *ServerConfig) error {
 	return nil
 }
 
+// Reads and merges the given config files, validating them strictly first if strict is set.
+func readConfigFiles(runMode SyncGatewayRunMode, paths []string, strict bool) (config *ServerConfig, err error) {
+	for _, filename := range paths {
+		if strict {
+			if err := ValidateServerConfigFile(runMode, filename); err != nil {
+				return nil, base.RedactErrorf("Config file %s is invalid:\n%v", base.UD(filename), err)
+			}
+		}
+		c, err := ReadServerConfig(runMode, filename)
+		if err != nil {
+			return nil, base.RedactErrorf("Error reading config file %s: %v", base.UD(filename), err)
+		}
+		if config == nil {
+			config = c
+		} else {
+			if err := config.MergeWith(c); err != nil {
+				return nil, base.RedactErrorf("Error reading config file %s: %v", base.UD(filename), err)
+			}
+		}
+	}
+	return config, nil
+}
+
 // Reads the command line flags and the optional config file.
 func ParseCommandLine(runMode SyncGatewayRunMode) {
 	addr := flag.String("interface", DefaultInterface, "Address to bind to")
@@ -759,77 +871,89 @@ func ParseCommandLine(runMode SyncGatewayRunMode) {
 	certpath := flag.String("certpath", "", "Client certificate path")
 	cacertpath := flag.String("cacertpath", "", "Root CA certificate path")
 	keypath := flag.String("keypath", "", "Client certificate key path")
+	strict := flag.Bool("strict", false, "Reject config files with unknown properties or invalid JavaScript")
+	validate := flag.Bool("validate", false, "Validate the config files strictly, then exit")
 
 	// used by service scripts as a way to specify a per-distro defaultLogFilePath
 	defaultLogFilePathFlag := flag.String("defaultLogFilePath", "", "Path to log files, if not overridden by --logFilePath, or the config")
 
 	flag.Parse()
 
+	if *validate {
+		if flag.NArg() == 0 {
+			fmt.Fprintln(os.Stderr, "No config files to validate")
+			os.Exit(1)
+		}
+		if !validateConfigFiles(runMode, flag.Args()) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if flag.NArg() > 0 {
 		// Read the configuration file(s), if any:
-		for i := 0; i < flag.NArg(); i++ {
-			filename := flag.Arg(i)
-			c, err := ReadServerConfig(runMode, filename)
-			if err != nil {
-				base.Fatalf(base.KeyAll, "Error reading config file %s: %v", base.UD(filename), err)
-			}
-			if config == nil {
-				config = c
-			} else {
-				if err := config.MergeWith(c); err != nil {
-					base.Fatalf(base.KeyAll, "Error reading config file %s: %v", base.UD(filename), err)
-				}
-			}
+		var err error
+		if config, err = readConfigFiles(runMode, flag.Args(), *strict); err != nil {
+			base.Fatalf(base.KeyAll, "%v", err)
 		}
+		config.configFilePaths = flag.Args()
+		config.strictConfig = *strict
 
 		// Override the config file with global settings from command line flags:
-		if *addr != DefaultInterface {
-			config.Interface = addr
-		}
-		if *authAddr != DefaultAdminInterface {
-			config.AdminInterface = authAddr
-		}
-		if *profAddr != "" {
-			config.ProfileInterface = profAddr
-		}
-		if *configServer != "" {
-			config.ConfigServer = configServer
-		}
-		if *deploymentID != "" {
-			config.DeploymentID = deploymentID
-		}
-		if *pretty {
-			config.Pretty = *pretty
-		}
+		config.applyCommandLineOverrides = func(config *ServerConfig) {
+			if *addr != DefaultInterface {
+				config.Interface = addr
+			}
+			if *authAddr != DefaultAdminInterface {
+				config.AdminInterface = authAddr
+			}
+			if *profAddr != "" {
+				config.ProfileInterface = profAddr
+			}
+			if *configServer != "" {
+				config.ConfigServer = configServer
+			}
+			if *deploymentID != "" {
+				config.DeploymentID = deploymentID
+			}
+			if *pretty {
+				config.Pretty = *pretty
+			}
 
-		// If the interfaces were not specified in either the config file or
-		// on the command line, set them to the default values
-		if config.Interface == nil {
-			config.Interface = &DefaultInterface
-		}
-		if config.AdminInterface == nil {
-			config.AdminInterface = &DefaultAdminInterface
-		}
+			// If the interfaces were not specified in either the config file or
+			// on the command line, set them to the default values
+			if config.Interface == nil {
+				config.Interface = &DefaultInterface
+			}
+			if config.AdminInterface == nil {
+				config.AdminInterface = &DefaultAdminInterface
+			}
 
-		if *logFilePath != "" {
-			config.Logging.LogFilePath = *logFilePath
-		}
+			if *logFilePath != "" {
+				config.Logging.LogFilePath = *logFilePath
+			}
 
-		if *logKeys != "" {
-			config.Logging.Console.LogKeys = strings.Split(*logKeys, ",")
-		}
+			if *logKeys != "" {
+				config.Logging.Console.LogKeys = strings.Split(*logKeys, ",")
+			}
 
-		if *skipRunModeValidation == true {
-			config.SkipRunmodeValidation = *skipRunModeValidation
-		}
+			if *skipRunModeValidation == true {
+				config.SkipRunmodeValidation = *skipRunModeValidation
+			}
 
-		if defaultLogFilePathFlag != nil {
-			defaultLogFilePath = *defaultLogFilePathFlag
+			if defaultLogFilePathFlag != nil {
+				defaultLogFilePath = *defaultLogFilePathFlag
+			}
+
+			// Log HTTP Responses if verbose is enabled.
+			if verbose != nil && *verbose {
+				config.Logging.Console.LogKeys = append(config.Logging.Console.LogKeys, "HTTP+")
+			}
 		}
+		config.applyCommandLineOverrides(config)
 
-		// Log HTTP Responses if verbose is enabled.
-		if verbose != nil && *verbose {
-			config.Logging.Console.LogKeys = append(config.Logging.Console.LogKeys, "HTTP+")
+		if config.fileConfig, err = config.deepCopy(); err != nil {
+			base.Fatalf(base.KeyAll, "Error copying config: %v", err)
 		}
 
 	} else {
@@ -906,7 +1030,7 @@ func (config *ServerConfig) Serve(addr string, handler http.Handler) {
 		config.ServerWriteTimeout,
 		http2Enabled,
 	)
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		base.Fatalf(base.KeyAll, "Failed to start HTTP server on %s: %v", base.UD(addr), err)
 	}
 }
@@ -941,8 +1065,9 @@ func (config *ServerConfig) NumIndexWriters() int {
 	return n
 }
 
-// Starts and runs the server given its configuration. (This function never returns.)
-func RunServer(config *ServerConfig) {
+// Starts and runs the server given its configuration, giving the signal handler the server's
+// context once it's created. (This function never returns.)
+func RunServer(config *ServerConfig, signalHandler *SignalHandler) {
 	PrettyPrint = config.Pretty
 
 	base.Infof(base.KeyAll, "Console LogKeys: %v", base.ConsoleLogKey().EnabledLogKeys())
@@ -966,13 +1091,31 @@ func RunServer(config *ServerConfig) {
 		}
 	}
 
+	// Set global password hash algorithm if configured
+	if config.PasswordHashAlgorithm != "" {
+		if err := auth.SetPasswordHashAlgorithm(config.PasswordHashAlgorithm); err != nil {
+			base.Fatalf(base.KeyAll, "Configuration error: %v", err)
+		}
+	}
+
 	sc := NewServerContext(config)
+	signalHandler.setServerContext(sc)
 	for _, dbConfig := range config.Databases {
-		if _, err := sc.AddDatabaseFromConfig(dbConfig); err != nil {
+		if _, err := sc.addDatabaseWithPersistedConfig(dbConfig); err != nil {
 			base.Fatalf(base.KeyAll, "Error opening database %s: %+v", base.MD(dbConfig.Name), err)
 		}
 	}
 
+	// Apply any persisted database configs that couldn't be read before opening the databases, and
+	// watch for changes to them
+	sc.refreshPersistedDbConfigs()
+	sc.startDbConfigPoller()
+
+	// Register this node in the buckets, so that other nodes can see it
+	sc.startNodeHeartbeat()
+
+	sc.startConfigFileWatcher()
+
 	if config.ProfileInterface != nil {
 		//runtime.MemProfileRate = 10 * 1024
 		base.Infof(base.KeyAll, "Starting profile server on %s", base.UD(*config.ProfileInterface))
@@ -988,6 +1131,9 @@ func RunServer(config *ServerConfig) {
 
 	base.Infof(base.KeyAll, "Starting server on %s ...", base.UD(*config.Interface))
 	config.Serve(*config.Interface, CreatePublicHandler(sc))
+
+	// The public server only stops when the server is draining, which exits the process when done
+	select {}
 }
 
 func HandleSighup() {
@@ -1025,16 +1171,40 @@ func ValidateConfigOrPanic(runMode SyncGatewayRunMode) {
 
 }
 
-func RegisterSignalHandler() {
+// Handles signals sent to the server: SIGHUP rotates the log files and reloads the config, and
+// SIGTERM drains the server's connections before exiting.  Until the server's context has been
+// created, SIGHUP only rotates the log files and SIGTERM exits immediately.
+type SignalHandler struct {
+	lock sync.RWMutex
+	sc   *ServerContext // Set once the server's context has been created
+}
+
+// Starts handling signals.  This should be called as early as possible, so that signals received
+// while the server starts up don't kill the process.
+func RegisterSignalHandler() *SignalHandler {
+	h := &SignalHandler{}
 	signalchannel := make(chan os.Signal, 1)
-	signal.Notify(signalchannel, syscall.SIGHUP, os.Interrupt, os.Kill)
+	signal.Notify(signalchannel, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt, os.Kill)
 
 	go func() {
 		for sig := range signalchannel {
 			base.Infof(base.KeyAll, "Handling signal: %v", sig)
+			sc := h.serverContext()
 			switch sig {
 			case syscall.SIGHUP:
 				HandleSighup()
+				// Reload the config, if it was read from config files
+				if sc != nil && len(sc.config.configFilePaths) > 0 {
+					sc.handleConfigReload()
+				}
+			case syscall.SIGTERM:
+				// Drain connections before exiting; a second SIGTERM exits immediately
+				if sc != nil && sc.claimDrain() {
+					go sc.drainAndExit()
+					continue
+				}
+				base.FlushLogBuffers()
+				os.Exit(143) // 143 == exit code 128 + 15 (terminated)
 			case os.Interrupt, os.Kill:
 				// Ensure log buffers are flushed before exiting.
 				base.FlushLogBuffers()
@@ -1042,6 +1212,23 @@ func RegisterSignalHandler() {
 			}
 		}
 	}()
+	return h
+}
+
+// Gives the handler the server's context, once it's been created.
+func (h *SignalHandler) setServerContext(sc *ServerContext) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	h.sc = sc
+	h.lock.Unlock()
+}
+
+func (h *SignalHandler) serverContext() *ServerContext {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.sc
 }
 
 func panicHandler() (panicHandler func()) {
@@ -1061,7 +1248,7 @@ func panicHandler() (panicHandler func()) {
 // Main entry point for a simple server; you can have your main() function just call this.
 // It parses command-line flags, reads the optional configuration file, then starts the server.
 func ServerMain(runMode SyncGatewayRunMode) {
-	RegisterSignalHandler()
+	signalHandler := RegisterSignalHandler()
 	defer panicHandler()()
 
 	ParseCommandLine(runMode)
@@ -1084,5 +1271,5 @@ func ServerMain(runMode SyncGatewayRunMode) {
 	}
 
 	ValidateConfigOrPanic(runMode)
-	RunServer(config)
+	RunServer(config, signalHandler)
 }
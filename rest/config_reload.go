@@ -0,0 +1,415 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Hot reload of the server config.  On SIGHUP (or when the config files change, if watching is
+// enabled) the config files are re-read and compared with the config the server was started
+// with.  Settings that can be changed while running are applied in place, and databases are
+// added, removed or reloaded; changes to any other settings are reported as requiring a restart.
+
+// Describes the changes made by a config reload.
+type ConfigReloadResult struct {
+	Applied           []string `json:"applied,omitempty"`            // Settings that were changed in place
+	RestartRequired   []string `json:"restart_required,omitempty"`   // Settings that changed, but only take effect after a restart
+	DatabasesAdded    []string `json:"databases_added,omitempty"`    // Databases that were added
+	DatabasesRemoved  []string `json:"databases_removed,omitempty"`  // Databases that were removed
+	DatabasesReloaded []string `json:"databases_reloaded,omitempty"` // Databases that were reloaded with a changed config
+}
+
+func (result *ConfigReloadResult) hasChanges() bool {
+	return len(result.Applied) > 0 || len(result.RestartRequired) > 0 || len(result.DatabasesAdded) > 0 ||
+		len(result.DatabasesRemoved) > 0 || len(result.DatabasesReloaded) > 0
+}
+
+func configValueChanged(oldValue, newValue interface{}) bool {
+	return !reflect.DeepEqual(oldValue, newValue)
+}
+
+func (config *ServerConfig) deepCopy() (*ServerConfig, error) {
+	configCopy := &ServerConfig{}
+	if err := base.DeepCopyInefficient(&configCopy, config); err != nil {
+		return nil, err
+	}
+	return configCopy, nil
+}
+
+// Re-reads the config files given on the command line, and applies them to the running server.
+func (sc *ServerContext) ReloadConfigFiles() (*ConfigReloadResult, error) {
+	if len(sc.config.configFilePaths) == 0 {
+		return nil, errors.New("Sync Gateway wasn't started with a config file")
+	}
+	newConfig, err := readConfigFiles(sc.config.RunMode, sc.config.configFilePaths, sc.config.strictConfig)
+	if err != nil {
+		return nil, err
+	}
+	if sc.config.applyCommandLineOverrides != nil {
+		sc.config.applyCommandLineOverrides(newConfig)
+	}
+	return sc.ReloadConfig(newConfig)
+}
+
+// Applies a newly read server config to the running server.  The new config is compared with the
+// config previously loaded, rather than the running config, so that databases changed through the
+// admin API aren't reverted unless their config file entry changed.
+func (sc *ServerContext) ReloadConfig(newConfig *ServerConfig) (*ConfigReloadResult, error) {
+	sc.reloadLock.Lock()
+	defer sc.reloadLock.Unlock()
+
+	oldConfig := sc.fileConfig
+	if oldConfig == nil {
+		return nil, errors.New("The server config couldn't be copied at startup, so can't be reloaded")
+	}
+	loadedConfig, err := newConfig.deepCopy()
+	if err != nil {
+		return nil, err
+	}
+	result := &ConfigReloadResult{}
+
+	// Settings that are only used at startup
+	restartSettings := []struct {
+		name               string
+		oldValue, newValue interface{}
+	}{
+		{"Interface", oldConfig.Interface, loadedConfig.Interface},
+		{"AdminInterface", oldConfig.AdminInterface, loadedConfig.AdminInterface},
+		{"ProfileInterface", oldConfig.ProfileInterface, loadedConfig.ProfileInterface},
+		{"SSLCert", oldConfig.SSLCert, loadedConfig.SSLCert},
+		{"SSLKey", oldConfig.SSLKey, loadedConfig.SSLKey},
+		{"ServerReadTimeout", oldConfig.ServerReadTimeout, loadedConfig.ServerReadTimeout},
+		{"ServerWriteTimeout", oldConfig.ServerWriteTimeout, loadedConfig.ServerWriteTimeout},
+		{"ConfigServer", oldConfig.ConfigServer, loadedConfig.ConfigServer},
+		{"DeploymentID", oldConfig.DeploymentID, loadedConfig.DeploymentID},
+		{"StatsReportInterval", oldConfig.StatsReportInterval, loadedConfig.StatsReportInterval},
+		{"MaxCouchbaseConnections", oldConfig.MaxCouchbaseConnections, loadedConfig.MaxCouchbaseConnections},
+		{"MaxCouchbaseOverflow", oldConfig.MaxCouchbaseOverflow, loadedConfig.MaxCouchbaseOverflow},
+		{"CouchbaseKeepaliveInterval", oldConfig.CouchbaseKeepaliveInterval, loadedConfig.CouchbaseKeepaliveInterval},
+		{"cluster_config", oldConfig.ClusterConfig, loadedConfig.ClusterConfig},
+		{"unsupported", oldConfig.Unsupported, loadedConfig.Unsupported},
+		{"config_watch_interval_secs", oldConfig.ConfigWatchIntervalSecs, loadedConfig.ConfigWatchIntervalSecs},
+		{"replication_lease_secs", oldConfig.ReplicationLeaseSecs, loadedConfig.ReplicationLeaseSecs},
+		{"replication_lease_db", oldConfig.ReplicationLeaseDb, loadedConfig.ReplicationLeaseDb},
+		{"memory_budget_bytes", oldConfig.MemoryBudgetBytes, loadedConfig.MemoryBudgetBytes},
+		// The login routes are only registered if these are configured at startup
+		{"Facebook", oldConfig.Facebook != nil, loadedConfig.Facebook != nil},
+		{"Google", oldConfig.Google != nil, loadedConfig.Google != nil},
+	}
+	for _, setting := range restartSettings {
+		if configValueChanged(setting.oldValue, setting.newValue) {
+			result.RestartRequired = append(result.RestartRequired, setting.name)
+		}
+	}
+
+	// Global auth settings are applied first, so that an invalid value fails the reload before
+	// anything else has changed.
+	if configValueChanged(oldConfig.BcryptCost, loadedConfig.BcryptCost) {
+		if err := auth.SetBcryptCost(newConfig.BcryptCost); err != nil {
+			return result, err
+		}
+	}
+	if configValueChanged(oldConfig.PasswordHashAlgorithm, loadedConfig.PasswordHashAlgorithm) {
+		if err := auth.SetPasswordHashAlgorithm(newConfig.PasswordHashAlgorithm); err != nil {
+			return result, err
+		}
+	}
+
+	// Logging is set up on the new config, so that it goes through the same defaulting as at startup
+	loggingChanged := configValueChanged(oldConfig.Logging, loadedConfig.Logging) ||
+		configValueChanged(oldConfig.DeprecatedLog, loadedConfig.DeprecatedLog) ||
+		configValueChanged(oldConfig.DeprecatedLogFilePath, loadedConfig.DeprecatedLogFilePath)
+	if loggingChanged {
+		base.FlushLogBuffers()
+		warnings, err := newConfig.setupAndValidateLogging()
+		for _, logFn := range warnings {
+			logFn()
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+
+	liveSettings := []struct {
+		name    string
+		changed bool
+		apply   func()
+	}{
+		{"bcrypt_cost", configValueChanged(oldConfig.BcryptCost, loadedConfig.BcryptCost), func() {
+			sc.config.BcryptCost = newConfig.BcryptCost
+		}},
+		{"password_hash_algorithm", configValueChanged(oldConfig.PasswordHashAlgorithm, loadedConfig.PasswordHashAlgorithm), func() {
+			sc.config.PasswordHashAlgorithm = newConfig.PasswordHashAlgorithm
+		}},
+		{"logging", loggingChanged, func() {
+			sc.config.Logging = newConfig.Logging
+			sc.config.DeprecatedLog = newConfig.DeprecatedLog
+			sc.config.DeprecatedLogFilePath = newConfig.DeprecatedLogFilePath
+		}},
+		{"CORS", configValueChanged(oldConfig.CORS, loadedConfig.CORS), func() {
+			sc.config.CORS = newConfig.CORS
+		}},
+		{"Facebook", oldConfig.Facebook != nil && loadedConfig.Facebook != nil && configValueChanged(oldConfig.Facebook, loadedConfig.Facebook), func() {
+			sc.config.Facebook = newConfig.Facebook
+		}},
+		{"Google", oldConfig.Google != nil && loadedConfig.Google != nil && configValueChanged(oldConfig.Google, loadedConfig.Google), func() {
+			sc.config.Google = newConfig.Google
+		}},
+		{"AdminUI", configValueChanged(oldConfig.AdminUI, loadedConfig.AdminUI), func() {
+			sc.config.AdminUI = newConfig.AdminUI
+		}},
+		{"Pretty", configValueChanged(oldConfig.Pretty, loadedConfig.Pretty), func() {
+			sc.config.Pretty = newConfig.Pretty
+			PrettyPrint = newConfig.Pretty
+		}},
+		{"CompressResponses", configValueChanged(oldConfig.CompressResponses, loadedConfig.CompressResponses), func() {
+			sc.config.CompressResponses = newConfig.CompressResponses
+		}},
+		{"MaxHeartbeat", configValueChanged(oldConfig.MaxHeartbeat, loadedConfig.MaxHeartbeat), func() {
+			sc.config.MaxHeartbeat = newConfig.MaxHeartbeat
+		}},
+		{"replicator_compression", configValueChanged(oldConfig.ReplicatorCompression, loadedConfig.ReplicatorCompression), func() {
+			sc.config.ReplicatorCompression = newConfig.ReplicatorCompression
+		}},
+		{"SlowQueryWarningThreshold", configValueChanged(oldConfig.SlowQueryWarningThreshold, loadedConfig.SlowQueryWarningThreshold), func() {
+			sc.config.SlowQueryWarningThreshold = newConfig.SlowQueryWarningThreshold
+			slowQuery := kDefaultSlowQueryWarningThreshold
+			if newConfig.SlowQueryWarningThreshold != nil {
+				slowQuery = *newConfig.SlowQueryWarningThreshold
+			}
+			base.SlowQueryWarningThreshold = time.Duration(slowQuery) * time.Millisecond
+		}},
+		{"MaxFileDescriptors", configValueChanged(oldConfig.MaxFileDescriptors, loadedConfig.MaxFileDescriptors), func() {
+			sc.config.MaxFileDescriptors = newConfig.MaxFileDescriptors
+			SetMaxFileDescriptors(newConfig.MaxFileDescriptors)
+		}},
+		{"MaxIncomingConnections", configValueChanged(oldConfig.MaxIncomingConnections, loadedConfig.MaxIncomingConnections), func() {
+			sc.config.MaxIncomingConnections = newConfig.MaxIncomingConnections
+			maxConns := DefaultMaxIncomingConnections
+			if newConfig.MaxIncomingConnections != nil {
+				maxConns = *newConfig.MaxIncomingConnections
+			}
+			for _, addr := range []*string{sc.config.Interface, sc.config.AdminInterface} {
+				if addr != nil {
+					base.SetHTTPConnLimit(*addr, maxConns)
+				}
+			}
+		}},
+		{"db_config_poll_interval_secs", configValueChanged(oldConfig.DbConfigPollIntervalSecs, loadedConfig.DbConfigPollIntervalSecs), func() {
+			sc.config.DbConfigPollIntervalSecs = newConfig.DbConfigPollIntervalSecs
+			sc.stopDbConfigPoller()
+			sc.startDbConfigPoller()
+		}},
+		{"health_max_feed_lag_secs", configValueChanged(oldConfig.HealthMaxFeedLagSecs, loadedConfig.HealthMaxFeedLagSecs), func() {
+			sc.config.HealthMaxFeedLagSecs = newConfig.HealthMaxFeedLagSecs
+		}},
+		{"shutdown_timeout_secs", configValueChanged(oldConfig.ShutdownTimeoutSecs, loadedConfig.ShutdownTimeoutSecs), func() {
+			sc.config.ShutdownTimeoutSecs = newConfig.ShutdownTimeoutSecs
+		}},
+		{"node_heartbeat_interval_secs", configValueChanged(oldConfig.NodeHeartbeatIntervalSecs, loadedConfig.NodeHeartbeatIntervalSecs), func() {
+			sc.config.NodeHeartbeatIntervalSecs = newConfig.NodeHeartbeatIntervalSecs
+		}},
+	}
+	sc.lock.Lock()
+	for _, setting := range liveSettings {
+		if setting.changed {
+			setting.apply()
+			result.Applied = append(result.Applied, setting.name)
+		}
+	}
+	sc.lock.Unlock()
+
+	// Heartbeats update the buckets and read the config, so are restarted without the lock
+	if configValueChanged(oldConfig.NodeHeartbeatIntervalSecs, loadedConfig.NodeHeartbeatIntervalSecs) {
+		sc.stopNodeHeartbeat()
+		sc.startNodeHeartbeat()
+	}
+
+	if configValueChanged(oldConfig.Replications, loadedConfig.Replications) {
+		sc.reloadReplications(oldConfig.Replications, loadedConfig.Replications)
+		result.Applied = append(result.Applied, "Replications")
+	}
+
+	var failedDbs []string
+	for dbName, dbConfig := range newConfig.Databases {
+		oldDbConfig := oldConfig.Databases[dbName]
+		if oldDbConfig == nil {
+			if err := sc.addDatabaseFromFileConfig(dbConfig); err != nil {
+				base.Warnf(base.KeyAll, "Error adding db %s on config reload: %v", base.MD(dbName), err)
+				failedDbs = append(failedDbs, dbName)
+				// Leave it out of the loaded config, so that the next reload tries again
+				delete(loadedConfig.Databases, dbName)
+				continue
+			}
+			result.DatabasesAdded = append(result.DatabasesAdded, dbName)
+		} else if configValueChanged(oldDbConfig, loadedConfig.Databases[dbName]) {
+			if err := sc.reloadDatabaseWithFileConfig(dbConfig); err != nil {
+				base.Warnf(base.KeyAll, "Error reloading db %s on config reload: %v", base.MD(dbName), err)
+				failedDbs = append(failedDbs, dbName)
+				loadedConfig.Databases[dbName] = oldDbConfig
+				continue
+			}
+			result.DatabasesReloaded = append(result.DatabasesReloaded, dbName)
+		}
+	}
+	for dbName := range oldConfig.Databases {
+		if newConfig.Databases[dbName] == nil {
+			sc.RemoveDatabase(dbName)
+			sc.lock.Lock()
+			delete(sc.config.Databases, dbName)
+			sc.lock.Unlock()
+			result.DatabasesRemoved = append(result.DatabasesRemoved, dbName)
+		}
+	}
+
+	sc.fileConfig = loadedConfig
+
+	if len(failedDbs) > 0 {
+		return result, fmt.Errorf("Error applying config for databases: %s", strings.Join(failedDbs, ", "))
+	}
+	return result, nil
+}
+
+// Adds a database that was added to the config files, with its persisted config if it has one.
+func (sc *ServerContext) addDatabaseFromFileConfig(dbConfig *DbConfig) error {
+	if _, err := sc.addDatabaseWithPersistedConfig(dbConfig); err != nil {
+		return err
+	}
+	_, err := sc.refreshPersistedDbConfig(dbConfig.Name)
+	return err
+}
+
+// Reloads a database whose entry in the config files changed.  A config persisted through the
+// admin API still takes precedence over the config file's settings, other than the bucket
+// connection settings.
+func (sc *ServerContext) reloadDatabaseWithFileConfig(dbConfig *DbConfig) error {
+	sc.lock.Lock()
+	sc.config.Databases[dbConfig.Name] = dbConfig
+	delete(sc.dbConfigCas, dbConfig.Name)
+	delete(sc.dbConfigFailures, dbConfig.Name)
+	sc.lock.Unlock()
+
+	if _, err := sc.ReloadDatabaseFromConfig(dbConfig.Name, false); err != nil {
+		return err
+	}
+	_, err := sc.refreshPersistedDbConfig(dbConfig.Name)
+	return err
+}
+
+// Cancels the configured replications that were removed or changed, and starts the ones that
+// were added or changed.
+func (sc *ServerContext) reloadReplications(oldReplications, newReplications []*ReplicationConfig) {
+	containsReplication := func(replications []*ReplicationConfig, replication *ReplicationConfig) bool {
+		for _, r := range replications {
+			if reflect.DeepEqual(r, replication) {
+				return true
+			}
+		}
+		return false
+	}
+
+	leased := sc.replicationLeasesActive()
+	for _, replicationConfig := range oldReplications {
+		if containsReplication(newReplications, replicationConfig) {
+			continue
+		}
+		if leased {
+			sc.releaseReplication(replicationConfig)
+		} else {
+			sc.stopReplication(replicationConfig)
+		}
+	}
+
+	// With leases, new replications are started by whichever node takes their leases
+	for _, replicationConfig := range newReplications {
+		if !leased && !containsReplication(oldReplications, replicationConfig) {
+			sc.startReplication(replicationConfig)
+		}
+	}
+
+	sc.lock.Lock()
+	sc.config.Replications = newReplications
+	for replicationConfig := range sc.replicationErrors {
+		if !containsReplication(newReplications, replicationConfig) {
+			delete(sc.replicationErrors, replicationConfig)
+		}
+	}
+	sc.lock.Unlock()
+
+	if leased {
+		sc.updateReplicationLeases()
+	}
+}
+
+// Reloads the config files, logging the changes made.
+func (sc *ServerContext) handleConfigReload() {
+	result, err := sc.ReloadConfigFiles()
+	if err != nil {
+		base.Errorf(base.KeyAll, "Error reloading config: %v", err)
+	}
+	if result == nil || !result.hasChanges() {
+		base.Infof(base.KeyAll, "Reloaded config, no changes found")
+		return
+	}
+	base.Infof(base.KeyAll, "Reloaded config.  Applied: %v, databases added: %v, removed: %v, reloaded: %v",
+		result.Applied, base.MD(result.DatabasesAdded), base.MD(result.DatabasesRemoved), base.MD(result.DatabasesReloaded))
+	if len(result.RestartRequired) > 0 {
+		base.Warnf(base.KeyAll, "Config changes to %v will only take effect after Sync Gateway is restarted", result.RestartRequired)
+	}
+}
+
+// Starts watching the config files for changes, reloading the config when they're modified.
+func (sc *ServerContext) startConfigFileWatcher() {
+	if sc.config.ConfigWatchIntervalSecs == nil || *sc.config.ConfigWatchIntervalSecs <= 0 {
+		return
+	}
+
+	configFilePaths := sc.config.configFilePaths
+	modTimes := func() map[string]time.Time {
+		times := make(map[string]time.Time, len(configFilePaths))
+		for _, path := range configFilePaths {
+			if info, err := os.Stat(path); err == nil {
+				times[path] = info.ModTime()
+			}
+		}
+		return times
+	}
+
+	interval := time.Second * time.Duration(*sc.config.ConfigWatchIntervalSecs)
+	lastModTimes := modTimes()
+
+	sc.tickerLock.Lock()
+	sc.configWatchTicker.stop()
+	sc.configWatchTicker = newBackgroundTicker(interval, func() {
+		if currentModTimes := modTimes(); configValueChanged(lastModTimes, currentModTimes) {
+			lastModTimes = currentModTimes
+			base.Infof(base.KeyAll, "Config file changed, reloading")
+			sc.handleConfigReload()
+		}
+	})
+	sc.tickerLock.Unlock()
+	base.Infof(base.KeyAll, "Watching config files for changes with frequency: %v", interval)
+}
+
+func (sc *ServerContext) stopConfigFileWatcher() {
+	sc.tickerLock.Lock()
+	sc.configWatchTicker.stop()
+	sc.configWatchTicker = nil
+	sc.tickerLock.Unlock()
+}
@@ -0,0 +1,89 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadConfig(t *testing.T) {
+
+	if !base.UnitTestUrlIsWalrus() {
+		t.Skip("This test only works under walrus")
+	}
+
+	readConfig := func(configJSON string) *ServerConfig {
+		config, err := ReadServerConfigFromData(SyncGatewayRunModeNormal, []byte(configJSON))
+		assert.NoError(t, err)
+		return config
+	}
+
+	initialJSON := `{"CORS": {"Origin": ["http://example.com"]},
+		"Databases": {
+			"db1": {"server": "walrus:", "bucket": "reload_db1", "revs_limit": 100},
+			"db2": {"server": "walrus:", "bucket": "reload_db2"}
+		}}`
+	config := readConfig(initialJSON)
+	sc := NewServerContext(config)
+	defer sc.Close()
+	for _, dbConfig := range config.Databases {
+		_, err := sc.AddDatabaseFromConfig(dbConfig)
+		assert.NoError(t, err)
+	}
+
+	// Reloading an unchanged config doesn't change anything
+	result, err := sc.ReloadConfig(readConfig(initialJSON))
+	assert.NoError(t, err)
+	assert.False(t, result.hasChanges())
+
+	result, err = sc.ReloadConfig(readConfig(`{"Interface": ":4999", "CORS": {"Origin": ["http://example.org"]}, "MaxHeartbeat": 60,
+		"Databases": {
+			"db1": {"server": "walrus:", "bucket": "reload_db1", "revs_limit": 200},
+			"db3": {"server": "walrus:", "bucket": "reload_db3"}
+		}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Interface"}, result.RestartRequired)
+	assert.Equal(t, []string{"CORS", "MaxHeartbeat"}, result.Applied)
+	assert.Equal(t, []string{"db3"}, result.DatabasesAdded)
+	assert.Equal(t, []string{"db2"}, result.DatabasesRemoved)
+	assert.Equal(t, []string{"db1"}, result.DatabasesReloaded)
+
+	// Live settings were applied, settings requiring a restart weren't
+	assert.Equal(t, []string{"http://example.org"}, sc.GetConfig().CORS.Origin)
+	assert.Equal(t, uint64(60), sc.GetConfig().MaxHeartbeat)
+	assert.Nil(t, sc.GetConfig().Interface)
+
+	assert.Equal(t, uint32(200), sc.Database("db1").RevsLimit)
+	assert.NotNil(t, sc.Database("db3"))
+	_, err = sc.GetDatabase("db2")
+	assert.Error(t, err)
+	assert.Nil(t, sc.GetDatabaseConfig("db2"))
+}
+
+func TestReloadConfigFilesWithoutConfigFile(t *testing.T) {
+
+	sc := NewServerContext(&ServerConfig{
+		Facebook:       &FacebookConfig{},
+		AdminInterface: &DefaultAdminInterface,
+	})
+	defer sc.Close()
+
+	// Only a config read from config files can be re-read
+	_, err := sc.ReloadConfigFiles()
+	assert.Error(t, err)
+
+	// Without a copy of the startup config, there's nothing to compare a reload with
+	sc.fileConfig = nil
+	_, err = sc.ReloadConfig(&ServerConfig{})
+	assert.Error(t, err)
+}
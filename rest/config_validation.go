@@ -0,0 +1,617 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/robertkrimen/otto"
+)
+
+// Strict config validation, used by the -strict and -validate command line flags.  Unlike the
+// normal config parsing, it rejects unknown properties, compiles the JavaScript functions in the
+// config, and reports every problem found along with its JSON path and line number.
+
+// A problem found by strict config validation.
+type ConfigValidationError struct {
+	Path    string // JSON path of the property, e.g. "databases.db1.sync"
+	Line    int    // Line of the config file containing the property, or 0 if not known
+	Message string
+}
+
+func (e *ConfigValidationError) Error() string {
+	location := e.Path
+	if e.Line > 0 {
+		location = fmt.Sprintf("line %d: %s", e.Line, e.Path)
+	}
+	if location == "" {
+		return e.Message
+	}
+	return location + ": " + e.Message
+}
+
+// All of the problems found by strict config validation.
+type ConfigValidationErrors []*ConfigValidationError
+
+func (errs ConfigValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Config properties of type interface{}, and the types their values are decoded into later.
+var configInterfacePropertyTypes = map[string]reflect.Type{
+	"event_handlers": reflect.TypeOf(EventHandlerConfig{}),
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Reads a config file or URL, and validates it strictly.
+func ValidateServerConfigFile(runMode SyncGatewayRunMode, path string) error {
+	var data []byte
+	var err error
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		var resp *http.Response
+		if resp, err = http.Get(path); err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		data, err = ioutil.ReadAll(resp.Body)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	return ValidateServerConfigData(runMode, data)
+}
+
+// Validates the JSON of a server config strictly.  Returns nil if the config is valid, otherwise a
+// ConfigValidationErrors listing every problem found.
+func ValidateServerConfigData(runMode SyncGatewayRunMode, data []byte) error {
+
+	// Find the line of every property, which also checks the JSON syntax
+	scanner := &jsonLineScanner{data: data, line: 1, lines: map[string]int{}}
+	if err := scanner.scan(); err != nil {
+		return ConfigValidationErrors{err.(*ConfigValidationError)}
+	}
+
+	var errs ConfigValidationErrors
+	addError := func(path string, format string, args ...interface{}) {
+		errs = append(errs, &ConfigValidationError{
+			Path:    path,
+			Line:    scanner.lines[path],
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	data, err := base.ExpandConfigVariables(base.ConvertBackQuotedStrings(data))
+	if err != nil {
+		addError("", "%v", err)
+		return errs
+	}
+
+	var generic map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&generic); err != nil {
+		addError("", "%v", err)
+		return errs
+	}
+	checkConfigProperties(generic, reflect.TypeOf(ServerConfig{}), "", addError)
+	if len(errs) > 0 {
+		// The config can't be decoded if any of its properties have the wrong type
+		return errs
+	}
+
+	var config *ServerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		addError("", "%v", err)
+		return errs
+	}
+	config.RunMode = runMode
+
+	databasesKey := findConfigKey(generic, "Databases")
+	dbNames := make([]string, 0, len(config.Databases))
+	for name := range config.Databases {
+		dbNames = append(dbNames, name)
+	}
+	sort.Strings(dbNames)
+
+	for _, name := range dbNames {
+		dbConfig := config.Databases[name]
+		dbPath := joinConfigPath(databasesKey, name)
+		if err := dbConfig.setup(name); err != nil {
+			addError(dbPath, "%v", err)
+			continue
+		}
+		if err := config.validateDbConfig(dbConfig); err != nil {
+			addError(dbPath, "%v", err)
+		}
+
+		// Compile the JavaScript functions
+		dbGeneric, _ := generic[databasesKey].(map[string]interface{})[name].(map[string]interface{})
+		if dbConfig.Sync != nil {
+			if err := validateJavaScriptFunction(*dbConfig.Sync); err != nil {
+				addError(joinConfigPath(dbPath, "sync"), "invalid sync function: %v", err)
+			}
+		}
+		if dbConfig.ImportFilter != nil {
+			if err := validateJavaScriptFunction(*dbConfig.ImportFilter); err != nil {
+				addError(joinConfigPath(dbPath, "import_filter"), "invalid import filter: %v", err)
+			}
+		}
+		handlersPath := joinConfigPath(dbPath, findConfigKey(dbGeneric, "event_handlers"))
+		handlers, _ := dbGeneric[findConfigKey(dbGeneric, "event_handlers")].(map[string]interface{})
+		for _, event := range []string{"document_changed", "db_state_changed"} {
+			eventKey := findConfigKey(handlers, event)
+			eventConfigs, _ := handlers[eventKey].([]interface{})
+			for i, eventConfig := range eventConfigs {
+				eventMap, _ := eventConfig.(map[string]interface{})
+				filterKey := findConfigKey(eventMap, "filter")
+				filter, ok := eventMap[filterKey].(string)
+				if !ok || filter == "" {
+					continue
+				}
+				if err := validateJavaScriptFunction(filter); err != nil {
+					filterPath := joinConfigPath(fmt.Sprintf("%s[%d]", joinConfigPath(handlersPath, eventKey), i), filterKey)
+					addError(filterPath, "invalid webhook filter: %v", err)
+				}
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Checks that every property of a decoded JSON value is a property of the given type, and that its
+// value can be decoded into the property's type, reporting those that can't.
+func checkConfigProperties(value interface{}, t reflect.Type, path string, addError func(path string, format string, args ...interface{})) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// Types that decode themselves can't be checked
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) || reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return
+	}
+	if !configValueFitsType(value, t) {
+		addError(path, "value of type %s can't be used as %s", jsonTypeName(value), t)
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		fields := configFieldTypes(t)
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			childPath := joinConfigPath(path, key)
+			fieldType, ok := fields[strings.ToLower(key)]
+			if !ok {
+				if suggestion := closestConfigField(key, fields); suggestion != "" {
+					addError(childPath, "unknown property %q, did you mean %q?", key, suggestion)
+				} else {
+					addError(childPath, "unknown property %q", key)
+				}
+				continue
+			}
+			if fieldType.Kind() == reflect.Interface {
+				if interfaceType, ok := configInterfacePropertyTypes[strings.ToLower(key)]; ok {
+					fieldType = interfaceType
+				}
+			}
+			checkConfigProperties(object[key], fieldType, childPath, addError)
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, item := range object {
+			checkConfigProperties(item, t.Elem(), joinConfigPath(path, key), addError)
+		}
+	case reflect.Slice, reflect.Array:
+		items, ok := value.([]interface{})
+		if !ok {
+			return
+		}
+		for i, item := range items {
+			checkConfigProperties(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), addError)
+		}
+	}
+}
+
+// Whether a decoded JSON value can be decoded into a value of the given type, as encoding/json
+// would.  The items of objects and arrays aren't checked.
+func configValueFitsType(value interface{}, t reflect.Type) bool {
+	if value == nil {
+		return true // null leaves any value unset
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Struct, reflect.Map:
+		_, ok := value.(map[string]interface{})
+		return ok
+	case reflect.Slice:
+		if _, ok := value.(string); ok && t.Elem().Kind() == reflect.Uint8 {
+			return true // []byte is decoded from base64
+		}
+		_, ok := value.([]interface{})
+		return ok
+	case reflect.Array:
+		_, ok := value.([]interface{})
+		return ok
+	case reflect.String:
+		_, ok := value.(string)
+		return ok
+	case reflect.Bool:
+		_, ok := value.(bool)
+		return ok
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		i, err := strconv.ParseInt(string(number), 10, 64)
+		return err == nil && !reflect.Zero(t).OverflowInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		number, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		u, err := strconv.ParseUint(string(number), 10, 64)
+		return err == nil && !reflect.Zero(t).OverflowUint(u)
+	case reflect.Float32, reflect.Float64:
+		number, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := number.Float64()
+		return err == nil && !reflect.Zero(t).OverflowFloat(f)
+	}
+	return true
+}
+
+// Describes the type of a decoded JSON value, e.g. "number 1.5", as in encoding/json's errors.
+func jsonTypeName(value interface{}) string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case json.Number:
+		return "number " + string(v)
+	}
+	return "null"
+}
+
+// Returns the types of the JSON properties of a struct, by lower-cased name, including those of
+// embedded structs.
+func configFieldTypes(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" {
+			embeddedType := field.Type
+			if embeddedType.Kind() == reflect.Ptr {
+				embeddedType = embeddedType.Elem()
+			}
+			for embeddedName, embeddedFieldType := range configFieldTypes(embeddedType) {
+				if _, ok := fields[embeddedName]; !ok {
+					fields[embeddedName] = embeddedFieldType
+				}
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[strings.ToLower(name)] = field.Type
+	}
+	return fields
+}
+
+// Returns the known property closest in spelling to an unknown one, if there's one close enough
+// to be a likely typo.
+func closestConfigField(key string, fields map[string]reflect.Type) string {
+	key = strings.ToLower(key)
+	closest, closestDistance := "", 3
+	for name := range fields {
+		if distance := editDistance(key, name); distance < closestDistance || (distance == closestDistance && name < closest) {
+			closest, closestDistance = name, distance
+		}
+	}
+	return closest
+}
+
+// Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Returns the key of an object matching a property name case-insensitively, as encoding/json
+// does, or the name itself if there's no such key.
+func findConfigKey(object map[string]interface{}, name string) string {
+	if _, ok := object[name]; ok {
+		return name
+	}
+	for key := range object {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+	return name
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// Compiles a JavaScript function, as used for sync functions and filters.
+func validateJavaScriptFunction(source string) error {
+	value, err := otto.New().Run("(" + source + ")")
+	if err != nil {
+		return err
+	}
+	if !value.IsFunction() {
+		return errors.New("not a function")
+	}
+	return nil
+}
+
+// Strictly validates each of the given config files, printing any problems found.  Returns false
+// if any of them are invalid.
+func validateConfigFiles(runMode SyncGatewayRunMode, paths []string) bool {
+	valid := true
+	for _, path := range paths {
+		if err := ValidateServerConfigFile(runMode, path); err != nil {
+			fmt.Fprintf(os.Stderr, "Config file %s is invalid:\n%v\n", path, err)
+			valid = false
+		} else {
+			fmt.Fprintf(os.Stderr, "Config file %s is valid\n", path)
+		}
+	}
+	return valid
+}
+
+// Scans JSON text, recording the line on which each property appears, by JSON path.  Config
+// files may contain backquoted strings, which are allowed to span lines.
+type jsonLineScanner struct {
+	data  []byte
+	pos   int
+	line  int
+	lines map[string]int
+}
+
+func (s *jsonLineScanner) scan() error {
+	if err := s.scanValue(""); err != nil {
+		return err
+	}
+	s.skipSpace()
+	if s.pos < len(s.data) {
+		return s.errorf("unexpected %q after the end of the config", s.data[s.pos])
+	}
+	return nil
+}
+
+func (s *jsonLineScanner) errorf(format string, args ...interface{}) error {
+	return &ConfigValidationError{Line: s.line, Message: "invalid JSON: " + fmt.Sprintf(format, args...)}
+}
+
+func (s *jsonLineScanner) skipSpace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case '\n':
+			s.line++
+		case ' ', '\t', '\r':
+		default:
+			return
+		}
+		s.pos++
+	}
+}
+
+func (s *jsonLineScanner) peek() byte {
+	s.skipSpace()
+	if s.pos >= len(s.data) {
+		return 0
+	}
+	return s.data[s.pos]
+}
+
+func (s *jsonLineScanner) scanValue(path string) error {
+	switch c := s.peek(); c {
+	case 0:
+		return s.errorf("unexpected end of the config")
+	case '{':
+		return s.scanObject(path)
+	case '[':
+		return s.scanArray(path)
+	case '"', '`':
+		_, err := s.scanString()
+		return err
+	default:
+		return s.scanLiteral()
+	}
+}
+
+func (s *jsonLineScanner) scanObject(path string) error {
+	s.pos++
+	if s.peek() == '}' {
+		s.pos++
+		return nil
+	}
+	for {
+		if s.peek() != '"' {
+			return s.errorf("expected a property name")
+		}
+		line := s.line
+		key, err := s.scanString()
+		if err != nil {
+			return err
+		}
+		childPath := joinConfigPath(path, key)
+		s.lines[childPath] = line
+		if s.peek() != ':' {
+			return s.errorf("expected ':' after property %q", key)
+		}
+		s.pos++
+		if err := s.scanValue(childPath); err != nil {
+			return err
+		}
+		switch s.peek() {
+		case ',':
+			s.pos++
+		case '}':
+			s.pos++
+			return nil
+		default:
+			return s.errorf("expected ',' or '}' after property %q", key)
+		}
+	}
+}
+
+func (s *jsonLineScanner) scanArray(path string) error {
+	s.pos++
+	if s.peek() == ']' {
+		s.pos++
+		return nil
+	}
+	for i := 0; ; i++ {
+		if err := s.scanValue(fmt.Sprintf("%s[%d]", path, i)); err != nil {
+			return err
+		}
+		switch s.peek() {
+		case ',':
+			s.pos++
+		case ']':
+			s.pos++
+			return nil
+		default:
+			return s.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+// Scans a double-quoted or backquoted string, returning its value.
+func (s *jsonLineScanner) scanString() (string, error) {
+	delimiter := s.data[s.pos]
+	start := s.pos
+	s.pos++
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		switch {
+		case c == '\\':
+			s.pos++
+			if s.pos < len(s.data) && s.data[s.pos] == '\n' {
+				s.line++
+			}
+		case c == delimiter:
+			s.pos++
+			if delimiter == '`' {
+				return string(s.data[start+1 : s.pos-1]), nil
+			}
+			var value string
+			if err := json.Unmarshal(s.data[start:s.pos], &value); err != nil {
+				return "", s.errorf("invalid string: %v", err)
+			}
+			return value, nil
+		case c == '\n':
+			if delimiter == '"' {
+				return "", s.errorf("unterminated string")
+			}
+			s.line++
+		}
+		s.pos++
+	}
+	return "", s.errorf("unterminated string")
+}
+
+// Scans a number, true, false or null.
+func (s *jsonLineScanner) scanLiteral() error {
+	start := s.pos
+	for s.pos < len(s.data) && strings.IndexByte("0123456789+-.eEtruefalsn", s.data[s.pos]) >= 0 {
+		s.pos++
+	}
+	if start == s.pos {
+		return s.errorf("unexpected %q", s.data[s.pos])
+	}
+	var value interface{}
+	if err := json.Unmarshal(s.data[start:s.pos], &value); err != nil {
+		return s.errorf("invalid value %q", s.data[start:s.pos])
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateServerConfigData(t *testing.T) {
+
+	validConfig := `{
+	"interface": ":4984",
+	"databases": {
+		"db": {
+			"server": "walrus:",
+			"bucket": "db",
+			"users": {"GUEST": {"disabled": false, "admin_channels": ["*"]}},
+			"sync": ` + "`function(doc) { channel(doc.channels); }`" + `,
+			"event_handlers": {
+				"document_changed": [{"handler": "webhook", "url": "http://localhost:8081", "filter": "function(doc) { return true; }"}]
+			}
+		}
+	}
+}`
+	assert.NoError(t, ValidateServerConfigData(SyncGatewayRunModeNormal, []byte(validConfig)))
+
+	invalidConfig := `{
+	"interface": ":4984",
+	"databses": {},
+	"databases": {
+		"db": {
+			"server": "walrus:",
+			"bucket": "db",
+			"revs_limt": 100,
+			"sync": "function(doc) { channel(doc.channels); ",
+			"event_handlers": {
+				"document_changed": [{"handler": "webhook", "url": "http://localhost:8081", "filter": "function(doc) { return doc. }"}]
+			}
+		}
+	}
+}`
+	err := ValidateServerConfigData(SyncGatewayRunModeNormal, []byte(invalidConfig))
+	errs, ok := err.(ConfigValidationErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 4)
+	if len(errs) == 4 {
+		assert.Equal(t, "databases.db.revs_limt", errs[0].Path)
+		assert.Equal(t, 8, errs[0].Line)
+		assert.Contains(t, errs[0].Message, `did you mean "revs_limit"?`)
+
+		assert.Equal(t, "databses", errs[1].Path)
+		assert.Equal(t, 3, errs[1].Line)
+		assert.Contains(t, errs[1].Message, `did you mean "databases"?`)
+
+		assert.Equal(t, "databases.db.sync", errs[2].Path)
+		assert.Equal(t, 9, errs[2].Line)
+		assert.Contains(t, errs[2].Message, "invalid sync function")
+
+		assert.Equal(t, "databases.db.event_handlers.document_changed[0].filter", errs[3].Path)
+		assert.Equal(t, 11, errs[3].Line)
+		assert.Contains(t, errs[3].Message, "invalid webhook filter")
+	}
+
+	// Database config errors are reported against the database
+	err = ValidateServerConfigData(SyncGatewayRunModeNormal, []byte(`{"databases": {"db": {"server": "walrus:", "bucket": "db", "import_docs": "sometimes"}}}`))
+	errs, ok = err.(ConfigValidationErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 1)
+	if len(errs) == 1 {
+		assert.Equal(t, "databases.db", errs[0].Path)
+		assert.Equal(t, 1, errs[0].Line)
+	}
+
+	// Every property with the wrong type is reported, with its JSON path and line
+	err = ValidateServerConfigData(SyncGatewayRunModeNormal, []byte(`{
+	"interface": 4984,
+	"databases": {
+		"db": {
+			"server": "walrus:",
+			"revs_limit": -1,
+			"users": {"GUEST": {"disabled": "no"}}
+		}
+	}
+}`))
+	errs, ok = err.(ConfigValidationErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 3)
+	if len(errs) == 3 {
+		assert.Equal(t, "databases.db.revs_limit", errs[0].Path)
+		assert.Equal(t, 6, errs[0].Line)
+		assert.Equal(t, "value of type number -1 can't be used as uint32", errs[0].Message)
+
+		assert.Equal(t, "databases.db.users.GUEST.disabled", errs[1].Path)
+		assert.Equal(t, 7, errs[1].Line)
+		assert.Equal(t, "value of type string can't be used as bool", errs[1].Message)
+
+		assert.Equal(t, "interface", errs[2].Path)
+		assert.Equal(t, 2, errs[2].Line)
+		assert.Equal(t, "value of type number 4984 can't be used as string", errs[2].Message)
+	}
+
+	// Syntax errors are reported with their line
+	err = ValidateServerConfigData(SyncGatewayRunModeNormal, []byte("{\n\"interface\": \":4984\"\n\"adminInterface\": \":4985\"\n}"))
+	errs, ok = err.(ConfigValidationErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 1)
+	if len(errs) == 1 {
+		assert.Equal(t, 3, errs[0].Line)
+		assert.Contains(t, errs[0].Message, "invalid JSON")
+	}
+}
@@ -61,6 +61,17 @@ func (h *handler) handleGetDoc() error {
 	}
 
 	if openRevs == "" {
+		if attachmentsSince == nil && !(h.requestAccepts("multipart/") && !h.requestAccepts("application/json")) {
+			// Single-revision GET without attachment bodies, so the revision's JSON can be written as-is:
+			bodyBytes, revID, err := h.db.GetRevJSONWithHistory(docid, revid, revsLimit, revsFrom, showExp)
+			if err != nil {
+				return err
+			}
+			h.setHeader("Etag", strconv.Quote(revID))
+			h.writeRawJSONStatus(http.StatusOK, bodyBytes)
+			return nil
+		}
+
 		// Single-revision GET:
 		value, err := h.db.GetRevWithHistory(docid, revid, revsLimit, revsFrom, attachmentsSince, showExp)
 		if err != nil {
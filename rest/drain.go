@@ -0,0 +1,151 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Draining shuts the server down gracefully, on SIGTERM or a POST to the admin API's /_drain.
+// The public interface stops accepting connections, continuous changes feeds end with their
+// last_seq, BLIP connections are closed once their in-flight changes have been sent, replications
+// are stopped, and queued events are sent to the event handlers.  The process then exits, even if
+// draining hasn't finished by the shutdown timeout.
+
+const DefaultShutdownTimeoutSecs = 30
+
+// How often to check whether connections and event queues have drained
+const kDrainPollInterval = 50 * time.Millisecond
+
+// Called once the server has drained; replaced by tests.
+var drainExit = func() {
+	base.FlushLogBuffers()
+	os.Exit(0)
+}
+
+// Returns a channel that's closed when the server starts draining.
+func (sc *ServerContext) drainChannel() <-chan struct{} {
+	return sc.drainChan
+}
+
+// Returns true if the server is draining.
+func (sc *ServerContext) IsDraining() bool {
+	select {
+	case <-sc.drainChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns the time allowed for draining.
+func (sc *ServerContext) shutdownTimeout() time.Duration {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+	if sc.config.ShutdownTimeoutSecs != nil {
+		return time.Duration(*sc.config.ShutdownTimeoutSecs) * time.Second
+	}
+	return DefaultShutdownTimeoutSecs * time.Second
+}
+
+// Drains the server, then closes it and exits the process.  Returns immediately if the server is
+// already draining.
+func (sc *ServerContext) DrainAndExit() {
+	if !sc.claimDrain() {
+		return
+	}
+	sc.drainAndExit()
+}
+
+// Claims the right to drain the server, returning false if it's already been claimed.  Draining
+// itself may start later, so this is what decides which of concurrent requests to drain wins.
+func (sc *ServerContext) claimDrain() bool {
+	claimed := false
+	sc.drainOnce.Do(func() {
+		claimed = true
+	})
+	return claimed
+}
+
+// Drains the server, then closes it and exits the process.  Must only be called after claimDrain
+// returns true.
+func (sc *ServerContext) drainAndExit() {
+	sc.drain(sc.shutdownTimeout())
+	sc.Close()
+	drainExit()
+}
+
+// Drains the server, waiting up to the given timeout.  Must only be called once.
+func (sc *ServerContext) drain(timeout time.Duration) {
+	base.Infof(base.KeyAll, "Draining connections before shutting down, for up to %v", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Ends changes feeds, and tells BLIP connections to close
+	close(sc.drainChan)
+
+	// Stop accepting connections on the public interface, and wait for its requests to complete
+	sc.lock.RLock()
+	publicInterface := sc.config.Interface
+	sc.lock.RUnlock()
+	if publicInterface != nil {
+		if _, err := base.ShutdownHTTPServer(ctx, *publicInterface); err != nil {
+			base.Warnf(base.KeyAll, "Requests still active at shutdown timeout: %v", err)
+		}
+	}
+
+	// WebSocket connections aren't tracked by the HTTP server
+	for atomic.LoadInt64(&sc.activeWebSockets) > 0 && ctx.Err() == nil {
+		time.Sleep(kDrainPollInterval)
+	}
+	if remaining := atomic.LoadInt64(&sc.activeWebSockets); remaining > 0 {
+		base.Warnf(base.KeyAll, "%d WebSocket connections still open at shutdown timeout", remaining)
+	}
+
+	if err := sc.replicator.StopReplications(); err != nil {
+		base.Warnf(base.KeyAll, "Error stopping replications: %v", err)
+	}
+
+	for name, dbc := range sc.AllDatabases() {
+		deadline, _ := ctx.Deadline()
+		if !dbc.EventMgr.Flush(time.Until(deadline)) {
+			base.Warnf(base.KeyAll, "Events for database %s still queued at shutdown timeout", base.MD(name))
+		}
+	}
+
+	base.Infof(base.KeyAll, "Finished draining")
+}
+
+// Tracks an open WebSocket connection; the returned function must be called when it closes.
+func (sc *ServerContext) trackWebSocket() (closed func()) {
+	atomic.AddInt64(&sc.activeWebSockets, 1)
+	return func() {
+		atomic.AddInt64(&sc.activeWebSockets, -1)
+	}
+}
+
+// HTTP handler for POST /_drain
+func (h *handler) handleDrain() error {
+	if !h.server.claimDrain() {
+		return base.HTTPErrorf(http.StatusConflict, "Server is already draining")
+	}
+	go h.server.drainAndExit()
+	h.writeJSONStatus(http.StatusAccepted, map[string]interface{}{
+		"draining":     true,
+		"timeout_secs": int(h.server.shutdownTimeout() / time.Second),
+	})
+	return nil
+}
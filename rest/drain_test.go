@@ -0,0 +1,61 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrain(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+	sc := rt.ServerContext()
+
+	response := rt.SendAdminRequest("PUT", "/db/doc1", `{"channels": ["A"]}`)
+	assertStatus(t, response, 201)
+
+	changesDone := make(chan *TestResponse)
+	go func() {
+		changesDone <- rt.SendAdminRequest("GET", "/db/_changes?feed=continuous&since=0", "")
+	}()
+
+	assert.False(t, sc.IsDraining())
+	assert.True(t, sc.claimDrain())
+	sc.drain(5 * time.Second)
+	assert.True(t, sc.IsDraining())
+
+	// The continuous feed ends with its last sequence
+	select {
+	case changesResponse := <-changesDone:
+		assertStatus(t, changesResponse, 200)
+		lines := strings.Split(strings.TrimSpace(changesResponse.Body.String()), "\n")
+		var last map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &last))
+		assert.Contains(t, last, "last_seq")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Continuous changes feed didn't end when draining")
+	}
+
+	// A draining node isn't ready for requests
+	response = rt.SendRequest("GET", "/_health", "")
+	assertStatus(t, response, 503)
+	var health HealthResponse
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &health))
+	assert.True(t, health.Draining)
+
+	response = rt.SendAdminRequest("POST", "/_drain", "")
+	assertStatus(t, response, 409)
+}
@@ -30,6 +30,7 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	pkgerrors "github.com/pkg/errors"
 
 	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
@@ -163,11 +164,11 @@ func (h *handler) invoke(method handlerMethod) error {
 
 			dbState := atomic.LoadUint32(&dbContext.State)
 
-			//if dbState == db.DBOnline, continue flow and invoke the handler method
+			//if dbState == db.DBOnline or db.DBReadOnly, continue flow and invoke the handler method
 			if dbState == db.DBOffline {
 				//DB is offline, only handlers with runOffline true can run in this state
 				return base.HTTPErrorf(http.StatusServiceUnavailable, "DB is currently under maintenance")
-			} else if dbState != db.DBOnline {
+			} else if dbState != db.DBOnline && dbState != db.DBReadOnly {
 				//DB is in transition state, no calls will be accepted until it is Online or Offline state
 				return base.HTTPErrorf(http.StatusServiceUnavailable, fmt.Sprintf("DB is %v - try again later", db.RunStateString[dbState]))
 			}
@@ -341,7 +342,7 @@ func (h *handler) checkAuth(context *db.DatabaseContext) (err error) {
 			}
 			return base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
 		}
-		return nil
+		return h.checkPasswordChangeRequired()
 	}
 
 	// Check cookie
@@ -349,7 +350,7 @@ func (h *handler) checkAuth(context *db.DatabaseContext) (err error) {
 	if err != nil {
 		return err
 	} else if h.user != nil {
-		return nil
+		return h.checkPasswordChangeRequired()
 	}
 
 	// No auth given -- check guest access
@@ -366,6 +367,24 @@ func (h *handler) checkAuth(context *db.DatabaseContext) (err error) {
 	return nil
 }
 
+// The database URLs a user who must change their password may still use
+var passwordChangeAllowedPaths = []string{"/_account/password", "/_session"}
+
+// A user who must change their password may only change it, or view or end their session.  The
+// whole path is compared, as a document's attachment could have the same name as one of the URLs.
+func (h *handler) checkPasswordChangeRequired() error {
+	if !h.user.PasswordChangeRequired() {
+		return nil
+	}
+	dbPath := "/" + mux.Vars(h.rq)["db"]
+	for _, allowed := range passwordChangeAllowedPaths {
+		if h.rq.URL.Path == dbPath+allowed {
+			return nil
+		}
+	}
+	return base.HTTPErrorf(http.StatusForbidden, "Password change required")
+}
+
 func (h *handler) assertAdminOnly() {
 	if h.privs != adminPrivs {
 		panic("Admin-only handler called without admin privileges, on " + h.rq.RequestURI)
@@ -562,18 +581,24 @@ func (h *handler) disableResponseCompression() {
 // Writes an object to the response in JSON format.
 // If status is nonzero, the header will be written with that status.
 func (h *handler) writeJSONStatus(status int, value interface{}) {
-	if !h.requestAccepts("application/json") {
-		base.Warnf(base.KeyAll, "Client won't accept JSON, only %s", h.rq.Header.Get("Accept"))
-		h.writeStatus(http.StatusNotAcceptable, "only application/json available")
-		return
-	}
-
 	jsonOut, err := json.Marshal(value)
 	if err != nil {
 		base.Warnf(base.KeyAll, "Couldn't serialize JSON for %v : %s", base.UD(value), err)
 		h.writeStatus(http.StatusInternalServerError, "JSON serialization failed")
 		return
 	}
+	h.writeRawJSONStatus(status, jsonOut)
+}
+
+// Writes JSON that's already been marshalled to the response.
+// If status is nonzero, the header will be written with that status.
+func (h *handler) writeRawJSONStatus(status int, jsonOut []byte) {
+	if !h.requestAccepts("application/json") {
+		base.Warnf(base.KeyAll, "Client won't accept JSON, only %s", h.rq.Header.Get("Accept"))
+		h.writeStatus(http.StatusNotAcceptable, "only application/json available")
+		return
+	}
+
 	if PrettyPrint {
 		var buffer bytes.Buffer
 		json.Indent(&buffer, jsonOut, "", "  ")
@@ -678,6 +703,10 @@ func (h *handler) writeError(err error) {
 	if err != nil {
 		err = auth.OIDCToHTTPError(err) // Map OIDC/OAuth2 errors to HTTP form
 		status, message := base.ErrorAsHTTPStatus(err)
+		if pkgerrors.Cause(err) == base.ErrReadOnly && h.db != nil {
+			retryAfter := int(math.Ceil(h.db.ReadOnlyRetryAfter().Seconds()))
+			h.setHeader("Retry-After", strconv.Itoa(retryAfter))
+		}
 		h.writeStatus(status, message)
 		format := "%v"
 		if base.StacktraceOnAPIErrors {
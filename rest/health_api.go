@@ -0,0 +1,307 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Health checks, for load balancers and orchestrators such as Kubernetes.  /_ping is a liveness
+// check, which succeeds as long as the server is able to handle requests.  /_health is a readiness
+// check, which fails (with a 503) unless every database is online and connected to its bucket.
+// On the public interface /_health only reports the overall status, as the per-database results
+// name the databases and include raw error messages.
+
+const (
+	HealthStatusOK        = "ok"
+	HealthStatusDegraded  = "degraded"  // Something's wrong that doesn't affect serving requests
+	HealthStatusUnhealthy = "unhealthy" // The node shouldn't be sent requests
+)
+
+// Maximum time an individual check can take before it's considered failed
+const kHealthCheckTimeout = 5 * time.Second
+
+// Default feed lag above which a database is reported as unhealthy
+const DefaultHealthMaxFeedLagSecs = 60
+
+// Document read to check bucket connectivity; it doesn't need to exist.
+const kHealthCheckDocID = db.KSyncKeyPrefix + "health_check"
+
+// Response of /_health
+type HealthResponse struct {
+	Status       string                     `json:"status"`
+	Draining     bool                       `json:"draining,omitempty"`
+	Databases    map[string]*DatabaseHealth `json:"databases,omitempty"`    // Only reported on the admin interface
+	Replications []*ReplicationHealth       `json:"replications,omitempty"` // Only reported on the admin interface
+}
+
+// The result of a single health check
+type HealthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type DatabaseHealth struct {
+	Status       string       `json:"status"`
+	State        string       `json:"state"`
+	Bucket       *HealthCheck `json:"bucket,omitempty"`
+	Feed         *FeedHealth  `json:"feed,omitempty"`
+	SyncFunction *HealthCheck `json:"sync_function,omitempty"`
+	ImportFilter *HealthCheck `json:"import_filter,omitempty"`
+	Config       *HealthCheck `json:"persisted_config,omitempty"` // Only reported if the persisted config failed to load
+}
+
+type FeedHealth struct {
+	HealthCheck
+	LastEventAgeMs *int64 `json:"last_event_age_ms,omitempty"` // Time since the last feed event was received
+	LagMs          *int64 `json:"lag_ms,omitempty"`            // Delay between the last mutation being written and received
+}
+
+type ReplicationHealth struct {
+	HealthCheck
+	ReplicationID    string `json:"replication_id,omitempty"`
+	Source           string `json:"source"`
+	Target           string `json:"target"`
+	DocWriteFailures uint32 `json:"doc_write_failures,omitempty"`
+}
+
+// HTTP handler for GET /_ping: liveness check.  Doesn't take the server context's lock, which is
+// held while databases are loaded, so that a node isn't restarted for reloading a config.
+func (h *handler) handlePing() error {
+	h.writeJSON(map[string]interface{}{"status": HealthStatusOK})
+	return nil
+}
+
+// HTTP handler for GET /_health: readiness check
+func (h *handler) handleHealth() error {
+	response := h.server.checkHealth()
+	if h.privs != adminPrivs {
+		// Database names and errors aren't public, and replication URLs may contain credentials
+		response.Databases = nil
+		response.Replications = nil
+	}
+	status := http.StatusOK
+	if response.Status == HealthStatusUnhealthy {
+		status = http.StatusServiceUnavailable
+	}
+	h.setHeader("Cache-Control", "no-cache")
+	h.writeJSONStatus(status, response)
+	return nil
+}
+
+// Runs the health checks of every database and replication.
+func (sc *ServerContext) checkHealth() *HealthResponse {
+	response := &HealthResponse{
+		Status:    HealthStatusOK,
+		Databases: map[string]*DatabaseHealth{},
+	}
+
+	maxFeedLag := time.Duration(DefaultHealthMaxFeedLagSecs) * time.Second
+	sc.lock.RLock()
+	if sc.config.HealthMaxFeedLagSecs != nil {
+		maxFeedLag = time.Duration(*sc.config.HealthMaxFeedLagSecs) * time.Second
+	}
+	sc.lock.RUnlock()
+
+	var wg sync.WaitGroup
+	var resultsLock sync.Mutex
+	for name, dbc := range sc.AllDatabases() {
+		wg.Add(1)
+		go func(name string, dbc *db.DatabaseContext) {
+			defer wg.Done()
+			dbHealth := checkDatabaseHealth(dbc, maxFeedLag, sc.PersistedDbConfigError(name))
+			resultsLock.Lock()
+			response.Databases[name] = dbHealth
+			resultsLock.Unlock()
+		}(name, dbc)
+	}
+	wg.Wait()
+
+	for _, dbHealth := range response.Databases {
+		response.Status = worseHealthStatus(response.Status, dbHealth.Status)
+	}
+
+	// A draining node shouldn't be sent new requests
+	if sc.IsDraining() {
+		response.Draining = true
+		response.Status = HealthStatusUnhealthy
+	}
+
+	response.Replications = sc.checkReplicationHealth()
+	for _, replicationHealth := range response.Replications {
+		if replicationHealth.Status != HealthStatusOK {
+			// Replication problems don't affect this node's ability to serve requests
+			response.Status = worseHealthStatus(response.Status, HealthStatusDegraded)
+		}
+	}
+
+	return response
+}
+
+// Runs the health checks of a database.  A persisted config that failed to load leaves the database
+// running with its previous config, so is only reported as degraded.
+func checkDatabaseHealth(dbc *db.DatabaseContext, maxFeedLag time.Duration, configErr error) *DatabaseHealth {
+	state := atomic.LoadUint32(&dbc.State)
+	health := &DatabaseHealth{
+		Status: HealthStatusOK,
+		State:  db.RunStateString[state],
+	}
+	if state == db.DBReadOnly {
+		// Still serving reads
+		health.Status = HealthStatusDegraded
+	} else if state != db.DBOnline {
+		health.Status = HealthStatusUnhealthy
+	}
+
+	if bucket := dbc.Bucket; bucket != nil {
+		health.Bucket = runHealthCheck(func() error {
+			_, _, err := bucket.GetRaw(kHealthCheckDocID)
+			if err != nil && !base.IsDocNotFoundError(err) {
+				return err
+			}
+			return nil
+		})
+	} else {
+		health.Bucket = &HealthCheck{Status: HealthStatusUnhealthy, Error: "Not connected to bucket"}
+	}
+	health.Status = worseHealthStatus(health.Status, health.Bucket.Status)
+
+	if feedStatus := dbc.FeedStatus(); !feedStatus.StartTime.IsZero() {
+		health.Feed = checkFeedHealth(feedStatus, maxFeedLag)
+		health.Status = worseHealthStatus(health.Status, health.Feed.Status)
+	}
+
+	if dbc.ChannelMapper != nil {
+		health.SyncFunction = checkJSServerHealth(dbc.ChannelMapper.JSServer)
+		health.Status = worseHealthStatus(health.Status, health.SyncFunction.Status)
+	}
+	if importFilter := dbc.Options.ImportOptions.ImportFilter; importFilter != nil {
+		health.ImportFilter = checkJSServerHealth(importFilter.JSServer)
+		health.Status = worseHealthStatus(health.Status, health.ImportFilter.Status)
+	}
+	if configErr != nil {
+		health.Config = &HealthCheck{Status: HealthStatusDegraded, Error: fmt.Sprintf("Persisted config failed to load: %v", configErr)}
+		health.Status = worseHealthStatus(health.Status, health.Config.Status)
+	}
+
+	return health
+}
+
+func checkFeedHealth(feedStatus db.ChangeFeedStatus, maxFeedLag time.Duration) *FeedHealth {
+	health := &FeedHealth{HealthCheck: HealthCheck{Status: HealthStatusOK}}
+	if !feedStatus.LastEventTime.IsZero() {
+		lastEventAgeMs := int64(time.Since(feedStatus.LastEventTime) / time.Millisecond)
+		health.LastEventAgeMs = &lastEventAgeMs
+	}
+	if feedStatus.Lag > 0 {
+		lagMs := int64(feedStatus.Lag / time.Millisecond)
+		health.LagMs = &lagMs
+	}
+
+	if !feedStatus.Running {
+		health.Status = HealthStatusUnhealthy
+		health.Error = "Mutation feed is not running"
+		if feedStatus.Error != nil {
+			health.Error = fmt.Sprintf("Mutation feed was dropped: %v", feedStatus.Error)
+		}
+	} else if maxFeedLag > 0 && feedStatus.Lag > maxFeedLag && time.Since(feedStatus.LastEventTime) < maxFeedLag {
+		// Only a recent lag counts, since an idle feed keeps the lag of the last event it received
+		health.Status = HealthStatusUnhealthy
+		health.Error = fmt.Sprintf("Mutation feed is lagging by %v", feedStatus.Lag)
+	}
+	return health
+}
+
+// Checks that a JavaScript runner can be obtained from a JSServer's pool.
+func checkJSServerHealth(server *sgbucket.JSServer) *HealthCheck {
+	return runHealthCheck(func() error {
+		_, err := server.WithTask(func(task sgbucket.JSServerTask) (interface{}, error) {
+			return nil, nil
+		})
+		return err
+	})
+}
+
+// Runs a check, failing it if it doesn't complete within kHealthCheckTimeout.
+func runHealthCheck(check func() error) *HealthCheck {
+	result := make(chan error, 1)
+	go func() {
+		result <- check()
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-time.After(kHealthCheckTimeout):
+		err = errors.New("Timed out")
+	}
+	if err != nil {
+		return &HealthCheck{Status: HealthStatusUnhealthy, Error: err.Error()}
+	}
+	return &HealthCheck{Status: HealthStatusOK}
+}
+
+// Reports the replications that failed to start, and those that have failed to write documents.
+func (sc *ServerContext) checkReplicationHealth() []*ReplicationHealth {
+	var results []*ReplicationHealth
+
+	sc.lock.RLock()
+	for replicationConfig, err := range sc.replicationErrors {
+		results = append(results, &ReplicationHealth{
+			HealthCheck:   HealthCheck{Status: HealthStatusDegraded, Error: fmt.Sprintf("Unable to start replication: %v", err)},
+			ReplicationID: replicationConfig.ReplicationId,
+			Source:        replicationConfig.Source,
+			Target:        replicationConfig.Target,
+		})
+	}
+	sc.lock.RUnlock()
+
+	for _, task := range sc.replicator.ActiveTasks() {
+		health := &ReplicationHealth{
+			HealthCheck:      HealthCheck{Status: HealthStatusOK},
+			ReplicationID:    task.ReplicationID,
+			Source:           task.Source,
+			Target:           task.Target,
+			DocWriteFailures: task.DocWriteFailures,
+		}
+		if task.DocWriteFailures > 0 {
+			health.Status = HealthStatusDegraded
+			health.Error = fmt.Sprintf("%d documents failed to be written", task.DocWriteFailures)
+		}
+		results = append(results, health)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].ReplicationID != results[j].ReplicationID {
+			return results[i].ReplicationID < results[j].ReplicationID
+		}
+		return results[i].Source+results[i].Target < results[j].Source+results[j].Target
+	})
+	return results
+}
+
+// Returns the worse of two health statuses.
+func worseHealthStatus(a, b string) string {
+	rank := map[string]int{HealthStatusOK: 0, HealthStatusDegraded: 1, HealthStatusUnhealthy: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,88 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheckEndpoints(t *testing.T) {
+
+	var rt RestTester
+	rt.NoFlush = true
+	defer rt.Close()
+
+	response := rt.SendRequest("GET", "/_ping", "")
+	assertStatus(t, response, 200)
+	response = rt.SendAdminRequest("GET", "/_ping", "")
+	assertStatus(t, response, 200)
+
+	// The public interface only reports the overall status
+	var health HealthResponse
+	response = rt.SendRequest("GET", "/_health", "")
+	assertStatus(t, response, 200)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &health))
+	assert.Equal(t, HealthStatusOK, health.Status)
+	assert.Nil(t, health.Databases)
+
+	health = HealthResponse{}
+	response = rt.SendAdminRequest("GET", "/_health", "")
+	assertStatus(t, response, 200)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &health))
+	assert.Equal(t, HealthStatusOK, health.Status)
+	if assert.NotNil(t, health.Databases["db"]) {
+		assert.Equal(t, HealthStatusOK, health.Databases["db"].Status)
+		assert.Equal(t, "Online", health.Databases["db"].State)
+		assert.Equal(t, HealthStatusOK, health.Databases["db"].Bucket.Status)
+	}
+
+	// An offline database makes the node unready
+	response = rt.SendAdminRequest("POST", "/db/_offline", "")
+	assertStatus(t, response, 200)
+	response = rt.SendAdminRequest("GET", "/_health", "")
+	assertStatus(t, response, 503)
+	health = HealthResponse{}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &health))
+	assert.Equal(t, HealthStatusUnhealthy, health.Status)
+	if assert.NotNil(t, health.Databases["db"]) {
+		assert.Equal(t, "Offline", health.Databases["db"].State)
+	}
+	response = rt.SendRequest("GET", "/_health", "")
+	assertStatus(t, response, 503)
+	assert.NotContains(t, response.Body.String(), `"db"`)
+}
+
+func TestCheckFeedHealth(t *testing.T) {
+
+	now := time.Now()
+	maxLag := time.Minute
+
+	health := checkFeedHealth(db.ChangeFeedStatus{Running: true, StartTime: now, LastEventTime: now, Lag: time.Second}, maxLag)
+	assert.Equal(t, HealthStatusOK, health.Status)
+	assert.Equal(t, int64(1000), *health.LagMs)
+
+	// A recent event that arrived long after it was written
+	health = checkFeedHealth(db.ChangeFeedStatus{Running: true, StartTime: now, LastEventTime: now, Lag: 2 * time.Minute}, maxLag)
+	assert.Equal(t, HealthStatusUnhealthy, health.Status)
+
+	// The lag of an idle feed's last event doesn't count
+	health = checkFeedHealth(db.ChangeFeedStatus{Running: true, StartTime: now, LastEventTime: now.Add(-time.Hour), Lag: 2 * time.Minute}, maxLag)
+	assert.Equal(t, HealthStatusOK, health.Status)
+
+	health = checkFeedHealth(db.ChangeFeedStatus{Running: false, StartTime: now, Error: errors.New("connection reset")}, maxLag)
+	assert.Equal(t, HealthStatusUnhealthy, health.Status)
+	assert.Contains(t, health.Error, "connection reset")
+}
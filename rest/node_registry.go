@@ -0,0 +1,377 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Each node registers itself in the buckets of the databases it serves, so that any node can list
+// the nodes sharing its buckets.  The registrations of the nodes using a bucket are kept in a
+// single document, which each node rewrites on every heartbeat.  A registration expires if its
+// node misses several heartbeats, and the document expires if every node does.
+//
+// The registrations also list the databases each node imports, which are used to partition the
+// bucket's vbuckets between the nodes importing it.  Partitions are reassigned on every heartbeat,
+// so when a node joins or leaves, import is rebalanced within a few heartbeat intervals.
+
+const NodeRegistryDocID = db.KSyncKeyPrefix + "nodes"
+
+const DefaultNodeHeartbeatIntervalSecs = 10
+
+// Number of heartbeat intervals after which a node's registration expires
+const kNodeRegistrationTTLIntervals = 3
+
+const (
+	NodeStatusOnline   = "online"
+	NodeStatusDraining = "draining"
+)
+
+// A node's entry in the registry document
+type NodeRegistration struct {
+	UUID           string            `json:"uuid"`
+	Version        string            `json:"version"`
+	Hostname       string            `json:"hostname,omitempty"`
+	Interface      string            `json:"interface,omitempty"`
+	AdminInterface string            `json:"admin_interface,omitempty"`
+	Status         string            `json:"status"`
+	Databases      map[string]string `json:"databases"` // Database name -> state, e.g. "Online"
+	StartTime      time.Time         `json:"start_time"`
+	LastHeartbeat  time.Time         `json:"last_heartbeat"`
+	Expires        time.Time         `json:"expires"`
+
+	Import map[string]*NodeImportStatus `json:"import,omitempty"` // Databases the node imports documents for
+}
+
+// A node's import of documents for a database
+type NodeImportStatus struct {
+	Partitions int   `json:"partitions"`   // Number of vbuckets the node imports
+	Pending    int   `json:"pending"`      // Number of docs in other nodes' vbuckets awaiting import
+	Imported   int64 `json:"import_count"` // Number of docs imported by the node
+}
+
+// The registry document
+type nodeRegistry struct {
+	Nodes map[string]*NodeRegistration `json:"nodes"`
+}
+
+// Response of GET /_cluster
+type ClusterStatus struct {
+	NodeUUID string              `json:"node_uuid"` // UUID of the node handling the request
+	Nodes    []*NodeRegistration `json:"nodes"`
+}
+
+// Returns the interval between heartbeats, or 0 if heartbeats are disabled.
+func (sc *ServerContext) nodeHeartbeatInterval() time.Duration {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+	return sc._nodeHeartbeatInterval()
+}
+
+func (sc *ServerContext) _nodeHeartbeatInterval() time.Duration {
+	intervalSecs := DefaultNodeHeartbeatIntervalSecs
+	if sc.config.NodeHeartbeatIntervalSecs != nil {
+		intervalSecs = *sc.config.NodeHeartbeatIntervalSecs
+	}
+	if intervalSecs <= 0 {
+		return 0
+	}
+	return time.Duration(intervalSecs) * time.Second
+}
+
+// Returns this node's registration for the given databases, as of now.
+func (sc *ServerContext) nodeRegistration(dbcs []*db.DatabaseContext, ttl time.Duration) *NodeRegistration {
+	now := time.Now()
+	registration := &NodeRegistration{
+		UUID:          sc.nodeUUID,
+		Version:       base.LongVersionString,
+		Status:        NodeStatusOnline,
+		Databases:     make(map[string]string, len(dbcs)),
+		StartTime:     sc.startTime,
+		LastHeartbeat: now,
+		Expires:       now.Add(ttl),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		registration.Hostname = hostname
+	}
+	sc.lock.RLock()
+	if sc.config.Interface != nil {
+		registration.Interface = *sc.config.Interface
+	}
+	if sc.config.AdminInterface != nil {
+		registration.AdminInterface = *sc.config.AdminInterface
+	}
+	sc.lock.RUnlock()
+	if sc.IsDraining() {
+		registration.Status = NodeStatusDraining
+	}
+	for _, dbc := range dbcs {
+		registration.Databases[dbc.Name] = db.RunStateString[atomic.LoadUint32(&dbc.State)]
+		if dbc.ImportEnabled() {
+			if registration.Import == nil {
+				registration.Import = map[string]*NodeImportStatus{}
+			}
+			vbNos, _, pending := dbc.ImportPartitions()
+			status := &NodeImportStatus{Partitions: len(vbNos), Pending: pending}
+			if importCount, ok := dbc.DbStats.SharedBucketImport().Get(base.StatKeyImportCount).(*expvar.Int); ok {
+				status.Imported = importCount.Value()
+			}
+			registration.Import[dbc.Name] = status
+		}
+	}
+	return registration
+}
+
+// Groups the databases being served by bucket name.
+func databasesByBucket(databases map[string]*db.DatabaseContext) map[string][]*db.DatabaseContext {
+	byBucket := map[string][]*db.DatabaseContext{}
+	for _, dbc := range databases {
+		if dbc.Bucket == nil {
+			continue
+		}
+		bucketName := dbc.Bucket.GetName()
+		byBucket[bucketName] = append(byBucket[bucketName], dbc)
+	}
+	return byBucket
+}
+
+// Updates the registry document in a bucket, calling the given function to change it.  Expired
+// registrations are removed.
+func updateNodeRegistry(bucket base.Bucket, ttl time.Duration, update func(registry *nodeRegistry)) error {
+	expiry := base.DurationToCbsExpiry(ttl)
+	_, err := bucket.Update(NodeRegistryDocID, expiry, func(current []byte) ([]byte, *uint32, error) {
+		registry := &nodeRegistry{}
+		if len(current) > 0 {
+			if err := json.Unmarshal(current, registry); err != nil {
+				base.Warnf(base.KeyAll, "Replacing invalid node registry document: %v", err)
+				registry = &nodeRegistry{}
+			}
+		}
+		if registry.Nodes == nil {
+			registry.Nodes = map[string]*NodeRegistration{}
+		}
+		now := time.Now()
+		for uuid, registration := range registry.Nodes {
+			if registration.Expires.Before(now) {
+				delete(registry.Nodes, uuid)
+			}
+		}
+		update(registry)
+		updated, err := json.Marshal(registry)
+		return updated, &expiry, err
+	})
+	return err
+}
+
+// Writes this node's registration into the bucket of each database.
+func (sc *ServerContext) heartbeatNode() {
+	interval := sc.nodeHeartbeatInterval()
+	if interval == 0 {
+		interval = DefaultNodeHeartbeatIntervalSecs * time.Second
+	}
+	ttl := interval * kNodeRegistrationTTLIntervals
+
+	for bucketName, dbcs := range databasesByBucket(sc.AllDatabases()) {
+		registration := sc.nodeRegistration(dbcs, ttl)
+		var liveNodes map[string]*NodeRegistration
+		err := updateNodeRegistry(dbcs[0].Bucket, ttl, func(registry *nodeRegistry) {
+			registry.Nodes[registration.UUID] = registration
+			liveNodes = registry.Nodes
+		})
+		if err != nil {
+			// Import partitions are left as they are until the registry can be updated
+			base.Warnf(base.KeyAll, "Unable to register node in bucket %s: %v", base.MD(bucketName), err)
+			continue
+		}
+		sc.assignImportPartitions(dbcs, liveNodes, ttl)
+	}
+}
+
+// Partitions the vbuckets of the databases that this node imports between the live nodes
+// importing them, and applies this node's partitions.  A departed node's vbuckets are reassigned
+// within a registration TTL and a heartbeat of its last write, so documents awaiting import by
+// other nodes are kept for twice the TTL.
+func (sc *ServerContext) assignImportPartitions(dbcs []*db.DatabaseContext, nodes map[string]*NodeRegistration, ttl time.Duration) {
+	for _, dbc := range dbcs {
+		if !dbc.ImportEnabled() {
+			continue
+		}
+		maxVbNo, err := dbc.Bucket.GetMaxVbno()
+		if err != nil {
+			base.Warnf(base.KeyImport, "Unable to partition import for database %s: %v", base.MD(dbc.Name), err)
+			continue
+		}
+		importNodes := make([]string, 0, len(nodes))
+		for uuid, registration := range nodes {
+			// Draining nodes hand their partitions over to the others
+			if registration.Status == NodeStatusOnline && registration.Import[dbc.Name] != nil {
+				importNodes = append(importNodes, uuid)
+			}
+		}
+		dbc.SetImportPartitions(importPartitionsForNode(importNodes, sc.nodeUUID, maxVbNo), 2*ttl)
+	}
+}
+
+// Partitions vbuckets between nodes by rendezvous hashing: each vbucket goes to the node with the
+// highest hash of its UUID and the vbucket number, so when a node joins or leaves, only the
+// vbuckets it gains or loses are reassigned.  Returns the vbuckets of the given node.
+func importPartitionsForNode(nodeUUIDs []string, nodeUUID string, maxVbNo uint16) []uint16 {
+	vbNos := []uint16{}
+	for vbNo := uint16(0); vbNo < maxVbNo; vbNo++ {
+		owner := ""
+		var ownerHash uint64
+		for _, uuid := range nodeUUIDs {
+			sum := sha1.Sum([]byte(uuid + ":" + strconv.Itoa(int(vbNo))))
+			hash := binary.BigEndian.Uint64(sum[:8])
+			if owner == "" || hash > ownerHash || (hash == ownerHash && uuid < owner) {
+				owner = uuid
+				ownerHash = hash
+			}
+		}
+		if owner == nodeUUID {
+			vbNos = append(vbNos, vbNo)
+		}
+	}
+	return vbNos
+}
+
+// Removes this node's registration from the buckets of its databases, if it was registered.
+func (sc *ServerContext) deregisterNode() {
+	sc.tickerLock.Lock()
+	registered := sc.nodeHeartbeatTicker != nil
+	sc.tickerLock.Unlock()
+	if !registered {
+		return
+	}
+	ttl := sc.nodeHeartbeatInterval()
+	if ttl == 0 {
+		ttl = DefaultNodeHeartbeatIntervalSecs * time.Second
+	}
+	ttl *= kNodeRegistrationTTLIntervals
+	for bucketName, dbcs := range databasesByBucket(sc.AllDatabases()) {
+		err := updateNodeRegistry(dbcs[0].Bucket, ttl, func(registry *nodeRegistry) {
+			delete(registry.Nodes, sc.nodeUUID)
+		})
+		if err != nil {
+			base.Infof(base.KeyAll, "Unable to deregister node from bucket %s: %v", base.MD(bucketName), err)
+		}
+	}
+}
+
+// Returns the live nodes registered in the buckets of this node's databases, including this node.
+func (sc *ServerContext) ClusterStatus() (*ClusterStatus, error) {
+	interval := sc.nodeHeartbeatInterval()
+	if interval == 0 {
+		interval = DefaultNodeHeartbeatIntervalSecs * time.Second
+	}
+
+	databases := sc.AllDatabases()
+	nodes := map[string]*NodeRegistration{}
+	for _, dbcs := range databasesByBucket(databases) {
+		data, _, err := dbcs[0].Bucket.GetRaw(NodeRegistryDocID)
+		if err != nil {
+			if base.IsDocNotFoundError(err) {
+				continue
+			}
+			return nil, err
+		}
+		var registry nodeRegistry
+		if err := json.Unmarshal(data, &registry); err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		for uuid, registration := range registry.Nodes {
+			if registration.Expires.Before(now) {
+				continue
+			}
+			// A node serving databases in several buckets has a registration in each
+			if existing := nodes[uuid]; existing != nil {
+				for name, state := range registration.Databases {
+					existing.Databases[name] = state
+				}
+				for name, status := range registration.Import {
+					if existing.Import == nil {
+						existing.Import = map[string]*NodeImportStatus{}
+					}
+					existing.Import[name] = status
+				}
+				if registration.LastHeartbeat.After(existing.LastHeartbeat) {
+					existing.LastHeartbeat = registration.LastHeartbeat
+					existing.Expires = registration.Expires
+					existing.Status = registration.Status
+				}
+			} else {
+				nodes[uuid] = registration
+			}
+		}
+	}
+
+	// This node's registration may not have been written yet, and is more up to date anyway
+	allDbcs := make([]*db.DatabaseContext, 0, len(databases))
+	for _, dbc := range databases {
+		allDbcs = append(allDbcs, dbc)
+	}
+	nodes[sc.nodeUUID] = sc.nodeRegistration(allDbcs, interval*kNodeRegistrationTTLIntervals)
+
+	status := &ClusterStatus{
+		NodeUUID: sc.nodeUUID,
+		Nodes:    make([]*NodeRegistration, 0, len(nodes)),
+	}
+	for _, registration := range nodes {
+		status.Nodes = append(status.Nodes, registration)
+	}
+	sort.Slice(status.Nodes, func(i, j int) bool {
+		return status.Nodes[i].UUID < status.Nodes[j].UUID
+	})
+	return status, nil
+}
+
+func (sc *ServerContext) startNodeHeartbeat() {
+	interval := sc.nodeHeartbeatInterval()
+	if interval == 0 {
+		base.Infof(base.KeyAll, "Node registration heartbeats are disabled")
+		return
+	}
+
+	sc.heartbeatNode()
+	sc.tickerLock.Lock()
+	sc.nodeHeartbeatTicker.stop()
+	sc.nodeHeartbeatTicker = newBackgroundTicker(interval, sc.heartbeatNode)
+	sc.tickerLock.Unlock()
+	base.Infof(base.KeyAll, "Registered node %s, with heartbeat frequency: %v", sc.nodeUUID, interval)
+}
+
+// Stops the heartbeat.  The stopped ticker is kept, to show that the node has been registered.
+func (sc *ServerContext) stopNodeHeartbeat() {
+	sc.tickerLock.Lock()
+	sc.nodeHeartbeatTicker.stop()
+	sc.tickerLock.Unlock()
+}
+
+// HTTP handler for GET /_cluster
+func (h *handler) handleGetCluster() error {
+	status, err := h.server.ClusterStatus()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(status)
+	return nil
+}
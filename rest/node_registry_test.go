@@ -0,0 +1,128 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterStatus(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+	bucket := rt.Bucket()
+	sc := rt.ServerContext()
+
+	sc.heartbeatNode()
+
+	// Another live node, and one that has stopped heartbeating
+	now := time.Now()
+	err := updateNodeRegistry(bucket, time.Minute, func(registry *nodeRegistry) {
+		assert.NotNil(t, registry.Nodes[sc.nodeUUID])
+		registry.Nodes["other-node"] = &NodeRegistration{
+			UUID:          "other-node",
+			Status:        NodeStatusOnline,
+			Databases:     map[string]string{"db": "Online"},
+			LastHeartbeat: now,
+			Expires:       now.Add(time.Minute),
+		}
+		registry.Nodes["dead-node"] = &NodeRegistration{
+			UUID:          "dead-node",
+			Status:        NodeStatusOnline,
+			Databases:     map[string]string{"db": "Online"},
+			LastHeartbeat: now.Add(-time.Hour),
+			Expires:       now.Add(-time.Minute),
+		}
+	})
+	assert.NoError(t, err)
+
+	response := rt.SendAdminRequest("GET", "/_cluster", "")
+	assertStatus(t, response, 200)
+	var status ClusterStatus
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &status))
+	assert.Equal(t, sc.nodeUUID, status.NodeUUID)
+
+	uuids := make([]string, 0, len(status.Nodes))
+	for _, node := range status.Nodes {
+		uuids = append(uuids, node.UUID)
+		if node.UUID == sc.nodeUUID {
+			assert.Equal(t, map[string]string{"db": "Online"}, node.Databases)
+			assert.Equal(t, NodeStatusOnline, node.Status)
+		}
+	}
+	assert.ElementsMatch(t, []string{sc.nodeUUID, "other-node"}, uuids)
+
+	// The cluster status isn't available on the public interface
+	response = rt.SendRequest("GET", "/_cluster", "")
+	assert.NotEqual(t, 200, response.Code)
+}
+
+func TestNodeHeartbeatRestart(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+	bucket := rt.Bucket()
+	sc := rt.ServerContext()
+
+	// Restarting the heartbeat stops the previous one
+	sc.startNodeHeartbeat()
+	first := sc.nodeHeartbeatTicker
+	sc.stopNodeHeartbeat()
+	sc.startNodeHeartbeat()
+	assert.NotEqual(t, first, sc.nodeHeartbeatTicker)
+	select {
+	case <-first.done:
+	default:
+		assert.Fail(t, "Previous heartbeat wasn't stopped")
+	}
+
+	// Deregistering removes the node from the registry
+	sc.stopNodeHeartbeat()
+	sc.deregisterNode()
+	err := updateNodeRegistry(bucket, time.Minute, func(registry *nodeRegistry) {
+		assert.Nil(t, registry.Nodes[sc.nodeUUID])
+	})
+	assert.NoError(t, err)
+}
+
+func TestImportPartitionsForNode(t *testing.T) {
+
+	const maxVbNo = 1024
+	nodes := []string{"node-a", "node-b", "node-c"}
+	owners := map[uint16]string{}
+	for _, node := range nodes {
+		vbNos := importPartitionsForNode(nodes, node, maxVbNo)
+		// Each node gets a reasonable share
+		assert.True(t, len(vbNos) > maxVbNo/6, "node %s has %d vbuckets", node, len(vbNos))
+		for _, vbNo := range vbNos {
+			_, found := owners[vbNo]
+			assert.False(t, found, "vbucket %d assigned twice", vbNo)
+			owners[vbNo] = node
+		}
+	}
+	assert.Len(t, owners, maxVbNo)
+
+	// When a node leaves, only its vbuckets are reassigned
+	remaining := []string{"node-a", "node-c"}
+	for _, node := range remaining {
+		for _, vbNo := range importPartitionsForNode(remaining, node, maxVbNo) {
+			if owners[vbNo] != "node-b" {
+				assert.Equal(t, owners[vbNo], node)
+			}
+		}
+	}
+
+	// A node that isn't importing gets no vbuckets
+	assert.Len(t, importPartitionsForNode(nodes, "node-d", maxVbNo), 0)
+}
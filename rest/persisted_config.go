@@ -0,0 +1,348 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Database configs written through the admin API are stored in a metadata document in the
+// database's own bucket, so they survive restarts and are picked up by every Sync Gateway node
+// attached to that bucket.  The CAS of the document versions the config.
+
+const (
+	DbConfigDocID                   = db.KSyncKeyPrefix + "dbconfig" // Key of the persisted db config document
+	DefaultDbConfigPollIntervalSecs = 10                             // How often nodes check for persisted config changes
+)
+
+// Returns a copy of the config as it's stored in the bucket.  Anyone with read access to the
+// bucket can read it, so credentials aren't persisted: the bucket connection settings, the initial
+// users (whose passwords are in plain text) and the OIDC providers' client secrets.  The bucket
+// settings and client secrets come from each node's own config, and the users are saved in the
+// bucket by the node the config was written to.
+func (dbConfig *DbConfig) persistableCopy() (*DbConfig, error) {
+	configCopy, err := dbConfig.DeepCopy()
+	if err != nil {
+		return nil, err
+	}
+	configCopy.BucketConfig = BucketConfig{}
+	configCopy.Name = ""
+	configCopy.Users = nil
+	if configCopy.OIDCConfig != nil {
+		for _, provider := range configCopy.OIDCConfig.Providers {
+			provider.ValidationKey = nil
+		}
+	}
+	return configCopy, nil
+}
+
+// Combines a persisted config with the credentials of the local config of the database: its bucket
+// connection settings, initial users and the client secrets of OIDC providers of the same name.
+func mergePersistedDbConfig(persisted *DbConfig, local *DbConfig) (*DbConfig, error) {
+	merged, err := persisted.DeepCopy()
+	if err != nil {
+		return nil, err
+	}
+	merged.BucketConfig = local.BucketConfig
+	merged.Users = local.Users
+	if merged.OIDCConfig != nil && local.OIDCConfig != nil {
+		for name, provider := range merged.OIDCConfig.Providers {
+			if localProvider := local.OIDCConfig.Providers[name]; localProvider != nil {
+				provider.ValidationKey = localProvider.ValidationKey
+			}
+		}
+	}
+	if err := merged.setup(local.Name); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// Reads the persisted config from a bucket.  Returns a nil config if none has been persisted.
+func loadPersistedDbConfig(bucket base.Bucket) (config *DbConfig, cas uint64, err error) {
+	cas, err = bucket.Get(DbConfigDocID, &config)
+	if err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	return config, cas, nil
+}
+
+// Parses the CAS of a persisted config from an If-Match or ETag header value.
+func parseDbConfigEtag(etag string) (uint64, error) {
+	if strings.HasPrefix(etag, `"`) {
+		if unquoted, err := strconv.Unquote(etag); err == nil {
+			etag = unquoted
+		}
+	}
+	cas, err := strconv.ParseUint(etag, 10, 64)
+	if err != nil {
+		return 0, base.HTTPErrorf(http.StatusBadRequest, "Invalid If-Match header %q", etag)
+	}
+	return cas, nil
+}
+
+func formatDbConfigEtag(cas uint64) string {
+	return strconv.Quote(strconv.FormatUint(cas, 10))
+}
+
+// A persisted database config that failed to load
+type dbConfigFailure struct {
+	cas uint64 // CAS of the persisted config
+	err error
+}
+
+// Returns the error loading the named database's current persisted config, if it failed to load.
+func (sc *ServerContext) PersistedDbConfigError(dbName string) error {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+	if failure := sc.dbConfigFailures[dbName]; failure != nil {
+		return failure.err
+	}
+	return nil
+}
+
+// Returns the CAS of the persisted config the named database was last loaded with, or 0 if it
+// isn't using a persisted config.
+func (sc *ServerContext) PersistedDbConfigCas(dbName string) uint64 {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+	return sc.dbConfigCas[dbName]
+}
+
+// Reloads the named database with a config, then writes the config to its bucket.  The config is
+// loaded locally first, so that one that fails to load is never persisted; if the write fails, the
+// database is reloaded with its previous config.  If expectedCas is non-nil, the update fails with a
+// 409 unless the persisted config is at that CAS, which is checked before anything is reloaded;
+// either way, the write fails if the persisted config changes while the database is reloaded.
+// Returns the CAS of the new persisted config.
+func (sc *ServerContext) PutPersistedDbConfig(dbName string, config *DbConfig, expectedCas *uint64) (uint64, error) {
+	persisted, err := config.persistableCopy()
+	if err != nil {
+		return 0, err
+	}
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	dbc := sc.databases_[dbName]
+	previous := sc.config.Databases[dbName]
+	if dbc == nil || previous == nil {
+		return 0, base.HTTPErrorf(http.StatusNotFound, "no such database %q", dbName)
+	}
+	if dbc.Bucket == nil {
+		return 0, base.HTTPErrorf(http.StatusServiceUnavailable, "Database %q, bucket is not available", dbName)
+	}
+
+	// A stale expected CAS is rejected before the database is reloaded
+	_, cas, err := loadPersistedDbConfig(dbc.Bucket)
+	if err != nil {
+		return 0, err
+	}
+	if expectedCas != nil && *expectedCas != cas {
+		return 0, base.HTTPErrorf(http.StatusConflict, "Database config has been updated by another request")
+	}
+
+	// This node keeps the credentials given with the config, which aren't persisted
+	local := *previous
+	local.Users = config.Users
+	local.OIDCConfig = config.OIDCConfig
+	merged, err := mergePersistedDbConfig(persisted, &local)
+	if err != nil {
+		return 0, base.HTTPErrorf(http.StatusBadRequest, "%v", err)
+	}
+	if err := merged.validate(); err != nil {
+		return 0, base.HTTPErrorf(http.StatusBadRequest, "%v", err)
+	}
+	reloaded, err := sc._reloadDatabaseWithConfig(dbName, merged)
+	if err != nil {
+		sc._restoreDatabaseConfig(dbName, previous)
+		return 0, err
+	}
+
+	newCas, err := reloaded.Bucket.WriteCas(DbConfigDocID, 0, 0, cas, persisted, 0)
+	if err != nil {
+		sc._restoreDatabaseConfig(dbName, previous)
+		if base.IsCasMismatch(err) {
+			return 0, base.HTTPErrorf(http.StatusConflict, "Database config has been updated by another request")
+		}
+		return 0, err
+	}
+	sc.dbConfigCas[dbName] = newCas
+	delete(sc.dbConfigFailures, dbName)
+	base.Infof(base.KeyAll, "Persisted config for db %s, cas %d", base.MD(dbName), newCas)
+	return newCas, nil
+}
+
+// Removes the named database and loads it again with a config, which replaces its current config.
+// Requires sc.lock.
+func (sc *ServerContext) _reloadDatabaseWithConfig(dbName string, config *DbConfig) (*db.DatabaseContext, error) {
+	sc.config.Databases[dbName] = config
+	sc._removeDatabase(dbName)
+	return sc._getOrAddDatabaseFromConfig(config, false)
+}
+
+// Reloads the named database with the config it had before a failed update.  Requires sc.lock.
+func (sc *ServerContext) _restoreDatabaseConfig(dbName string, previous *DbConfig) {
+	if _, err := sc._reloadDatabaseWithConfig(dbName, previous); err != nil {
+		base.Warnf(base.KeyAll, "Error restoring the previous config of db %s: %v", base.MD(dbName), err)
+	}
+}
+
+// Returns the config to open a database with at startup: its persisted config if it has one,
+// combined with the credentials of the config file, along with the persisted config's CAS.  This
+// means each database is only loaded once.  The persisted config of a walrus bucket can't be read
+// before the database is opened, so it's applied by the first refresh.
+func withPersistedDbConfig(local *DbConfig) (*DbConfig, uint64) {
+	spec, err := GetBucketSpec(local)
+	if err != nil || spec.IsWalrusBucket() {
+		return local, 0
+	}
+	bucket, err := db.ConnectToBucket(spec, nil)
+	if err != nil {
+		// Reported when the database fails to open
+		return local, 0
+	}
+	defer bucket.Close()
+
+	persisted, cas, err := loadPersistedDbConfig(bucket)
+	if err == nil && persisted != nil {
+		var merged *DbConfig
+		if merged, err = mergePersistedDbConfig(persisted, local); err == nil {
+			base.Infof(base.KeyAll, "Opening db %s with its persisted config, cas %d", base.MD(local.Name), cas)
+			return merged, cas
+		}
+	}
+	if err != nil {
+		base.Warnf(base.KeyAll, "Error loading persisted config for db %s: %v", base.MD(local.Name), err)
+	}
+	return local, 0
+}
+
+// Opens a database from the config file, with its persisted config if it has one.
+func (sc *ServerContext) addDatabaseWithPersistedConfig(local *DbConfig) (*db.DatabaseContext, error) {
+	config, cas := withPersistedDbConfig(local)
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	dbc, err := sc._getOrAddDatabaseFromConfig(config, false)
+	if err == nil && cas != 0 {
+		sc.dbConfigCas[dbc.Name] = cas
+	}
+	return dbc, err
+}
+
+// Reloads the named database if its persisted config has changed since the database was loaded,
+// unless it's already failed to load.  Returns true if the database was reloaded.
+func (sc *ServerContext) refreshPersistedDbConfig(dbName string) (bool, error) {
+	dbc, err := sc.GetDatabase(dbName)
+	if err != nil {
+		return false, err
+	}
+	if dbc.Bucket == nil {
+		return false, nil
+	}
+
+	persisted, cas, err := loadPersistedDbConfig(dbc.Bucket)
+	if err != nil || persisted == nil || cas == sc.PersistedDbConfigCas(dbName) || cas == sc.failedDbConfigCas(dbName) {
+		return false, err
+	}
+
+	base.Infof(base.KeyAll, "Persisted config for db %s has changed (cas %d), reloading", base.MD(dbName), cas)
+	return true, sc.applyPersistedDbConfig(dbName, persisted, cas)
+}
+
+// Checks the persisted config of every database, reloading those that have changed.
+func (sc *ServerContext) refreshPersistedDbConfigs() {
+	for _, dbName := range sc.AllDatabaseNames() {
+		if _, err := sc.refreshPersistedDbConfig(dbName); err != nil {
+			base.Warnf(base.KeyAll, "Error loading persisted config for db %s: %v", base.MD(dbName), err)
+		}
+	}
+}
+
+// Returns the CAS of the named database's persisted config that failed to load, or 0 if none.
+func (sc *ServerContext) failedDbConfigCas(dbName string) uint64 {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+	if failure := sc.dbConfigFailures[dbName]; failure != nil {
+		return failure.cas
+	}
+	return 0
+}
+
+// Replaces the config of the named database with a persisted config, and reloads the database.  If
+// the config fails to load, the database is restored with its previous config, and the failure is
+// recorded so that the config isn't retried until it changes, and is reported by /_health.
+func (sc *ServerContext) applyPersistedDbConfig(dbName string, persisted *DbConfig, cas uint64) error {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	localConfig := sc.config.Databases[dbName]
+	if localConfig == nil {
+		return base.HTTPErrorf(http.StatusNotFound, "no such database %q", dbName)
+	}
+	if cas == sc.dbConfigCas[dbName] {
+		// Already applied by a concurrent refresh
+		return nil
+	}
+	merged, err := mergePersistedDbConfig(persisted, localConfig)
+	if err == nil {
+		err = merged.validate()
+	}
+	if err == nil {
+		if _, err = sc._reloadDatabaseWithConfig(dbName, merged); err != nil {
+			sc._restoreDatabaseConfig(dbName, localConfig)
+		}
+	}
+	if err != nil {
+		sc.dbConfigFailures[dbName] = &dbConfigFailure{cas: cas, err: err}
+		return err
+	}
+	sc.dbConfigCas[dbName] = cas
+	delete(sc.dbConfigFailures, dbName)
+	return nil
+}
+
+// Starts polling the buckets of all databases for persisted config changes made by other nodes.
+func (sc *ServerContext) startDbConfigPoller() {
+
+	pollIntervalSecs := DefaultDbConfigPollIntervalSecs
+	if sc.config.DbConfigPollIntervalSecs != nil {
+		pollIntervalSecs = *sc.config.DbConfigPollIntervalSecs
+	}
+	if pollIntervalSecs <= 0 {
+		base.Infof(base.KeyAll, "Polling for persisted database config changes is disabled")
+		return
+	}
+
+	interval := time.Second * time.Duration(pollIntervalSecs)
+
+	sc.tickerLock.Lock()
+	sc.dbConfigPollTicker.stop()
+	sc.dbConfigPollTicker = newBackgroundTicker(interval, sc.refreshPersistedDbConfigs)
+	sc.tickerLock.Unlock()
+	base.Infof(base.KeyAll, "Polling for persisted database config changes with frequency: %v", interval)
+}
+
+func (sc *ServerContext) stopDbConfigPoller() {
+	sc.tickerLock.Lock()
+	sc.dbConfigPollTicker.stop()
+	sc.dbConfigPollTicker = nil
+	sc.tickerLock.Unlock()
+}
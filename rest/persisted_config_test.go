@@ -0,0 +1,169 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPersistedDbConfig(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+
+	makeConfig := func(revsLimit int) string {
+		return fmt.Sprintf(`{"revs_limit":%d, "use_views":%t, "num_index_replicas":0, "enable_shared_bucket_access":%t}`,
+			revsLimit, base.TestUseViews(), base.TestUseXattrs())
+	}
+	getRevsLimit := func() uint32 {
+		response := rt.SendAdminRequest("GET", "/db/_config", "")
+		assertStatus(t, response, 200)
+		var config DbConfig
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &config))
+		if config.RevsLimit == nil {
+			return 0
+		}
+		return *config.RevsLimit
+	}
+
+	// No persisted config yet
+	response := rt.SendAdminRequest("GET", "/db/_config", "")
+	assertStatus(t, response, 200)
+	assert.Equal(t, "", response.Header().Get("Etag"))
+
+	// PUT persists the config and applies it
+	response = rt.SendAdminRequest("PUT", "/db/_config", makeConfig(200))
+	assertStatus(t, response, 201)
+	etag := response.Header().Get("Etag")
+	assert.NotEqual(t, "", etag)
+	assert.Equal(t, uint32(200), getRevsLimit())
+	assert.Equal(t, etag, rt.SendAdminRequest("GET", "/db/_config", "").Header().Get("Etag"))
+
+	// The persisted doc doesn't include the bucket connection settings
+	bucket := rt.ServerContext().Database("db").Bucket
+	persisted, cas, err := loadPersistedDbConfig(bucket)
+	assert.NoError(t, err)
+	assert.Equal(t, formatDbConfigEtag(cas), etag)
+	assert.Nil(t, persisted.Server)
+	assert.Nil(t, persisted.Bucket)
+	assert.Equal(t, "", persisted.Password)
+	assert.Equal(t, uint32(200), *persisted.RevsLimit)
+
+	// Concurrent edits are detected with If-Match
+	response = rt.SendAdminRequestWithHeaders("PUT", "/db/_config", makeConfig(300), map[string]string{"If-Match": etag})
+	assertStatus(t, response, 201)
+	newEtag := response.Header().Get("Etag")
+	assert.NotEqual(t, etag, newEtag)
+	response = rt.SendAdminRequestWithHeaders("PUT", "/db/_config", makeConfig(400), map[string]string{"If-Match": etag})
+	assertStatus(t, response, 409)
+	response = rt.SendAdminRequestWithHeaders("PUT", "/db/_config", makeConfig(400), map[string]string{"If-Match": "bogus"})
+	assertStatus(t, response, 400)
+	assert.Equal(t, uint32(300), getRevsLimit())
+
+	// A config that fails to load isn't persisted, and the database keeps its previous config
+	badConfig := strings.Replace(makeConfig(600), "{", `{"event_handlers": {"bogus": true}, `, 1)
+	response = rt.SendAdminRequest("PUT", "/db/_config", badConfig)
+	assert.NotEqual(t, 201, response.Code)
+	assert.Equal(t, uint32(300), getRevsLimit())
+	assert.Equal(t, newEtag, rt.SendAdminRequest("GET", "/db/_config", "").Header().Get("Etag"))
+
+	// A change persisted by another node is picked up on refresh
+	bucket = rt.ServerContext().Database("db").Bucket
+	persisted, cas, err = loadPersistedDbConfig(bucket)
+	assert.NoError(t, err)
+	revsLimit := uint32(500)
+	persisted.RevsLimit = &revsLimit
+	_, err = bucket.WriteCas(DbConfigDocID, 0, 0, cas, persisted, 0)
+	assert.NoError(t, err)
+
+	reloaded, err := rt.ServerContext().refreshPersistedDbConfig("db")
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, uint32(500), getRevsLimit())
+	assert.Equal(t, uint32(500), rt.ServerContext().Database("db").RevsLimit)
+
+	reloaded, err = rt.ServerContext().refreshPersistedDbConfig("db")
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+
+	// A persisted config that fails to load leaves the database with its previous config, isn't
+	// retried until it changes, and is reported by /_health
+	appliedCas := rt.ServerContext().PersistedDbConfigCas("db")
+	persisted, cas, err = loadPersistedDbConfig(bucket)
+	assert.NoError(t, err)
+	persisted.EventHandlers = map[string]interface{}{"bogus": true}
+	_, err = bucket.WriteCas(DbConfigDocID, 0, 0, cas, persisted, 0)
+	assert.NoError(t, err)
+	_, err = rt.ServerContext().refreshPersistedDbConfig("db")
+	assert.Error(t, err)
+	assert.Equal(t, appliedCas, rt.ServerContext().PersistedDbConfigCas("db"))
+	assert.Equal(t, uint32(500), getRevsLimit())
+	reloaded, err = rt.ServerContext().refreshPersistedDbConfig("db")
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+
+	health := rt.ServerContext().checkHealth()
+	assert.Equal(t, HealthStatusDegraded, health.Databases["db"].Status)
+	assert.NotNil(t, health.Databases["db"].Config)
+
+	// Fixing the config applies it
+	persisted, cas, err = loadPersistedDbConfig(bucket)
+	assert.NoError(t, err)
+	persisted.EventHandlers = nil
+	_, err = bucket.WriteCas(DbConfigDocID, 0, 0, cas, persisted, 0)
+	assert.NoError(t, err)
+	reloaded, err = rt.ServerContext().refreshPersistedDbConfig("db")
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Nil(t, rt.ServerContext().PersistedDbConfigError("db"))
+}
+
+func TestPersistedDbConfigCredentials(t *testing.T) {
+	server := "walrus:"
+	password := "letmein"
+	secret := "oidc-secret"
+	config := &DbConfig{
+		BucketConfig: BucketConfig{Server: &server},
+		Users:        map[string]*db.PrincipalConfig{"alice": {Password: &password}},
+		OIDCConfig:   &auth.OIDCOptions{Providers: auth.OIDCProviderMap{"test": {Issuer: "https://example.com", ValidationKey: &secret}}},
+	}
+
+	// Credentials aren't written to the bucket
+	persisted, err := config.persistableCopy()
+	assert.NoError(t, err)
+	assert.Nil(t, persisted.Server)
+	assert.Nil(t, persisted.Users)
+	assert.Nil(t, persisted.OIDCConfig.Providers["test"].ValidationKey)
+	assert.Equal(t, "https://example.com", persisted.OIDCConfig.Providers["test"].Issuer)
+	assert.Equal(t, &secret, config.OIDCConfig.Providers["test"].ValidationKey)
+
+	// Each node uses those of its own config
+	localServer := "walrus:local"
+	localSecret := "local-secret"
+	local := &DbConfig{
+		Name:         "db",
+		BucketConfig: BucketConfig{Server: &localServer},
+		OIDCConfig:   &auth.OIDCOptions{Providers: auth.OIDCProviderMap{"test": {ValidationKey: &localSecret}}},
+	}
+	merged, err := mergePersistedDbConfig(persisted, local)
+	assert.NoError(t, err)
+	assert.Equal(t, &localServer, merged.Server)
+	assert.Nil(t, merged.Users)
+	assert.Equal(t, &localSecret, merged.OIDCConfig.Providers["test"].ValidationKey)
+	assert.Equal(t, "https://example.com", merged.OIDCConfig.Providers["test"].Issuer)
+}
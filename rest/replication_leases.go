@@ -0,0 +1,382 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// The replications in the config are run by a single node of the cluster, rather than by every
+// node that loads the config.  Each replication has a lease document in a bucket shared by the
+// nodes; a node only runs the replications whose leases it holds, and renews them periodically.
+// If a node stops renewing a lease, because it died or lost its connection to the bucket, another
+// node takes the lease over once it expires and starts the replication.
+//
+// Leases are opt-in: they're only used when replication_lease_db names the database whose bucket
+// holds them, which must be the same on every node.  Without it, every node runs every replication,
+// as before leases were added.  While the lease database isn't available, no replications are run.
+//
+// A one-shot replication keeps its lease after it's finished, so that other nodes don't repeat it;
+// if its owner goes away, the node taking over runs it again from its last checkpoint.
+//
+// A node that can't renew a lease, because the renewal failed or the lease database is
+// unavailable, stops the replication before the lease can expire, so that it's never run by two
+// nodes at once.
+
+const DefaultReplicationLeaseSecs = 10
+
+// Number of renewal intervals after which a lease that hasn't been renewed expires
+const kReplicationLeaseTTLIntervals = 3
+
+const replicationLeaseKeyPrefix = db.KSyncKeyPrefix + "replicationLease:"
+
+var errReplicationLeaseHeld = errors.New("Replication lease is held by another node")
+
+// A replication's lease document
+type ReplicationLease struct {
+	Owner    string    `json:"owner"`    // UUID of the node running the replication
+	Acquired time.Time `json:"acquired"` // When the owner took the lease
+	Renewed  time.Time `json:"renewed"`  // When the owner last renewed the lease
+	Expires  time.Time `json:"expires"`
+}
+
+// A replication in the config, and the node running it
+type ReplicationOwnership struct {
+	ReplicationId string     `json:"replication_id,omitempty"`
+	Source        string     `json:"source"`
+	Target        string     `json:"target"`
+	Continuous    bool       `json:"continuous"`
+	LeaseKey      string     `json:"lease_key"`
+	Owner         string     `json:"owner,omitempty"` // Node UUID, as listed by /_cluster
+	Expires       *time.Time `json:"expires,omitempty"`
+	Local         bool       `json:"local"` // True if this node is running the replication
+}
+
+// Response of GET /_replication_leases
+type ReplicationLeasesStatus struct {
+	NodeUUID     string                  `json:"node_uuid"` // UUID of the node handling the request
+	Replications []*ReplicationOwnership `json:"replications"`
+}
+
+// Returns the key of a replication's lease document.  Replications without a replication_id are
+// identified by a hash of their config, which is the same on every node loading it.
+func replicationLeaseKey(replicationConfig *ReplicationConfig) string {
+	if replicationConfig.ReplicationId != "" {
+		return replicationLeaseKeyPrefix + replicationConfig.ReplicationId
+	}
+	data, _ := json.Marshal(replicationConfig)
+	return fmt.Sprintf("%s%x", replicationLeaseKeyPrefix, sha1.Sum(data))
+}
+
+// Returns the interval between lease renewals, or 0 if leases are disabled.
+func (sc *ServerContext) replicationLeaseInterval() time.Duration {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+	if sc.config.ReplicationLeaseDb == nil {
+		return 0
+	}
+	leaseSecs := DefaultReplicationLeaseSecs
+	if sc.config.ReplicationLeaseSecs != nil {
+		leaseSecs = *sc.config.ReplicationLeaseSecs
+	}
+	if leaseSecs <= 0 {
+		return 0
+	}
+	return time.Duration(leaseSecs) * time.Second
+}
+
+// Returns the bucket holding the replication leases, or nil if there's no such database.
+func (sc *ServerContext) replicationLeaseBucket() base.Bucket {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+	if sc.config.ReplicationLeaseDb == nil {
+		return nil
+	}
+	if dbc := sc.databases_[*sc.config.ReplicationLeaseDb]; dbc != nil {
+		return dbc.Bucket
+	}
+	return nil
+}
+
+// Takes or renews the lease with the given key for a node.  Returns false if another node holds
+// an unexpired lease.
+func acquireReplicationLease(bucket base.Bucket, key string, owner string, ttl time.Duration) (bool, error) {
+	expiry := base.DurationToCbsExpiry(ttl)
+	_, err := bucket.Update(key, expiry, func(current []byte) ([]byte, *uint32, error) {
+		now := time.Now()
+		lease := &ReplicationLease{}
+		if len(current) > 0 {
+			if err := json.Unmarshal(current, lease); err != nil {
+				base.Warnf(base.KeyReplicate, "Replacing invalid replication lease %s: %v", base.UD(key), err)
+				lease = &ReplicationLease{}
+			}
+		}
+		if lease.Owner != owner {
+			if lease.Owner != "" && lease.Expires.After(now) {
+				return nil, nil, errReplicationLeaseHeld
+			}
+			lease.Owner = owner
+			lease.Acquired = now
+		}
+		lease.Renewed = now
+		lease.Expires = now.Add(ttl)
+		updated, err := json.Marshal(lease)
+		return updated, &expiry, err
+	})
+	if err == errReplicationLeaseHeld {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Gives up a node's lease, so that another node can take it without waiting for it to expire.
+func releaseReplicationLease(bucket base.Bucket, key string, owner string) error {
+	_, err := bucket.Update(key, 0, func(current []byte) ([]byte, *uint32, error) {
+		lease := &ReplicationLease{}
+		if len(current) == 0 || json.Unmarshal(current, lease) != nil || lease.Owner != owner {
+			return nil, nil, errReplicationLeaseHeld
+		}
+		// Deletes the lease document
+		return nil, nil, nil
+	})
+	if err == errReplicationLeaseHeld {
+		return nil
+	}
+	return err
+}
+
+// Reads a lease document, returning nil if there isn't one.
+func getReplicationLease(bucket base.Bucket, key string) (*ReplicationLease, error) {
+	data, _, err := bucket.GetRaw(key)
+	if err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	lease := &ReplicationLease{}
+	if err := json.Unmarshal(data, lease); err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// Takes or renews the leases of the replications in the config, starting the replications whose
+// leases were taken and stopping those whose leases were lost.
+func (sc *ServerContext) updateReplicationLeases() {
+	sc.replicationLeaseLock.Lock()
+	defer sc.replicationLeaseLock.Unlock()
+	if sc.replicationLeaseTicker == nil {
+		// Leases were stopped while waiting for the lock
+		return
+	}
+
+	interval := sc.replicationLeaseInterval()
+	if interval == 0 {
+		interval = DefaultReplicationLeaseSecs * time.Second
+	}
+	ttl := interval * kReplicationLeaseTTLIntervals
+
+	bucket := sc.replicationLeaseBucket()
+	if bucket == nil {
+		base.Warnf(base.KeyReplicate, "Database holding the replication leases isn't available, unable to renew leases")
+		sc._stopUnrenewedReplications(interval, ttl)
+		return
+	}
+
+	sc.lock.RLock()
+	replications := make(map[string]*ReplicationConfig, len(sc.config.Replications))
+	for _, replicationConfig := range sc.config.Replications {
+		replications[replicationLeaseKey(replicationConfig)] = replicationConfig
+	}
+	sc.lock.RUnlock()
+
+	// Replications that have been removed from the config
+	for key, replicationConfig := range sc.ownedReplications {
+		if replications[key] == nil {
+			sc._releaseReplication(bucket, key, replicationConfig)
+		}
+	}
+
+	draining := sc.IsDraining()
+	for key, replicationConfig := range replications {
+		owned := sc.ownedReplications[key] != nil
+		if draining && !owned {
+			// Leave new leases to nodes that aren't shutting down
+			continue
+		}
+		// The lease's expiry is measured from before the request, as the write may land any time after
+		renewing := time.Now()
+		acquired, err := acquireReplicationLease(bucket, key, sc.nodeUUID, ttl)
+		if err != nil {
+			// The lease may still be valid, so the replication keeps running until it could expire
+			base.Warnf(base.KeyReplicate, "Unable to renew replication lease %s: %v", base.UD(key), err)
+			continue
+		}
+		if acquired {
+			sc.replicationLeaseRenewed[key] = renewing
+		}
+		if acquired && !owned {
+			base.Infof(base.KeyReplicate, "Took replication lease %s, starting replication", base.UD(key))
+			sc.ownedReplications[key] = replicationConfig
+			sc.startReplication(replicationConfig)
+		} else if !acquired && owned {
+			base.Warnf(base.KeyReplicate, "Replication lease %s was taken by another node, stopping replication", base.UD(key))
+			delete(sc.ownedReplications, key)
+			delete(sc.replicationLeaseRenewed, key)
+			sc.stopReplication(replicationConfig)
+		}
+	}
+	sc._stopUnrenewedReplications(interval, ttl)
+}
+
+// Stops the replications run by this node whose leases could expire before the next renewal, as
+// another node may take them over then.  Expects replicationLeaseLock to be held.
+func (sc *ServerContext) _stopUnrenewedReplications(interval, ttl time.Duration) {
+	nextRenewal := time.Now().Add(interval)
+	for key, replicationConfig := range sc.ownedReplications {
+		if renewed := sc.replicationLeaseRenewed[key]; renewed.Add(ttl).After(nextRenewal) {
+			continue
+		}
+		base.Warnf(base.KeyReplicate, "Replication lease %s could expire before it's renewed, stopping replication", base.UD(key))
+		delete(sc.ownedReplications, key)
+		delete(sc.replicationLeaseRenewed, key)
+		sc.stopReplication(replicationConfig)
+	}
+}
+
+// Stops a replication run by this node and releases its lease.  Expects replicationLeaseLock to
+// be held.
+func (sc *ServerContext) _releaseReplication(bucket base.Bucket, key string, replicationConfig *ReplicationConfig) {
+	sc.stopReplication(replicationConfig)
+	delete(sc.ownedReplications, key)
+	delete(sc.replicationLeaseRenewed, key)
+	if bucket == nil {
+		return
+	}
+	if err := releaseReplicationLease(bucket, key, sc.nodeUUID); err != nil {
+		base.Infof(base.KeyReplicate, "Unable to release replication lease %s: %v", base.UD(key), err)
+	}
+}
+
+// Stops a replication run by this node, if it holds its lease, and releases the lease.
+func (sc *ServerContext) releaseReplication(replicationConfig *ReplicationConfig) {
+	sc.replicationLeaseLock.Lock()
+	defer sc.replicationLeaseLock.Unlock()
+	key := replicationLeaseKey(replicationConfig)
+	if sc.ownedReplications[key] != nil {
+		sc._releaseReplication(sc.replicationLeaseBucket(), key, replicationConfig)
+	}
+}
+
+// Returns true if the replications in the config are being run through leases.
+func (sc *ServerContext) replicationLeasesActive() bool {
+	sc.replicationLeaseLock.Lock()
+	defer sc.replicationLeaseLock.Unlock()
+	return sc.replicationLeaseTicker != nil
+}
+
+// Starts taking and renewing replication leases.  Returns false if leases are disabled, in which
+// case the replications should be started directly.
+func (sc *ServerContext) startReplicationLeases() bool {
+	interval := sc.replicationLeaseInterval()
+	if interval == 0 {
+		base.Infof(base.KeyAll, "Replication leases are disabled, running all configured replications on this node")
+		return false
+	}
+
+	sc.replicationLeaseLock.Lock()
+	sc.replicationLeaseTicker.stop()
+	sc.replicationLeaseTicker = newBackgroundTicker(interval, sc.updateReplicationLeases)
+	sc.replicationLeaseLock.Unlock()
+
+	sc.updateReplicationLeases()
+	base.Infof(base.KeyAll, "Running replications through leases, with renewal frequency: %v", interval)
+	return true
+}
+
+// Stops renewing replication leases, stopping the replications run by this node and releasing
+// their leases.
+func (sc *ServerContext) stopReplicationLeases() {
+	sc.replicationLeaseLock.Lock()
+	defer sc.replicationLeaseLock.Unlock()
+	if sc.replicationLeaseTicker == nil {
+		return
+	}
+	sc.replicationLeaseTicker.stop()
+	sc.replicationLeaseTicker = nil
+	bucket := sc.replicationLeaseBucket()
+	for key, replicationConfig := range sc.ownedReplications {
+		sc._releaseReplication(bucket, key, replicationConfig)
+	}
+}
+
+// Returns the replications in the config, and the nodes running them.
+func (sc *ServerContext) ReplicationOwnership() (*ReplicationLeasesStatus, error) {
+	sc.lock.RLock()
+	replications := make([]*ReplicationConfig, len(sc.config.Replications))
+	copy(replications, sc.config.Replications)
+	sc.lock.RUnlock()
+
+	status := &ReplicationLeasesStatus{
+		NodeUUID:     sc.nodeUUID,
+		Replications: make([]*ReplicationOwnership, 0, len(replications)),
+	}
+	leasesActive := sc.replicationLeasesActive()
+	bucket := sc.replicationLeaseBucket()
+	now := time.Now()
+	for _, replicationConfig := range replications {
+		ownership := &ReplicationOwnership{
+			ReplicationId: replicationConfig.ReplicationId,
+			Source:        replicationConfig.Source,
+			Target:        replicationConfig.Target,
+			Continuous:    replicationConfig.Continuous,
+			LeaseKey:      replicationLeaseKey(replicationConfig),
+		}
+		if !leasesActive {
+			// Every node runs the replication
+			ownership.Owner = sc.nodeUUID
+			ownership.Local = true
+		} else if bucket != nil {
+			lease, err := getReplicationLease(bucket, ownership.LeaseKey)
+			if err != nil {
+				return nil, err
+			}
+			if lease != nil && lease.Expires.After(now) {
+				ownership.Owner = lease.Owner
+				ownership.Expires = &lease.Expires
+				ownership.Local = lease.Owner == sc.nodeUUID
+			}
+		}
+		status.Replications = append(status.Replications, ownership)
+	}
+	sort.Slice(status.Replications, func(i, j int) bool {
+		return status.Replications[i].LeaseKey < status.Replications[j].LeaseKey
+	})
+	return status, nil
+}
+
+// HTTP handler for GET /_replication_leases
+func (h *handler) handleGetReplicationLeases() error {
+	status, err := h.server.ReplicationOwnership()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(status)
+	return nil
+}
@@ -0,0 +1,135 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicationLeases(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+	bucket := rt.Bucket()
+	key := replicationLeaseKey(&ReplicationConfig{ReplicationId: "r1"})
+
+	acquired, err := acquireReplicationLease(bucket, key, "node-a", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	// Only the owner can renew or release the lease
+	acquired, err = acquireReplicationLease(bucket, key, "node-b", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+	assert.NoError(t, releaseReplicationLease(bucket, key, "node-b"))
+	acquired, err = acquireReplicationLease(bucket, key, "node-a", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	// A released lease can be taken straight away
+	assert.NoError(t, releaseReplicationLease(bucket, key, "node-a"))
+	acquired, err = acquireReplicationLease(bucket, key, "node-b", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	// So can a lease its owner stopped renewing
+	expired, _ := json.Marshal(ReplicationLease{Owner: "dead-node", Expires: time.Now().Add(-time.Second)})
+	assert.NoError(t, bucket.SetRaw(key, 0, expired))
+	acquired, err = acquireReplicationLease(bucket, key, "node-a", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+}
+
+func TestReplicationOwnership(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+	bucket := rt.Bucket()
+	sc := rt.ServerContext()
+
+	replicationConfig := &ReplicationConfig{ReplicationId: "r1", Source: "http://localhost:4985/db", Target: "http://remote:4984/db", Continuous: true}
+	sc.config.Replications = []*ReplicationConfig{replicationConfig}
+	leaseDb := "db"
+	sc.config.ReplicationLeaseDb = &leaseDb
+	sc.replicationLeaseTicker = newBackgroundTicker(time.Hour, func() {})
+	defer sc.stopReplicationLeases()
+
+	// The replication is running on another node, so this node doesn't start it
+	_, err := acquireReplicationLease(bucket, replicationLeaseKey(replicationConfig), "other-node", time.Minute)
+	assert.NoError(t, err)
+	sc.updateReplicationLeases()
+	assert.Len(t, sc.ownedReplications, 0)
+
+	response := rt.SendAdminRequest("GET", "/_replication_leases", "")
+	assertStatus(t, response, 200)
+	var status ReplicationLeasesStatus
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &status))
+	assert.Equal(t, sc.nodeUUID, status.NodeUUID)
+	if assert.Len(t, status.Replications, 1) {
+		ownership := status.Replications[0]
+		assert.Equal(t, "r1", ownership.ReplicationId)
+		assert.Equal(t, "other-node", ownership.Owner)
+		assert.False(t, ownership.Local)
+		assert.NotNil(t, ownership.Expires)
+	}
+
+	// Lease ownership isn't available on the public interface
+	response = rt.SendRequest("GET", "/_replication_leases", "")
+	assert.NotEqual(t, 200, response.Code)
+}
+
+func TestReplicationLeaseRenewalFailure(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+	sc := rt.ServerContext()
+
+	replicationConfig := &ReplicationConfig{ReplicationId: "r1", Source: "http://localhost:4985/db", Target: "http://remote:4984/db", Continuous: true}
+	key := replicationLeaseKey(replicationConfig)
+	sc.config.Replications = []*ReplicationConfig{replicationConfig}
+	leaseDb := "nonexistent"
+	sc.config.ReplicationLeaseDb = &leaseDb
+	sc.replicationLeaseTicker = newBackgroundTicker(time.Hour, func() {})
+	defer sc.stopReplicationLeases()
+
+	// While the lease database is unavailable, a recently renewed replication keeps running
+	sc.ownedReplications[key] = replicationConfig
+	sc.replicationLeaseRenewed[key] = time.Now()
+	sc.updateReplicationLeases()
+	assert.Len(t, sc.ownedReplications, 1)
+
+	// Once its lease could expire before the next renewal, it's stopped
+	sc.replicationLeaseRenewed[key] = time.Now().Add(-DefaultReplicationLeaseSecs * time.Second * kReplicationLeaseTTLIntervals)
+	sc.updateReplicationLeases()
+	assert.Len(t, sc.ownedReplications, 0)
+	assert.Len(t, sc.replicationLeaseRenewed, 0)
+}
+
+func TestReplicationLeasesOptIn(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+	sc := rt.ServerContext()
+
+	// Without a lease database, every node runs every replication
+	assert.Equal(t, time.Duration(0), sc.replicationLeaseInterval())
+	assert.False(t, sc.startReplicationLeases())
+	assert.False(t, sc.replicationLeasesActive())
+
+	// A lease interval alone isn't enough to enable leases
+	_, err := ReadServerConfigFromData(SyncGatewayRunModeNormal, []byte(`{"replication_lease_secs": 10}`))
+	assert.Error(t, err)
+	_, err = ReadServerConfigFromData(SyncGatewayRunModeNormal, []byte(`{"replication_lease_secs": 10, "replication_lease_db": "db"}`))
+	assert.NoError(t, err)
+}
@@ -42,6 +42,13 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 	r.StrictSlash(true)
 	// Global operations:
 	r.Handle("/", makeHandler(sc, privs, (*handler).handleRoot)).Methods("GET", "HEAD")
+	// Health checks don't require authentication, but report more on the admin port
+	healthPrivs := publicPrivs
+	if privs == adminPrivs {
+		healthPrivs = adminPrivs
+	}
+	r.Handle("/_ping", makeHandler(sc, healthPrivs, (*handler).handlePing)).Methods("GET", "HEAD")
+	r.Handle("/_health", makeHandler(sc, healthPrivs, (*handler).handleHealth)).Methods("GET", "HEAD")
 
 	// Operations on databases:
 	r.Handle("/{db:"+dbRegex+"}/", makeOfflineHandler(sc, privs, (*handler).handleGetDB)).Methods("GET", "HEAD")
@@ -121,6 +128,18 @@ func CreatePublicHandler(sc *ServerContext) http.Handler {
 		(*handler).handleSessionPOST)).Methods("POST")
 	dbr.Handle("/_session", makeHandler(sc, regularPrivs,
 		(*handler).handleSessionDELETE)).Methods("DELETE")
+
+	// Self-service account management for the logged-in user:
+	dbr.Handle("/_account/password", makeHandler(sc, regularPrivs,
+		(*handler).handleAccountPasswordPUT)).Methods("PUT")
+	dbr.Handle("/_account/email", makeHandler(sc, regularPrivs,
+		(*handler).handleAccountEmailPUT)).Methods("PUT")
+	dbr.Handle("/_account/sessions", makeHandler(sc, regularPrivs,
+		(*handler).handleAccountSessionsGET)).Methods("GET", "HEAD")
+	dbr.Handle("/_account/sessions", makeHandler(sc, regularPrivs,
+		(*handler).handleAccountSessionsDELETE)).Methods("DELETE")
+	dbr.Handle("/_account/sessions/{handle}", makeHandler(sc, regularPrivs,
+		(*handler).handleAccountSessionDELETE)).Methods("DELETE")
 	// The routine below is part of the CouchDB REST API, users can't create DB's via the pblic API
 	// but if the client set the 'createTarget' property of the Replicatior SG should return HTTP status 412
 	// if the db exists, and 403 if it doesn't.
@@ -211,10 +230,16 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeHandler(sc, adminPrivs, (*handler).handleExpvar)).Methods("GET")
 	r.Handle("/_config",
 		makeHandler(sc, adminPrivs, (*handler).handleGetConfig)).Methods("GET")
+	r.Handle("/_drain",
+		makeHandler(sc, adminPrivs, (*handler).handleDrain)).Methods("POST")
+	r.Handle("/_cluster",
+		makeHandler(sc, adminPrivs, (*handler).handleGetCluster)).Methods("GET")
 	r.Handle("/_replicate",
 		makeOfflineHandler(sc, adminPrivs, (*handler).handleReplicate)).Methods("POST")
 	r.Handle("/_active_tasks",
 		makeOfflineHandler(sc, adminPrivs, (*handler).handleActiveTasks)).Methods("GET")
+	r.Handle("/_replication_leases",
+		makeHandler(sc, adminPrivs, (*handler).handleGetReplicationLeases)).Methods("GET")
 
 	r.Handle("/_sgcollect_info",
 		makeHandler(sc, adminPrivs, (*handler).handleSGCollectStatus)).Methods("GET")
@@ -260,6 +285,8 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeOfflineHandler(sc, adminPrivs, (*handler).handleDbOnline)).Methods("POST")
 	dbr.Handle("/_offline",
 		makeOfflineHandler(sc, adminPrivs, (*handler).handleDbOffline)).Methods("POST")
+	dbr.Handle("/_readonly",
+		makeOfflineHandler(sc, adminPrivs, (*handler).handleDbReadOnly)).Methods("POST")
 	dbr.Handle("/_dump/{view}",
 		makeHandler(sc, adminPrivs, (*handler).handleDump)).Methods("GET")
 	dbr.Handle("/_view/{view}", // redundant; just for backward compatibility with 1.0
@@ -274,6 +301,18 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeHandler(sc, adminPrivs, (*handler).handleIndexAllChannels)).Methods("GET")
 	dbr.Handle("/_repair",
 		makeHandler(sc, adminPrivs, (*handler).handleRepair)).Methods("POST")
+	dbr.Handle("/_cache/channels",
+		makeHandler(sc, adminPrivs, (*handler).handleGetChannelCaches)).Methods("GET")
+	dbr.Handle("/_cache/channels/{channel}",
+		makeHandler(sc, adminPrivs, (*handler).handleGetChannelCache)).Methods("GET")
+	dbr.Handle("/_cache/channels/{channel}",
+		makeHandler(sc, adminPrivs, (*handler).handleEvictChannelCache)).Methods("DELETE")
+	dbr.Handle("/_cache/channels/{channel}/_prewarm",
+		makeHandler(sc, adminPrivs, (*handler).handlePrewarmChannelCache)).Methods("POST")
+	dbr.Handle("/_cache/sequences",
+		makeHandler(sc, adminPrivs, (*handler).handleGetCacheSequences)).Methods("GET")
+	dbr.Handle("/_cache/skipped/{seq}",
+		makeHandler(sc, adminPrivs, (*handler).handleAbandonSkippedSequence)).Methods("DELETE")
 
 	// The routes below are part of the CouchDB REST API but should only be available to admins,
 	// so the handlers are moved to the admin port.
@@ -44,25 +44,63 @@ const DefaultLogFreqencySecs = 5
 // This struct is accessed from HTTP handlers running on multiple goroutines, so it needs to
 // be thread-safe.
 type ServerContext struct {
-	config             *ServerConfig
-	databases_         map[string]*db.DatabaseContext
-	lock               sync.RWMutex
-	statsTicker        *time.Ticker
-	statsLoggingTicker *time.Ticker
-	HTTPClient         *http.Client
-	replicator         *base.Replicator
+	config              *ServerConfig
+	databases_          map[string]*db.DatabaseContext
+	lock                sync.RWMutex
+	statsTicker         *time.Ticker
+	statsLoggingTicker  *time.Ticker
+	HTTPClient          *http.Client
+	replicator          *base.Replicator
+	dbConfigCas         map[string]uint64           // CAS of the persisted config each database was loaded with
+	dbConfigFailures    map[string]*dbConfigFailure // Persisted configs that failed to load, which aren't retried until they change
+	tickerLock          sync.Mutex                  // Guards starting and stopping the background tickers below
+	dbConfigPollTicker  *backgroundTicker
+	fileConfig          *ServerConfig // Config as read from the config files, which reloads are compared with
+	reloadLock          sync.Mutex    // Serializes config reloads
+	configWatchTicker   *backgroundTicker
+	replicationErrors   map[*ReplicationConfig]error // Errors starting the replications in the config, reported by /_health
+	drainChan           chan struct{}                // Closed when the server starts draining
+	drainOnce           sync.Once
+	activeWebSockets    int64     // Number of open WebSocket connections (changes feeds and BLIP); accessed atomically
+	nodeUUID            string    // Identifies this node in the node registry
+	startTime           time.Time // When this node started
+	nodeHeartbeatTicker *backgroundTicker
+
+	replicationLeaseLock    sync.Mutex                    // Serializes lease renewals; protects the fields below
+	replicationLeaseTicker  *backgroundTicker             // Set if the replications in the config are run through leases
+	ownedReplications       map[string]*ReplicationConfig // Replications whose leases this node holds, by lease key
+	replicationLeaseRenewed map[string]time.Time          // When each lease this node holds was last renewed, by lease key
+
+	memoryGovernor *db.MemoryGovernor // Keeps the databases' caches within memory_budget_bytes; nil if there's no budget
 }
 
 func NewServerContext(config *ServerConfig) *ServerContext {
 	sc := &ServerContext{
-		config:     config,
-		databases_: map[string]*db.DatabaseContext{},
-		HTTPClient: http.DefaultClient,
-		replicator: base.NewReplicator(),
+		config:           config,
+		databases_:       map[string]*db.DatabaseContext{},
+		HTTPClient:       http.DefaultClient,
+		replicator:       base.NewReplicator(),
+		dbConfigCas:      map[string]uint64{},
+		dbConfigFailures: map[string]*dbConfigFailure{},
+
+		replicationErrors: map[*ReplicationConfig]error{},
+		drainChan:         make(chan struct{}),
+		nodeUUID:          base.CreateUUID(),
+		startTime:         time.Now(),
+		ownedReplications: map[string]*ReplicationConfig{},
+
+		replicationLeaseRenewed: map[string]time.Time{},
 	}
 	if config.Databases == nil {
 		config.Databases = DbConfigMap{}
 	}
+	if config.fileConfig != nil {
+		sc.fileConfig = config.fileConfig
+	} else if fileConfig, err := config.deepCopy(); err == nil {
+		sc.fileConfig = fileConfig
+	} else {
+		base.Warnf(base.KeyAll, "Unable to copy server config, config reloads won't be available: %v", err)
+	}
 
 	// Initialize the go-couchbase library's global configuration variables:
 	couchbase.PoolSize = DefaultMaxCouchbaseConnections
@@ -84,6 +122,10 @@ func NewServerContext(config *ServerConfig) *ServerContext {
 	}
 	base.SlowQueryWarningThreshold = time.Duration(slowQuery) * time.Millisecond
 
+	if config.MemoryBudgetBytes != nil && *config.MemoryBudgetBytes > 0 {
+		sc.memoryGovernor = db.NewMemoryGovernor(*config.MemoryBudgetBytes)
+	}
+
 	sc.startStatsLogger()
 
 	return sc
@@ -97,7 +139,10 @@ func (sc *ServerContext) PostStartup() {
 		time.Sleep(time.Second)
 	}
 
-	sc.startReplicators()
+	// Unless the replications are coordinated with other nodes, this node runs all of them
+	if !sc.startReplicationLeases() {
+		sc.startReplicators()
+	}
 
 }
 
@@ -105,24 +150,59 @@ func (sc *ServerContext) PostStartup() {
 func (sc *ServerContext) startReplicators() {
 
 	for _, replicationConfig := range sc.config.Replications {
+		sc.startReplication(replicationConfig)
+	}
 
-		params, _, _, err := validateReplicationParameters(*replicationConfig, true, *sc.config.AdminInterface)
-		if err != nil {
-			base.Errorf(base.KeyAll, "Error validating replication parameters: %v", err)
-			continue
-		}
+}
 
-		// Force one-shot replications to run Async
-		// to avoid blocking server startup
-		params.Async = true
+// startReplication starts a single replication defined in the config
+func (sc *ServerContext) startReplication(replicationConfig *ReplicationConfig) {
 
-		// Run single replication, cancel parameter will always be false
-		if _, err := sc.replicator.Replicate(params, false); err != nil {
-			base.Warnf(base.KeyAll, "Error starting replication %v: %v", base.UD(params.ReplicationId), err)
-		}
+	params, _, _, err := validateReplicationParameters(*replicationConfig, true, sc.adminInterface())
+	if err != nil {
+		base.Errorf(base.KeyAll, "Error validating replication parameters: %v", err)
+		sc.setReplicationError(replicationConfig, err)
+		return
+	}
+
+	// Force one-shot replications to run Async
+	// to avoid blocking server startup
+	params.Async = true
 
+	// Run single replication, cancel parameter will always be false
+	if _, err = sc.replicator.Replicate(params, false); err != nil {
+		base.Warnf(base.KeyAll, "Error starting replication %v: %v", base.UD(params.ReplicationId), err)
 	}
+	sc.setReplicationError(replicationConfig, err)
+}
+
+// stopReplication cancels a single replication defined in the config
+func (sc *ServerContext) stopReplication(replicationConfig *ReplicationConfig) {
+	params, _, _, err := validateReplicationParameters(*replicationConfig, true, sc.adminInterface())
+	if err != nil {
+		return
+	}
+	if _, err := sc.replicator.Replicate(params, true); err != nil {
+		base.Debugf(base.KeyReplicate, "Replication %v not cancelled: %v", base.UD(params.ReplicationId), err)
+	}
+}
+
+// Returns the address of the admin interface, which replications of local databases go through.
+func (sc *ServerContext) adminInterface() string {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+	return *sc.config.AdminInterface
+}
 
+// Records the error starting a replication in the config, or clears it if err is nil.
+func (sc *ServerContext) setReplicationError(replicationConfig *ReplicationConfig, err error) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if err != nil {
+		sc.replicationErrors[replicationConfig] = err
+	} else {
+		delete(sc.replicationErrors, replicationConfig)
+	}
 }
 
 func (sc *ServerContext) FindDbByBucketName(bucketName string) string {
@@ -141,6 +221,13 @@ func (sc *ServerContext) FindDbByBucketName(bucketName string) string {
 }
 
 func (sc *ServerContext) Close() {
+	// Releasing the leases needs the lock, and lets other nodes take over the replications
+	sc.stopReplicationLeases()
+
+	// Deregistering updates the buckets, so is done before taking the lock
+	sc.stopNodeHeartbeat()
+	sc.deregisterNode()
+
 	sc.lock.Lock()
 	defer sc.lock.Unlock()
 
@@ -149,6 +236,8 @@ func (sc *ServerContext) Close() {
 	}
 
 	sc.stopStatsLogger()
+	sc.stopDbConfigPoller()
+	sc.stopConfigFileWatcher()
 
 	for _, ctx := range sc.databases_ {
 		ctx.Close()
@@ -158,6 +247,7 @@ func (sc *ServerContext) Close() {
 	}
 
 	sc.databases_ = nil
+	sc.memoryGovernor.Stop()
 
 }
 
@@ -413,6 +503,18 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		if config.CacheConfig.ChannelCacheAge != nil && *config.CacheConfig.ChannelCacheAge > 0 {
 			cacheOptions.ChannelCacheAge = time.Duration(*config.CacheConfig.ChannelCacheAge) * time.Second
 		}
+		if prewarm := config.CacheConfig.Prewarm; prewarm != nil {
+			cacheOptions.Prewarm = &db.CachePrewarmOptions{Channels: prewarm.Channels}
+			if prewarm.RecentChannels != nil {
+				cacheOptions.Prewarm.RecentChannels = *prewarm.RecentChannels
+			}
+			if prewarm.RecordIntervalSecs != nil {
+				cacheOptions.Prewarm.RecordInterval = time.Duration(*prewarm.RecordIntervalSecs) * time.Second
+			}
+			if prewarm.MaxQueriesPerSec != nil {
+				cacheOptions.Prewarm.MaxQueriesPerSec = *prewarm.MaxQueriesPerSec
+			}
+		}
 
 	}
 
@@ -557,6 +659,32 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 	} else {
 		revCacheSize = db.KDefaultRevisionCacheCapacity
 	}
+	var revCacheShards uint16
+	if config.RevCacheShards != nil {
+		revCacheShards = *config.RevCacheShards
+	}
+	var revCacheMaxBytes int64
+	if config.RevCacheMaxBytes != nil {
+		revCacheMaxBytes = *config.RevCacheMaxBytes
+	}
+
+	var maxSequenceBatchSize uint64
+	if config.MaxSequenceBatchSize != nil {
+		maxSequenceBatchSize = *config.MaxSequenceBatchSize
+	}
+
+	var backfillConcurrency, combinedQueryMinChannels int
+	if config.BackfillConcurrency != nil {
+		backfillConcurrency = *config.BackfillConcurrency
+	}
+	if config.CombinedQueryMinChannels != nil {
+		combinedQueryMinChannels = *config.CombinedQueryMinChannels
+	}
+
+	var bulkConcurrency int
+	if config.BulkConcurrency != nil {
+		bulkConcurrency = *config.BulkConcurrency
+	}
 
 	// Enable doc tracking if needed for autoImport or shadowing.  Only supported for non-xattr configurations
 	trackDocs := false
@@ -575,6 +703,9 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		IndexOptions:              channelIndexOptions,
 		SequenceHashOptions:       sequenceHashOptions,
 		RevisionCacheCapacity:     revCacheSize,
+		RevisionCacheShardCount:   revCacheShards,
+		RevisionCacheMaxBytes:     revCacheMaxBytes,
+		MemoryGovernor:            sc.memoryGovernor,
 		OldRevExpirySeconds:       oldRevExpirySeconds,
 		LocalDocExpirySecs:        localDocExpirySecs,
 		AdminInterface:            sc.config.AdminInterface,
@@ -588,6 +719,14 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		AllowConflicts:            config.ConflictsAllowed(),
 		SendWWWAuthenticateHeader: config.SendWWWAuthenticateHeader,
 		UseViews:                  useViews,
+		EnforceWriteAccess:        config.EnforceWriteAccess,
+		AllowSelfService:          config.AllowSelfService,
+		PasswordPolicy:            config.PasswordPolicy,
+		SessionOptions:            config.SessionOptions,
+		BackfillConcurrency:       backfillConcurrency,
+		CombinedQueryMinChannels:  combinedQueryMinChannels,
+		MaxSequenceBatchSize:      maxSequenceBatchSize,
+		BulkConcurrency:           bulkConcurrency,
 	}
 
 	// Create the DB Context
@@ -664,6 +803,12 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		if dbcontext.EventMgr.HasHandlerForEvent(db.DBStateChange) {
 			dbcontext.EventMgr.RaiseDBStateChangeEvent(dbName, "offline", "DB loaded from config", *sc.config.AdminInterface)
 		}
+	} else if dbcontext.LoadReadOnlyState() {
+		// Stays read-only across reloads and restarts, until it's taken online
+		atomic.StoreUint32(&dbcontext.State, db.DBReadOnly)
+		if dbcontext.EventMgr.HasHandlerForEvent(db.DBStateChange) {
+			dbcontext.EventMgr.RaiseDBStateChangeEvent(dbName, "readonly", "DB loaded from config", *sc.config.AdminInterface)
+		}
 	} else {
 		atomic.StoreUint32(&dbcontext.State, db.DBOnline)
 		if dbcontext.EventMgr.HasHandlerForEvent(db.DBStateChange) {
@@ -690,8 +835,12 @@ func (sc *ServerContext) TakeDbOnline(database *db.DatabaseContext) {
 		}
 
 		// Reloaded DB should already be online in most cases, but force state to online to handle cases
-		// where config specifies offline startup
-		atomic.StoreUint32(&reloadedDb.State, db.DBOnline)
+		// where config specifies offline startup.  A DB made read-only stays so.
+		if reloadedDb.LoadReadOnlyState() {
+			atomic.CompareAndSwapUint32(&reloadedDb.State, db.DBOffline, db.DBReadOnly)
+		} else {
+			atomic.CompareAndSwapUint32(&reloadedDb.State, db.DBOffline, db.DBOnline)
+		}
 
 	} else {
 		base.Infof(base.KeyCRUD, "Unable to take Database : %v online , database must be in Offline state", base.UD(database.Name))
@@ -847,6 +996,8 @@ func (sc *ServerContext) RemoveDatabase(dbName string) bool {
 	sc.lock.Lock()
 	defer sc.lock.Unlock()
 
+	delete(sc.dbConfigCas, dbName)
+	delete(sc.dbConfigFailures, dbName)
 	return sc._removeDatabase(dbName)
 }
 
@@ -977,6 +1128,43 @@ func (sc *ServerContext) startStatsLogger() {
 
 }
 
+// A task run periodically on its own goroutine until it's stopped.
+type backgroundTicker struct {
+	ticker   *time.Ticker
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newBackgroundTicker(interval time.Duration, task func()) *backgroundTicker {
+	t := &backgroundTicker{
+		ticker: time.NewTicker(interval),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		for {
+			select {
+			case <-t.ticker.C:
+				task()
+			case <-t.done:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// Stops the ticker, ending its goroutine once any run of the task in progress returns.  Does nothing
+// if the ticker is nil or already stopped.
+func (t *backgroundTicker) stop() {
+	if t == nil {
+		return
+	}
+	t.stopOnce.Do(func() {
+		t.ticker.Stop()
+		close(t.done)
+	})
+}
+
 func (sc *ServerContext) stopStatsLogger() {
 	if sc.statsLoggingTicker != nil {
 		sc.statsLoggingTicker.Stop()
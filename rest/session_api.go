@@ -104,7 +104,7 @@ func (h *handler) handleSessionDELETE() error {
 	if cookie == nil {
 		return base.HTTPErrorf(http.StatusNotFound, "no session")
 	}
-	http.SetCookie(h.response, cookie)
+	h.db.Authenticator().SetSessionCookie(h.response, cookie)
 	return nil
 }
 
@@ -124,13 +124,13 @@ func (h *handler) makeSessionWithTTL(user auth.User, expiry time.Duration) (sess
 	}
 	h.user = user
 	auth := h.db.Authenticator()
-	session, err := auth.CreateSession(user.Name(), expiry)
+	session, err := h.db.CreateUserSession(user.Name(), expiry)
 	if err != nil {
 		return "", err
 	}
 	cookie := auth.MakeSessionCookie(session)
-	base.AddDbPathToCookie(h.rq, cookie)
-	http.SetCookie(h.response, cookie)
+	auth.SetSessionCookiePath(h.rq, cookie)
+	auth.SetSessionCookie(h.response, cookie)
 	return session.ID, nil
 }
 
@@ -208,7 +208,7 @@ func (h *handler) createUserSession() error {
 	}
 
 	authenticator := h.db.Authenticator()
-	session, err := authenticator.CreateSession(params.Name, ttl)
+	session, err := h.db.CreateUserSession(params.Name, ttl)
 	if err != nil {
 		return err
 	}